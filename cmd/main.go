@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	// the users' time zones are checked against it, the host may have no zoneinfo
+	_ "time/tzdata"
 
 	"github.com/2beens/ispend/internal"
 	log "github.com/sirupsen/logrus"
@@ -23,6 +25,8 @@ func main() {
 				-port=<port>		> used port
 				-logfile=<logFileName>  > output log file name
 				-loglvl=<logLevel>	> set log level [debug | error | fatal | info | trace | warn]
+
+				migrate <command>	> run schema migrations [status | up | down | goto <version>]
 			`)
 		log.Println()
 		return
@@ -35,6 +39,14 @@ func main() {
 		log.Fatalf("cannot open/read yaml conf file: %s", err.Error())
 	}
 
+	if flag.Arg(0) == "migrate" {
+		err = internal.RunMigrateCommand(yamlConfData, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	server, err := internal.NewServer(yamlConfData, *logFile)
 	if err != nil {
 		log.Fatal(err)
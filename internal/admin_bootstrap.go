@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+// bootstrapAdmin makes sure there is an admin to manage the other users: as long as there is none,
+// it creates the configured one with the password from the ISPEND_ADMIN_PASSWORD env var. An existing
+// user of that name is promoted only when the password matches, so whoever registered the name first
+// does not become admin just by that. ISPEND_ADMIN_USERNAME and ISPEND_ADMIN_EMAIL override the config.
+func (s *Server) bootstrapAdmin(ctx context.Context, spenderDB db.SpenderDB) error {
+	username := os.Getenv("ISPEND_ADMIN_USERNAME")
+	if username == "" {
+		username = s.config.Admin.Username
+	}
+	email := os.Getenv("ISPEND_ADMIN_EMAIL")
+	if email == "" {
+		email = s.config.Admin.Email
+	}
+	password := os.Getenv("ISPEND_ADMIN_PASSWORD")
+
+	users, err := spenderDB.GetAllUsers(ctx, false)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Role == models.RoleAdmin {
+			log.Debugf(" > admin bootstrap: admin [%s] exists already", user.Username)
+			return nil
+		}
+	}
+
+	if username == "" || password == "" {
+		log.Warnln(" > admin bootstrap: there is no admin, set the admin username and ISPEND_ADMIN_PASSWORD to create one")
+		return nil
+	}
+
+	// the password is verified or hashed before the transaction, it's slow on purpose; the transaction
+	// then checks the user is as it was, and only writes
+	user, err := spenderDB.GetUser(ctx, username, false)
+	if err != nil && err != platform.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		ok, _, err := s.passwordHasher.Verify(password, user.Password)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("user [" + username + "] exists already, with a different password")
+		}
+		return spenderDB.WithTx(ctx, func(tx db.SpenderTx) error {
+			current, err := tx.GetUser(ctx, username, false)
+			if err != nil {
+				return err
+			}
+			if current.Password != user.Password {
+				return errors.New("the password of user [" + username + "] changed during the admin bootstrap")
+			}
+			log.Infof(" > admin bootstrap: promoting user [%s] to admin", username)
+			return tx.SetUserRole(ctx, username, models.RoleAdmin)
+		})
+	}
+
+	if err := s.passwordPolicy.Check(password); err != nil {
+		log.Warnf(" > admin bootstrap: the admin password does not meet the password policy: %s", err)
+	}
+	passwordHash, err := s.passwordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return spenderDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		spendKinds, err := tx.GetAllDefaultSpendKinds(ctx)
+		if err != nil {
+			return err
+		}
+		admin := models.NewUser(email, username, passwordHash, spendKinds)
+		admin.Role = models.RoleAdmin
+		if _, err := tx.StoreUser(ctx, admin); err != nil {
+			return err
+		}
+		log.Infof(" > admin bootstrap: created admin [%s]", username)
+		return nil
+	})
+}
@@ -0,0 +1,375 @@
+package internal_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendJSON sends the body as JSON, authenticated with the cookies or, if it's not empty, with the access token
+func (rt *routesTest) sendJSON(method, path string, body interface{}, cookies []*http.Cookie, accessToken string) *httptest.ResponseRecorder {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			panic(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+		if cookie.Name == platform.CSRFCookieName {
+			req.Header.Set(platform.CSRFHeaderName, cookie.Value)
+		}
+	}
+	rec := httptest.NewRecorder()
+	rt.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func (rt *routesTest) register(t *testing.T, username, password string) {
+	rec := rt.sendJSON("POST", "/api/v1/users", map[string]string{
+		"username": username,
+		"email":    username + "@example.com",
+		"password": password,
+	}, nil, "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+}
+
+func decodeProblem(t *testing.T, rec *httptest.ResponseRecorder, status int) models.Problem {
+	require.Equal(t, status, rec.Code, rec.Body.String())
+	assert.Equal(t, platform.ProblemContentType, rec.Header().Get("Content-Type"))
+	var problem models.Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal(t, status, problem.Status)
+	assert.Equal(t, http.StatusText(status), problem.Title)
+	return problem
+}
+
+func TestAPIV1_OpenAPIDocumentCoversRoutes(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+
+	rec := rt.sendJSON("GET", "/api/v1/openapi.json", nil, nil, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var doc platform.OpenAPIDocument
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	require.Len(t, doc.Servers, 1)
+	assert.Equal(t, "/api/v1", doc.Servers[0].URL)
+
+	documented := 0
+	for _, operations := range doc.Paths {
+		documented += len(operations)
+	}
+
+	routes := 0
+	err := rt.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/v1/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// the method not allowed fallback of the path
+			return nil
+		}
+		for _, method := range methods {
+			routes++
+			operation := doc.Paths[strings.TrimPrefix(template, "/api/v1")][strings.ToLower(method)]
+			if assert.NotNil(t, operation, "%s %s is not documented", method, template) {
+				assert.NotEmpty(t, operation.Summary)
+				assert.Contains(t, operation.Responses, "500")
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Greater(t, routes, 15)
+	assert.Equal(t, routes, documented, "documented operations without a route")
+
+	spends := doc.Paths["/me/spends/{id}"]["get"]
+	require.NotNil(t, spends)
+	require.Len(t, spends.Parameters, 1)
+	assert.Equal(t, "id", spends.Parameters[0].Name)
+	assert.Contains(t, spends.Responses, "401")
+	assert.Contains(t, spends.Responses, "403")
+	assert.Contains(t, spends.Responses, "404")
+	assert.Equal(t, "#/components/schemas/SpendingDTO", spends.Responses["200"].Content["application/json"].Schema.Ref)
+	assert.Equal(t, "#/components/schemas/Problem", spends.Responses["404"].Content[platform.ProblemContentType].Schema.Ref)
+
+	userSchema := doc.Components.Schemas["UserDTO"]
+	require.NotNil(t, userSchema)
+	assert.Contains(t, userSchema.Properties, "username")
+	assert.NotContains(t, userSchema.Properties, "password")
+	assert.Contains(t, doc.Components.Schemas["NewUserRequest"].Required, "password")
+}
+
+func TestAPIV1_Spends(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+	rt.register(t, "walker", "walkerpass123")
+	cookies := rt.login(t, "walker", "walkerpass123")
+
+	rec := rt.sendJSON("GET", "/api/v1/me/spend-kinds", nil, cookies, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var spendKinds []models.SpendKindDTO
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &spendKinds))
+	require.NotEmpty(t, spendKinds)
+
+	rec = rt.sendJSON("POST", "/api/v1/me/spends", map[string]interface{}{
+		"currency": "EUR",
+		"amount":   12.5,
+		"kind_id":  spendKinds[0].ID,
+	}, cookies, "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var spending models.SpendingDTO
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &spending))
+	require.NotEmpty(t, spending.ID)
+	assert.Equal(t, "/api/v1/me/spends/"+spending.ID, rec.Header().Get("Location"))
+	assert.Equal(t, float32(12.5), spending.Amount)
+	assert.Equal(t, spendKinds[0].ID, spending.Kind.ID)
+
+	rec = rt.sendJSON("GET", rec.Header().Get("Location"), nil, cookies, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = rt.sendJSON("GET", "/api/v1/me/spends", nil, cookies, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var spends []models.SpendingDTO
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &spends))
+	assert.Equal(t, []models.SpendingDTO{spending}, spends)
+
+	rec = rt.sendJSON("POST", "/api/v1/me/spends", map[string]interface{}{"currency": "EUR", "amount": 1, "kind_id": 999}, cookies, "")
+	decodeProblem(t, rec, http.StatusBadRequest)
+
+	rec = rt.sendJSON("DELETE", "/api/v1/me/spends/"+spending.ID, nil, cookies, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	rec = rt.sendJSON("GET", "/api/v1/me/spends/"+spending.ID, nil, cookies, "")
+	problem := decodeProblem(t, rec, http.StatusNotFound)
+	assert.Equal(t, "about:blank", problem.Type)
+	assert.Equal(t, "/api/v1/me/spends/"+spending.ID, problem.Instance)
+}
+
+func TestAPIV1_Problems(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+	rt.register(t, "walker", "walkerpass123")
+	cookies := rt.login(t, "walker", "walkerpass123")
+
+	rec := rt.sendJSON("GET", "/api/v1/me", nil, nil, "")
+	decodeProblem(t, rec, http.StatusUnauthorized)
+	assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+
+	// only the admins can see all the users
+	decodeProblem(t, rt.sendJSON("GET", "/api/v1/users", nil, cookies, ""), http.StatusForbidden)
+
+	rec = rt.send("POST", "/api/v1/users", url.Values{"username": {"other"}, "email": {"other@example.com"}, "password": {"otherpass123"}}, nil)
+	decodeProblem(t, rec, http.StatusUnsupportedMediaType)
+	rec = rt.sendJSON("POST", "/api/v1/users", map[string]string{"username": "other", "is_admin": "true"}, nil, "")
+	assert.Contains(t, decodeProblem(t, rec, http.StatusBadRequest).Detail, "is_admin")
+	rec = rt.sendJSON("POST", "/api/v1/users", map[string]string{"username": "walker", "email": "walker2@example.com", "password": "walkerpass123"}, nil, "")
+	decodeProblem(t, rec, http.StatusConflict)
+	rec = rt.sendJSON("POST", "/api/v1/users", map[string]string{"username": "walker2", "email": "walker@example.com", "password": "walkerpass123"}, nil, "")
+	decodeProblem(t, rec, http.StatusConflict)
+	rec = rt.sendJSON("POST", "/api/v1/users", map[string]string{"username": "other", "email": "other@example.com", "password": "short"}, nil, "")
+	assert.Equal(t, []models.FieldError{
+		{Field: "password", Code: "password_policy", Message: platform.ErrPasswordTooShort.Error()},
+	}, decodeProblem(t, rec, http.StatusBadRequest).Errors)
+
+	decodeProblem(t, rt.sendJSON("GET", "/api/v1/nothing/here", nil, cookies, ""), http.StatusNotFound)
+	rec = rt.sendJSON("PUT", "/api/v1/me/spends", nil, cookies, "")
+	decodeProblem(t, rec, http.StatusMethodNotAllowed)
+	assert.Equal(t, "GET, POST", rec.Header().Get("Allow"))
+
+	// the cookie authenticated changes need the CSRF token
+	var sessionCookie []*http.Cookie
+	for _, cookie := range cookies {
+		if cookie.Name == platform.SessionCookieName {
+			sessionCookie = append(sessionCookie, cookie)
+		}
+	}
+	rec = rt.sendJSON("PATCH", "/api/v1/me/profile", map[string]string{"locale": "de-DE"}, sessionCookie, "")
+	assert.Equal(t, "invalid CSRF token", decodeProblem(t, rec, http.StatusForbidden).Detail)
+	rec = rt.sendJSON("GET", "/api/v1/me", nil, nil, "not-a-token")
+	decodeProblem(t, rec, http.StatusUnauthorized)
+	assert.Equal(t, `Bearer error="invalid_token"`, rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestAPIV1_Account(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+	rt.register(t, "walker", "walkerpass123")
+
+	// the API clients log in with the token endpoint
+	rec := rt.send("POST", "/oauth/token", url.Values{"grant_type": {"password"}, "username": {"walker"}, "password": {"walkerpass123"}}, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tokens))
+
+	rec = rt.sendJSON("GET", "/api/v1/me", nil, nil, tokens.AccessToken)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var me models.UserDTO
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &me))
+	assert.Equal(t, "walker", me.Username)
+	assert.Equal(t, "walker@example.com", me.Email)
+
+	rec = rt.sendJSON("PATCH", "/api/v1/me/profile", map[string]string{"display_name": " Walker ", "timezone": "Europe/Berlin"}, nil, tokens.AccessToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = rt.sendJSON("PATCH", "/api/v1/me/profile", map[string]string{"locale": "de-DE"}, nil, tokens.AccessToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var profile models.UserProfile
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &profile))
+	assert.Equal(t, models.UserProfile{DisplayName: "Walker", Timezone: "Europe/Berlin", Locale: "de-DE"}, profile)
+	rec = rt.sendJSON("PATCH", "/api/v1/me/profile", map[string]string{"timezone": "Mars/Olympus"}, nil, tokens.AccessToken)
+	decodeProblem(t, rec, http.StatusBadRequest)
+
+	cookies := rt.login(t, "walker", "walkerpass123")
+	rec = rt.sendJSON("PUT", "/api/v1/me/password", map[string]string{"old_password": "wrongpass", "new_password": "walkerpass456"}, cookies, "")
+	decodeProblem(t, rec, http.StatusForbidden)
+	rec = rt.sendJSON("PUT", "/api/v1/me/password", map[string]string{"old_password": "walkerpass123", "new_password": "walkerpass456"}, cookies, "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	// the tokens end with the password change, the session it came with stays
+	rec = rt.send("POST", "/oauth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}}, nil)
+	assert.NotEqual(t, http.StatusOK, rec.Code)
+	rec = rt.sendJSON("GET", "/api/v1/me/sessions", nil, cookies, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var sessions []models.LoginSessionDTO
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 1)
+	assert.True(t, sessions[0].Current)
+
+	rec = rt.sendJSON("DELETE", "/api/v1/me", map[string]string{"password": "walkerpass456"}, cookies, "")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	decodeProblem(t, rt.sendJSON("GET", "/api/v1/me", nil, cookies, ""), http.StatusUnauthorized)
+}
+
+func TestLegacyRoutes_Deprecated(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+	rt.register(t, "walker", "walkerpass123")
+	cookies := rt.login(t, "walker", "walkerpass123")
+
+	rec := rt.send("GET", "/spending/all/walker", nil, cookies)
+	assert.Contains(t, rec.Body.String(), `"isError":false`)
+	assert.Regexp(t, `^@\d+$`, rec.Header().Get("Deprecation"))
+	assert.Equal(t, `</api/v1/me/spends>; rel="successor-version"`, rec.Header().Get("Link"))
+
+	rec = rt.send("DELETE", "/spending/walker/abc", nil, cookies)
+	assert.Equal(t, `</api/v1/me/spends/abc>; rel="successor-version"`, rec.Header().Get("Link"))
+
+	// the logins have no successor in /api/v1, they stay as they are
+	rec = rt.send("POST", "/users/login", url.Values{"username": {"walker"}, "password": {"walkerpass123"}}, nil)
+	assert.Empty(t, rec.Header().Get("Deprecation"))
+	rec = rt.sendJSON("GET", "/api/v1/me", nil, cookies, "")
+	assert.Empty(t, rec.Header().Get("Deprecation"))
+}
+
+func TestRequestValidation_SharedByWebAndAPI(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+	rt.register(t, "walker", "walkerpass123")
+	cookies := rt.login(t, "walker", "walkerpass123")
+	var spendKinds []models.SpendKindDTO
+	require.NoError(t, json.Unmarshal(rt.sendJSON("GET", "/api/v1/me/spend-kinds", nil, cookies, "").Body.Bytes(), &spendKinds))
+	require.NotEmpty(t, spendKinds)
+	kindID := strconv.Itoa(spendKinds[0].ID)
+
+	tests := []struct {
+		name string
+		form url.Values
+		errs []models.FieldError
+	}{
+		{
+			name: "missing values",
+			form: url.Values{},
+			errs: []models.FieldError{
+				{Field: "currency", Code: "required", Message: "is required"},
+				{Field: "amount", Code: "required", Message: "is required"},
+				{Field: "kind_id", Code: "required", Message: "is required"},
+			},
+		},
+		{
+			name: "values out of the rules",
+			form: url.Values{"currency": {"euro"}, "amount": {"-3"}, "kind_id": {kindID}, "date": {"31.01.2026"}},
+			errs: []models.FieldError{
+				{Field: "currency", Code: "currency", Message: "must be a 3 letter currency code like EUR"},
+				{Field: "amount", Code: "min", Message: "must be at least 0", Param: "0"},
+				{Field: "date", Code: "date", Message: "must be a date like 2026-01-31"},
+			},
+		},
+		{
+			name: "unknown spend kind",
+			form: url.Values{"currency": {"eur"}, "amount": {"3"}, "kind_id": {"999"}},
+			errs: []models.FieldError{{Field: "kind_id", Code: "not_found", Message: "is not a spend kind of the user"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := rt.send("POST", "/spending", tt.form, cookies)
+			var resp models.APIResponse
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.True(t, resp.IsError)
+			assert.Equal(t, http.StatusBadRequest, resp.Status)
+			assert.Equal(t, tt.errs, resp.Errors)
+
+			body := make(map[string]interface{})
+			for field := range tt.form {
+				var value interface{} = tt.form.Get(field)
+				if number, err := strconv.ParseFloat(tt.form.Get(field), 64); err == nil {
+					value = number
+				}
+				body[field] = value
+			}
+			rec = rt.sendJSON("POST", "/api/v1/me/spends", body, cookies, "")
+			assert.Equal(t, tt.errs, decodeProblem(t, rec, http.StatusBadRequest).Errors)
+		})
+	}
+
+	// a value of a wrong type
+	rec := rt.send("POST", "/spending", url.Values{"currency": {"EUR"}, "amount": {"much"}, "kind_id": {kindID}}, cookies)
+	assert.Contains(t, rec.Body.String(), `"errors":[{"field":"amount","code":"invalid","message":"must be a number"}]`)
+	rec = rt.sendJSON("POST", "/api/v1/me/spends", map[string]interface{}{"currency": "EUR", "amount": "much", "kind_id": spendKinds[0].ID}, cookies, "")
+	assert.Equal(t, []models.FieldError{{Field: "amount", Code: "invalid", Message: "must be a number"}}, decodeProblem(t, rec, http.StatusBadRequest).Errors)
+
+	// the valid spending of another day, the currency tidied up
+	rec = rt.sendJSON("POST", "/api/v1/me/spends", map[string]interface{}{"currency": " eur", "amount": 3, "kind_id": spendKinds[0].ID, "date": "2026-01-31"}, cookies, "")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var spending models.SpendingDTO
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &spending))
+	assert.Equal(t, "EUR", spending.Currency)
+	assert.Equal(t, time.Date(2026, time.January, 31, 0, 0, 0, 0, time.UTC), spending.Timestamp.UTC())
+
+	// the other requests go through the same rules
+	rec = rt.send("PUT", "/users/walker/role", url.Values{"role": {"root"}}, rt.login(t, "ispend-admin", "adminpass123"))
+	assert.Contains(t, rec.Body.String(), `{"field":"role","code":"oneof","message":"must be one of: user, admin, read-only","param":"user admin read-only"}`)
+	rec = rt.sendJSON("PATCH", "/api/v1/me/profile", map[string]string{"default_currency": "euros", "locale": "de_DE"}, cookies, "")
+	assert.Equal(t, []string{"default_currency", "locale"}, fieldsOf(decodeProblem(t, rec, http.StatusBadRequest).Errors))
+	rec = rt.sendJSON("POST", "/api/v1/users", map[string]string{
+		"username": strings.Repeat("w", 36),
+		"email":    "long@example.com",
+		"password": "longpass123",
+	}, nil, "")
+	assert.Equal(t, []string{"username"}, fieldsOf(decodeProblem(t, rec, http.StatusBadRequest).Errors))
+}
+
+func fieldsOf(errs []models.FieldError) []string {
+	var fields []string
+	for _, fieldErr := range errs {
+		fields = append(fields, fieldErr.Field)
+	}
+	return fields
+}
@@ -0,0 +1,60 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/db/dbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance_InMemoryDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) db.SpenderDB {
+		return db.NewInMemoryDB()
+	})
+}
+
+func TestConformance_PersistentInMemoryDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) db.SpenderDB {
+		inMemDB := db.NewPersistentInMemoryDB(filepath.Join(t.TempDir(), "ispend.json"), 0, true)
+		require.NoError(t, inMemDB.Open())
+		t.Cleanup(func() {
+			assert.NoError(t, inMemDB.Close())
+		})
+		return inMemDB
+	})
+}
+
+func TestConformance_SQLiteDB(t *testing.T) {
+	dbtest.RunConformance(t, func(t *testing.T) db.SpenderDB {
+		sqliteDB := db.NewSQLiteDB(filepath.Join(t.TempDir(), "ispend.db"), true)
+		require.NoError(t, sqliteDB.Open())
+		t.Cleanup(func() {
+			assert.NoError(t, sqliteDB.Close())
+		})
+		return sqliteDB
+	})
+}
+
+// TestConformance_PostgresDBClient needs no docker or embedded postgres, just
+// a DB to run against (its schema gets migrated up, but no data is dropped):
+//
+//	ISPEND_TEST_POSTGRES_DSN="host=localhost dbname=ispend_test sslmode=disable" go test ./internal/db/
+func TestConformance_PostgresDBClient(t *testing.T) {
+	dsn := os.Getenv("ISPEND_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("ISPEND_TEST_POSTGRES_DSN not set")
+	}
+
+	dbtest.RunConformance(t, func(t *testing.T) db.SpenderDB {
+		pdb := db.NewPostgresDBClientWithDSN(dsn, 5, true)
+		require.NoError(t, pdb.Open())
+		t.Cleanup(func() {
+			assert.NoError(t, pdb.Close())
+		})
+		return pdb
+	})
+}
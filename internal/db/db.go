@@ -1,24 +1,70 @@
 package db
 
 import (
+	"context"
+	"time"
+
 	"github.com/2beens/ispend/internal/models"
 )
 
+// SpenderTx holds all the data operations, which can run either directly
+// on the DB, or within a transaction started by SpenderDB.WithTx
+type SpenderTx interface {
+	StoreDefaultSpendKind(ctx context.Context, kind models.SpendKind) (int, error)
+	GetAllDefaultSpendKinds(ctx context.Context) ([]models.SpendKind, error)
+	GetSpendKind(ctx context.Context, username string, spendingKindID int) (*models.SpendKind, error)
+	GetSpendKinds(ctx context.Context, username string) ([]models.SpendKind, error)
+	StoreSpendKind(ctx context.Context, username string, kind *models.SpendKind) (int, error)
+	// GetSpendKindsOfUsers loads the spend kinds of all the users at once, by the username;
+	// the unknown users are left out of the result
+	GetSpendKindsOfUsers(ctx context.Context, usernames []string) (map[string][]models.SpendKind, error)
+
+	StoreUser(ctx context.Context, user *models.User) (int, error)
+	GetUser(ctx context.Context, username string, loadAllData bool) (*models.User, error)
+	GetAllUsers(ctx context.Context, loadAllUserData bool) (models.Users, error)
+	// SetUserRole returns platform.ErrNotFound for an unknown user
+	SetUserRole(ctx context.Context, username, role string) error
+	// SetEmailVerified returns platform.ErrNotFound for an unknown user
+	SetEmailVerified(ctx context.Context, username string, verified bool) error
+	// SetUserPassword returns platform.ErrNotFound for an unknown user
+	SetUserPassword(ctx context.Context, username, passwordHash string) error
+	// UpdateUser stores the user's email, its verified flag and its profile, the other fields have their own setters;
+	// returns platform.ErrNotFound for an unknown user, and platform.ErrAlreadyExists if another user has the email
+	UpdateUser(ctx context.Context, user *models.User) error
+	// DeleteUser erases the user together with all its data: spends, spend kinds and WebAuthn credentials;
+	// returns platform.ErrNotFound for an unknown user
+	DeleteUser(ctx context.Context, username string) error
+	// SetUserTOTP replaces the whole two-factor authentication state of the user,
+	// returns platform.ErrNotFound for an unknown user
+	SetUserTOTP(ctx context.Context, username string, totp models.TOTP) error
+
+	// StoreWebAuthnCredential returns platform.ErrNotFound for an unknown user,
+	// and platform.ErrAlreadyExists if any user has the credential already
+	StoreWebAuthnCredential(ctx context.Context, credential *models.WebAuthnCredential) error
+	// GetWebAuthnCredentials returns platform.ErrNotFound for an unknown user
+	GetWebAuthnCredentials(ctx context.Context, username string) ([]models.WebAuthnCredential, error)
+	// GetWebAuthnCredential returns platform.ErrNotFound for an unknown credential
+	GetWebAuthnCredential(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error)
+	// UpdateWebAuthnCredentialUse records a login with the credential, returns platform.ErrNotFound for an unknown one
+	UpdateWebAuthnCredentialUse(ctx context.Context, credentialID []byte, signCount uint32, backupState bool, usedAt time.Time) error
+	// DeleteWebAuthnCredential returns platform.ErrNotFound if the user has no such credential
+	DeleteWebAuthnCredential(ctx context.Context, username string, credentialID []byte) error
+
+	StoreSpending(ctx context.Context, username string, spending models.Spending) (string, error)
+	GetSpends(ctx context.Context, username string) ([]models.Spending, error)
+	// GetSpendsOfUsers loads the spends of all the users at once, by the username;
+	// the unknown users are left out of the result
+	GetSpendsOfUsers(ctx context.Context, usernames []string) (map[string][]models.Spending, error)
+	DeleteSpending(ctx context.Context, username, spendID string) error
+}
+
 type SpenderDB interface {
 	Open() error
 	Close() error
 
-	StoreDefaultSpendKind(kind models.SpendKind) (int, error)
-	GetAllDefaultSpendKinds() ([]models.SpendKind, error)
-	GetSpendKind(username string, spendingKindID int) (*models.SpendKind, error)
-	GetSpendKinds(username string) ([]models.SpendKind, error)
-	StoreSpendKind(username string, kind *models.SpendKind) (int, error)
-
-	StoreUser(user *models.User) (int, error)
-	GetUser(username string, loadAllData bool) (*models.User, error)
-	GetAllUsers(loadAllUserData bool) (models.Users, error)
+	// WithTx runs f within a transaction - all the changes made via tx are
+	// committed if f returns nil, and rolled back otherwise
+	WithTx(ctx context.Context, f func(tx SpenderTx) error) error
 
-	StoreSpending(username string, spending models.Spending) (string, error)
-	GetSpends(username string) ([]models.Spending, error)
-	DeleteSpending(username, spendID string) error
+	SpenderTx
 }
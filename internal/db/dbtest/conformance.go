@@ -0,0 +1,754 @@
+// Package dbtest holds the conformance test suite every db.SpenderDB implementation must pass.
+//
+// The suite pins down the behaviour the rest of the server relies on: error values,
+// ID semantics, ordering and transactions. It only ever touches users it creates
+// itself, so it can run against a DB already holding some data.
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var usernameCounter int64
+
+// RunConformance runs the whole suite, calling newDB for a fresh, opened DB in every sub-test
+func RunConformance(t *testing.T, newDB func(t *testing.T) db.SpenderDB) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, spenderDB db.SpenderDB)
+	}{
+		{"DefaultSpendKinds", testDefaultSpendKinds},
+		{"StoreAndGetUser", testStoreAndGetUser},
+		{"StoreUserDuplicate", testStoreUserDuplicate},
+		{"GetAllUsers", testGetAllUsers},
+		{"UnknownUser", testUnknownUser},
+		{"UserRoles", testUserRoles},
+		{"EmailVerifiedAndPassword", testEmailVerifiedAndPassword},
+		{"UserTOTP", testUserTOTP},
+		{"UpdateUser", testUpdateUser},
+		{"DeleteUser", testDeleteUser},
+		{"WebAuthnCredentials", testWebAuthnCredentials},
+		{"SpendKinds", testSpendKinds},
+		{"Spends", testSpends},
+		{"DeleteSpending", testDeleteSpending},
+		{"DataOfUsers", testDataOfUsers},
+		{"WithTxCommit", testWithTxCommit},
+		{"WithTxRollback", testWithTxRollback},
+		{"CanceledContext", testCanceledContext},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newDB(t))
+		})
+	}
+}
+
+// newUsername returns a username not used by any other test in this process
+func newUsername() string {
+	return fmt.Sprintf("conformance%d_%d", time.Now().UnixNano()%1e6, atomic.AddInt64(&usernameCounter, 1))
+}
+
+func newTestUser(spendKindNames ...string) *models.User {
+	username := newUsername()
+	var spendKinds []models.SpendKind
+	for _, name := range spendKindNames {
+		spendKinds = append(spendKinds, models.SpendKind{Name: name})
+	}
+	return models.NewUser(username+"@serjspends.de", username, "password-hash", spendKinds)
+}
+
+func newTestWebAuthnCredential(username string) *models.WebAuthnCredential {
+	return &models.WebAuthnCredential{
+		ID:              []byte(newUsername()),
+		Username:        username,
+		UserHandle:      []byte("handle-" + username),
+		Name:            "laptop",
+		PublicKey:       []byte{0xa5, 0x01, 0x02},
+		AttestationType: "none",
+		Transports:      []string{"internal", "hybrid"},
+		AAGUID:          make([]byte, 16),
+		SignCount:       1,
+		BackupEligible:  true,
+		CreatedAt:       time.Date(2019, 10, 10, 12, 0, 0, 0, time.UTC),
+		LastUsedAt:      time.Date(2019, 10, 10, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func newTestSpending(kindName string, amount float32) models.Spending {
+	return models.Spending{
+		Currency:  "RSD",
+		Amount:    amount,
+		Kind:      &models.SpendKind{Name: kindName},
+		Timestamp: time.Date(2019, 10, 10, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func testDefaultSpendKinds(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	before, err := spenderDB.GetAllDefaultSpendKinds(ctx)
+	require.NoError(t, err)
+
+	name := newUsername()
+	id, err := spenderDB.StoreDefaultSpendKind(ctx, models.SpendKind{Name: name})
+	require.NoError(t, err)
+	assert.True(t, id > 0, "default spend kind IDs must be positive")
+
+	after, err := spenderDB.GetAllDefaultSpendKinds(ctx)
+	require.NoError(t, err)
+	require.Len(t, after, len(before)+1)
+	// ordered by insertion
+	assert.Equal(t, models.SpendKind{ID: id, Name: name}, after[len(after)-1])
+}
+
+func testStoreAndGetUser(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser("sk1", "sk2")
+	user.Spends = append(user.Spends, newTestSpending("sk2", 10), newTestSpending("sk3", 20))
+	userID, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	assert.True(t, userID > 0, "user IDs must be positive")
+
+	// IDs are assigned to the stored spend kinds and spends
+	for _, sk := range user.SpendKinds {
+		assert.True(t, sk.ID > 0)
+	}
+	for _, s := range user.Spends {
+		assert.NotEmpty(t, s.ID)
+	}
+
+	storedUser, err := spenderDB.GetUser(ctx, user.Username, true)
+	require.NoError(t, err)
+	assert.Equal(t, user.Email, storedUser.Email)
+	assert.Equal(t, user.Username, storedUser.Username)
+	assert.Equal(t, user.Password, storedUser.Password)
+
+	// the spend kind missing for the second spending is created on the fly
+	require.Len(t, storedUser.SpendKinds, 3)
+	assert.Equal(t, user.SpendKinds[0], storedUser.SpendKinds[0])
+	assert.Equal(t, user.SpendKinds[1], storedUser.SpendKinds[1])
+	assert.Equal(t, "sk3", storedUser.SpendKinds[2].Name)
+
+	require.Len(t, storedUser.Spends, 2)
+	assert.Equal(t, user.Spends[0].ID, storedUser.Spends[0].ID)
+	// spends resolve to the user's own spend kinds, by name
+	assert.Equal(t, storedUser.SpendKinds[1], *storedUser.Spends[0].Kind)
+	assert.Equal(t, storedUser.SpendKinds[2], *storedUser.Spends[1].Kind)
+
+	userWithoutData, err := spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.Equal(t, user.Username, userWithoutData.Username)
+	assert.Empty(t, userWithoutData.Spends)
+	assert.Empty(t, userWithoutData.SpendKinds)
+}
+
+func testStoreUserDuplicate(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser("sk1")
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+
+	duplicate := models.NewUser("other@serjspends.de", user.Username, "other", nil)
+	_, err = spenderDB.StoreUser(ctx, duplicate)
+	assert.Equal(t, platform.ErrAlreadyExists, err)
+
+	// the email is unique too
+	sameEmail := models.NewUser(user.Email, "other-"+user.Username, "other", nil)
+	_, err = spenderDB.StoreUser(ctx, sameEmail)
+	assert.Equal(t, platform.ErrAlreadyExists, err)
+	_, err = spenderDB.GetUser(ctx, sameEmail.Username, false)
+	assert.Equal(t, platform.ErrNotFound, err)
+
+	storedUser, err := spenderDB.GetUser(ctx, user.Username, true)
+	require.NoError(t, err)
+	assert.Equal(t, user.Email, storedUser.Email)
+	assert.Len(t, storedUser.SpendKinds, 1)
+}
+
+func testGetAllUsers(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	before, err := spenderDB.GetAllUsers(ctx, false)
+	require.NoError(t, err)
+
+	user1 := newTestUser("sk1")
+	user1.Spends = append(user1.Spends, newTestSpending("sk1", 1))
+	user2 := newTestUser()
+	_, err = spenderDB.StoreUser(ctx, user1)
+	require.NoError(t, err)
+	_, err = spenderDB.StoreUser(ctx, user2)
+	require.NoError(t, err)
+
+	withData, err := spenderDB.GetAllUsers(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, withData, len(before)+2)
+	// ordered by insertion
+	assert.Equal(t, user1.Username, withData[len(withData)-2].Username)
+	assert.Len(t, withData[len(withData)-2].Spends, 1)
+	assert.Len(t, withData[len(withData)-2].SpendKinds, 1)
+	assert.Equal(t, user2.Username, withData[len(withData)-1].Username)
+	assert.Empty(t, withData[len(withData)-1].Spends)
+
+	withoutData, err := spenderDB.GetAllUsers(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, withoutData, len(before)+2)
+	assert.Equal(t, user1.Username, withoutData[len(withoutData)-2].Username)
+	assert.Empty(t, withoutData[len(withoutData)-2].Spends)
+	assert.Empty(t, withoutData[len(withoutData)-2].SpendKinds)
+}
+
+func testUnknownUser(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+	username := newUsername()
+
+	_, err := spenderDB.GetUser(ctx, username, true)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = spenderDB.GetSpends(ctx, username)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = spenderDB.GetSpendKinds(ctx, username)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = spenderDB.GetSpendKind(ctx, username, 1)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = spenderDB.StoreSpendKind(ctx, username, &models.SpendKind{Name: "sk1"})
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = spenderDB.StoreSpending(ctx, username, newTestSpending("sk1", 1))
+	assert.Equal(t, platform.ErrNotFound, err)
+	assert.Equal(t, platform.ErrNotFound, spenderDB.DeleteSpending(ctx, username, "1"))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.SetUserRole(ctx, username, models.RoleAdmin))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.SetEmailVerified(ctx, username, true))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.SetUserPassword(ctx, username, "new-hash"))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.SetUserTOTP(ctx, username, models.TOTP{Secret: "secret"}))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.StoreWebAuthnCredential(ctx, newTestWebAuthnCredential(username)))
+	_, err = spenderDB.GetWebAuthnCredentials(ctx, username)
+	assert.Equal(t, platform.ErrNotFound, err)
+	assert.Equal(t, platform.ErrNotFound, spenderDB.DeleteWebAuthnCredential(ctx, username, []byte("credential")))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.UpdateUser(ctx, models.NewUser(username+"@serjspends.de", username, "hash", nil)))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.DeleteUser(ctx, username))
+}
+
+func testEmailVerifiedAndPassword(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser()
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	storedUser, err := spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.False(t, storedUser.EmailVerified)
+
+	require.NoError(t, spenderDB.SetEmailVerified(ctx, user.Username, true))
+	require.NoError(t, spenderDB.SetUserPassword(ctx, user.Username, "new-hash"))
+	storedUser, err = spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.True(t, storedUser.EmailVerified)
+	assert.Equal(t, "new-hash", storedUser.Password)
+	assert.Equal(t, user.Email, storedUser.Email)
+
+	users, err := spenderDB.GetAllUsers(ctx, false)
+	require.NoError(t, err)
+	require.NotEmpty(t, users)
+	assert.Equal(t, user.Username, users[len(users)-1].Username)
+	assert.True(t, users[len(users)-1].EmailVerified)
+
+	require.NoError(t, spenderDB.SetEmailVerified(ctx, user.Username, false))
+	storedUser, err = spenderDB.GetUser(ctx, user.Username, true)
+	require.NoError(t, err)
+	assert.False(t, storedUser.EmailVerified)
+}
+
+func testUpdateUser(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser()
+	user.Profile = models.UserProfile{DisplayName: "Serj", DefaultCurrency: "RSD"}
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	storedUser, err := spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.Equal(t, user.Profile, storedUser.Profile)
+
+	storedUser.Email = "new-" + user.Email
+	storedUser.EmailVerified = true
+	storedUser.Profile = models.UserProfile{
+		DisplayName:     "Сергей",
+		DefaultCurrency: "EUR",
+		Timezone:        "Europe/Berlin",
+		Locale:          "de-DE",
+	}
+	// only the email, its verified flag and the profile change
+	storedUser.Password = "other-hash"
+	storedUser.Role = models.RoleAdmin
+	require.NoError(t, spenderDB.UpdateUser(ctx, storedUser))
+
+	updatedUser, err := spenderDB.GetUser(ctx, user.Username, true)
+	require.NoError(t, err)
+	assert.Equal(t, "new-"+user.Email, updatedUser.Email)
+	assert.True(t, updatedUser.EmailVerified)
+	assert.Equal(t, storedUser.Profile, updatedUser.Profile)
+	assert.Equal(t, "password-hash", updatedUser.Password)
+	assert.Equal(t, models.RoleUser, updatedUser.Role)
+
+	users, err := spenderDB.GetAllUsers(ctx, false)
+	require.NoError(t, err)
+	require.NotEmpty(t, users)
+	assert.Equal(t, storedUser.Profile, users[len(users)-1].Profile)
+
+	// no two users with the same email
+	otherUser := newTestUser()
+	_, err = spenderDB.StoreUser(ctx, otherUser)
+	require.NoError(t, err)
+	otherUser.Email = updatedUser.Email
+	assert.Equal(t, platform.ErrAlreadyExists, spenderDB.UpdateUser(ctx, otherUser))
+	// the user's own email is no conflict
+	assert.NoError(t, spenderDB.UpdateUser(ctx, updatedUser))
+}
+
+func testDeleteUser(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser("sk1")
+	user.Spends = append(user.Spends, newTestSpending("sk1", 10), newTestSpending("sk2", 20))
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	credential := newTestWebAuthnCredential(user.Username)
+	require.NoError(t, spenderDB.StoreWebAuthnCredential(ctx, credential))
+	otherUser := newTestUser("sk1")
+	otherUser.Spends = append(otherUser.Spends, newTestSpending("sk1", 30))
+	_, err = spenderDB.StoreUser(ctx, otherUser)
+	require.NoError(t, err)
+
+	// rolled back with the transaction
+	errAbort := errors.New("abort")
+	err = spenderDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		if err := tx.DeleteUser(ctx, user.Username); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.Equal(t, errAbort, err)
+	_, err = spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+
+	require.NoError(t, spenderDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		return tx.DeleteUser(ctx, user.Username)
+	}))
+	_, err = spenderDB.GetUser(ctx, user.Username, true)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = spenderDB.GetSpends(ctx, user.Username)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = spenderDB.GetWebAuthnCredential(ctx, credential.ID)
+	assert.Equal(t, platform.ErrNotFound, err)
+	users, err := spenderDB.GetAllUsers(ctx, true)
+	require.NoError(t, err)
+	for _, u := range users {
+		assert.NotEqual(t, user.Username, u.Username)
+	}
+
+	// the other users keep their data
+	spends, err := spenderDB.GetSpends(ctx, otherUser.Username)
+	require.NoError(t, err)
+	assert.Len(t, spends, 1)
+
+	// the username can be registered again, from scratch
+	newUser := newTestUser()
+	newUser.Username = user.Username
+	_, err = spenderDB.StoreUser(ctx, newUser)
+	require.NoError(t, err)
+	spends, err = spenderDB.GetSpends(ctx, user.Username)
+	require.NoError(t, err)
+	assert.Empty(t, spends)
+	credentials, err := spenderDB.GetWebAuthnCredentials(ctx, user.Username)
+	require.NoError(t, err)
+	assert.Empty(t, credentials)
+}
+
+func testUserTOTP(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser()
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	storedUser, err := spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.Equal(t, models.TOTP{}, storedUser.TOTP)
+
+	totp := models.TOTP{
+		Secret:        "JBSWY3DPEHPK3PXP",
+		Enabled:       true,
+		RecoveryCodes: []string{"hash1", "hash2"},
+		LastUsedStep:  56789012,
+	}
+	require.NoError(t, spenderDB.SetUserTOTP(ctx, user.Username, totp))
+	storedUser, err = spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.Equal(t, totp, storedUser.TOTP)
+	storedUser, err = spenderDB.GetUser(ctx, user.Username, true)
+	require.NoError(t, err)
+	assert.Equal(t, totp, storedUser.TOTP)
+
+	// the stored codes are not shared with the caller
+	totp.RecoveryCodes[0] = "changed"
+	storedUser, err = spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.Equal(t, "hash1", storedUser.TOTP.RecoveryCodes[0])
+
+	users, err := spenderDB.GetAllUsers(ctx, false)
+	require.NoError(t, err)
+	require.NotEmpty(t, users)
+	assert.True(t, users[len(users)-1].TOTP.Enabled)
+
+	require.NoError(t, spenderDB.SetUserTOTP(ctx, user.Username, models.TOTP{}))
+	storedUser, err = spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.Equal(t, models.TOTP{}, storedUser.TOTP)
+}
+
+func testWebAuthnCredentials(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser()
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	credentials, err := spenderDB.GetWebAuthnCredentials(ctx, user.Username)
+	require.NoError(t, err)
+	assert.Empty(t, credentials)
+
+	first := newTestWebAuthnCredential(user.Username)
+	second := newTestWebAuthnCredential(user.Username)
+	second.Name = "phone"
+	second.Transports = nil
+	second.CreatedAt = first.CreatedAt.Add(time.Hour)
+	require.NoError(t, spenderDB.StoreWebAuthnCredential(ctx, first))
+	require.NoError(t, spenderDB.StoreWebAuthnCredential(ctx, second))
+	assert.Equal(t, platform.ErrAlreadyExists, spenderDB.StoreWebAuthnCredential(ctx, first))
+
+	credentials, err = spenderDB.GetWebAuthnCredentials(ctx, user.Username)
+	require.NoError(t, err)
+	require.Len(t, credentials, 2)
+	assert.Equal(t, *first, credentials[0])
+	assert.Equal(t, "phone", credentials[1].Name)
+	assert.Empty(t, credentials[1].Transports)
+
+	credential, err := spenderDB.GetWebAuthnCredential(ctx, first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, *first, *credential)
+	_, err = spenderDB.GetWebAuthnCredential(ctx, []byte("unknown credential"))
+	assert.Equal(t, platform.ErrNotFound, err)
+
+	usedAt := first.CreatedAt.Add(24 * time.Hour)
+	require.NoError(t, spenderDB.UpdateWebAuthnCredentialUse(ctx, first.ID, 7, true, usedAt))
+	credential, err = spenderDB.GetWebAuthnCredential(ctx, first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), credential.SignCount)
+	assert.True(t, credential.BackupState)
+	assert.True(t, usedAt.Equal(credential.LastUsedAt))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.UpdateWebAuthnCredentialUse(ctx, []byte("unknown credential"), 1, false, usedAt))
+
+	// only the owner deletes a credential
+	otherUser := newTestUser()
+	_, err = spenderDB.StoreUser(ctx, otherUser)
+	require.NoError(t, err)
+	assert.Equal(t, platform.ErrNotFound, spenderDB.DeleteWebAuthnCredential(ctx, otherUser.Username, first.ID))
+	require.NoError(t, spenderDB.DeleteWebAuthnCredential(ctx, user.Username, first.ID))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.DeleteWebAuthnCredential(ctx, user.Username, first.ID))
+	credentials, err = spenderDB.GetWebAuthnCredentials(ctx, user.Username)
+	require.NoError(t, err)
+	require.Len(t, credentials, 1)
+	assert.Equal(t, second.ID, credentials[0].ID)
+
+	// rolled back with the transaction
+	errAbort := errors.New("abort")
+	err = spenderDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		if err := tx.StoreWebAuthnCredential(ctx, newTestWebAuthnCredential(user.Username)); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.Equal(t, errAbort, err)
+	credentials, err = spenderDB.GetWebAuthnCredentials(ctx, user.Username)
+	require.NoError(t, err)
+	assert.Len(t, credentials, 1)
+}
+
+func testUserRoles(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser()
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	noRole := newTestUser()
+	noRole.Role = ""
+	_, err = spenderDB.StoreUser(ctx, noRole)
+	require.NoError(t, err)
+
+	storedUser, err := spenderDB.GetUser(ctx, user.Username, false)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, storedUser.Role)
+	storedUser, err = spenderDB.GetUser(ctx, noRole.Username, false)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, storedUser.Role)
+
+	require.NoError(t, spenderDB.SetUserRole(ctx, user.Username, models.RoleAdmin))
+	storedUser, err = spenderDB.GetUser(ctx, user.Username, true)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleAdmin, storedUser.Role)
+
+	users, err := spenderDB.GetAllUsers(ctx, false)
+	require.NoError(t, err)
+	roles := make(map[string]string)
+	for _, u := range users {
+		roles[u.Username] = u.Role
+	}
+	assert.Equal(t, models.RoleAdmin, roles[user.Username])
+	assert.Equal(t, models.RoleUser, roles[noRole.Username])
+}
+
+func testSpendKinds(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser()
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+
+	spendKinds, err := spenderDB.GetSpendKinds(ctx, user.Username)
+	require.NoError(t, err)
+	assert.Empty(t, spendKinds)
+
+	id1, err := spenderDB.StoreSpendKind(ctx, user.Username, &models.SpendKind{Name: "sk1"})
+	require.NoError(t, err)
+	id2, err := spenderDB.StoreSpendKind(ctx, user.Username, &models.SpendKind{ID: id1, Name: "sk2"})
+	require.NoError(t, err)
+	assert.True(t, id1 > 0)
+	assert.NotEqual(t, id1, id2, "given spend kind IDs are ignored, new ones are assigned")
+
+	spendKinds, err = spenderDB.GetSpendKinds(ctx, user.Username)
+	require.NoError(t, err)
+	// ordered by insertion
+	assert.Equal(t, []models.SpendKind{{ID: id1, Name: "sk1"}, {ID: id2, Name: "sk2"}}, spendKinds)
+
+	spendKind, err := spenderDB.GetSpendKind(ctx, user.Username, id2)
+	require.NoError(t, err)
+	assert.Equal(t, models.SpendKind{ID: id2, Name: "sk2"}, *spendKind)
+
+	_, err = spenderDB.GetSpendKind(ctx, user.Username, id2+1000)
+	assert.Equal(t, platform.ErrNotFound, err)
+
+	// spend kinds are per user
+	otherUser := newTestUser()
+	_, err = spenderDB.StoreUser(ctx, otherUser)
+	require.NoError(t, err)
+	_, err = spenderDB.GetSpendKind(ctx, otherUser.Username, id1)
+	assert.Equal(t, platform.ErrNotFound, err)
+}
+
+func testSpends(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser("sk1")
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+
+	spends, err := spenderDB.GetSpends(ctx, user.Username)
+	require.NoError(t, err)
+	assert.Empty(t, spends)
+
+	spending1 := newTestSpending("sk1", 12.5)
+	spending1.ID = "ignored"
+	id1, err := spenderDB.StoreSpending(ctx, user.Username, spending1)
+	require.NoError(t, err)
+	id2, err := spenderDB.StoreSpending(ctx, user.Username, newTestSpending("new kind", 7))
+	require.NoError(t, err)
+	assert.NotEmpty(t, id1)
+	assert.NotEqual(t, "ignored", id1, "given spending IDs are ignored, new ones are assigned")
+	assert.NotEqual(t, id1, id2)
+
+	spends, err = spenderDB.GetSpends(ctx, user.Username)
+	require.NoError(t, err)
+	require.Len(t, spends, 2)
+	// ordered by insertion
+	assert.Equal(t, id1, spends[0].ID)
+	assert.Equal(t, "RSD", spends[0].Currency)
+	assert.Equal(t, float32(12.5), spends[0].Amount)
+	assert.True(t, spending1.Timestamp.Equal(spends[0].Timestamp))
+	assert.Equal(t, models.SpendKind{ID: user.SpendKinds[0].ID, Name: "sk1"}, *spends[0].Kind)
+	assert.Equal(t, id2, spends[1].ID)
+	assert.Equal(t, "new kind", spends[1].Kind.Name)
+
+	spendKinds, err := spenderDB.GetSpendKinds(ctx, user.Username)
+	require.NoError(t, err)
+	require.Len(t, spendKinds, 2)
+	assert.Equal(t, spendKinds[1], *spends[1].Kind)
+}
+
+func testDeleteSpending(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser()
+	_, err := spenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	id1, err := spenderDB.StoreSpending(ctx, user.Username, newTestSpending("sk1", 1))
+	require.NoError(t, err)
+	id2, err := spenderDB.StoreSpending(ctx, user.Username, newTestSpending("sk1", 2))
+	require.NoError(t, err)
+
+	// a spending can only be deleted by its owner
+	otherUser := newTestUser()
+	_, err = spenderDB.StoreUser(ctx, otherUser)
+	require.NoError(t, err)
+	assert.Equal(t, platform.ErrNotFound, spenderDB.DeleteSpending(ctx, otherUser.Username, id1))
+
+	require.NoError(t, spenderDB.DeleteSpending(ctx, user.Username, id1))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.DeleteSpending(ctx, user.Username, id1))
+	assert.Equal(t, platform.ErrNotFound, spenderDB.DeleteSpending(ctx, user.Username, "not-an-id"))
+
+	spends, err := spenderDB.GetSpends(ctx, user.Username)
+	require.NoError(t, err)
+	require.Len(t, spends, 1)
+	assert.Equal(t, id2, spends[0].ID)
+}
+
+func testDataOfUsers(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	var users []*models.User
+	for i := 0; i < 3; i++ {
+		user := newTestUser("sk1")
+		_, err := spenderDB.StoreUser(ctx, user)
+		require.NoError(t, err)
+		users = append(users, user)
+	}
+	_, err := spenderDB.StoreSpending(ctx, users[0].Username, newTestSpending("sk1", 1))
+	require.NoError(t, err)
+	_, err = spenderDB.StoreSpending(ctx, users[0].Username, newTestSpending("sk2", 2))
+	require.NoError(t, err)
+	_, err = spenderDB.StoreSpending(ctx, users[2].Username, newTestSpending("sk1", 3))
+	require.NoError(t, err)
+
+	unknown := newUsername()
+	usernames := []string{users[0].Username, users[1].Username, users[2].Username, unknown}
+
+	spendsByUser, err := spenderDB.GetSpendsOfUsers(ctx, usernames)
+	require.NoError(t, err)
+	assert.NotContains(t, spendsByUser, unknown)
+	for _, user := range users {
+		spends, err := spenderDB.GetSpends(ctx, user.Username)
+		require.NoError(t, err)
+		assert.Equal(t, spends, spendsByUser[user.Username])
+	}
+	assert.Len(t, spendsByUser[users[0].Username], 2)
+	assert.Empty(t, spendsByUser[users[1].Username])
+
+	spendKindsByUser, err := spenderDB.GetSpendKindsOfUsers(ctx, usernames)
+	require.NoError(t, err)
+	assert.NotContains(t, spendKindsByUser, unknown)
+	for _, user := range users {
+		spendKinds, err := spenderDB.GetSpendKinds(ctx, user.Username)
+		require.NoError(t, err)
+		assert.Equal(t, spendKinds, spendKindsByUser[user.Username])
+	}
+	assert.Len(t, spendKindsByUser[users[0].Username], 2)
+
+	// more users than the next power of two, and none at all
+	spendsByUser, err = spenderDB.GetSpendsOfUsers(ctx, append(usernames, newUsername()))
+	require.NoError(t, err)
+	assert.Len(t, spendsByUser, 3)
+	spendsByUser, err = spenderDB.GetSpendsOfUsers(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, spendsByUser)
+}
+
+func testWithTxCommit(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	user := newTestUser()
+	var spendingID string
+	err := spenderDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		if _, err := tx.StoreUser(ctx, user); err != nil {
+			return err
+		}
+		var err error
+		spendingID, err = tx.StoreSpending(ctx, user.Username, newTestSpending("sk1", 1))
+		return err
+	})
+	require.NoError(t, err)
+
+	spends, err := spenderDB.GetSpends(ctx, user.Username)
+	require.NoError(t, err)
+	require.Len(t, spends, 1)
+	assert.Equal(t, spendingID, spends[0].ID)
+}
+
+func testWithTxRollback(t *testing.T, spenderDB db.SpenderDB) {
+	ctx := context.Background()
+
+	existingUser := newTestUser()
+	_, err := spenderDB.StoreUser(ctx, existingUser)
+	require.NoError(t, err)
+	existingSpendingID, err := spenderDB.StoreSpending(ctx, existingUser.Username, newTestSpending("sk1", 1))
+	require.NoError(t, err)
+
+	newUser := newTestUser()
+	errAbort := errors.New("abort")
+	err = spenderDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		if _, err := tx.StoreUser(ctx, newUser); err != nil {
+			return err
+		}
+		if _, err := tx.StoreSpending(ctx, existingUser.Username, newTestSpending("sk2", 2)); err != nil {
+			return err
+		}
+		if err := tx.DeleteSpending(ctx, existingUser.Username, existingSpendingID); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err)
+
+	_, err = spenderDB.GetUser(ctx, newUser.Username, false)
+	assert.Equal(t, platform.ErrNotFound, err)
+
+	spends, err := spenderDB.GetSpends(ctx, existingUser.Username)
+	require.NoError(t, err)
+	require.Len(t, spends, 1)
+	assert.Equal(t, existingSpendingID, spends[0].ID)
+
+	spendKinds, err := spenderDB.GetSpendKinds(ctx, existingUser.Username)
+	require.NoError(t, err)
+	assert.Len(t, spendKinds, 1)
+}
+
+func testCanceledContext(t *testing.T, spenderDB db.SpenderDB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	user := newTestUser()
+	_, err := spenderDB.StoreUser(ctx, user)
+	assert.Error(t, err)
+	_, err = spenderDB.GetAllUsers(ctx, true)
+	assert.Error(t, err)
+
+	called := false
+	err = spenderDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		called = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+
+	_, err = spenderDB.GetUser(context.Background(), user.Username, false)
+	assert.Equal(t, platform.ErrNotFound, err)
+}
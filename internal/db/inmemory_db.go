@@ -1,7 +1,12 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/2beens/ispend/internal/models"
 	"github.com/2beens/ispend/internal/platform"
@@ -10,12 +15,28 @@ import (
 type InMemoryDB struct {
 	DefaultSpendKinds []models.SpendKind
 	Users             models.Users
+	// webAuthnCredentials are the credentials of the users, by their usernames
+	webAuthnCredentials map[string][]models.WebAuthnCredential
+
+	// last used IDs, imitating the SQL sequences - they are not reverted on rollback either
+	lastDefaultSpendKindID int
+	lastUserID             int
+	lastSpendKindID        int
+	lastSpendID            int
+
+	// mu guards all of the above, a transaction holds it until it's done; the data
+	// never leaves the DB other than copied, so it's never touched without it
+	mu sync.RWMutex
+
+	// persistence is nil for a DB living only in memory
+	persistence *memPersistence
 }
 
 func NewInMemoryDB() *InMemoryDB {
 	inMemDB := &InMemoryDB{
-		DefaultSpendKinds: []models.SpendKind{},
-		Users:             models.Users{},
+		DefaultSpendKinds:   []models.SpendKind{},
+		Users:               models.Users{},
+		webAuthnCredentials: make(map[string][]models.WebAuthnCredential),
 	}
 
 	inMemDB.prepareDebuggingData()
@@ -24,24 +45,302 @@ func NewInMemoryDB() *InMemoryDB {
 }
 
 func (db *InMemoryDB) Open() error {
-	return nil
+	if db.persistence == nil {
+		return nil
+	}
+	return db.openPersistence()
 }
 
 func (db *InMemoryDB) Close() error {
-	return nil
+	if db.persistence == nil {
+		return nil
+	}
+	return db.closePersistence()
 }
 
-func (db *InMemoryDB) StoreDefaultSpendKind(kind models.SpendKind) (int, error) {
-	db.DefaultSpendKinds = append(db.DefaultSpendKinds, kind)
-	return kind.ID, nil
+// WithTx snapshots the whole DB state before running f, and restores it
+// if f fails, giving the same rollback semantics as the SQL backends
+func (db *InMemoryDB) WithTx(ctx context.Context, f func(tx SpenderTx) error) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	defaultSpendKindsSnapshot := append([]models.SpendKind{}, db.DefaultSpendKinds...)
+	usersSnapshot := make(models.Users, 0, len(db.Users))
+	for _, user := range db.Users {
+		usersSnapshot = append(usersSnapshot, copyUser(user))
+	}
+	webAuthnCredentialsSnapshot := make(map[string][]models.WebAuthnCredential, len(db.webAuthnCredentials))
+	for username, credentials := range db.webAuthnCredentials {
+		webAuthnCredentialsSnapshot[username] = copyWebAuthnCredentials(credentials)
+	}
+
+	tx := &inMemoryTx{db: db, inTx: true}
+	rollback := func() {
+		db.DefaultSpendKinds = defaultSpendKindsSnapshot
+		db.Users = usersSnapshot
+		db.webAuthnCredentials = webAuthnCredentialsSnapshot
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			rollback()
+			panic(p)
+		}
+	}()
+
+	err = f(tx)
+	if err == nil {
+		// same as with SQL transactions, nothing gets committed after the context is done
+		err = ctx.Err()
+	}
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	// only the committed changes make it to the op log
+	return db.appendOps(tx.pendingOps)
+}
+
+func copyUser(user *models.User) *models.User {
+	userCopy := *user
+	userCopy.Spends = copySpends(user.Spends)
+	userCopy.SpendKinds = append([]models.SpendKind{}, user.SpendKinds...)
+	userCopy.TOTP = copyTOTP(user.TOTP)
+	return &userCopy
+}
+
+// copyWebAuthnCredentials copies the credentials together with their byte slices
+func copyWebAuthnCredentials(credentials []models.WebAuthnCredential) []models.WebAuthnCredential {
+	credentialsCopy := make([]models.WebAuthnCredential, len(credentials))
+	for i, credential := range credentials {
+		credentialsCopy[i] = copyWebAuthnCredential(credential)
+	}
+	return credentialsCopy
 }
 
-func (db *InMemoryDB) GetAllDefaultSpendKinds() ([]models.SpendKind, error) {
-	return db.DefaultSpendKinds, nil
+func copyWebAuthnCredential(credential models.WebAuthnCredential) models.WebAuthnCredential {
+	credential.ID = append([]byte(nil), credential.ID...)
+	credential.UserHandle = append([]byte(nil), credential.UserHandle...)
+	credential.PublicKey = append([]byte(nil), credential.PublicKey...)
+	credential.AAGUID = append([]byte(nil), credential.AAGUID...)
+	credential.Transports = append([]string(nil), credential.Transports...)
+	return credential
 }
 
-func (db *InMemoryDB) GetSpendKind(username string, spendingKindID int) (*models.SpendKind, error) {
-	user, err := db.GetUser(username, true)
+func copyTOTP(totp models.TOTP) models.TOTP {
+	totp.RecoveryCodes = append([]string(nil), totp.RecoveryCodes...)
+	return totp
+}
+
+// copySpends copies the spends together with their kinds, which are pointers
+func copySpends(spends []models.Spending) []models.Spending {
+	spendsCopy := make([]models.Spending, len(spends))
+	for i, spending := range spends {
+		spendsCopy[i] = spending
+		if spending.Kind != nil {
+			kind := *spending.Kind
+			spendsCopy[i].Kind = &kind
+		}
+	}
+	return spendsCopy
+}
+
+// locked returns the tx doing the work of a single, auto committed DB call, the caller must hold db.mu
+// (a read lock is enough for the read-only calls)
+func (db *InMemoryDB) locked() *inMemoryTx {
+	return &inMemoryTx{db: db}
+}
+
+func (db *InMemoryDB) StoreDefaultSpendKind(ctx context.Context, kind models.SpendKind) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().StoreDefaultSpendKind(ctx, kind)
+}
+
+func (db *InMemoryDB) GetAllDefaultSpendKinds(ctx context.Context) ([]models.SpendKind, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetAllDefaultSpendKinds(ctx)
+}
+
+func (db *InMemoryDB) GetSpendKind(ctx context.Context, username string, spendingKindID int) (*models.SpendKind, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetSpendKind(ctx, username, spendingKindID)
+}
+
+func (db *InMemoryDB) GetSpendKinds(ctx context.Context, username string) ([]models.SpendKind, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetSpendKinds(ctx, username)
+}
+
+func (db *InMemoryDB) GetSpendKindsOfUsers(ctx context.Context, usernames []string) (map[string][]models.SpendKind, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetSpendKindsOfUsers(ctx, usernames)
+}
+
+func (db *InMemoryDB) StoreSpendKind(ctx context.Context, username string, kind *models.SpendKind) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().StoreSpendKind(ctx, username, kind)
+}
+
+func (db *InMemoryDB) StoreUser(ctx context.Context, user *models.User) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().StoreUser(ctx, user)
+}
+
+func (db *InMemoryDB) GetUser(ctx context.Context, username string, loadAllData bool) (*models.User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetUser(ctx, username, loadAllData)
+}
+
+func (db *InMemoryDB) GetAllUsers(ctx context.Context, loadAllUserData bool) (models.Users, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetAllUsers(ctx, loadAllUserData)
+}
+
+func (db *InMemoryDB) SetUserRole(ctx context.Context, username, role string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().SetUserRole(ctx, username, role)
+}
+
+func (db *InMemoryDB) SetEmailVerified(ctx context.Context, username string, verified bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().SetEmailVerified(ctx, username, verified)
+}
+
+func (db *InMemoryDB) SetUserPassword(ctx context.Context, username, passwordHash string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().SetUserPassword(ctx, username, passwordHash)
+}
+
+func (db *InMemoryDB) UpdateUser(ctx context.Context, user *models.User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().UpdateUser(ctx, user)
+}
+
+func (db *InMemoryDB) DeleteUser(ctx context.Context, username string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().DeleteUser(ctx, username)
+}
+
+func (db *InMemoryDB) SetUserTOTP(ctx context.Context, username string, totp models.TOTP) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().SetUserTOTP(ctx, username, totp)
+}
+
+func (db *InMemoryDB) StoreWebAuthnCredential(ctx context.Context, credential *models.WebAuthnCredential) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().StoreWebAuthnCredential(ctx, credential)
+}
+
+func (db *InMemoryDB) GetWebAuthnCredentials(ctx context.Context, username string) ([]models.WebAuthnCredential, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetWebAuthnCredentials(ctx, username)
+}
+
+func (db *InMemoryDB) GetWebAuthnCredential(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetWebAuthnCredential(ctx, credentialID)
+}
+
+func (db *InMemoryDB) UpdateWebAuthnCredentialUse(ctx context.Context, credentialID []byte, signCount uint32, backupState bool, usedAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().UpdateWebAuthnCredentialUse(ctx, credentialID, signCount, backupState, usedAt)
+}
+
+func (db *InMemoryDB) DeleteWebAuthnCredential(ctx context.Context, username string, credentialID []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().DeleteWebAuthnCredential(ctx, username, credentialID)
+}
+
+func (db *InMemoryDB) StoreSpending(ctx context.Context, username string, spending models.Spending) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().StoreSpending(ctx, username, spending)
+}
+
+func (db *InMemoryDB) GetSpends(ctx context.Context, username string) ([]models.Spending, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetSpends(ctx, username)
+}
+
+func (db *InMemoryDB) GetSpendsOfUsers(ctx context.Context, usernames []string) (map[string][]models.Spending, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.locked().GetSpendsOfUsers(ctx, usernames)
+}
+
+func (db *InMemoryDB) DeleteSpending(ctx context.Context, username, spendID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.locked().DeleteSpending(ctx, username, spendID)
+}
+
+// inMemoryTx does the actual work on the InMemoryDB data, always with db.mu held,
+// and hands out only copies of it
+type inMemoryTx struct {
+	db *InMemoryDB
+
+	// inTx is set within WithTx, where the op log entries wait for the commit
+	inTx       bool
+	pendingOps []memOp
+}
+
+// changed records a change for the op log, right away or on commit if in a transaction
+func (tx *inMemoryTx) changed(op memOp) error {
+	if tx.db.persistence == nil || tx.db.persistence.opLog == nil {
+		return nil
+	}
+	if tx.inTx {
+		tx.pendingOps = append(tx.pendingOps, op)
+		return nil
+	}
+	return tx.db.appendOps([]memOp{op})
+}
+
+func (tx *inMemoryTx) StoreDefaultSpendKind(ctx context.Context, kind models.SpendKind) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	tx.db.lastDefaultSpendKindID++
+	kind.ID = tx.db.lastDefaultSpendKindID
+	tx.db.DefaultSpendKinds = append(tx.db.DefaultSpendKinds, kind)
+	return kind.ID, tx.changed(tx.db.defaultSpendKindsOp())
+}
+
+func (tx *inMemoryTx) GetAllDefaultSpendKinds(ctx context.Context) ([]models.SpendKind, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return append([]models.SpendKind{}, tx.db.DefaultSpendKinds...), nil
+}
+
+func (tx *inMemoryTx) GetSpendKind(ctx context.Context, username string, spendingKindID int) (*models.SpendKind, error) {
+	user, err := tx.getUser(ctx, username)
 	if err != nil {
 		return nil, err
 	}
@@ -55,61 +354,344 @@ func (db *InMemoryDB) GetSpendKind(username string, spendingKindID int) (*models
 	return nil, platform.ErrNotFound
 }
 
-func (db *InMemoryDB) GetSpendKinds(username string) ([]models.SpendKind, error) {
-	user, err := db.GetUser(username, true)
+func (tx *inMemoryTx) GetSpendKinds(ctx context.Context, username string) ([]models.SpendKind, error) {
+	user, err := tx.getUser(ctx, username)
 	if err != nil {
 		return nil, err
 	}
-	return user.SpendKinds, nil
+	return append([]models.SpendKind{}, user.SpendKinds...), nil
+}
+
+func (tx *inMemoryTx) GetSpendKindsOfUsers(ctx context.Context, usernames []string) (map[string][]models.SpendKind, error) {
+	spendKindsByUser := make(map[string][]models.SpendKind, len(usernames))
+	for _, username := range usernames {
+		spendKinds, err := tx.GetSpendKinds(ctx, username)
+		if err == platform.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		spendKindsByUser[username] = spendKinds
+	}
+	return spendKindsByUser, nil
 }
 
-func (db *InMemoryDB) StoreSpendKind(username string, kind *models.SpendKind) (int, error) {
-	user, err := db.GetUser(username, true)
+func (tx *inMemoryTx) StoreSpendKind(ctx context.Context, username string, kind *models.SpendKind) (int, error) {
+	user, err := tx.getUser(ctx, username)
 	if err != nil {
 		return -1, err
 	}
-	user.SpendKinds = append(user.SpendKinds, *kind)
-	return -1, nil
+	id := tx.storeSpendKind(user, kind.Name)
+	return id, tx.changed(tx.db.userOp(user))
+}
+
+func (tx *inMemoryTx) storeSpendKind(user *models.User, name string) int {
+	tx.db.lastSpendKindID++
+	user.SpendKinds = append(user.SpendKinds, models.SpendKind{
+		ID:   tx.db.lastSpendKindID,
+		Name: name,
+	})
+	return tx.db.lastSpendKindID
+}
+
+// StoreUser assigns IDs to the user's spend kinds and spends, the same way the SQL backends do
+func (tx *inMemoryTx) StoreUser(ctx context.Context, user *models.User) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.getUser(ctx, user.Username); err == nil {
+		return 0, platform.ErrAlreadyExists
+	}
+	// the email is unique too, as in the SQL backends
+	for _, other := range tx.db.Users {
+		if other.Email == user.Email {
+			return 0, platform.ErrAlreadyExists
+		}
+	}
+
+	storedUser := &models.User{
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Username:      user.Username,
+		Password:      user.Password,
+		Role:          user.Role,
+		Profile:       user.Profile,
+	}
+	if storedUser.Role == "" {
+		storedUser.Role = models.RoleUser
+	}
+	for i := range user.SpendKinds {
+		user.SpendKinds[i].ID = tx.storeSpendKind(storedUser, user.SpendKinds[i].Name)
+	}
+	for i := range user.Spends {
+		user.Spends[i].ID = tx.storeSpending(storedUser, user.Spends[i])
+	}
+
+	tx.db.lastUserID++
+	tx.db.Users = append(tx.db.Users, storedUser)
+	return tx.db.lastUserID, tx.changed(tx.db.userOp(storedUser))
 }
 
-func (db *InMemoryDB) StoreUser(user *models.User) (int, error) {
-	db.Users = append(db.Users, user)
-	return 0, nil
+// GetUser returns the user without its spends and spend kinds, unless loadAllData is set
+func (tx *inMemoryTx) GetUser(ctx context.Context, username string, loadAllData bool) (*models.User, error) {
+	user, err := tx.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if loadAllData {
+		return copyUser(user), nil
+	}
+	return &models.User{
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Username:      user.Username,
+		Password:      user.Password,
+		Role:          user.Role,
+		TOTP:          copyTOTP(user.TOTP),
+		Profile:       user.Profile,
+	}, nil
 }
 
-func (db *InMemoryDB) GetUser(username string, loadAllData bool) (*models.User, error) {
-	for i := range db.Users {
-		if db.Users[i].Username == username {
-			return db.Users[i], nil
+func (tx *inMemoryTx) getUser(ctx context.Context, username string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i := range tx.db.Users {
+		if tx.db.Users[i].Username == username {
+			return tx.db.Users[i], nil
 		}
 	}
 	return nil, platform.ErrNotFound
 }
 
-func (db *InMemoryDB) GetAllUsers(loadAllUserData bool) (models.Users, error) {
-	return db.Users, nil
+func (tx *inMemoryTx) GetAllUsers(ctx context.Context, loadAllUserData bool) (models.Users, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if loadAllUserData {
+		users := make(models.Users, 0, len(tx.db.Users))
+		for _, user := range tx.db.Users {
+			users = append(users, copyUser(user))
+		}
+		return users, nil
+	}
+
+	var users models.Users
+	for _, user := range tx.db.Users {
+		users = append(users, &models.User{
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			Password:      user.Password,
+			Role:          user.Role,
+			TOTP:          copyTOTP(user.TOTP),
+			Profile:       user.Profile,
+		})
+	}
+	return users, nil
+}
+
+func (tx *inMemoryTx) SetUserRole(ctx context.Context, username, role string) error {
+	user, err := tx.getUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	user.Role = role
+	return tx.changed(tx.db.userOp(user))
+}
+
+func (tx *inMemoryTx) SetEmailVerified(ctx context.Context, username string, verified bool) error {
+	user, err := tx.getUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	user.EmailVerified = verified
+	return tx.changed(tx.db.userOp(user))
 }
 
-func (db *InMemoryDB) StoreSpending(username string, spending models.Spending) (string, error) {
-	user, err := db.GetUser(username, true)
+func (tx *inMemoryTx) SetUserPassword(ctx context.Context, username, passwordHash string) error {
+	user, err := tx.getUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	user.Password = passwordHash
+	return tx.changed(tx.db.userOp(user))
+}
+
+func (tx *inMemoryTx) UpdateUser(ctx context.Context, user *models.User) error {
+	storedUser, err := tx.getUser(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	for _, other := range tx.db.Users {
+		if other.Email == user.Email && other.Username != user.Username {
+			return platform.ErrAlreadyExists
+		}
+	}
+	storedUser.Email = user.Email
+	storedUser.EmailVerified = user.EmailVerified
+	storedUser.Profile = user.Profile
+	return tx.changed(tx.db.userOp(storedUser))
+}
+
+func (tx *inMemoryTx) DeleteUser(ctx context.Context, username string) error {
+	if _, err := tx.getUser(ctx, username); err != nil {
+		return err
+	}
+	// a new slice, the array may be shared with a snapshot
+	users := make(models.Users, 0, len(tx.db.Users)-1)
+	for _, user := range tx.db.Users {
+		if user.Username != username {
+			users = append(users, user)
+		}
+	}
+	tx.db.Users = users
+	delete(tx.db.webAuthnCredentials, username)
+	return tx.changed(tx.db.deleteUserOp(username))
+}
+
+func (tx *inMemoryTx) SetUserTOTP(ctx context.Context, username string, totp models.TOTP) error {
+	user, err := tx.getUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	user.TOTP = copyTOTP(totp)
+	return tx.changed(tx.db.userOp(user))
+}
+
+func (tx *inMemoryTx) StoreWebAuthnCredential(ctx context.Context, credential *models.WebAuthnCredential) error {
+	user, err := tx.getUser(ctx, credential.Username)
+	if err != nil {
+		return err
+	}
+	if _, _, err := tx.getWebAuthnCredential(credential.ID); err == nil {
+		return platform.ErrAlreadyExists
+	}
+	if tx.db.webAuthnCredentials == nil {
+		tx.db.webAuthnCredentials = make(map[string][]models.WebAuthnCredential)
+	}
+	tx.db.webAuthnCredentials[user.Username] = append(tx.db.webAuthnCredentials[user.Username], copyWebAuthnCredential(*credential))
+	return tx.changed(tx.db.userOp(user))
+}
+
+func (tx *inMemoryTx) GetWebAuthnCredentials(ctx context.Context, username string) ([]models.WebAuthnCredential, error) {
+	user, err := tx.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return copyWebAuthnCredentials(tx.db.webAuthnCredentials[user.Username]), nil
+}
+
+func (tx *inMemoryTx) GetWebAuthnCredential(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	credential, _, err := tx.getWebAuthnCredential(credentialID)
+	if err != nil {
+		return nil, err
+	}
+	credentialCopy := copyWebAuthnCredential(*credential)
+	return &credentialCopy, nil
+}
+
+func (tx *inMemoryTx) UpdateWebAuthnCredentialUse(ctx context.Context, credentialID []byte, signCount uint32, backupState bool, usedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	credential, user, err := tx.getWebAuthnCredential(credentialID)
+	if err != nil {
+		return err
+	}
+	credential.SignCount = signCount
+	credential.BackupState = backupState
+	credential.LastUsedAt = usedAt
+	return tx.changed(tx.db.userOp(user))
+}
+
+func (tx *inMemoryTx) DeleteWebAuthnCredential(ctx context.Context, username string, credentialID []byte) error {
+	user, err := tx.getUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	credentials := tx.db.webAuthnCredentials[user.Username]
+	for i := range credentials {
+		if bytes.Equal(credentials[i].ID, credentialID) {
+			tx.db.webAuthnCredentials[user.Username] = append(credentials[:i:i], credentials[i+1:]...)
+			return tx.changed(tx.db.userOp(user))
+		}
+	}
+	return platform.ErrNotFound
+}
+
+// getWebAuthnCredential returns the stored credential itself, and its user
+func (tx *inMemoryTx) getWebAuthnCredential(credentialID []byte) (*models.WebAuthnCredential, *models.User, error) {
+	for _, user := range tx.db.Users {
+		credentials := tx.db.webAuthnCredentials[user.Username]
+		for i := range credentials {
+			if bytes.Equal(credentials[i].ID, credentialID) {
+				return &credentials[i], user, nil
+			}
+		}
+	}
+	return nil, nil, platform.ErrNotFound
+}
+
+func (tx *inMemoryTx) StoreSpending(ctx context.Context, username string, spending models.Spending) (string, error) {
+	user, err := tx.getUser(ctx, username)
 	if err != nil {
 		return "", err
 	}
+	id := tx.storeSpending(user, spending)
+	return id, tx.changed(tx.db.userOp(user))
+}
+
+// storeSpending resolves the spend kind by its name, creating it for the user if missing
+func (tx *inMemoryTx) storeSpending(user *models.User, spending models.Spending) string {
+	kindID := -1
+	for _, sk := range user.SpendKinds {
+		if sk.Name == spending.Kind.Name {
+			kindID = sk.ID
+			break
+		}
+	}
+	if kindID < 0 {
+		kindID = tx.storeSpendKind(user, spending.Kind.Name)
+	}
 
+	tx.db.lastSpendID++
+	spending.ID = strconv.Itoa(tx.db.lastSpendID)
+	spending.Kind = &models.SpendKind{ID: kindID, Name: spending.Kind.Name}
 	user.Spends = append(user.Spends, spending)
-	return platform.GenerateRandomString(10), nil
+
+	return spending.ID
 }
 
-func (db *InMemoryDB) GetSpends(username string) ([]models.Spending, error) {
-	user, err := db.GetUser(username, true)
+func (tx *inMemoryTx) GetSpends(ctx context.Context, username string) ([]models.Spending, error) {
+	user, err := tx.getUser(ctx, username)
 	if err != nil {
 		return nil, err
 	}
-	return user.Spends, nil
+	return copySpends(user.Spends), nil
+}
+
+func (tx *inMemoryTx) GetSpendsOfUsers(ctx context.Context, usernames []string) (map[string][]models.Spending, error) {
+	spendsByUser := make(map[string][]models.Spending, len(usernames))
+	for _, username := range usernames {
+		spends, err := tx.GetSpends(ctx, username)
+		if err == platform.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		spendsByUser[username] = spends
+	}
+	return spendsByUser, nil
 }
 
-func (db *InMemoryDB) DeleteSpending(username, spendID string) error {
-	user, err := db.GetUser(username, true)
+func (tx *inMemoryTx) DeleteSpending(ctx context.Context, username, spendID string) error {
+	user, err := tx.getUser(ctx, username)
 	if err != nil {
 		return err
 	}
@@ -126,63 +708,58 @@ func (db *InMemoryDB) DeleteSpending(username, spendID string) error {
 		return platform.ErrNotFound
 	}
 
-	// remove spending by its index
-	user.Spends = append(user.Spends[:indexToRemove], user.Spends[indexToRemove+1:]...)
+	// remove spending by its index, without touching the array possibly shared with a snapshot
+	spends := make([]models.Spending, 0, len(user.Spends)-1)
+	spends = append(spends, user.Spends[:indexToRemove]...)
+	user.Spends = append(spends, user.Spends[indexToRemove+1:]...)
 
-	return nil
+	return tx.changed(tx.db.userOp(user))
 }
 
 func (db *InMemoryDB) prepareDebuggingData() {
-	skNightlife := models.SpendKind{ID: 1, Name: "nightlife"}
-	skTravel := models.SpendKind{ID: 2, Name: "travel"}
-	skFood := models.SpendKind{ID: 3, Name: "food"}
-	skRent := models.SpendKind{ID: 4, Name: "rent"}
+	ctx := context.Background()
+	skNightlife := models.SpendKind{Name: "nightlife"}
+	skTravel := models.SpendKind{Name: "travel"}
+	skFood := models.SpendKind{Name: "food"}
+	skRent := models.SpendKind{Name: "rent"}
 	defSpendKinds := []models.SpendKind{skNightlife, skTravel, skFood, skRent}
 
 	adminUser := models.NewUser("admin@serjspends.de", "admin", "admin1", defSpendKinds)
 	adminUser.Spends = append(adminUser.Spends, models.Spending{
-		ID:       "sp1",
 		Amount:   100,
 		Currency: "RSD",
 		Kind:     &skNightlife,
 	})
 	adminUser.Spends = append(adminUser.Spends, models.Spending{
-		ID:       "sp2",
 		Amount:   2300,
 		Currency: "RSD",
 		Kind:     &skTravel,
 	})
 	lazarUser := models.NewUser("lazar@serjspends.de", "lazar", "lazar1", defSpendKinds)
 	lazarUser.Spends = append(lazarUser.Spends, models.Spending{
-		ID:       "sp3",
 		Amount:   89.99,
 		Currency: "USD",
 		Kind:     &skTravel,
 	})
 
-	_, err := db.StoreUser(adminUser)
+	_, err := db.StoreUser(ctx, adminUser)
 	if err != nil {
 		log.Panic(err.Error())
 	}
-	_, err = db.StoreUser(lazarUser)
+	_, err = db.StoreUser(ctx, lazarUser)
 	if err != nil {
 		log.Panic(err.Error())
 	}
 
-	_, err = db.StoreDefaultSpendKind(skNightlife)
-	if err != nil {
-		log.Panic(err.Error())
-	}
-	_, err = db.StoreDefaultSpendKind(skFood)
-	if err != nil {
-		log.Panic(err.Error())
-	}
-	_, err = db.StoreDefaultSpendKind(skRent)
-	if err != nil {
-		log.Panic(err.Error())
-	}
-	_, err = db.StoreDefaultSpendKind(skTravel)
-	if err != nil {
-		log.Panic(err.Error())
+	prepareDefaultSpendKinds(db)
+}
+
+func prepareDefaultSpendKinds(tx SpenderTx) {
+	ctx := context.Background()
+	for _, name := range []string{"nightlife", "food", "rent", "travel"} {
+		_, err := tx.StoreDefaultSpendKind(ctx, models.SpendKind{Name: name})
+		if err != nil {
+			log.Panic(err.Error())
+		}
 	}
 }
@@ -0,0 +1,211 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryDB_WithTx_Commit(t *testing.T) {
+	inMemDB := db.NewInMemoryDB()
+	ctx := context.Background()
+
+	err := inMemDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		_, err := tx.StoreUser(ctx, models.NewUser("email1", "user1", "pass1", nil))
+		if err != nil {
+			return err
+		}
+		_, err = tx.StoreSpending(ctx, "user1", models.Spending{Currency: "RSD", Amount: 10, Kind: &models.SpendKind{ID: 1, Name: "sk1"}})
+		return err
+	})
+	require.NoError(t, err)
+
+	spends, err := inMemDB.GetSpends(ctx, "user1")
+	require.NoError(t, err)
+	assert.Len(t, spends, 1)
+}
+
+func TestInMemoryDB_WithTx_Rollback(t *testing.T) {
+	inMemDB := db.NewInMemoryDB()
+	ctx := context.Background()
+	usersBefore, err := inMemDB.GetAllUsers(ctx, true)
+	require.NoError(t, err)
+	adminSpendsBefore, err := inMemDB.GetSpends(ctx, "admin")
+	require.NoError(t, err)
+
+	errAbort := errors.New("abort")
+	err = inMemDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		if _, err := tx.StoreUser(ctx, models.NewUser("email1", "user1", "pass1", nil)); err != nil {
+			return err
+		}
+		if _, err := tx.StoreSpending(ctx, "admin", models.Spending{Currency: "RSD", Amount: 10, Kind: &models.SpendKind{ID: 1}}); err != nil {
+			return err
+		}
+		if err := tx.DeleteSpending(ctx, "admin", "1"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err)
+
+	usersAfter, err := inMemDB.GetAllUsers(ctx, true)
+	require.NoError(t, err)
+	assert.Len(t, usersAfter, len(usersBefore))
+	_, err = inMemDB.GetUser(ctx, "user1", false)
+	assert.Error(t, err)
+
+	adminSpendsAfter, err := inMemDB.GetSpends(ctx, "admin")
+	require.NoError(t, err)
+	assert.Equal(t, len(adminSpendsBefore), len(adminSpendsAfter))
+	assert.Equal(t, "1", adminSpendsAfter[0].ID)
+}
+
+func TestInMemoryDB_CanceledContext(t *testing.T) {
+	inMemDB := db.NewInMemoryDB()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := inMemDB.GetUser(ctx, "admin", true)
+	assert.Equal(t, context.Canceled, err)
+	_, err = inMemDB.GetSpends(ctx, "admin")
+	assert.Equal(t, context.Canceled, err)
+	_, err = inMemDB.StoreSpending(ctx, "admin", models.Spending{Currency: "RSD", Amount: 10, Kind: &models.SpendKind{ID: 1}})
+	assert.Equal(t, context.Canceled, err)
+
+	spends, err := inMemDB.GetSpends(context.Background(), "admin")
+	require.NoError(t, err)
+	assert.Len(t, spends, 2)
+}
+
+func TestInMemoryDB_ReturnsCopies(t *testing.T) {
+	inMemDB := db.NewInMemoryDB()
+	ctx := context.Background()
+
+	user, err := inMemDB.GetUser(ctx, "admin", true)
+	require.NoError(t, err)
+	user.Password = "changed"
+	user.Spends[0].Amount = -1
+	user.Spends[0].Kind.Name = "changed"
+	user.SpendKinds[0].Name = "changed"
+
+	spends, err := inMemDB.GetSpends(ctx, "admin")
+	require.NoError(t, err)
+	spends[1].Currency = "changed"
+
+	defaultSpendKinds, err := inMemDB.GetAllDefaultSpendKinds(ctx)
+	require.NoError(t, err)
+	defaultSpendKinds[0].Name = "changed"
+
+	users, err := inMemDB.GetAllUsers(ctx, true)
+	require.NoError(t, err)
+	users[0].Spends = nil
+
+	user, err = inMemDB.GetUser(ctx, "admin", true)
+	require.NoError(t, err)
+	assert.Equal(t, "admin1", user.Password)
+	require.Len(t, user.Spends, 2)
+	assert.Equal(t, float32(100), user.Spends[0].Amount)
+	assert.Equal(t, "nightlife", user.Spends[0].Kind.Name)
+	assert.Equal(t, "RSD", user.Spends[1].Currency)
+	assert.Equal(t, "nightlife", user.SpendKinds[0].Name)
+
+	defaultSpendKinds, err = inMemDB.GetAllDefaultSpendKinds(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "nightlife", defaultSpendKinds[0].Name)
+}
+
+// TestInMemoryDB_ConcurrentAccess is meant to be run with the race detector:
+//
+//	go test -race ./internal/db/
+func TestInMemoryDB_ConcurrentAccess(t *testing.T) {
+	inMemDB := db.NewInMemoryDB()
+	ctx := context.Background()
+
+	const workers = 16
+	const iterations = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			username := "stress" + strconv.Itoa(w)
+			if _, err := inMemDB.StoreUser(ctx, models.NewUser(username+"@mail", username, "pass", nil)); err != nil {
+				t.Error(err)
+				return
+			}
+
+			for i := 0; i < iterations; i++ {
+				spendID, err := inMemDB.StoreSpending(ctx, username, models.Spending{Currency: "RSD", Amount: float32(i), Kind: &models.SpendKind{Name: "food"}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := inMemDB.StoreSpending(ctx, "admin", models.Spending{Currency: "EUR", Amount: 1, Kind: &models.SpendKind{Name: "travel"}}); err != nil {
+					t.Error(err)
+					return
+				}
+
+				// reads of other users' data, mutating what's returned
+				users, err := inMemDB.GetAllUsers(ctx, true)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, user := range users {
+					for j := range user.Spends {
+						user.Spends[j].Amount++
+					}
+				}
+				adminSpends, err := inMemDB.GetSpends(ctx, "admin")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(adminSpends) > 0 {
+					adminSpends[0].Kind.Name = "mutated"
+				}
+				if _, err := inMemDB.GetSpendKinds(ctx, "admin"); err != nil {
+					t.Error(err)
+					return
+				}
+
+				err = inMemDB.WithTx(ctx, func(tx db.SpenderTx) error {
+					if _, err := tx.StoreSpendKind(ctx, username, &models.SpendKind{Name: "kind" + strconv.Itoa(i)}); err != nil {
+						return err
+					}
+					return tx.DeleteSpending(ctx, username, spendID)
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < workers; w++ {
+		username := "stress" + strconv.Itoa(w)
+		spends, err := inMemDB.GetSpends(ctx, username)
+		require.NoError(t, err)
+		assert.Empty(t, spends)
+		spendKinds, err := inMemDB.GetSpendKinds(ctx, username)
+		require.NoError(t, err)
+		assert.Len(t, spendKinds, iterations+1)
+	}
+
+	adminSpends, err := inMemDB.GetSpends(ctx, "admin")
+	require.NoError(t, err)
+	assert.Len(t, adminSpends, 2+workers*iterations)
+	assert.Equal(t, "nightlife", adminSpends[0].Kind.Name)
+	assert.Equal(t, float32(100), adminSpends[0].Amount)
+}
@@ -0,0 +1,508 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	log "github.com/sirupsen/logrus"
+)
+
+const memSnapshotVersion = 1
+
+const (
+	memOpUser              = "user"
+	memOpDeleteUser        = "delete_user"
+	memOpDefaultSpendKinds = "default_spend_kinds"
+)
+
+// memPersistence keeps an InMemoryDB in a JSON snapshot file, written periodically and on Close,
+// and optionally in an op log file next to it, so the changes since the last snapshot survive a crash
+type memPersistence struct {
+	path             string
+	snapshotInterval time.Duration
+	useOpLog         bool
+
+	opLog *os.File
+
+	chStop chan struct{}
+	wg     sync.WaitGroup
+}
+
+// memSnapshot is the file format of the snapshot, kept apart from the API models
+// so their JSON tags never decide what gets persisted
+type memSnapshot struct {
+	Version           int                `json:"version"`
+	DefaultSpendKinds []models.SpendKind `json:"default_spend_kinds"`
+	Users             []memUser          `json:"users"`
+	Counters          memCounters        `json:"counters"`
+}
+
+type memUser struct {
+	Email         string             `json:"email"`
+	EmailVerified bool               `json:"email_verified"`
+	Username      string             `json:"username"`
+	Password      string             `json:"password"`
+	Role          string             `json:"role"`
+	TOTP          *memTOTP           `json:"totp,omitempty"`
+	Profile       *memProfile        `json:"profile,omitempty"`
+	Spends        []models.Spending  `json:"spends"`
+	SpendKinds    []models.SpendKind `json:"spend_kinds"`
+	// WebAuthnCredentials are kept apart from the users in memory, see InMemoryDB.webAuthnCredentials
+	WebAuthnCredentials []models.WebAuthnCredential `json:"webauthn_credentials,omitempty"`
+}
+
+type memTOTP struct {
+	Secret        string   `json:"secret"`
+	Enabled       bool     `json:"enabled"`
+	RecoveryCodes []string `json:"recovery_codes"`
+	LastUsedStep  int64    `json:"last_used_step"`
+}
+
+type memProfile struct {
+	DisplayName     string `json:"display_name"`
+	DefaultCurrency string `json:"default_currency"`
+	Timezone        string `json:"timezone"`
+	Locale          string `json:"locale"`
+}
+
+type memCounters struct {
+	LastDefaultSpendKindID int `json:"last_default_spend_kind_id"`
+	LastUserID             int `json:"last_user_id"`
+	LastSpendKindID        int `json:"last_spend_kind_id"`
+	LastSpendID            int `json:"last_spend_id"`
+}
+
+// memOp is a single op log line, holding the whole new state of what was changed,
+// so replaying it is just overwriting and can safely be done more than once
+type memOp struct {
+	Type              string             `json:"type"`
+	User              *memUser           `json:"user,omitempty"`
+	Username          string             `json:"username,omitempty"`
+	DefaultSpendKinds []models.SpendKind `json:"default_spend_kinds,omitempty"`
+	Counters          memCounters        `json:"counters"`
+}
+
+// NewPersistentInMemoryDB creates an InMemoryDB stored in the snapshot file at path, loaded on Open and
+// saved every snapshotInterval (never if 0) and on Close; with useOpLog each change is also appended to
+// path + ".log" right away. A new DB gets just the default spend kinds, no debugging data.
+func NewPersistentInMemoryDB(path string, snapshotInterval time.Duration, useOpLog bool) *InMemoryDB {
+	return &InMemoryDB{
+		DefaultSpendKinds:   []models.SpendKind{},
+		Users:               models.Users{},
+		webAuthnCredentials: make(map[string][]models.WebAuthnCredential),
+		persistence: &memPersistence{
+			path:             path,
+			snapshotInterval: snapshotInterval,
+			useOpLog:         useOpLog,
+		},
+	}
+}
+
+// Snapshot writes the current DB state to the snapshot file, and truncates the op log it now contains
+func (db *InMemoryDB) Snapshot() error {
+	if db.persistence == nil {
+		return errors.New("in memory DB is not persistent, cannot snapshot")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.snapshot()
+}
+
+func (db *InMemoryDB) openPersistence() error {
+	p := db.persistence
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	loaded, err := db.loadSnapshot()
+	if err != nil {
+		return fmt.Errorf("load in memory DB snapshot %s: %s", p.path, err)
+	}
+	replayed, err := db.replayOpLog()
+	if err != nil {
+		return fmt.Errorf("replay in memory DB op log %s: %s", p.opLogPath(), err)
+	}
+	log.Debugf("in memory DB: loaded snapshot [%t], replayed %d op log entries", loaded, replayed)
+
+	if !loaded && replayed == 0 {
+		prepareDefaultSpendKinds(db.locked())
+	}
+
+	// start from a fresh snapshot, so the op log only ever holds what came after it
+	if err := db.snapshot(); err != nil {
+		return err
+	}
+
+	if p.useOpLog {
+		p.opLog, err = os.OpenFile(p.opLogPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.snapshotInterval > 0 {
+		p.chStop = make(chan struct{})
+		p.wg.Add(1)
+		go db.snapshotPeriodically()
+	}
+
+	return nil
+}
+
+func (db *InMemoryDB) closePersistence() error {
+	p := db.persistence
+	if p.chStop != nil {
+		close(p.chStop)
+		p.wg.Wait()
+		p.chStop = nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.snapshot()
+	if p.opLog != nil {
+		if closeErr := p.opLog.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		p.opLog = nil
+	}
+	return err
+}
+
+func (db *InMemoryDB) snapshotPeriodically() {
+	p := db.persistence
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.Snapshot(); err != nil {
+				log.Errorf("in memory DB: periodic snapshot failed: %s", err)
+			}
+		case <-p.chStop:
+			return
+		}
+	}
+}
+
+func (p *memPersistence) opLogPath() string {
+	return p.path + ".log"
+}
+
+// snapshot must be called with db.mu held
+func (db *InMemoryDB) snapshot() error {
+	p := db.persistence
+
+	snapshot := memSnapshot{
+		Version:           memSnapshotVersion,
+		DefaultSpendKinds: db.DefaultSpendKinds,
+		Users:             make([]memUser, 0, len(db.Users)),
+		Counters:          db.counters(),
+	}
+	for _, user := range db.Users {
+		snapshot.Users = append(snapshot.Users, db.newMemUser(user))
+	}
+
+	// write to a temp file first and rename it, so a crash never leaves a half written snapshot
+	tmpFile, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op when the rename already happened
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	if err := json.NewEncoder(tmpFile).Encode(snapshot); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), p.path); err != nil {
+		return err
+	}
+
+	// everything in the op log is in the snapshot now
+	if p.opLog != nil {
+		return p.opLog.Truncate(0)
+	}
+	if err := os.Remove(p.opLogPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadSnapshot must be called with db.mu held, it returns false if there is no snapshot file yet
+func (db *InMemoryDB) loadSnapshot() (bool, error) {
+	content, err := os.ReadFile(db.persistence.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var snapshot memSnapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return false, err
+	}
+	if snapshot.Version != memSnapshotVersion {
+		return false, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	db.DefaultSpendKinds = append([]models.SpendKind{}, snapshot.DefaultSpendKinds...)
+	db.Users = make(models.Users, 0, len(snapshot.Users))
+	db.webAuthnCredentials = make(map[string][]models.WebAuthnCredential)
+	for _, user := range snapshot.Users {
+		db.Users = append(db.Users, user.toUser())
+		db.setWebAuthnCredentials(user)
+	}
+	db.setCounters(snapshot.Counters)
+
+	return true, nil
+}
+
+// replayOpLog must be called with db.mu held, it applies all the ops logged after the last snapshot
+func (db *InMemoryDB) replayOpLog() (int, error) {
+	opLogFile, err := os.Open(db.persistence.opLogPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := opLogFile.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	replayed := 0
+	reader := bufio.NewReader(opLogFile)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// a crash while appending the last op, it never got acknowledged anyway
+				log.Warnf("in memory DB: ignoring incomplete last op log entry")
+			}
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		var op memOp
+		if err := json.Unmarshal(line, &op); err != nil {
+			return replayed, fmt.Errorf("op log entry %d: %s", replayed+1, err)
+		}
+		if err := db.applyOp(op); err != nil {
+			return replayed, fmt.Errorf("op log entry %d: %s", replayed+1, err)
+		}
+		replayed++
+	}
+}
+
+func (db *InMemoryDB) applyOp(op memOp) error {
+	switch op.Type {
+	case memOpUser:
+		if op.User == nil {
+			return errors.New("user op without a user")
+		}
+		user := op.User.toUser()
+		replaced := false
+		for i := range db.Users {
+			if db.Users[i].Username == user.Username {
+				db.Users[i] = user
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			db.Users = append(db.Users, user)
+		}
+		db.setWebAuthnCredentials(*op.User)
+	case memOpDeleteUser:
+		users := make(models.Users, 0, len(db.Users))
+		for _, user := range db.Users {
+			if user.Username != op.Username {
+				users = append(users, user)
+			}
+		}
+		db.Users = users
+		delete(db.webAuthnCredentials, op.Username)
+	case memOpDefaultSpendKinds:
+		db.DefaultSpendKinds = append([]models.SpendKind{}, op.DefaultSpendKinds...)
+	default:
+		return fmt.Errorf("unknown op type: %s", op.Type)
+	}
+	db.setCounters(op.Counters)
+	return nil
+}
+
+// appendOps must be called with db.mu held, the ops are synced to disk before it returns
+func (db *InMemoryDB) appendOps(ops []memOp) error {
+	if len(ops) == 0 || db.persistence == nil || db.persistence.opLog == nil {
+		return nil
+	}
+
+	var buf []byte
+	for _, op := range ops {
+		line, err := json.Marshal(op)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	if _, err := db.persistence.opLog.Write(buf); err != nil {
+		log.Errorf("in memory DB: op log write error: %s", err)
+		return err
+	}
+	return db.persistence.opLog.Sync()
+}
+
+func (db *InMemoryDB) userOp(user *models.User) memOp {
+	u := db.newMemUser(user)
+	return memOp{
+		Type:     memOpUser,
+		User:     &u,
+		Counters: db.counters(),
+	}
+}
+
+func (db *InMemoryDB) deleteUserOp(username string) memOp {
+	return memOp{
+		Type:     memOpDeleteUser,
+		Username: username,
+		Counters: db.counters(),
+	}
+}
+
+func (db *InMemoryDB) defaultSpendKindsOp() memOp {
+	return memOp{
+		Type:              memOpDefaultSpendKinds,
+		DefaultSpendKinds: append([]models.SpendKind{}, db.DefaultSpendKinds...),
+		Counters:          db.counters(),
+	}
+}
+
+func (db *InMemoryDB) counters() memCounters {
+	return memCounters{
+		LastDefaultSpendKindID: db.lastDefaultSpendKindID,
+		LastUserID:             db.lastUserID,
+		LastSpendKindID:        db.lastSpendKindID,
+		LastSpendID:            db.lastSpendID,
+	}
+}
+
+func (db *InMemoryDB) setCounters(counters memCounters) {
+	db.lastDefaultSpendKindID = counters.LastDefaultSpendKindID
+	db.lastUserID = counters.LastUserID
+	db.lastSpendKindID = counters.LastSpendKindID
+	db.lastSpendID = counters.LastSpendID
+}
+
+// newMemUser must be called with db.mu held
+func (db *InMemoryDB) newMemUser(user *models.User) memUser {
+	var totp *memTOTP
+	if user.TOTP.Secret != "" {
+		totp = &memTOTP{
+			Secret:        user.TOTP.Secret,
+			Enabled:       user.TOTP.Enabled,
+			RecoveryCodes: append([]string(nil), user.TOTP.RecoveryCodes...),
+			LastUsedStep:  user.TOTP.LastUsedStep,
+		}
+	}
+	var profile *memProfile
+	if user.Profile != (models.UserProfile{}) {
+		profile = &memProfile{
+			DisplayName:     user.Profile.DisplayName,
+			DefaultCurrency: user.Profile.DefaultCurrency,
+			Timezone:        user.Profile.Timezone,
+			Locale:          user.Profile.Locale,
+		}
+	}
+	return memUser{
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Username:      user.Username,
+		Password:      user.Password,
+		Role:          user.Role,
+		TOTP:          totp,
+		Profile:       profile,
+		Spends:        append([]models.Spending{}, user.Spends...),
+		SpendKinds:    append([]models.SpendKind{}, user.SpendKinds...),
+
+		WebAuthnCredentials: copyWebAuthnCredentials(db.webAuthnCredentials[user.Username]),
+	}
+}
+
+// setWebAuthnCredentials restores the credentials of the persisted user, db.mu must be held
+func (db *InMemoryDB) setWebAuthnCredentials(u memUser) {
+	if db.webAuthnCredentials == nil {
+		db.webAuthnCredentials = make(map[string][]models.WebAuthnCredential)
+	}
+	if len(u.WebAuthnCredentials) == 0 {
+		delete(db.webAuthnCredentials, u.Username)
+		return
+	}
+	db.webAuthnCredentials[u.Username] = copyWebAuthnCredentials(u.WebAuthnCredentials)
+}
+
+func (u memUser) toUser() *models.User {
+	role := u.Role
+	if role == "" {
+		// persisted before the users had roles
+		role = models.RoleUser
+	}
+	var totp models.TOTP
+	if u.TOTP != nil {
+		totp = models.TOTP{
+			Secret:        u.TOTP.Secret,
+			Enabled:       u.TOTP.Enabled,
+			RecoveryCodes: append([]string(nil), u.TOTP.RecoveryCodes...),
+			LastUsedStep:  u.TOTP.LastUsedStep,
+		}
+	}
+	var profile models.UserProfile
+	if u.Profile != nil {
+		profile = models.UserProfile{
+			DisplayName:     u.Profile.DisplayName,
+			DefaultCurrency: u.Profile.DefaultCurrency,
+			Timezone:        u.Profile.Timezone,
+			Locale:          u.Profile.Locale,
+		}
+	}
+	return &models.User{
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		Username:      u.Username,
+		Password:      u.Password,
+		Role:          role,
+		TOTP:          totp,
+		Profile:       profile,
+		Spends:        append([]models.Spending{}, u.Spends...),
+		SpendKinds:    append([]models.SpendKind{}, u.SpendKinds...),
+	}
+}
@@ -0,0 +1,180 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openPersistentInMemoryDB(t *testing.T, path string, useOpLog bool) *db.InMemoryDB {
+	inMemDB := db.NewPersistentInMemoryDB(path, 0, useOpLog)
+	require.NoError(t, inMemDB.Open())
+	return inMemDB
+}
+
+func TestPersistentInMemoryDB_NewDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ispend.json")
+	inMemDB := openPersistentInMemoryDB(t, path, false)
+	defer func() {
+		assert.NoError(t, inMemDB.Close())
+	}()
+	ctx := context.Background()
+
+	users, err := inMemDB.GetAllUsers(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+
+	defaultSpendKinds, err := inMemDB.GetAllDefaultSpendKinds(ctx)
+	require.NoError(t, err)
+	assert.Len(t, defaultSpendKinds, 4)
+
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestPersistentInMemoryDB_SnapshotOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ispend.json")
+	ctx := context.Background()
+
+	inMemDB := openPersistentInMemoryDB(t, path, false)
+	_, err := inMemDB.StoreUser(ctx, models.NewUser("email1", "user1", "pass1", nil))
+	require.NoError(t, err)
+	spendID, err := inMemDB.StoreSpending(ctx, "user1", models.Spending{Currency: "RSD", Amount: 10, Kind: &models.SpendKind{Name: "food"}})
+	require.NoError(t, err)
+	require.NoError(t, inMemDB.Close())
+
+	inMemDB = openPersistentInMemoryDB(t, path, false)
+	defer func() {
+		assert.NoError(t, inMemDB.Close())
+	}()
+
+	user, err := inMemDB.GetUser(ctx, "user1", true)
+	require.NoError(t, err)
+	assert.Equal(t, "pass1", user.Password)
+	require.Len(t, user.Spends, 1)
+	assert.Equal(t, spendID, user.Spends[0].ID)
+	assert.Equal(t, "food", user.Spends[0].Kind.Name)
+	require.Len(t, user.SpendKinds, 1)
+
+	// the IDs continue where they stopped before the restart
+	newSpendID, err := inMemDB.StoreSpending(ctx, "user1", models.Spending{Currency: "RSD", Amount: 20, Kind: &models.SpendKind{Name: "food"}})
+	require.NoError(t, err)
+	assert.NotEqual(t, spendID, newSpendID)
+
+	defaultSpendKinds, err := inMemDB.GetAllDefaultSpendKinds(ctx)
+	require.NoError(t, err)
+	assert.Len(t, defaultSpendKinds, 4)
+}
+
+func TestPersistentInMemoryDB_OpLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ispend.json")
+	ctx := context.Background()
+
+	// never closed, as if the server crashed - only the op log has the changes
+	crashedDB := openPersistentInMemoryDB(t, path, true)
+	_, err := crashedDB.StoreUser(ctx, models.NewUser("email1", "user1", "pass1", nil))
+	require.NoError(t, err)
+	_, err = crashedDB.StoreSpending(ctx, "user1", models.Spending{Currency: "RSD", Amount: 10, Kind: &models.SpendKind{Name: "food"}})
+	require.NoError(t, err)
+	spendID, err := crashedDB.StoreSpending(ctx, "user1", models.Spending{Currency: "EUR", Amount: 20, Kind: &models.SpendKind{Name: "rent"}})
+	require.NoError(t, err)
+	require.NoError(t, crashedDB.DeleteSpending(ctx, "user1", spendID))
+
+	errAbort := errors.New("abort")
+	err = crashedDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		if _, err := tx.StoreUser(ctx, models.NewUser("email2", "user2", "pass2", nil)); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.Equal(t, errAbort, err)
+
+	inMemDB := openPersistentInMemoryDB(t, path, true)
+	defer func() {
+		assert.NoError(t, inMemDB.Close())
+	}()
+
+	spends, err := inMemDB.GetSpends(ctx, "user1")
+	require.NoError(t, err)
+	require.Len(t, spends, 1)
+	assert.Equal(t, "RSD", spends[0].Currency)
+
+	spendKinds, err := inMemDB.GetSpendKinds(ctx, "user1")
+	require.NoError(t, err)
+	assert.Len(t, spendKinds, 2)
+
+	// the rolled back transaction never made it to the op log
+	_, err = inMemDB.GetUser(ctx, "user2", false)
+	assert.Error(t, err)
+}
+
+func TestPersistentInMemoryDB_OpLogReplay_UpdateAndDeleteUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ispend.json")
+	ctx := context.Background()
+
+	crashedDB := openPersistentInMemoryDB(t, path, true)
+	_, err := crashedDB.StoreUser(ctx, models.NewUser("email1", "user1", "pass1", nil))
+	require.NoError(t, err)
+	_, err = crashedDB.StoreUser(ctx, models.NewUser("email2", "user2", "pass2", nil))
+	require.NoError(t, err)
+	user, err := crashedDB.GetUser(ctx, "user1", false)
+	require.NoError(t, err)
+	user.Email = "new-email1"
+	user.Profile = models.UserProfile{DisplayName: "User One", Timezone: "Europe/Belgrade"}
+	require.NoError(t, crashedDB.UpdateUser(ctx, user))
+	require.NoError(t, crashedDB.DeleteUser(ctx, "user2"))
+
+	// replayed from the op log, then from the snapshot taken on close
+	for _, useOpLog := range []bool{true, false} {
+		inMemDB := openPersistentInMemoryDB(t, path, useOpLog)
+		user, err = inMemDB.GetUser(ctx, "user1", false)
+		require.NoError(t, err)
+		assert.Equal(t, "new-email1", user.Email)
+		assert.Equal(t, models.UserProfile{DisplayName: "User One", Timezone: "Europe/Belgrade"}, user.Profile)
+		users, err := inMemDB.GetAllUsers(ctx, false)
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		assert.Equal(t, "user1", users[0].Username)
+		require.NoError(t, inMemDB.Close())
+	}
+}
+
+func TestPersistentInMemoryDB_IncompleteOpLogEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ispend.json")
+	ctx := context.Background()
+
+	crashedDB := openPersistentInMemoryDB(t, path, true)
+	_, err := crashedDB.StoreUser(ctx, models.NewUser("email1", "user1", "pass1", nil))
+	require.NoError(t, err)
+
+	opLog, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = opLog.WriteString(`{"type":"user","user":{"username":"us`)
+	require.NoError(t, err)
+	require.NoError(t, opLog.Close())
+
+	inMemDB := openPersistentInMemoryDB(t, path, true)
+	defer func() {
+		assert.NoError(t, inMemDB.Close())
+	}()
+
+	users, err := inMemDB.GetAllUsers(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "user1", users[0].Username)
+}
+
+func TestPersistentInMemoryDB_CorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ispend.json")
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0600))
+
+	inMemDB := db.NewPersistentInMemoryDB(path, 0, false)
+	assert.Error(t, inMemDB.Open())
+}
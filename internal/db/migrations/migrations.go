@@ -0,0 +1,36 @@
+// Package migrations holds the versioned SQL schema migrations, compiled into the binary.
+//
+// Every migration is a pair of files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql. Versions are applied in ascending order and
+// must never be renumbered or edited once they reached production.
+//
+// Each SQL backend has its own directory, but the versions are kept in sync:
+// a schema change adds the same version to every backend.
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// Postgres returns the migrations for the Postgres backend.
+func Postgres() fs.FS {
+	return subDir("postgres")
+}
+
+// SQLite returns the migrations for the SQLite backend.
+func SQLite() fs.FS {
+	return subDir("sqlite")
+}
+
+func subDir(dir string) fs.FS {
+	sub, err := fs.Sub(files, dir)
+	if err != nil {
+		// cannot happen, the directory is embedded at compile time
+		panic(err)
+	}
+	return sub
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS spends;
+DROP TABLE IF EXISTS spend_kinds;
+DROP TABLE IF EXISTS default_spend_kinds;
+DROP TABLE IF EXISTS users;
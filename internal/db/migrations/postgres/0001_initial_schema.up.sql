@@ -0,0 +1,31 @@
+-- IF NOT EXISTS lets databases created by the old scripts/ispend_db_setup.sql
+-- adopt the migrations without losing data.
+CREATE TABLE IF NOT EXISTS users (
+    id serial PRIMARY KEY,
+    email varchar(35) UNIQUE,
+    username varchar(35) UNIQUE NOT NULL,
+    password varchar(130) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS spend_kinds (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL,
+    name varchar(35) NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS default_spend_kinds (
+    id serial PRIMARY KEY,
+    name varchar(35) UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS spends (
+    id serial PRIMARY KEY,
+    currency char(10) NOT NULL,
+    amount real NOT NULL,
+    spend_timestamp timestamp NOT NULL,
+    user_id integer NOT NULL,
+    kind_id integer NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (kind_id) REFERENCES spend_kinds(id)
+);
@@ -0,0 +1,4 @@
+INSERT INTO default_spend_kinds (name) VALUES ('Travel') ON CONFLICT (name) DO NOTHING;
+INSERT INTO default_spend_kinds (name) VALUES ('Nightlife') ON CONFLICT (name) DO NOTHING;
+INSERT INTO default_spend_kinds (name) VALUES ('Rent') ON CONFLICT (name) DO NOTHING;
+INSERT INTO default_spend_kinds (name) VALUES ('Food') ON CONFLICT (name) DO NOTHING;
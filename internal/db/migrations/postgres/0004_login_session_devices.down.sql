@@ -0,0 +1,3 @@
+ALTER TABLE login_sessions DROP COLUMN ip_address;
+ALTER TABLE login_sessions DROP COLUMN user_agent;
+ALTER TABLE login_sessions DROP COLUMN device_name;
@@ -0,0 +1,3 @@
+ALTER TABLE login_sessions ADD COLUMN device_name varchar(64) NOT NULL DEFAULT '';
+ALTER TABLE login_sessions ADD COLUMN user_agent varchar(512) NOT NULL DEFAULT '';
+ALTER TABLE login_sessions ADD COLUMN ip_address varchar(64) NOT NULL DEFAULT '';
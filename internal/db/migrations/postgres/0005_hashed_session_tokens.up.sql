@@ -0,0 +1,4 @@
+-- sessions are now looked up by the hash of their token, the ones
+-- stored with plain session IDs cannot be used anymore
+DELETE FROM login_sessions;
+ALTER TABLE login_sessions RENAME COLUMN session_id TO token_hash;
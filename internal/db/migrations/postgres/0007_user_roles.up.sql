@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN role varchar(16) NOT NULL DEFAULT 'user';
@@ -0,0 +1,15 @@
+-- the users registered before had no way to verify their email addresses
+ALTER TABLE users ADD COLUMN email_verified boolean NOT NULL DEFAULT false;
+
+-- email verification and password reset tokens, deleted when used
+CREATE TABLE account_tokens (
+    token_hash varchar(128) PRIMARY KEY,
+    purpose varchar(32) NOT NULL,
+    username varchar(35) NOT NULL,
+    email varchar(254) NOT NULL,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL
+);
+
+CREATE INDEX account_tokens_username_idx ON account_tokens (username, purpose);
+CREATE INDEX account_tokens_expires_at_idx ON account_tokens (expires_at);
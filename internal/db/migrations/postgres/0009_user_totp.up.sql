@@ -0,0 +1,5 @@
+-- TOTP two-factor authentication; the recovery codes are comma separated hashes
+ALTER TABLE users ADD COLUMN totp_secret varchar(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN totp_recovery_codes text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
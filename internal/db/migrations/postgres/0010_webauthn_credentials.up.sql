@@ -0,0 +1,18 @@
+-- the passkeys / security keys of the users; the user handle is the same for all the credentials of a user
+CREATE TABLE webauthn_credentials (
+    id bytea PRIMARY KEY,
+    username varchar(35) NOT NULL,
+    user_handle bytea NOT NULL,
+    name varchar(64) NOT NULL,
+    public_key bytea NOT NULL,
+    attestation_type varchar(32) NOT NULL,
+    transports varchar(128) NOT NULL,
+    aaguid bytea NOT NULL,
+    sign_count bigint NOT NULL,
+    backup_eligible boolean NOT NULL,
+    backup_state boolean NOT NULL,
+    created_at timestamp NOT NULL,
+    last_used_at timestamp NOT NULL
+);
+
+CREATE INDEX webauthn_credentials_username_idx ON webauthn_credentials (username);
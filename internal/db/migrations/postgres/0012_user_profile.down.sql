@@ -0,0 +1,5 @@
+-- the email stays varchar(254): narrowing it back would fail as soon as a longer address is stored
+ALTER TABLE users DROP COLUMN locale;
+ALTER TABLE users DROP COLUMN timezone;
+ALTER TABLE users DROP COLUMN default_currency;
+ALTER TABLE users DROP COLUMN display_name;
@@ -0,0 +1,7 @@
+-- the users' own settings, all optional; the email grows to the longest possible address
+-- now that the users can change it
+ALTER TABLE users ALTER COLUMN email TYPE varchar(254);
+ALTER TABLE users ADD COLUMN display_name varchar(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN default_currency varchar(10) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN timezone varchar(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN locale varchar(35) NOT NULL DEFAULT '';
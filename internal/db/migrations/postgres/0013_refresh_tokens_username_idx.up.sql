@@ -0,0 +1,3 @@
+-- all the refresh tokens of a user are revoked when its password changes or is reset;
+-- the databases migrated with the former 0008 have the index already
+CREATE INDEX IF NOT EXISTS refresh_tokens_username_idx ON refresh_tokens (username);
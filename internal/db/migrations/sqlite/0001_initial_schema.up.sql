@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    email varchar(35) UNIQUE,
+    username varchar(35) UNIQUE NOT NULL,
+    password varchar(130) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS spend_kinds (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL,
+    name varchar(35) NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS default_spend_kinds (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name varchar(35) UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS spends (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    currency char(10) NOT NULL,
+    amount real NOT NULL,
+    spend_timestamp timestamp NOT NULL,
+    user_id integer NOT NULL,
+    kind_id integer NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (kind_id) REFERENCES spend_kinds(id)
+);
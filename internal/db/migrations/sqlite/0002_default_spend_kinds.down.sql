@@ -0,0 +1 @@
+DELETE FROM default_spend_kinds WHERE name IN ('Travel', 'Nightlife', 'Rent', 'Food');
@@ -0,0 +1,4 @@
+INSERT OR IGNORE INTO default_spend_kinds (name) VALUES ('Travel');
+INSERT OR IGNORE INTO default_spend_kinds (name) VALUES ('Nightlife');
+INSERT OR IGNORE INTO default_spend_kinds (name) VALUES ('Rent');
+INSERT OR IGNORE INTO default_spend_kinds (name) VALUES ('Food');
@@ -0,0 +1,11 @@
+-- expires_at is NULL for sessions that never expire
+CREATE TABLE login_sessions (
+    session_id text PRIMARY KEY,
+    username text NOT NULL,
+    created_at timestamp NOT NULL,
+    last_seen timestamp NOT NULL,
+    expires_at timestamp
+);
+
+CREATE INDEX login_sessions_username_idx ON login_sessions (username);
+CREATE INDEX login_sessions_expires_at_idx ON login_sessions (expires_at);
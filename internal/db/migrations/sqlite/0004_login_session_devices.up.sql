@@ -0,0 +1,3 @@
+ALTER TABLE login_sessions ADD COLUMN device_name text NOT NULL DEFAULT '';
+ALTER TABLE login_sessions ADD COLUMN user_agent text NOT NULL DEFAULT '';
+ALTER TABLE login_sessions ADD COLUMN ip_address text NOT NULL DEFAULT '';
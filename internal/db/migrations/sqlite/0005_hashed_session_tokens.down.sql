@@ -0,0 +1,2 @@
+DELETE FROM login_sessions;
+ALTER TABLE login_sessions RENAME COLUMN token_hash TO session_id;
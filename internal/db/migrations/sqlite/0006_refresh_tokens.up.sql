@@ -0,0 +1,13 @@
+-- used_at is NULL until the token gets rotated, used tokens are
+-- kept until they expire so their reuse can be recognized
+CREATE TABLE refresh_tokens (
+    token_hash text PRIMARY KEY,
+    family_id text NOT NULL,
+    username text NOT NULL,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+CREATE INDEX refresh_tokens_expires_at_idx ON refresh_tokens (expires_at);
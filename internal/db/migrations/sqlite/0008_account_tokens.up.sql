@@ -0,0 +1,15 @@
+-- the users registered before had no way to verify their email addresses
+ALTER TABLE users ADD COLUMN email_verified boolean NOT NULL DEFAULT 0;
+
+-- email verification and password reset tokens, deleted when used
+CREATE TABLE account_tokens (
+    token_hash text PRIMARY KEY,
+    purpose text NOT NULL,
+    username text NOT NULL,
+    email text NOT NULL,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL
+);
+
+CREATE INDEX account_tokens_username_idx ON account_tokens (username, purpose);
+CREATE INDEX account_tokens_expires_at_idx ON account_tokens (expires_at);
@@ -0,0 +1,5 @@
+-- TOTP two-factor authentication; the recovery codes are comma separated hashes
+ALTER TABLE users ADD COLUMN totp_secret text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled boolean NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_recovery_codes text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_last_step integer NOT NULL DEFAULT 0;
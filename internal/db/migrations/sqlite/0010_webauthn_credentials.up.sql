@@ -0,0 +1,18 @@
+-- the passkeys / security keys of the users; the user handle is the same for all the credentials of a user
+CREATE TABLE webauthn_credentials (
+    id blob PRIMARY KEY,
+    username text NOT NULL,
+    user_handle blob NOT NULL,
+    name text NOT NULL,
+    public_key blob NOT NULL,
+    attestation_type text NOT NULL,
+    transports text NOT NULL,
+    aaguid blob NOT NULL,
+    sign_count integer NOT NULL,
+    backup_eligible boolean NOT NULL,
+    backup_state boolean NOT NULL,
+    created_at timestamp NOT NULL,
+    last_used_at timestamp NOT NULL
+);
+
+CREATE INDEX webauthn_credentials_username_idx ON webauthn_credentials (username);
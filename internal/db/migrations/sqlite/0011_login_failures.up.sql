@@ -0,0 +1,9 @@
+-- the failed logins in a row per username and per IP address, for throttling the logins
+CREATE TABLE login_failures (
+    subject text PRIMARY KEY,
+    failures integer NOT NULL,
+    last_failed_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL
+);
+
+CREATE INDEX login_failures_expires_at_idx ON login_failures (expires_at);
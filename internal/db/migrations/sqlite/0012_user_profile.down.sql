@@ -0,0 +1,4 @@
+ALTER TABLE users DROP COLUMN locale;
+ALTER TABLE users DROP COLUMN timezone;
+ALTER TABLE users DROP COLUMN default_currency;
+ALTER TABLE users DROP COLUMN display_name;
@@ -0,0 +1,5 @@
+-- the users' own settings, all optional
+ALTER TABLE users ADD COLUMN display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN default_currency text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN timezone text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN locale text NOT NULL DEFAULT '';
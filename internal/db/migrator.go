@@ -0,0 +1,353 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationsLockID is the key of the postgres advisory lock taken while migrating,
+// so only one server instance at a time touches the schema
+const migrationsLockID = 7301245
+
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_([a-zA-Z0-9_]+)\.(up|down)\.sql$`)
+
+var ErrUnknownMigrationVersion = errors.New("unknown migration version")
+
+// Dialect tells the migrator which SQL DB it migrates
+type Dialect int
+
+const (
+	DialectPostgres Dialect = iota
+	DialectSQLite
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB, dialect Dialect, source fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(source)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		dialect:    dialect,
+		migrations: migrations,
+	}, nil
+}
+
+// LoadMigrations reads all *.up.sql and *.down.sql files from the root of source
+// and returns them sorted by version
+func LoadMigrations(source fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(source, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	migrationsMap := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := migrationFileRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in file: %s", entry.Name())
+		}
+
+		content, err := fs.ReadFile(source, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := migrationsMap[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			migrationsMap[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d used by both %s and %s", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range migrationsMap {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s is missing the up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Status returns all known migrations together with the info if they are applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(func(conn *sql.Conn) error {
+		applied, err := m.appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			appliedAt, ok := applied[migration.Version]
+			statuses = append(statuses, MigrationStatus{
+				Migration: migration,
+				Applied:   ok,
+				AppliedAt: appliedAt,
+			})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Version returns the latest applied migration version, or 0 if none is applied
+func (m *Migrator) Version() (int, error) {
+	version := 0
+	err := m.withLock(func(conn *sql.Conn) error {
+		var err error
+		version, err = m.currentVersion(conn)
+		return err
+	})
+	return version, err
+}
+
+// Up applies all pending migrations
+func (m *Migrator) Up() error {
+	if len(m.migrations) == 0 {
+		return nil
+	}
+	return m.Goto(m.migrations[len(m.migrations)-1].Version)
+}
+
+// Down rolls back the latest applied migration
+func (m *Migrator) Down() error {
+	return m.withLock(func(conn *sql.Conn) error {
+		current, err := m.currentVersion(conn)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			log.Debugln("migrator: nothing to roll back")
+			return nil
+		}
+
+		target := 0
+		for _, migration := range m.migrations {
+			if migration.Version < current {
+				target = migration.Version
+			}
+		}
+
+		return m.migrateTo(conn, target)
+	})
+}
+
+// Goto migrates the schema up or down to the given version, 0 meaning an empty schema
+func (m *Migrator) Goto(version int) error {
+	if version != 0 && m.indexOf(version) < 0 {
+		return ErrUnknownMigrationVersion
+	}
+	return m.withLock(func(conn *sql.Conn) error {
+		return m.migrateTo(conn, version)
+	})
+}
+
+func (m *Migrator) migrateTo(conn *sql.Conn, version int) error {
+	applied, err := m.appliedVersions(conn)
+	if err != nil {
+		return err
+	}
+
+	// roll back everything above the target version, newest first
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= version {
+			break
+		}
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == "" {
+			return fmt.Errorf("migration %d_%s cannot be rolled back, missing the down file", migration.Version, migration.Name)
+		}
+		err := m.apply(conn, migration.Down, `DELETE FROM schema_migrations WHERE version=$1`, migration.Version)
+		if err != nil {
+			return fmt.Errorf("roll back migration %d_%s: %s", migration.Version, migration.Name, err)
+		}
+		log.Infof("migrator: rolled back %d_%s", migration.Version, migration.Name)
+	}
+
+	// then apply all missing ones up to the target version, oldest first
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.apply(conn, migration.Up, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, migration.Version, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("apply migration %d_%s: %s", migration.Version, migration.Name, err)
+		}
+		log.Infof("migrator: applied %d_%s", migration.Version, migration.Name)
+	}
+
+	return nil
+}
+
+// apply runs the migration script and the schema_migrations bookkeeping in a single transaction
+func (m *Migrator) apply(conn *sql.Conn, script string, bookkeeping string, bookkeepingArgs ...interface{}) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		m.rollback(tx)
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, bookkeepingArgs...); err != nil {
+		m.rollback(tx)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) rollback(tx *sql.Tx) {
+	if err := tx.Rollback(); err != nil {
+		log.Errorf("migrator: transaction rollback error: %s", err)
+	}
+}
+
+func (m *Migrator) appliedVersions(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+func (m *Migrator) currentVersion(conn *sql.Conn) (int, error) {
+	applied, err := m.appliedVersions(conn)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+func (m *Migrator) indexOf(version int) int {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// withLock runs f on a dedicated connection holding the migrations advisory lock,
+// making sure the schema_migrations table exists first
+func (m *Migrator) withLock(f func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Errorf("migrator: close connection error: %s", err)
+		}
+	}()
+
+	// a SQLite DB file is owned by a single server process, and SQLite itself
+	// serializes the writes, so only postgres needs the lock
+	if m.dialect == DialectPostgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLockID); err != nil {
+			return fmt.Errorf("acquire migrations lock: %s", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationsLockID); err != nil {
+				log.Errorf("migrator: release migrations lock error: %s", err)
+			}
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer PRIMARY KEY,
+			applied_at timestamp NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return f(conn)
+}
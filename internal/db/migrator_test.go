@@ -0,0 +1,155 @@
+package db_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/db/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	source := fstest.MapFS{
+		"0002_second.up.sql":   {Data: []byte("CREATE TABLE b (id int);")},
+		"0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"0001_first.up.sql":    {Data: []byte("CREATE TABLE a (id int);")},
+		"0001_first.down.sql":  {Data: []byte("DROP TABLE a;")},
+		"0010_no_down.up.sql":  {Data: []byte("CREATE TABLE c (id int);")},
+	}
+
+	loaded, err := db.LoadMigrations(source)
+	require.NoError(t, err)
+	require.Len(t, loaded, 3)
+
+	assert.Equal(t, 1, loaded[0].Version)
+	assert.Equal(t, "first", loaded[0].Name)
+	assert.Equal(t, "CREATE TABLE a (id int);", loaded[0].Up)
+	assert.Equal(t, "DROP TABLE a;", loaded[0].Down)
+	assert.Equal(t, 2, loaded[1].Version)
+	assert.Equal(t, "second", loaded[1].Name)
+	assert.Equal(t, 10, loaded[2].Version)
+	assert.Empty(t, loaded[2].Down)
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		source fstest.MapFS
+	}{
+		{
+			name:   "bad file name",
+			source: fstest.MapFS{"first.up.sql": {Data: []byte("SELECT 1;")}},
+		},
+		{
+			name:   "zero version",
+			source: fstest.MapFS{"0000_zero.up.sql": {Data: []byte("SELECT 1;")}},
+		},
+		{
+			name:   "missing up file",
+			source: fstest.MapFS{"0001_first.down.sql": {Data: []byte("SELECT 1;")}},
+		},
+		{
+			name: "duplicate version",
+			source: fstest.MapFS{
+				"0001_first.up.sql":  {Data: []byte("SELECT 1;")},
+				"0001_second.up.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			loaded, err := db.LoadMigrations(tc.source)
+			assert.Error(t, err)
+			assert.Nil(t, loaded)
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	postgresMigrations, err := db.LoadMigrations(migrations.Postgres())
+	require.NoError(t, err)
+	require.NotEmpty(t, postgresMigrations)
+	sqliteMigrations, err := db.LoadMigrations(migrations.SQLite())
+	require.NoError(t, err)
+	require.Len(t, sqliteMigrations, len(postgresMigrations), "all backends must have the same migrations")
+
+	for i, migration := range postgresMigrations {
+		assert.Equal(t, i+1, migration.Version, "migration versions must not have gaps")
+		assert.NotEmpty(t, migration.Up)
+		assert.NotEmpty(t, migration.Down, "migration %d_%s has no down file", migration.Version, migration.Name)
+		assert.Equal(t, migration.Version, sqliteMigrations[i].Version)
+		assert.Equal(t, migration.Name, sqliteMigrations[i].Name)
+		assert.NotEmpty(t, sqliteMigrations[i].Down, "sqlite migration %d_%s has no down file", migration.Version, migration.Name)
+	}
+}
+
+func TestMigrator_SQLite(t *testing.T) {
+	sqliteDB := db.NewSQLiteDB(filepath.Join(t.TempDir(), "ispend.db"), false)
+	require.NoError(t, sqliteDB.Open())
+	defer sqliteDB.Close()
+
+	migrator, err := sqliteDB.Migrator()
+	require.NoError(t, err)
+	testMigrator(t, migrator)
+}
+
+// TestMigrator_Postgres runs only against a real postgres DB, e.g.:
+//
+//	ISPEND_TEST_POSTGRES_DSN="host=localhost dbname=ispend_test sslmode=disable" go test ./...
+func TestMigrator_Postgres(t *testing.T) {
+	dsn := os.Getenv("ISPEND_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("ISPEND_TEST_POSTGRES_DSN not set")
+	}
+
+	sqlDB, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer sqlDB.Close()
+
+	migrator, err := db.NewMigrator(sqlDB, db.DialectPostgres, migrations.Postgres())
+	require.NoError(t, err)
+	testMigrator(t, migrator)
+}
+
+func testMigrator(t *testing.T, migrator *db.Migrator) {
+	latest := migrator.Migrations()[len(migrator.Migrations())-1].Version
+
+	require.NoError(t, migrator.Goto(0))
+	version, err := migrator.Version()
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	require.NoError(t, migrator.Up())
+	version, err = migrator.Version()
+	require.NoError(t, err)
+	assert.Equal(t, latest, version)
+
+	// running up again is a no-op
+	require.NoError(t, migrator.Up())
+
+	statuses, err := migrator.Status()
+	require.NoError(t, err)
+	require.Len(t, statuses, len(migrator.Migrations()))
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+		assert.False(t, status.AppliedAt.IsZero())
+	}
+
+	require.NoError(t, migrator.Down())
+	version, err = migrator.Version()
+	require.NoError(t, err)
+	assert.Equal(t, latest-1, version)
+
+	assert.Equal(t, db.ErrUnknownMigrationVersion, migrator.Goto(latest+100))
+
+	require.NoError(t, migrator.Goto(latest))
+	version, err = migrator.Version()
+	require.NoError(t, err)
+	assert.Equal(t, latest, version)
+}
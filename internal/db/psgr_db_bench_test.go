@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/db/migrations"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestPostgresDBClient connects to the postgres DB given by ISPEND_TEST_POSTGRES_DSN, and
+// recreates its schema from scratch - never point it to a DB holding any valuable data
+func openTestPostgresDBClient(tb testing.TB) *PostgresDBClient {
+	dsn := os.Getenv("ISPEND_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		tb.Skip("ISPEND_TEST_POSTGRES_DSN not set")
+	}
+
+	sqlDB, err := sql.Open("postgres", dsn)
+	require.NoError(tb, err)
+	require.NoError(tb, sqlDB.Ping())
+
+	migrator, err := NewMigrator(sqlDB, DialectPostgres, migrations.Postgres())
+	require.NoError(tb, err)
+	require.NoError(tb, migrator.Goto(0))
+	require.NoError(tb, migrator.Up())
+
+	pdb := &PostgresDBClient{sqlClient: newSQLClient(sqlDB)}
+	tb.Cleanup(func() {
+		if err := pdb.Close(); err != nil {
+			tb.Error(err)
+		}
+	})
+
+	return pdb
+}
+
+func seedPostgres(tb testing.TB, pdb *PostgresDBClient, usersCount, spendsPerUser int) {
+	ctx := context.Background()
+	err := pdb.WithTx(ctx, func(tx SpenderTx) error {
+		store := tx.(*sqlStore)
+		for u := 0; u < usersCount; u++ {
+			var userID, kindID int
+			err := store.q.QueryRowContext(ctx,
+				`INSERT INTO users (email, username, password) VALUES ($1, $2, 'pass') RETURNING id`,
+				fmt.Sprintf("bench%d@serjspends.de", u), fmt.Sprintf("bench%d", u),
+			).Scan(&userID)
+			if err != nil {
+				return err
+			}
+			err = store.q.QueryRowContext(ctx,
+				`INSERT INTO spend_kinds (user_id, name) VALUES ($1, 'bench') RETURNING id`, userID,
+			).Scan(&kindID)
+			if err != nil {
+				return err
+			}
+			_, err = store.q.ExecContext(ctx, `
+				INSERT INTO spends (currency, amount, spend_timestamp, user_id, kind_id)
+				SELECT 'RSD', 10.5, $1, $2, $3 FROM generate_series(1, $4)`,
+				time.Now(), userID, kindID, spendsPerUser,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(tb, err)
+}
+
+// BenchmarkPostgresDBClient_GetAllUsers measures what NewUsersService runs at startup,
+// its latency should grow with the amount of data only, not with the number of queries
+func BenchmarkPostgresDBClient_GetAllUsers(b *testing.B) {
+	sizes := []struct {
+		users         int
+		spendsPerUser int
+	}{
+		{10, 10},
+		{100, 10},
+		{100, 100},
+		{1000, 10},
+	}
+
+	for _, size := range sizes {
+		b.Run(fmt.Sprintf("users=%d/spends=%d", size.users, size.spendsPerUser), func(b *testing.B) {
+			pdb := openTestPostgresDBClient(b)
+			seedPostgres(b, pdb, size.users, size.spendsPerUser)
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				users, err := pdb.GetAllUsers(ctx, true)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(users) != size.users {
+					b.Fatalf("expected %d users, got %d", size.users, len(users))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPostgresDBClient_GetSpends(b *testing.B) {
+	for _, spendsPerUser := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("spends=%d", spendsPerUser), func(b *testing.B) {
+			pdb := openTestPostgresDBClient(b)
+			seedPostgres(b, pdb, 10, spendsPerUser)
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				spends, err := pdb.GetSpends(ctx, "bench0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(spends) != spendsPerUser {
+					b.Fatalf("expected %d spends, got %d", spendsPerUser, len(spends))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMockedPostgresDBClient(t *testing.T) (*PostgresDBClient, sqlmock.Sqlmock) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		sqlDB.Close()
+	})
+
+	pdb := NewPostgresDBClient("localhost", 5432, "test", "test", "", "disable", 1, false)
+	pdb.sqlClient = newSQLClient(sqlDB)
+	return pdb, mock
+}
+
+func TestPostgresDBClient_StoreUser_RollbackOnFailure(t *testing.T) {
+	pdb, mock := newMockedPostgresDBClient(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id FROM users WHERE username=$1`)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT username FROM users WHERE email = $1`)).
+		WithArgs("email1").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users`)).
+		WithArgs("email1", false, "user1", "pass1", "user", "", "", "", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO spend_kinds`)).
+		WithArgs("user1", "sk1").
+		WillReturnError(errors.New("insert spend kind failed"))
+	mock.ExpectRollback()
+
+	user := models.NewUser("email1", "user1", "pass1", []models.SpendKind{{Name: "sk1"}})
+	_, err := pdb.StoreUser(context.Background(), user)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresDBClient_StoreUser_Commit(t *testing.T) {
+	pdb, mock := newMockedPostgresDBClient(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id FROM users WHERE username=$1`)).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT username FROM users WHERE email = $1`)).
+		WithArgs("email1").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users`)).
+		WithArgs("email1", false, "user1", "pass1", "user", "", "", "", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO spend_kinds`)).
+		WithArgs("user1", "sk1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+
+	user := models.NewUser("email1", "user1", "pass1", []models.SpendKind{{Name: "sk1"}})
+	id, err := pdb.StoreUser(context.Background(), user)
+	require.NoError(t, err)
+	assert.Equal(t, 7, id)
+	assert.Equal(t, 3, user.SpendKinds[0].ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresDBClient_WithTx_Rollback(t *testing.T) {
+	pdb, mock := newMockedPostgresDBClient(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM spends`)).
+		WithArgs("11", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	errAbort := errors.New("abort")
+	err := pdb.WithTx(context.Background(), func(tx SpenderTx) error {
+		store := tx.(*sqlStore)
+		_, err := store.q.ExecContext(context.Background(), `DELETE FROM spends WHERE id=$1 AND user_id=$2;`, "11", 7)
+		require.NoError(t, err)
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresDBClient_QueryCanceledWithContext(t *testing.T) {
+	pdb, mock := newMockedPostgresDBClient(t)
+
+	mock.ExpectPrepare(regexp.QuoteMeta(`SELECT id FROM users WHERE username=$1`)).
+		ExpectQuery().
+		WithArgs("user1").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := pdb.GetUserIDByUsername(ctx, "user1")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "query was not canceled")
+}
+
+func TestPostgresDBClient_WithTx_CanceledContext(t *testing.T) {
+	pdb, mock := newMockedPostgresDBClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	err := pdb.WithTx(ctx, func(tx SpenderTx) error {
+		called = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresDBClient_GetAllUsers_ConstantQueries(t *testing.T) {
+	pdb, mock := newMockedPostgresDBClient(t)
+
+	usersCount := 50
+	spendsPerUser := 20
+	userRows := sqlmock.NewRows([]string{
+		"id", "email", "email_verified", "username", "password", "role",
+		"totp_secret", "totp_enabled", "totp_recovery_codes", "totp_last_step",
+		"display_name", "default_currency", "timezone", "locale",
+	})
+	spendKindRows := sqlmock.NewRows([]string{"id", "user_id", "name"})
+	spendRows := sqlmock.NewRows([]string{"id", "currency", "amount", "spend_timestamp", "user_id", "kind_id", "kind_name"})
+	spendID := 0
+	for u := 1; u <= usersCount; u++ {
+		userRows.AddRow(u, fmt.Sprintf("email%d", u), false, fmt.Sprintf("user%d", u), "pass", "user", "", false, "", 0, "", "", "", "")
+		spendKindRows.AddRow(u, u, "sk")
+		for s := 0; s < spendsPerUser; s++ {
+			spendID++
+			spendRows.AddRow(strconv.Itoa(spendID), "RSD       ", 10.5, time.Now(), u, u, "sk")
+		}
+	}
+
+	// exactly 3 queries, no matter the number of users and spends
+	mock.ExpectPrepare(regexp.QuoteMeta(sqlSelectAllUsers)).ExpectQuery().WillReturnRows(userRows)
+	mock.ExpectPrepare(regexp.QuoteMeta(sqlSelectAllSpends)).ExpectQuery().WillReturnRows(spendRows)
+	mock.ExpectPrepare(regexp.QuoteMeta(sqlSelectAllSpendKinds)).ExpectQuery().WillReturnRows(spendKindRows)
+
+	users, err := pdb.GetAllUsers(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, users, usersCount)
+	for i, user := range users {
+		assert.Equal(t, fmt.Sprintf("user%d", i+1), user.Username)
+		require.Len(t, user.Spends, spendsPerUser)
+		require.Len(t, user.SpendKinds, 1)
+		assert.Equal(t, "RSD", user.Spends[0].Currency)
+		assert.Equal(t, i+1, user.Spends[0].Kind.ID)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresDBClient_PreparedStatementsReused(t *testing.T) {
+	pdb, mock := newMockedPostgresDBClient(t)
+
+	query := regexp.QuoteMeta(`SELECT id FROM users WHERE username=$1`)
+	prepared := mock.ExpectPrepare(query)
+	prepared.ExpectQuery().WithArgs("user1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	prepared.ExpectQuery().WithArgs("user2").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+
+	id, err := pdb.GetUserIDByUsername(context.Background(), "user1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+	id, err = pdb.GetUserIDByUsername(context.Background(), "user2")
+	require.NoError(t, err)
+	assert.Equal(t, 2, id)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisAccountTokenStore is a platform.AccountTokenStore keeping the account tokens in redis. Every token
+// is a hash expiring together with the token, and the user's tokens of each purpose are kept in a set.
+type RedisAccountTokenStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisAccountTokenStore creates a store for all the keys starting with prefix, e.g. "ispend:"
+func NewRedisAccountTokenStore(client redis.UniversalClient, prefix string) *RedisAccountTokenStore {
+	return &RedisAccountTokenStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (store *RedisAccountTokenStore) tokenKey(tokenHash string) string {
+	return store.prefix + "account_token:" + tokenHash
+}
+
+func (store *RedisAccountTokenStore) userKey(username, purpose string) string {
+	return store.prefix + "account_tokens:" + purpose + ":" + username
+}
+
+func (store *RedisAccountTokenStore) Save(ctx context.Context, token *platform.AccountToken) error {
+	if !token.ExpiresAt.After(time.Now()) {
+		// redis would drop it right away anyway
+		return nil
+	}
+
+	tokenKey := store.tokenKey(token.TokenHash)
+	userKey := store.userKey(token.Username, token.Purpose)
+	_, err := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, tokenKey, map[string]interface{}{
+			"purpose":    token.Purpose,
+			"username":   token.Username,
+			"email":      token.Email,
+			"created_at": token.CreatedAt.UTC().Format(time.RFC3339Nano),
+			"expires_at": token.ExpiresAt.UTC().Format(time.RFC3339Nano),
+		})
+		pipe.ExpireAt(ctx, tokenKey, token.ExpiresAt)
+		pipe.SAdd(ctx, userKey, token.TokenHash)
+		// the set lives as long as the longest living token in it
+		pipe.ExpireNX(ctx, userKey, time.Until(token.ExpiresAt))
+		pipe.ExpireGT(ctx, userKey, time.Until(token.ExpiresAt))
+		return nil
+	})
+	return err
+}
+
+func (store *RedisAccountTokenStore) Take(ctx context.Context, tokenHash string) (*platform.AccountToken, error) {
+	tokenKey := store.tokenKey(tokenHash)
+	var get *redis.MapStringStringCmd
+	var del *redis.IntCmd
+	// a MULTI makes sure only one of the concurrent requests finds the token before it's deleted
+	_, err := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGetAll(ctx, tokenKey)
+		del = pipe.Del(ctx, tokenKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields := get.Val()
+	if del.Val() == 0 || len(fields) == 0 {
+		return nil, platform.ErrNotFound
+	}
+
+	token := &platform.AccountToken{
+		TokenHash: tokenHash,
+		Purpose:   fields["purpose"],
+		Username:  fields["username"],
+		Email:     fields["email"],
+	}
+	if token.CreatedAt, err = time.Parse(time.RFC3339Nano, fields["created_at"]); err != nil {
+		return nil, err
+	}
+	if token.ExpiresAt, err = time.Parse(time.RFC3339Nano, fields["expires_at"]); err != nil {
+		return nil, err
+	}
+	if err := store.client.SRem(ctx, store.userKey(token.Username, token.Purpose), tokenHash).Err(); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (store *RedisAccountTokenStore) DeleteByUsername(ctx context.Context, username, purpose string) (int, error) {
+	userKey := store.userKey(username, purpose)
+	tokenHashes, err := store.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(tokenHashes) == 0 {
+		return 0, nil
+	}
+
+	keys := make([]string, len(tokenHashes))
+	for i, tokenHash := range tokenHashes {
+		keys[i] = store.tokenKey(tokenHash)
+	}
+	var deleted *redis.IntCmd
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, keys...)
+		pipe.Del(ctx, userKey)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted.Val()), nil
+}
+
+// DeleteExpired has nothing to do, redis expires the token keys itself
+func (store *RedisAccountTokenStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	return 0, ctx.Err()
+}
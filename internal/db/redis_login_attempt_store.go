@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisLoginAttemptStore is a platform.LoginAttemptStore keeping the failed logins in redis,
+// every subject's failures are a hash expiring together with them
+type RedisLoginAttemptStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// addFailureScript counts the failure, starting over if the previous ones expired at ARGV[1];
+// the times are unix milliseconds
+var addFailureScript = redis.NewScript(`
+local expiresAt = redis.call('HGET', KEYS[1], 'expires_at')
+if expiresAt and tonumber(expiresAt) <= tonumber(ARGV[1]) then
+	redis.call('DEL', KEYS[1])
+end
+local count = redis.call('HINCRBY', KEYS[1], 'count', 1)
+redis.call('HSET', KEYS[1], 'last_failed_at', ARGV[1], 'expires_at', ARGV[2])
+redis.call('PEXPIREAT', KEYS[1], ARGV[2])
+return count
+`)
+
+// NewRedisLoginAttemptStore creates a store for all the keys starting with prefix, e.g. "ispend:"
+func NewRedisLoginAttemptStore(client redis.UniversalClient, prefix string) *RedisLoginAttemptStore {
+	return &RedisLoginAttemptStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (store *RedisLoginAttemptStore) failuresKey(subject string) string {
+	return store.prefix + "login_failures:" + subject
+}
+
+func (store *RedisLoginAttemptStore) Get(ctx context.Context, subject string) (*platform.LoginFailures, error) {
+	fields, err := store.client.HGetAll(ctx, store.failuresKey(subject)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, platform.ErrNotFound
+	}
+
+	failures := &platform.LoginFailures{Subject: subject}
+	if failures.Count, err = strconv.Atoi(fields["count"]); err != nil {
+		return nil, err
+	}
+	lastFailedAt, err := strconv.ParseInt(fields["last_failed_at"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := strconv.ParseInt(fields["expires_at"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	failures.LastFailedAt = time.UnixMilli(lastFailedAt).UTC()
+	failures.ExpiresAt = time.UnixMilli(expiresAt).UTC()
+	return failures, nil
+}
+
+func (store *RedisLoginAttemptStore) AddFailure(ctx context.Context, subject string, now time.Time, ttl time.Duration) (*platform.LoginFailures, error) {
+	now = now.Truncate(time.Millisecond)
+	expiresAt := now.Add(ttl)
+	count, err := addFailureScript.Run(ctx, store.client, []string{store.failuresKey(subject)}, now.UnixMilli(), expiresAt.UnixMilli()).Int()
+	if err != nil {
+		return nil, err
+	}
+	return &platform.LoginFailures{
+		Subject:      subject,
+		Count:        count,
+		LastFailedAt: now.UTC(),
+		ExpiresAt:    expiresAt.UTC(),
+	}, nil
+}
+
+func (store *RedisLoginAttemptStore) Reset(ctx context.Context, subject string) error {
+	return store.client.Del(ctx, store.failuresKey(subject)).Err()
+}
+
+// DeleteExpired has nothing to do, redis expires the failures itself
+func (store *RedisLoginAttemptStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	return 0, ctx.Err()
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisRefreshTokenStore is a platform.RefreshTokenStore keeping the refresh tokens in redis. Every token
+// is a hash expiring together with the token, each family is a set of its token hashes, and each user
+// has a set of its family IDs.
+type RedisRefreshTokenStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// markUsedScript sets used_at only on an existing token not used yet, returning -1 for a missing token
+var markUsedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+return redis.call('HSETNX', KEYS[1], 'used_at', ARGV[1])
+`)
+
+// NewRedisRefreshTokenStore creates a store for all the keys starting with prefix, e.g. "ispend:"
+func NewRedisRefreshTokenStore(client redis.UniversalClient, prefix string) *RedisRefreshTokenStore {
+	return &RedisRefreshTokenStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (store *RedisRefreshTokenStore) tokenKey(tokenHash string) string {
+	return store.prefix + "refresh:" + tokenHash
+}
+
+func (store *RedisRefreshTokenStore) familyKey(familyID string) string {
+	return store.prefix + "refresh_family:" + familyID
+}
+
+func (store *RedisRefreshTokenStore) userKey(username string) string {
+	return store.prefix + "refresh_user:" + username
+}
+
+func (store *RedisRefreshTokenStore) Save(ctx context.Context, token *platform.RefreshToken) error {
+	if !token.ExpiresAt.After(time.Now()) {
+		// redis would drop it right away anyway
+		return nil
+	}
+
+	fields := map[string]interface{}{
+		"family_id":  token.FamilyID,
+		"username":   token.Username,
+		"created_at": token.CreatedAt.UTC().Format(time.RFC3339Nano),
+		"expires_at": token.ExpiresAt.UTC().Format(time.RFC3339Nano),
+	}
+	if token.IsUsed() {
+		fields["used_at"] = token.UsedAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	tokenKey := store.tokenKey(token.TokenHash)
+	familyKey := store.familyKey(token.FamilyID)
+	userKey := store.userKey(token.Username)
+	_, err := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, tokenKey, fields)
+		pipe.ExpireAt(ctx, tokenKey, token.ExpiresAt)
+		pipe.SAdd(ctx, familyKey, token.TokenHash)
+		// all tokens of a family expire together
+		pipe.ExpireAt(ctx, familyKey, token.ExpiresAt)
+		// the user's families live as long as the longest living one of them
+		pipe.SAdd(ctx, userKey, token.FamilyID)
+		pipe.ExpireNX(ctx, userKey, time.Until(token.ExpiresAt))
+		pipe.ExpireGT(ctx, userKey, time.Until(token.ExpiresAt))
+		return nil
+	})
+	return err
+}
+
+func (store *RedisRefreshTokenStore) Get(ctx context.Context, tokenHash string) (*platform.RefreshToken, error) {
+	fields, err := store.client.HGetAll(ctx, store.tokenKey(tokenHash)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, platform.ErrNotFound
+	}
+
+	token := &platform.RefreshToken{
+		TokenHash: tokenHash,
+		FamilyID:  fields["family_id"],
+		Username:  fields["username"],
+	}
+	if token.CreatedAt, err = time.Parse(time.RFC3339Nano, fields["created_at"]); err != nil {
+		return nil, err
+	}
+	if token.ExpiresAt, err = time.Parse(time.RFC3339Nano, fields["expires_at"]); err != nil {
+		return nil, err
+	}
+	if usedAt, ok := fields["used_at"]; ok {
+		if token.UsedAt, err = time.Parse(time.RFC3339Nano, usedAt); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+func (store *RedisRefreshTokenStore) MarkUsed(ctx context.Context, tokenHash string, usedAt time.Time) (bool, error) {
+	result, err := markUsedScript.Run(ctx, store.client,
+		[]string{store.tokenKey(tokenHash)},
+		usedAt.UTC().Format(time.RFC3339Nano),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	if result == -1 {
+		return false, platform.ErrNotFound
+	}
+	return result == 1, nil
+}
+
+func (store *RedisRefreshTokenStore) DeleteFamily(ctx context.Context, familyID string) (int, error) {
+	familyKey := store.familyKey(familyID)
+	tokenHashes, err := store.client.SMembers(ctx, familyKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(tokenHashes) == 0 {
+		return 0, nil
+	}
+
+	keys := make([]string, len(tokenHashes))
+	for i, tokenHash := range tokenHashes {
+		keys[i] = store.tokenKey(tokenHash)
+	}
+	var deleted *redis.IntCmd
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, keys...)
+		pipe.Del(ctx, familyKey)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted.Val()), nil
+}
+
+func (store *RedisRefreshTokenStore) DeleteByUsername(ctx context.Context, username string) (int, error) {
+	userKey := store.userKey(username)
+	familyIDs, err := store.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, familyID := range familyIDs {
+		familyDeleted, err := store.DeleteFamily(ctx, familyID)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += familyDeleted
+	}
+	return deleted, store.client.Del(ctx, userKey).Err()
+}
+
+// DeleteExpired has nothing to do, redis expires the token and family keys itself
+func (store *RedisRefreshTokenStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	return 0, ctx.Err()
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisSessionStore is a platform.SessionStore keeping the login sessions in redis. Every session
+// is a key expiring together with the session, and each user has a set of own session token hashes.
+type RedisSessionStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisSessionStore creates a store for all the keys starting with prefix, e.g. "ispend:"
+func NewRedisSessionStore(client redis.UniversalClient, prefix string) *RedisSessionStore {
+	return &RedisSessionStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (store *RedisSessionStore) sessionKey(tokenHash string) string {
+	return store.prefix + "session:" + tokenHash
+}
+
+func (store *RedisSessionStore) userSessionsKey(username string) string {
+	return store.prefix + "user_sessions:" + username
+}
+
+func (store *RedisSessionStore) Save(ctx context.Context, session *platform.LoginSession) error {
+	var ttl time.Duration
+	if !session.ExpiresAt.IsZero() {
+		ttl = time.Until(session.ExpiresAt)
+		if ttl <= 0 {
+			// redis would not take it anyway, it's the same as already swept
+			err := store.Delete(ctx, session.TokenHash)
+			if err == platform.ErrNotFound {
+				return nil
+			}
+			return err
+		}
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, store.sessionKey(session.TokenHash), data, ttl)
+		pipe.SAdd(ctx, store.userSessionsKey(session.Username), session.TokenHash)
+		return nil
+	})
+	return err
+}
+
+func (store *RedisSessionStore) Get(ctx context.Context, tokenHash string) (*platform.LoginSession, error) {
+	data, err := store.client.Get(ctx, store.sessionKey(tokenHash)).Bytes()
+	if err == redis.Nil {
+		return nil, platform.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session platform.LoginSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetByUsername also drops the token hashes of the sessions redis already expired from the user's set
+func (store *RedisSessionStore) GetByUsername(ctx context.Context, username string) ([]platform.LoginSession, error) {
+	sessions, _, err := store.userSessions(ctx, username, time.Time{})
+	return sessions, err
+}
+
+func (store *RedisSessionStore) Delete(ctx context.Context, tokenHash string) error {
+	session, err := store.Get(ctx, tokenHash)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, store.sessionKey(tokenHash))
+		pipe.SRem(ctx, store.userSessionsKey(session.Username), tokenHash)
+		return nil
+	})
+	return err
+}
+
+// DeleteExpired has little to do, as redis expires the session keys itself; it cleans up
+// the users' session sets, and deletes whatever is expired but still there due to clock skew
+func (store *RedisSessionStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	deleted := 0
+	iter := store.client.Scan(ctx, 0, store.userSessionsKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		username := iter.Val()[len(store.userSessionsKey("")):]
+		_, userDeleted, err := store.userSessions(ctx, username, now)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += userDeleted
+	}
+	return deleted, iter.Err()
+}
+
+// userSessions returns the user's sessions, removing the ones missing or expired at now (if not zero)
+func (store *RedisSessionStore) userSessions(ctx context.Context, username string, now time.Time) ([]platform.LoginSession, int, error) {
+	userSessionsKey := store.userSessionsKey(username)
+	tokenHashes, err := store.client.SMembers(ctx, userSessionsKey).Result()
+	if err != nil || len(tokenHashes) == 0 {
+		return nil, 0, err
+	}
+
+	keys := make([]string, len(tokenHashes))
+	for i, tokenHash := range tokenHashes {
+		keys[i] = store.sessionKey(tokenHash)
+	}
+	values, err := store.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var sessions []platform.LoginSession
+	var staleIDs []interface{}
+	var expiredKeys []string
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			staleIDs = append(staleIDs, tokenHashes[i])
+			continue
+		}
+		var session platform.LoginSession
+		if err := json.Unmarshal([]byte(data), &session); err != nil {
+			return nil, 0, err
+		}
+		if !now.IsZero() && session.IsExpired(now) {
+			staleIDs = append(staleIDs, tokenHashes[i])
+			expiredKeys = append(expiredKeys, keys[i])
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	if len(staleIDs) > 0 {
+		_, err := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(expiredKeys) > 0 {
+				pipe.Del(ctx, expiredKeys...)
+			}
+			pipe.SRem(ctx, userSessionsKey, staleIDs...)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	platform.SortLoginSessions(sessions)
+	return sessions, len(expiredKeys), nil
+}
@@ -0,0 +1,53 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/platform/sessiontest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLRefreshTokenStore_SQLite(t *testing.T) {
+	sessiontest.RunRefreshTokenConformance(t, func(t *testing.T) platform.RefreshTokenStore {
+		sqliteDB := db.NewSQLiteDB(filepath.Join(t.TempDir(), "ispend.db"), true)
+		require.NoError(t, sqliteDB.Open())
+		t.Cleanup(func() {
+			assert.NoError(t, sqliteDB.Close())
+		})
+		return sqliteDB.RefreshTokenStore()
+	})
+}
+
+func TestSQLRefreshTokenStore_Postgres(t *testing.T) {
+	dsn := os.Getenv("ISPEND_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("ISPEND_TEST_POSTGRES_DSN not set")
+	}
+
+	sessiontest.RunRefreshTokenConformance(t, func(t *testing.T) platform.RefreshTokenStore {
+		pdb := db.NewPostgresDBClientWithDSN(dsn, 5, true)
+		require.NoError(t, pdb.Open())
+		t.Cleanup(func() {
+			assert.NoError(t, pdb.Close())
+		})
+		return pdb.RefreshTokenStore()
+	})
+}
+
+func TestRedisRefreshTokenStore(t *testing.T) {
+	sessiontest.RunRefreshTokenConformance(t, func(t *testing.T) platform.RefreshTokenStore {
+		redisServer := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+		t.Cleanup(func() {
+			assert.NoError(t, client.Close())
+		})
+		return db.NewRedisRefreshTokenStore(client, "ispend:")
+	})
+}
@@ -0,0 +1,85 @@
+package db_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/platform/sessiontest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLSessionStore_SQLite(t *testing.T) {
+	sessiontest.RunConformance(t, func(t *testing.T) platform.SessionStore {
+		sqliteDB := db.NewSQLiteDB(filepath.Join(t.TempDir(), "ispend.db"), true)
+		require.NoError(t, sqliteDB.Open())
+		t.Cleanup(func() {
+			assert.NoError(t, sqliteDB.Close())
+		})
+		return sqliteDB.SessionStore()
+	})
+}
+
+func TestSQLSessionStore_Postgres(t *testing.T) {
+	dsn := os.Getenv("ISPEND_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("ISPEND_TEST_POSTGRES_DSN not set")
+	}
+
+	sessiontest.RunConformance(t, func(t *testing.T) platform.SessionStore {
+		pdb := db.NewPostgresDBClientWithDSN(dsn, 5, true)
+		require.NoError(t, pdb.Open())
+		t.Cleanup(func() {
+			assert.NoError(t, pdb.Close())
+		})
+		return pdb.SessionStore()
+	})
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	sessiontest.RunConformance(t, func(t *testing.T) platform.SessionStore {
+		redisServer := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+		t.Cleanup(func() {
+			assert.NoError(t, client.Close())
+		})
+		return db.NewRedisSessionStore(client, "ispend:")
+	})
+}
+
+func TestRedisSessionStore_ExpiresKeys(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	defer func() {
+		assert.NoError(t, client.Close())
+	}()
+	store := db.NewRedisSessionStore(client, "ispend:")
+	ctx := context.Background()
+
+	now := time.Now()
+	session := &platform.LoginSession{
+		Username:  "u1",
+		TokenHash: "s1",
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+	require.NoError(t, store.Save(ctx, session))
+	assert.True(t, redisServer.TTL("ispend:session:s1") > 59*time.Minute)
+
+	redisServer.FastForward(61 * time.Minute)
+
+	_, err := store.Get(ctx, "s1")
+	assert.Equal(t, platform.ErrNotFound, err)
+	sessions, err := store.GetByUsername(ctx, "u1")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	assert.False(t, redisServer.Exists("ispend:user_sessions:u1"))
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+// SQLAccountTokenStore is a platform.AccountTokenStore keeping the account tokens
+// in the account_tokens table of a postgres or SQLite DB
+type SQLAccountTokenStore struct {
+	db *sql.DB
+}
+
+func NewSQLAccountTokenStore(db *sql.DB) *SQLAccountTokenStore {
+	return &SQLAccountTokenStore{db: db}
+}
+
+// AccountTokenStore returns an account token store using the same DB, must be called after Open
+func (client *sqlClient) AccountTokenStore() *SQLAccountTokenStore {
+	return NewSQLAccountTokenStore(client.db)
+}
+
+func (store *SQLAccountTokenStore) Save(ctx context.Context, token *platform.AccountToken) error {
+	_, err := store.db.ExecContext(ctx, `
+		INSERT INTO account_tokens (token_hash, purpose, username, email, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		token.TokenHash,
+		token.Purpose,
+		token.Username,
+		token.Email,
+		token.CreatedAt.UTC(),
+		token.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		log.Errorf("sql account token store error 10711: %s", err)
+	}
+	return err
+}
+
+func (store *SQLAccountTokenStore) Take(ctx context.Context, tokenHash string) (*platform.AccountToken, error) {
+	// deleting it right away makes the row lock decide which of the concurrent requests gets it
+	row := store.db.QueryRowContext(ctx, `
+		DELETE FROM account_tokens WHERE token_hash = $1
+		RETURNING token_hash, purpose, username, email, created_at, expires_at`, tokenHash)
+
+	var token platform.AccountToken
+	err := row.Scan(&token.TokenHash, &token.Purpose, &token.Username, &token.Email, &token.CreatedAt, &token.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, platform.ErrNotFound
+	}
+	if err != nil {
+		log.Errorf("sql account token store error 10712: %s", err)
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (store *SQLAccountTokenStore) DeleteByUsername(ctx context.Context, username, purpose string) (int, error) {
+	result, err := store.db.ExecContext(ctx,
+		`DELETE FROM account_tokens WHERE username = $1 AND purpose = $2`, username, purpose)
+	if err != nil {
+		log.Errorf("sql account token store error 10713: %s", err)
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func (store *SQLAccountTokenStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	result, err := store.db.ExecContext(ctx, `DELETE FROM account_tokens WHERE expires_at <= $1`, now.UTC())
+	if err != nil {
+		log.Errorf("sql account token store error 10714: %s", err)
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/2beens/ispend/internal/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// sqlClient holds the parts shared by all database/sql backed SpenderDB implementations
+type sqlClient struct {
+	sqlStore
+	db *sql.DB
+}
+
+func newSQLClient(db *sql.DB) sqlClient {
+	return sqlClient{
+		sqlStore: sqlStore{q: db, stmts: newStmtCache(db)},
+		db:       db,
+	}
+}
+
+func (client *sqlClient) close() error {
+	client.stmts.close()
+	return client.db.Close()
+}
+
+func (client *sqlClient) WithTx(ctx context.Context, f func(tx SpenderTx) error) error {
+	if client.db == nil {
+		return errors.New("DB client is not opened")
+	}
+
+	tx, err := client.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		// the transaction is already rolled back if the context got canceled
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Errorf("DB client - transaction rollback error: %s", err)
+		}
+	}()
+
+	if err := f(&sqlStore{q: tx}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+
+	return nil
+}
+
+// StoreUser stores the user together with its spend kinds and spends atomically
+func (client *sqlClient) StoreUser(ctx context.Context, user *models.User) (int, error) {
+	id := 0
+	err := client.WithTx(ctx, func(tx SpenderTx) error {
+		var err error
+		id, err = tx.StoreUser(ctx, user)
+		return err
+	})
+	return id, err
+}
+
+// StoreSpending stores the spending, and its spend kind if not existing yet, atomically
+func (client *sqlClient) StoreSpending(ctx context.Context, username string, spending models.Spending) (string, error) {
+	id := ""
+	err := client.WithTx(ctx, func(tx SpenderTx) error {
+		var err error
+		id, err = tx.StoreSpending(ctx, username, spending)
+		return err
+	})
+	return id, err
+}
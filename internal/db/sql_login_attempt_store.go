@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+// SQLLoginAttemptStore is a platform.LoginAttemptStore keeping the failed logins
+// in the login_failures table of a postgres or SQLite DB
+type SQLLoginAttemptStore struct {
+	db *sql.DB
+}
+
+func NewSQLLoginAttemptStore(db *sql.DB) *SQLLoginAttemptStore {
+	return &SQLLoginAttemptStore{db: db}
+}
+
+// LoginAttemptStore returns a login attempt store using the same DB, must be called after Open
+func (client *sqlClient) LoginAttemptStore() *SQLLoginAttemptStore {
+	return NewSQLLoginAttemptStore(client.db)
+}
+
+func (store *SQLLoginAttemptStore) Get(ctx context.Context, subject string) (*platform.LoginFailures, error) {
+	row := store.db.QueryRowContext(ctx, `
+		SELECT subject, failures, last_failed_at, expires_at FROM login_failures WHERE subject = $1`, subject)
+
+	var failures platform.LoginFailures
+	err := row.Scan(&failures.Subject, &failures.Count, &failures.LastFailedAt, &failures.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, platform.ErrNotFound
+	}
+	if err != nil {
+		log.Errorf("sql login attempt store error 10721: %s", err)
+		return nil, err
+	}
+	return &failures, nil
+}
+
+func (store *SQLLoginAttemptStore) AddFailure(ctx context.Context, subject string, now time.Time, ttl time.Duration) (*platform.LoginFailures, error) {
+	// a single upsert, so the concurrent failures all get counted
+	row := store.db.QueryRowContext(ctx, `
+		INSERT INTO login_failures (subject, failures, last_failed_at, expires_at)
+		VALUES ($1, 1, $2, $3)
+		ON CONFLICT (subject) DO UPDATE SET
+			failures = CASE WHEN login_failures.expires_at <= $2 THEN 1 ELSE login_failures.failures + 1 END,
+			last_failed_at = $2,
+			expires_at = $3
+		RETURNING subject, failures, last_failed_at, expires_at`,
+		subject,
+		now.UTC(),
+		now.Add(ttl).UTC(),
+	)
+
+	var failures platform.LoginFailures
+	if err := row.Scan(&failures.Subject, &failures.Count, &failures.LastFailedAt, &failures.ExpiresAt); err != nil {
+		log.Errorf("sql login attempt store error 10722: %s", err)
+		return nil, err
+	}
+	return &failures, nil
+}
+
+func (store *SQLLoginAttemptStore) Reset(ctx context.Context, subject string) error {
+	_, err := store.db.ExecContext(ctx, `DELETE FROM login_failures WHERE subject = $1`, subject)
+	if err != nil {
+		log.Errorf("sql login attempt store error 10723: %s", err)
+	}
+	return err
+}
+
+func (store *SQLLoginAttemptStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	result, err := store.db.ExecContext(ctx, `DELETE FROM login_failures WHERE expires_at <= $1`, now.UTC())
+	if err != nil {
+		log.Errorf("sql login attempt store error 10724: %s", err)
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
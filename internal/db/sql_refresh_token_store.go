@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+// SQLRefreshTokenStore is a platform.RefreshTokenStore keeping the refresh tokens
+// in the refresh_tokens table of a postgres or SQLite DB
+type SQLRefreshTokenStore struct {
+	db *sql.DB
+}
+
+func NewSQLRefreshTokenStore(db *sql.DB) *SQLRefreshTokenStore {
+	return &SQLRefreshTokenStore{db: db}
+}
+
+// RefreshTokenStore returns a refresh token store using the same DB, must be called after Open
+func (client *sqlClient) RefreshTokenStore() *SQLRefreshTokenStore {
+	return NewSQLRefreshTokenStore(client.db)
+}
+
+func (store *SQLRefreshTokenStore) Save(ctx context.Context, token *platform.RefreshToken) error {
+	_, err := store.db.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, family_id, username, created_at, expires_at, used_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		token.TokenHash,
+		token.FamilyID,
+		token.Username,
+		token.CreatedAt.UTC(),
+		token.ExpiresAt.UTC(),
+		nullTime(token.UsedAt),
+	)
+	if err != nil {
+		log.Errorf("sql refresh token store error 10701: %s", err)
+	}
+	return err
+}
+
+func (store *SQLRefreshTokenStore) Get(ctx context.Context, tokenHash string) (*platform.RefreshToken, error) {
+	row := store.db.QueryRowContext(ctx, `
+		SELECT token_hash, family_id, username, created_at, expires_at, used_at
+		FROM refresh_tokens WHERE token_hash = $1`, tokenHash)
+
+	var token platform.RefreshToken
+	var usedAt sql.NullTime
+	err := row.Scan(&token.TokenHash, &token.FamilyID, &token.Username, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, platform.ErrNotFound
+	}
+	if err != nil {
+		log.Errorf("sql refresh token store error 10702: %s", err)
+		return nil, err
+	}
+	if usedAt.Valid {
+		token.UsedAt = usedAt.Time
+	}
+	return &token, nil
+}
+
+func (store *SQLRefreshTokenStore) MarkUsed(ctx context.Context, tokenHash string, usedAt time.Time) (bool, error) {
+	// the condition on used_at makes the row lock decide which of the concurrent requests wins
+	result, err := store.db.ExecContext(ctx,
+		`UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL`,
+		usedAt.UTC(), tokenHash,
+	)
+	if err != nil {
+		log.Errorf("sql refresh token store error 10703: %s", err)
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if updated == 1 {
+		return true, nil
+	}
+
+	if _, err := store.Get(ctx, tokenHash); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (store *SQLRefreshTokenStore) DeleteFamily(ctx context.Context, familyID string) (int, error) {
+	result, err := store.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE family_id = $1`, familyID)
+	if err != nil {
+		log.Errorf("sql refresh token store error 10704: %s", err)
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func (store *SQLRefreshTokenStore) DeleteByUsername(ctx context.Context, username string) (int, error) {
+	result, err := store.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE username = $1`, username)
+	if err != nil {
+		log.Errorf("sql refresh token store error 10706: %s", err)
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func (store *SQLRefreshTokenStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	result, err := store.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at <= $1`, now.UTC())
+	if err != nil {
+		log.Errorf("sql refresh token store error 10705: %s", err)
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+// SQLSessionStore is a platform.SessionStore keeping the login sessions in the login_sessions
+// table of a postgres or SQLite DB, so they survive server restarts
+type SQLSessionStore struct {
+	db *sql.DB
+}
+
+func NewSQLSessionStore(db *sql.DB) *SQLSessionStore {
+	return &SQLSessionStore{db: db}
+}
+
+// SessionStore returns a session store using the same DB, must be called after Open
+func (client *sqlClient) SessionStore() *SQLSessionStore {
+	return NewSQLSessionStore(client.db)
+}
+
+const sqlSelectSession = `
+	SELECT token_hash, username, created_at, last_seen, expires_at, device_name, user_agent, ip_address
+	FROM login_sessions`
+
+func (store *SQLSessionStore) Save(ctx context.Context, session *platform.LoginSession) error {
+	_, err := store.db.ExecContext(ctx, `
+		INSERT INTO login_sessions (token_hash, username, created_at, last_seen, expires_at, device_name, user_agent, ip_address)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (token_hash) DO UPDATE SET
+			username = excluded.username,
+			created_at = excluded.created_at,
+			last_seen = excluded.last_seen,
+			expires_at = excluded.expires_at,
+			device_name = excluded.device_name,
+			user_agent = excluded.user_agent,
+			ip_address = excluded.ip_address`,
+		session.TokenHash,
+		session.Username,
+		session.CreatedAt.UTC(),
+		session.LastSeen.UTC(),
+		nullTime(session.ExpiresAt),
+		session.DeviceName,
+		session.UserAgent,
+		session.IPAddress,
+	)
+	if err != nil {
+		log.Errorf("sql session store error 10501: %s", err)
+	}
+	return err
+}
+
+func (store *SQLSessionStore) Get(ctx context.Context, tokenHash string) (*platform.LoginSession, error) {
+	row := store.db.QueryRowContext(ctx, sqlSelectSession+` WHERE token_hash = $1`, tokenHash)
+	session, err := scanSession(row)
+	if err == sql.ErrNoRows {
+		return nil, platform.ErrNotFound
+	}
+	if err != nil {
+		log.Errorf("sql session store error 10502: %s", err)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (store *SQLSessionStore) GetByUsername(ctx context.Context, username string) ([]platform.LoginSession, error) {
+	rows, err := store.db.QueryContext(ctx, sqlSelectSession+` WHERE username = $1 ORDER BY created_at, token_hash`, username)
+	if err != nil {
+		log.Errorf("sql session store error 10503: %s", err)
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	var sessions []platform.LoginSession
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			log.Errorf("sql session store error 10504: %s", err)
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+func (store *SQLSessionStore) Delete(ctx context.Context, tokenHash string) error {
+	result, err := store.db.ExecContext(ctx, `DELETE FROM login_sessions WHERE token_hash = $1`, tokenHash)
+	if err != nil {
+		log.Errorf("sql session store error 10505: %s", err)
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return platform.ErrNotFound
+	}
+	return nil
+}
+
+func (store *SQLSessionStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	result, err := store.db.ExecContext(ctx, `DELETE FROM login_sessions WHERE expires_at <= $1`, now.UTC())
+	if err != nil {
+		log.Errorf("sql session store error 10506: %s", err)
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row rowScanner) (*platform.LoginSession, error) {
+	var session platform.LoginSession
+	var expiresAt sql.NullTime
+	err := row.Scan(
+		&session.TokenHash,
+		&session.Username,
+		&session.CreatedAt,
+		&session.LastSeen,
+		&expiresAt,
+		&session.DeviceName,
+		&session.UserAgent,
+		&session.IPAddress,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		session.ExpiresAt = expiresAt.Time
+	}
+	return &session, nil
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	if t.IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
@@ -0,0 +1,739 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlStore implements SpenderTx on top of a SQL DB connection or an open transaction
+type sqlStore struct {
+	q queryer
+	// stmts is nil within transactions, their statements are not worth preparing
+	stmts *stmtCache
+}
+
+// stmtCache lazily prepares statements and keeps them for the lifetime of the DB connection pool
+type stmtCache struct {
+	db    *sql.DB
+	mutex sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+func (c *stmtCache) get(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+
+	return stmt, nil
+}
+
+func (c *stmtCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for query, stmt := range c.stmts {
+		if err := stmt.Close(); err != nil {
+			log.Errorf("close prepared statement error: %s", err)
+		}
+		delete(c.stmts, query)
+	}
+}
+
+const (
+	sqlSelectUser = `
+		SELECT id, email, email_verified, username, password, role,
+			totp_secret, totp_enabled, totp_recovery_codes, totp_last_step,
+			display_name, default_currency, timezone, locale
+		FROM users
+		WHERE username=$1`
+	sqlSelectAllUsers = `
+		SELECT id, email, email_verified, username, password, role,
+			totp_secret, totp_enabled, totp_recovery_codes, totp_last_step,
+			display_name, default_currency, timezone, locale
+		FROM users
+		ORDER BY id`
+	sqlSelectUserSpendKinds = `
+		SELECT id, user_id, name
+		FROM spend_kinds
+		WHERE user_id=$1
+		ORDER BY id`
+	sqlSelectAllSpendKinds = `
+		SELECT id, user_id, name
+		FROM spend_kinds
+		ORDER BY id`
+	sqlSelectUserSpends = `
+		SELECT s.id, s.currency, s.amount, s.spend_timestamp, s.user_id, k.id, k.name
+		FROM spends s
+		JOIN spend_kinds k ON k.id = s.kind_id
+		WHERE s.user_id=$1
+		ORDER BY s.id`
+	// the %s of the batch queries is the IN list, see inList
+	sqlSelectUserIDs = `
+		SELECT id, username
+		FROM users
+		WHERE username IN (%s)`
+	sqlSelectSpendKindsOfUsers = `
+		SELECT id, user_id, name
+		FROM spend_kinds
+		WHERE user_id IN (%s)
+		ORDER BY id`
+	sqlSelectSpendsOfUsers = `
+		SELECT s.id, s.currency, s.amount, s.spend_timestamp, s.user_id, k.id, k.name
+		FROM spends s
+		JOIN spend_kinds k ON k.id = s.kind_id
+		WHERE s.user_id IN (%s)
+		ORDER BY s.id`
+	sqlSelectAllSpends = `
+		SELECT s.id, s.currency, s.amount, s.spend_timestamp, s.user_id, k.id, k.name
+		FROM spends s
+		JOIN spend_kinds k ON k.id = s.kind_id
+		ORDER BY s.id`
+)
+
+func (store *sqlStore) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if stmt := store.prepared(ctx, query); stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return store.q.QueryRowContext(ctx, query, args...)
+}
+
+func (store *sqlStore) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt := store.prepared(ctx, query); stmt != nil {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return store.q.QueryContext(ctx, query, args...)
+}
+
+func (store *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if stmt := store.prepared(ctx, query); stmt != nil {
+		return stmt.ExecContext(ctx, args...)
+	}
+	return store.q.ExecContext(ctx, query, args...)
+}
+
+func (store *sqlStore) prepared(ctx context.Context, query string) *sql.Stmt {
+	if store.stmts == nil {
+		return nil
+	}
+	stmt, err := store.stmts.get(ctx, query)
+	if err != nil {
+		// fall back to an unprepared query, it will fail again if the query is wrong
+		log.Warnf("prepare statement error: %s", err)
+		return nil
+	}
+	return stmt
+}
+
+func (store *sqlStore) StoreDefaultSpendKind(ctx context.Context, kind models.SpendKind) (int, error) {
+	sqlStatement := `
+		INSERT INTO default_spend_kinds (name)
+		VALUES ($1)
+		RETURNING id`
+	id := 0
+	err := store.queryRow(ctx, sqlStatement, kind.Name).Scan(&id)
+	if err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+func (store *sqlStore) GetAllDefaultSpendKinds(ctx context.Context) ([]models.SpendKind, error) {
+	rows, err := store.query(ctx, `SELECT id, name FROM default_spend_kinds ORDER BY id`)
+	defer store.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var spendKinds []models.SpendKind
+	for rows.Next() {
+		var id int
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return nil, err
+		}
+
+		spendKinds = append(spendKinds, models.SpendKind{
+			ID:   id,
+			Name: name,
+		})
+	}
+
+	return spendKinds, rows.Err()
+}
+
+func (store *sqlStore) GetSpendKind(ctx context.Context, username string, spendingKindID int) (*models.SpendKind, error) {
+	var name string
+	sqlStatement := `
+		SELECT k.name
+		FROM spend_kinds k
+		JOIN users u ON u.id = k.user_id
+		WHERE k.id=$1 AND u.username=$2`
+	row := store.queryRow(ctx, sqlStatement, spendingKindID, username)
+
+	err := row.Scan(&name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, platform.ErrNotFound
+		}
+		log.Errorf("sql DB error 10023: %s", err)
+		return nil, err
+	}
+	return &models.SpendKind{
+		ID:   spendingKindID,
+		Name: name,
+	}, nil
+}
+
+func (store *sqlStore) GetUserIDByUsername(ctx context.Context, username string) (int, error) {
+	var id int
+	sqlStatement := `SELECT id FROM users WHERE username=$1`
+	row := store.queryRow(ctx, sqlStatement, username)
+	err := row.Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return -1, platform.ErrNotFound
+		}
+		log.Errorf("sql DB error 10021: %s", err)
+		return -1, err
+	}
+	return id, nil
+}
+
+func (store *sqlStore) GetSpendKindsOfUsers(ctx context.Context, usernames []string) (map[string][]models.SpendKind, error) {
+	usernamesByID, err := store.userIDsByUsernames(ctx, usernames)
+	if err != nil || len(usernamesByID) == 0 {
+		return map[string][]models.SpendKind{}, err
+	}
+	placeholders, args := inList(userIDs(usernamesByID))
+	spendKindsByUserID, err := store.loadSpendKinds(ctx, fmt.Sprintf(sqlSelectSpendKindsOfUsers, placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	spendKindsByUser := make(map[string][]models.SpendKind, len(usernamesByID))
+	for id, username := range usernamesByID {
+		spendKindsByUser[username] = spendKindsByUserID[id]
+	}
+	return spendKindsByUser, nil
+}
+
+func (store *sqlStore) GetSpendKinds(ctx context.Context, username string) ([]models.SpendKind, error) {
+	userId, err := store.GetUserIDByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	spendKindsByUser, err := store.loadSpendKinds(ctx, sqlSelectUserSpendKinds, userId)
+	if err != nil {
+		return nil, err
+	}
+	return spendKindsByUser[userId], nil
+}
+
+// spendKindIDByName returns the ID of the user's spend kind with the given name
+func (store *sqlStore) spendKindIDByName(ctx context.Context, userId int, kindName string) (int, error) {
+	var id int
+	sqlStatement := `SELECT id FROM spend_kinds WHERE user_id=$1 AND name=$2`
+	row := store.queryRow(ctx, sqlStatement, userId, kindName)
+	err := row.Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return -1, platform.ErrNotFound
+		}
+		log.Errorf("sql DB error 10022: %s", err)
+		return -1, err
+	}
+	return id, nil
+}
+
+func (store *sqlStore) StoreSpendKind(ctx context.Context, username string, kind *models.SpendKind) (int, error) {
+	sqlStatement := `
+		INSERT INTO spend_kinds (user_id, name)
+		SELECT id, $2 FROM users WHERE username=$1
+		RETURNING id`
+	id := -1
+	err := store.queryRow(ctx, sqlStatement, username, kind.Name).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return -1, platform.ErrNotFound
+		}
+		return -1, err
+	}
+	return id, nil
+}
+
+func (store *sqlStore) StoreUser(ctx context.Context, user *models.User) (int, error) {
+	if _, err := store.GetUserIDByUsername(ctx, user.Username); err == nil {
+		return 0, platform.ErrAlreadyExists
+	} else if err != platform.ErrNotFound {
+		return 0, err
+	}
+	// the email is unique too, an account of the address is there already
+	var otherUsername string
+	err := store.queryRow(ctx, `SELECT username FROM users WHERE email = $1`, user.Email).Scan(&otherUsername)
+	if err == nil {
+		return 0, platform.ErrAlreadyExists
+	}
+	if err != sql.ErrNoRows {
+		log.Errorf("sql DB error 10025: %s", err)
+		return 0, err
+	}
+
+	sqlStatement := `
+		INSERT INTO users (email, email_verified, username, password, role,
+			display_name, default_currency, timezone, locale)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id`
+	role := user.Role
+	if role == "" {
+		role = models.RoleUser
+	}
+	id := 0
+	err = store.queryRow(
+		ctx, sqlStatement, user.Email, user.EmailVerified, user.Username, user.Password, role,
+		user.Profile.DisplayName, user.Profile.DefaultCurrency, user.Profile.Timezone, user.Profile.Locale,
+	).Scan(&id)
+	if err != nil {
+		return id, err
+	}
+
+	for i := range user.SpendKinds {
+		spendKindID, err := store.StoreSpendKind(ctx, user.Username, &user.SpendKinds[i])
+		if err != nil {
+			return -1, fmt.Errorf("store user - store spend kind error: %s", err)
+		}
+		user.SpendKinds[i].ID = spendKindID
+	}
+
+	for i := range user.Spends {
+		spendId, err := store.StoreSpending(ctx, user.Username, user.Spends[i])
+		if err != nil {
+			return -1, fmt.Errorf("store user - store spending error: %s", err)
+		}
+		user.Spends[i].ID = spendId
+	}
+
+	return id, nil
+}
+
+func (store *sqlStore) GetUser(ctx context.Context, username string, loadAllData bool) (*models.User, error) {
+	user := &models.User{}
+	var id int
+	err := scanUser(store.queryRow(ctx, sqlSelectUser, username), &id, user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, platform.ErrNotFound
+		}
+		log.Errorf("sql DB error 10011: %s", err)
+		return nil, err
+	}
+
+	if !loadAllData {
+		return user, nil
+	}
+
+	spendsByUser, err := store.loadSpends(ctx, sqlSelectUserSpends, id)
+	if err != nil {
+		return nil, err
+	}
+	spendKindsByUser, err := store.loadSpendKinds(ctx, sqlSelectUserSpendKinds, id)
+	if err != nil {
+		return nil, err
+	}
+	user.Spends = spendsByUser[id]
+	user.SpendKinds = spendKindsByUser[id]
+
+	return user, nil
+}
+
+// GetAllUsers loads all users with 1 query, or with 3 queries in total when loading all their data
+func (store *sqlStore) GetAllUsers(ctx context.Context, loadAllUserData bool) (models.Users, error) {
+	rows, err := store.query(ctx, sqlSelectAllUsers)
+	defer store.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var users models.Users
+	var userIDs []int
+	for rows.Next() {
+		user := &models.User{}
+		var id int
+		err = scanUser(rows, &id, user)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+		userIDs = append(userIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !loadAllUserData {
+		return users, nil
+	}
+
+	spendsByUser, err := store.loadSpends(ctx, sqlSelectAllSpends)
+	if err != nil {
+		return nil, err
+	}
+	spendKindsByUser, err := store.loadSpendKinds(ctx, sqlSelectAllSpendKinds)
+	if err != nil {
+		return nil, err
+	}
+	for i, user := range users {
+		user.Spends = spendsByUser[userIDs[i]]
+		user.SpendKinds = spendKindsByUser[userIDs[i]]
+	}
+
+	return users, nil
+}
+
+// scanUser scans a row of sqlSelectUser or sqlSelectAllUsers
+func scanUser(row rowScanner, id *int, user *models.User) error {
+	var recoveryCodes string
+	err := row.Scan(
+		id, &user.Email, &user.EmailVerified, &user.Username, &user.Password, &user.Role,
+		&user.TOTP.Secret, &user.TOTP.Enabled, &recoveryCodes, &user.TOTP.LastUsedStep,
+		&user.Profile.DisplayName, &user.Profile.DefaultCurrency, &user.Profile.Timezone, &user.Profile.Locale,
+	)
+	if err != nil {
+		return err
+	}
+	if recoveryCodes != "" {
+		user.TOTP.RecoveryCodes = strings.Split(recoveryCodes, ",")
+	}
+	return nil
+}
+
+func (store *sqlStore) SetUserRole(ctx context.Context, username, role string) error {
+	return store.updateUser(ctx, `UPDATE users SET role = $1 WHERE username = $2`, role, username)
+}
+
+func (store *sqlStore) SetEmailVerified(ctx context.Context, username string, verified bool) error {
+	return store.updateUser(ctx, `UPDATE users SET email_verified = $1 WHERE username = $2`, verified, username)
+}
+
+func (store *sqlStore) SetUserPassword(ctx context.Context, username, passwordHash string) error {
+	return store.updateUser(ctx, `UPDATE users SET password = $1 WHERE username = $2`, passwordHash, username)
+}
+
+func (store *sqlStore) SetUserTOTP(ctx context.Context, username string, totp models.TOTP) error {
+	return store.updateUser(ctx, `
+		UPDATE users
+		SET totp_secret = $1, totp_enabled = $2, totp_recovery_codes = $3, totp_last_step = $4
+		WHERE username = $5`,
+		totp.Secret, totp.Enabled, strings.Join(totp.RecoveryCodes, ","), totp.LastUsedStep, username,
+	)
+}
+
+func (store *sqlStore) UpdateUser(ctx context.Context, user *models.User) error {
+	var otherUsername string
+	err := store.queryRow(ctx, `SELECT username FROM users WHERE email = $1 AND username <> $2`, user.Email, user.Username).Scan(&otherUsername)
+	if err == nil {
+		return platform.ErrAlreadyExists
+	}
+	if err != sql.ErrNoRows {
+		log.Errorf("sql DB error 10015: %s", err)
+		return err
+	}
+
+	return store.updateUser(ctx, `
+		UPDATE users
+		SET email = $1, email_verified = $2, display_name = $3, default_currency = $4, timezone = $5, locale = $6
+		WHERE username = $7`,
+		user.Email, user.EmailVerified,
+		user.Profile.DisplayName, user.Profile.DefaultCurrency, user.Profile.Timezone, user.Profile.Locale,
+		user.Username,
+	)
+}
+
+// DeleteUser deletes the user's data table by table rather than relying on ON DELETE CASCADE, as the spends
+// reference the spend kinds too; it should run within a transaction, so no half deleted user is left behind
+func (store *sqlStore) DeleteUser(ctx context.Context, username string) error {
+	userId, err := store.GetUserIDByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range []struct {
+		query string
+		arg   interface{}
+	}{
+		{`DELETE FROM webauthn_credentials WHERE username = $1`, username},
+		{`DELETE FROM spends WHERE user_id = $1`, userId},
+		{`DELETE FROM spend_kinds WHERE user_id = $1`, userId},
+		{`DELETE FROM users WHERE id = $1`, userId},
+	} {
+		if _, err := store.exec(ctx, statement.query, statement.arg); err != nil {
+			log.Errorf("sql DB error 10016: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// updateUser runs the update of a single user, the last argument being the username
+func (store *sqlStore) updateUser(ctx context.Context, query string, args ...interface{}) error {
+	result, err := store.exec(ctx, query, args...)
+	if err != nil {
+		log.Errorf("sql DB error 10014: %s", err)
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return platform.ErrNotFound
+	}
+	return nil
+}
+
+func (store *sqlStore) StoreSpending(ctx context.Context, username string, spending models.Spending) (string, error) {
+	userId, err := store.GetUserIDByUsername(ctx, username)
+	if err != nil {
+		return "", err
+	}
+
+	spendKindId, err := store.spendKindIDByName(ctx, userId, spending.Kind.Name)
+	if err != nil && err != platform.ErrNotFound {
+		return "", err
+	}
+	if err == platform.ErrNotFound {
+		spendKindId, err = store.StoreSpendKind(ctx, username, spending.Kind)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	sqlStatement := `
+		INSERT INTO spends (currency, amount, spend_timestamp, user_id, kind_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`
+	id := 0
+	err = store.queryRow(
+		ctx, sqlStatement, spending.Currency, spending.Amount, spending.Timestamp, userId, spendKindId,
+	).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(id), nil
+}
+
+func (store *sqlStore) GetSpends(ctx context.Context, username string) ([]models.Spending, error) {
+	userId, err := store.GetUserIDByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	spendsByUser, err := store.loadSpends(ctx, sqlSelectUserSpends, userId)
+	if err != nil {
+		return nil, err
+	}
+	return spendsByUser[userId], nil
+}
+
+func (store *sqlStore) GetSpendsOfUsers(ctx context.Context, usernames []string) (map[string][]models.Spending, error) {
+	usernamesByID, err := store.userIDsByUsernames(ctx, usernames)
+	if err != nil || len(usernamesByID) == 0 {
+		return map[string][]models.Spending{}, err
+	}
+	placeholders, args := inList(userIDs(usernamesByID))
+	spendsByUserID, err := store.loadSpends(ctx, fmt.Sprintf(sqlSelectSpendsOfUsers, placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	spendsByUser := make(map[string][]models.Spending, len(usernamesByID))
+	for id, username := range usernamesByID {
+		spendsByUser[username] = spendsByUserID[id]
+	}
+	return spendsByUser, nil
+}
+
+func (store *sqlStore) DeleteSpending(ctx context.Context, username, spendID string) error {
+	log.Tracef("DB tries to delete spending [user: %s] [id: %s]...", username, spendID)
+	userId, err := store.GetUserIDByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+	// spending IDs are numeric in SQL DBs, anything else cannot exist
+	if _, err := strconv.Atoi(spendID); err != nil {
+		return platform.ErrNotFound
+	}
+
+	sqlStatement := `
+		DELETE FROM spends
+		WHERE id=$1 AND user_id=$2;`
+	res, err := store.exec(ctx, sqlStatement, spendID, userId)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count <= 0 {
+		return platform.ErrNotFound
+	}
+
+	log.Tracef("DB deleted spending [user: %s] [id: %s]", username, spendID)
+	return nil
+}
+
+// userIDsByUsernames returns the usernames of the known users by their IDs
+func (store *sqlStore) userIDsByUsernames(ctx context.Context, usernames []string) (map[int]string, error) {
+	usernamesByID := make(map[int]string, len(usernames))
+	if len(usernames) == 0 {
+		return usernamesByID, nil
+	}
+
+	values := make([]interface{}, 0, len(usernames))
+	for _, username := range usernames {
+		values = append(values, username)
+	}
+	placeholders, args := inList(values)
+	rows, err := store.query(ctx, fmt.Sprintf(sqlSelectUserIDs, placeholders), args...)
+	defer store.closeRows(rows)
+	if err != nil {
+		log.Errorf("sql DB error 10024: %s", err)
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		usernamesByID[id] = username
+	}
+	return usernamesByID, rows.Err()
+}
+
+func userIDs(usernamesByID map[int]string) []interface{} {
+	ids := make([]interface{}, 0, len(usernamesByID))
+	for id := range usernamesByID {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// inList returns the placeholders of an IN list of the values, and the values as the query arguments;
+// the list is padded to the next power of two with the first value, so the lists of any length share
+// only a handful of prepared statements. The values must not be empty.
+func inList(values []interface{}) (string, []interface{}) {
+	size := 1
+	for size < len(values) {
+		size *= 2
+	}
+
+	placeholders := make([]string, size)
+	args := make([]interface{}, size)
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		args[i] = values[0]
+		if i < len(values) {
+			args[i] = values[i]
+		}
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// loadSpends runs one of the spends queries, and groups the resulting spends by user ID
+func (store *sqlStore) loadSpends(ctx context.Context, query string, args ...interface{}) (map[int][]models.Spending, error) {
+	rows, err := store.query(ctx, query, args...)
+	defer store.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	spendsByUser := make(map[int][]models.Spending)
+	for rows.Next() {
+		var id, currency string
+		var userId, kindId int
+		var kindName string
+		var timestamp time.Time
+		var amount float32
+		err = rows.Scan(&id, &currency, &amount, &timestamp, &userId, &kindId, &kindName)
+		if err != nil {
+			return nil, err
+		}
+		spendsByUser[userId] = append(spendsByUser[userId], models.Spending{
+			ID:        id,
+			Currency:  strings.TrimSpace(currency),
+			Amount:    amount,
+			Kind:      &models.SpendKind{ID: kindId, Name: kindName},
+			Timestamp: timestamp,
+		})
+	}
+
+	return spendsByUser, rows.Err()
+}
+
+// loadSpendKinds runs one of the spend kinds queries, and groups the resulting spend kinds by user ID
+func (store *sqlStore) loadSpendKinds(ctx context.Context, query string, args ...interface{}) (map[int][]models.SpendKind, error) {
+	rows, err := store.query(ctx, query, args...)
+	defer store.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	spendKindsByUser := make(map[int][]models.SpendKind)
+	for rows.Next() {
+		var id, userId int
+		var name string
+		err = rows.Scan(&id, &userId, &name)
+		if err != nil {
+			return nil, err
+		}
+		spendKindsByUser[userId] = append(spendKindsByUser[userId], models.SpendKind{
+			ID:   id,
+			Name: name,
+		})
+	}
+
+	return spendKindsByUser, rows.Err()
+}
+
+func (store *sqlStore) closeRows(rows *sql.Rows) {
+	if rows != nil {
+		err := rows.Close()
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+const sqlSelectWebAuthnCredential = `
+		SELECT id, username, user_handle, name, public_key, attestation_type, transports, aaguid,
+			sign_count, backup_eligible, backup_state, created_at, last_used_at
+		FROM webauthn_credentials`
+
+func (store *sqlStore) StoreWebAuthnCredential(ctx context.Context, credential *models.WebAuthnCredential) error {
+	if _, err := store.GetUserIDByUsername(ctx, credential.Username); err != nil {
+		return err
+	}
+	if _, err := store.GetWebAuthnCredential(ctx, credential.ID); err == nil {
+		return platform.ErrAlreadyExists
+	} else if err != platform.ErrNotFound {
+		return err
+	}
+
+	_, err := store.exec(ctx, `
+		INSERT INTO webauthn_credentials (id, username, user_handle, name, public_key, attestation_type, transports, aaguid,
+			sign_count, backup_eligible, backup_state, created_at, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		credential.ID,
+		credential.Username,
+		credential.UserHandle,
+		credential.Name,
+		credential.PublicKey,
+		credential.AttestationType,
+		strings.Join(credential.Transports, ","),
+		nonNilBytes(credential.AAGUID),
+		int64(credential.SignCount),
+		credential.BackupEligible,
+		credential.BackupState,
+		credential.CreatedAt.UTC(),
+		credential.LastUsedAt.UTC(),
+	)
+	if err != nil {
+		log.Errorf("sql DB error 10031: %s", err)
+	}
+	return err
+}
+
+func (store *sqlStore) GetWebAuthnCredentials(ctx context.Context, username string) ([]models.WebAuthnCredential, error) {
+	if _, err := store.GetUserIDByUsername(ctx, username); err != nil {
+		return nil, err
+	}
+
+	rows, err := store.query(ctx, sqlSelectWebAuthnCredential+` WHERE username = $1 ORDER BY created_at`, username)
+	defer store.closeRows(rows)
+	if err != nil {
+		log.Errorf("sql DB error 10032: %s", err)
+		return nil, err
+	}
+
+	credentials := []models.WebAuthnCredential{}
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, *credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (store *sqlStore) GetWebAuthnCredential(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error) {
+	credential, err := scanWebAuthnCredential(store.queryRow(ctx, sqlSelectWebAuthnCredential+` WHERE id = $1`, credentialID))
+	if err == sql.ErrNoRows {
+		return nil, platform.ErrNotFound
+	}
+	if err != nil {
+		log.Errorf("sql DB error 10033: %s", err)
+		return nil, err
+	}
+	return credential, nil
+}
+
+func (store *sqlStore) UpdateWebAuthnCredentialUse(ctx context.Context, credentialID []byte, signCount uint32, backupState bool, usedAt time.Time) error {
+	return store.updateWebAuthnCredential(ctx, `
+		UPDATE webauthn_credentials
+		SET sign_count = $1, backup_state = $2, last_used_at = $3
+		WHERE id = $4`,
+		int64(signCount), backupState, usedAt.UTC(), credentialID,
+	)
+}
+
+func (store *sqlStore) DeleteWebAuthnCredential(ctx context.Context, username string, credentialID []byte) error {
+	if _, err := store.GetUserIDByUsername(ctx, username); err != nil {
+		return err
+	}
+	return store.updateWebAuthnCredential(ctx, `DELETE FROM webauthn_credentials WHERE username = $1 AND id = $2`, username, credentialID)
+}
+
+// updateWebAuthnCredential runs the update or delete of a single credential
+func (store *sqlStore) updateWebAuthnCredential(ctx context.Context, query string, args ...interface{}) error {
+	result, err := store.exec(ctx, query, args...)
+	if err != nil {
+		log.Errorf("sql DB error 10034: %s", err)
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return platform.ErrNotFound
+	}
+	return nil
+}
+
+func scanWebAuthnCredential(row rowScanner) (*models.WebAuthnCredential, error) {
+	var credential models.WebAuthnCredential
+	var transports string
+	var signCount int64
+	err := row.Scan(
+		&credential.ID, &credential.Username, &credential.UserHandle, &credential.Name, &credential.PublicKey,
+		&credential.AttestationType, &transports, &credential.AAGUID, &signCount,
+		&credential.BackupEligible, &credential.BackupState, &credential.CreatedAt, &credential.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if transports != "" {
+		credential.Transports = strings.Split(transports, ",")
+	}
+	credential.SignCount = uint32(signCount)
+	return &credential, nil
+}
+
+// nonNilBytes keeps the NOT NULL binary columns from getting a NULL for a nil slice
+func nonNilBytes(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/2beens/ispend/internal/db/migrations"
+	log "github.com/sirupsen/logrus"
+	// pure Go SQLite driver, no cgo needed
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a SpenderDB stored in a single SQLite file, meant for small single-user installs
+type SQLiteDB struct {
+	sqlClient
+	path        string
+	autoMigrate bool
+}
+
+// NewSQLiteDB creates a client for the SQLite DB file at path, ":memory:" being a fresh DB on each Open
+func NewSQLiteDB(path string, autoMigrate bool) *SQLiteDB {
+	return &SQLiteDB{
+		path:        path,
+		autoMigrate: autoMigrate,
+	}
+}
+
+func (sdb *SQLiteDB) Open() error {
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", "foreign_keys(1)")
+	pragmas.Add("_pragma", "busy_timeout(5000)")
+	if sdb.path != ":memory:" {
+		pragmas.Add("_pragma", "journal_mode(WAL)")
+	}
+
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?%s", sdb.path, pragmas.Encode()))
+	if err != nil {
+		return err
+	}
+
+	// SQLite serializes all the writes anyway, and a single connection avoids
+	// SQLITE_BUSY errors between our own connections (and keeps :memory: DBs alive)
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("cannot open sqlite DB %s: %s", sdb.path, err)
+	}
+	log.Debugf("successfully opened sqlite DB: %s", sdb.path)
+
+	sdb.sqlClient = newSQLClient(db)
+
+	if sdb.autoMigrate {
+		return sdb.migrate()
+	}
+	return nil
+}
+
+func (sdb *SQLiteDB) Close() error {
+	if sdb.db == nil {
+		return errors.New("sqlite DB client is nil, cannot close")
+	}
+	return sdb.close()
+}
+
+// Migrator returns the schema migrator for this client, must be called after Open
+func (sdb *SQLiteDB) Migrator() (*Migrator, error) {
+	if sdb.db == nil {
+		return nil, errors.New("sqlite DB client is not opened, cannot migrate")
+	}
+	return NewMigrator(sdb.db, DialectSQLite, migrations.SQLite())
+}
+
+func (sdb *SQLiteDB) migrate() error {
+	migrator, err := sdb.Migrator()
+	if err != nil {
+		return err
+	}
+	if err := migrator.Up(); err != nil {
+		return fmt.Errorf("sqlite schema migration failed: %s", err)
+	}
+	version, err := migrator.Version()
+	if err != nil {
+		return err
+	}
+	log.Debugf("sqlite schema migrated to version %d", version)
+	return nil
+}
@@ -0,0 +1,113 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLiteDB(t *testing.T) *db.SQLiteDB {
+	sqliteDB := db.NewSQLiteDB(filepath.Join(t.TempDir(), "ispend.db"), true)
+	require.NoError(t, sqliteDB.Open())
+	t.Cleanup(func() {
+		assert.NoError(t, sqliteDB.Close())
+	})
+	return sqliteDB
+}
+
+func TestSQLiteDB_DefaultSpendKinds(t *testing.T) {
+	sqliteDB := newTestSQLiteDB(t)
+
+	spendKinds, err := sqliteDB.GetAllDefaultSpendKinds(context.Background())
+	require.NoError(t, err)
+	require.Len(t, spendKinds, 4)
+	assert.Equal(t, "Travel", spendKinds[0].Name)
+}
+
+func TestSQLiteDB_UsersAndSpends(t *testing.T) {
+	sqliteDB := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	timestamp := time.Date(2019, 10, 10, 12, 0, 0, 0, time.UTC)
+	user := models.NewUser("email1", "user1", "pass1", []models.SpendKind{{Name: "sk1"}, {Name: "sk2"}})
+	user.Spends = append(user.Spends, models.Spending{Currency: "RSD", Amount: 12.5, Kind: &models.SpendKind{Name: "sk2"}, Timestamp: timestamp})
+	_, err := sqliteDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+
+	storedUser, err := sqliteDB.GetUser(ctx, "user1", true)
+	require.NoError(t, err)
+	assert.Equal(t, "email1", storedUser.Email)
+	require.Len(t, storedUser.SpendKinds, 2)
+	require.Len(t, storedUser.Spends, 1)
+	assert.Equal(t, "RSD", storedUser.Spends[0].Currency)
+	assert.Equal(t, float32(12.5), storedUser.Spends[0].Amount)
+	assert.Equal(t, "sk2", storedUser.Spends[0].Kind.Name)
+	assert.Equal(t, storedUser.SpendKinds[1].ID, storedUser.Spends[0].Kind.ID)
+	assert.True(t, timestamp.Equal(storedUser.Spends[0].Timestamp))
+
+	spendKind, err := sqliteDB.GetSpendKind(ctx, "user1", storedUser.SpendKinds[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "sk1", spendKind.Name)
+
+	spendID, err := sqliteDB.StoreSpending(ctx, "user1", models.Spending{Currency: "EUR", Amount: 3, Kind: &models.SpendKind{Name: "new kind"}, Timestamp: timestamp})
+	require.NoError(t, err)
+	spendKinds, err := sqliteDB.GetSpendKinds(ctx, "user1")
+	require.NoError(t, err)
+	assert.Len(t, spendKinds, 3)
+
+	require.NoError(t, sqliteDB.DeleteSpending(ctx, "user1", spendID))
+	spends, err := sqliteDB.GetSpends(ctx, "user1")
+	require.NoError(t, err)
+	assert.Len(t, spends, 1)
+
+	_, err = sqliteDB.GetUser(ctx, "not-existing", false)
+	assert.Equal(t, platform.ErrNotFound, err)
+
+	allUsers, err := sqliteDB.GetAllUsers(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, allUsers, 1)
+	assert.Len(t, allUsers[0].Spends, 1)
+}
+
+func TestSQLiteDB_WithTx_Rollback(t *testing.T) {
+	sqliteDB := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	errAbort := errors.New("abort")
+	err := sqliteDB.WithTx(ctx, func(tx db.SpenderTx) error {
+		if _, err := tx.StoreUser(ctx, models.NewUser("email1", "user1", "pass1", []models.SpendKind{{Name: "sk1"}})); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err)
+
+	_, err = sqliteDB.GetUser(ctx, "user1", false)
+	assert.Equal(t, platform.ErrNotFound, err)
+}
+
+func TestSQLiteDB_PersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ispend.db")
+	ctx := context.Background()
+
+	sqliteDB := db.NewSQLiteDB(path, true)
+	require.NoError(t, sqliteDB.Open())
+	_, err := sqliteDB.StoreUser(ctx, models.NewUser("email1", "user1", "pass1", nil))
+	require.NoError(t, err)
+	require.NoError(t, sqliteDB.Close())
+
+	sqliteDB = db.NewSQLiteDB(path, true)
+	require.NoError(t, sqliteDB.Open())
+	defer sqliteDB.Close()
+	user, err := sqliteDB.GetUser(ctx, "user1", false)
+	require.NoError(t, err)
+	assert.Equal(t, "email1", user.Email)
+}
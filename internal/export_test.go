@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// RouterSetup sets up the router of the server as Serve does, so the tests can send it requests
+func (s *Server) RouterSetup(chInterrupt chan models.Signal, baseURL string) *mux.Router {
+	return s.routerSetup(s.dbClient, s.graphiteClient, chInterrupt, baseURL)
+}
+
+// DBClient gives the tests the stored users, to look for their secrets in the responses
+func (s *Server) DBClient() db.SpenderDB {
+	return s.dbClient
+}
+
+// SetDBClient replaces the client the routers set up afterwards use, so the tests can watch the calls to it
+func (s *Server) SetDBClient(dbClient db.SpenderDB) {
+	s.dbClient = dbClient
+}
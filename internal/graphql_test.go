@@ -0,0 +1,276 @@
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type graphQLResult struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string `json:"message"`
+		Extensions struct {
+			Code   string              `json:"code"`
+			Fields []models.FieldError `json:"fields"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// graphQL runs the query with the variables, and decodes the response of the status
+func (rt *routesTest) graphQL(t *testing.T, query string, variables map[string]interface{}, cookies []*http.Cookie, status int) graphQLResult {
+	rec := rt.sendJSON("POST", "/graphql", map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	}, cookies, "")
+	require.Equal(t, status, rec.Code, rec.Body.String())
+	var result graphQLResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	return result
+}
+
+// countingDB counts the loads of the spends and spend kinds, to see they are batched
+type countingDB struct {
+	db.SpenderDB
+	spendsLoads     atomic.Int32
+	spendKindsLoads atomic.Int32
+}
+
+func (c *countingDB) GetSpendsOfUsers(ctx context.Context, usernames []string) (map[string][]models.Spending, error) {
+	c.spendsLoads.Add(1)
+	return c.SpenderDB.GetSpendsOfUsers(ctx, usernames)
+}
+
+func (c *countingDB) GetSpendKindsOfUsers(ctx context.Context, usernames []string) (map[string][]models.SpendKind, error) {
+	c.spendKindsLoads.Add(1)
+	return c.SpenderDB.GetSpendKindsOfUsers(ctx, usernames)
+}
+
+func TestGraphQL_SpendsAndTotals(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+	rt.register(t, "walker", "walkerpass123")
+	cookies := rt.login(t, "walker", "walkerpass123")
+
+	result := rt.graphQL(t, `{ me { username spendKinds { id name } } }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+	var me struct {
+		Me struct {
+			Username   string
+			SpendKinds []models.SpendKindDTO
+		}
+	}
+	require.NoError(t, json.Unmarshal(result.Data, &me))
+	assert.Equal(t, "walker", me.Me.Username)
+	require.GreaterOrEqual(t, len(me.Me.SpendKinds), 2)
+	food, other := me.Me.SpendKinds[0].ID, me.Me.SpendKinds[1].ID
+
+	addSpending := `mutation($currency: String!, $amount: Float!, $kindId: Int!, $date: String) {
+		addSpending(currency: $currency, amount: $amount, kindId: $kindId, date: $date) { id amount kind { id } }
+	}`
+	for _, spending := range []map[string]interface{}{
+		{"currency": "EUR", "amount": 10, "kindId": food, "date": "2026-01-01"},
+		{"currency": "EUR", "amount": 2.5, "kindId": food, "date": "2026-01-02"},
+		{"currency": "USD", "amount": 4, "kindId": food, "date": "2026-01-03"},
+		{"currency": "EUR", "amount": 7, "kindId": other, "date": "2026-02-01"},
+	} {
+		result = rt.graphQL(t, addSpending, spending, cookies, http.StatusOK)
+		require.Empty(t, result.Errors)
+	}
+
+	result = rt.graphQL(t, `{ me {
+		spends(first: 2, offset: 1) { amount currency }
+		january: spends(to: "2026-01-31") { amount }
+		totals { kind { id } currency total count }
+		februaryTotals: totals(from: "2026-02-01") { total }
+	} }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+	var data struct {
+		Me struct {
+			Spends []struct {
+				Amount   float64
+				Currency string
+			}
+			January []struct{ Amount float64 }
+			Totals  []struct {
+				Kind     struct{ ID int }
+				Currency string
+				Total    float64
+				Count    int
+			}
+			FebruaryTotals []struct{ Total float64 }
+		}
+	}
+	require.NoError(t, json.Unmarshal(result.Data, &data))
+	require.Len(t, data.Me.Spends, 2)
+	assert.Equal(t, 2.5, data.Me.Spends[0].Amount)
+	assert.Equal(t, "USD", data.Me.Spends[1].Currency)
+	assert.Len(t, data.Me.January, 3)
+	require.Len(t, data.Me.Totals, 3)
+	assert.Equal(t, food, data.Me.Totals[0].Kind.ID)
+	assert.Equal(t, "EUR", data.Me.Totals[0].Currency)
+	assert.Equal(t, 12.5, data.Me.Totals[0].Total)
+	assert.Equal(t, 2, data.Me.Totals[0].Count)
+	assert.Equal(t, "USD", data.Me.Totals[1].Currency)
+	assert.Equal(t, other, data.Me.Totals[2].Kind.ID)
+	require.Len(t, data.Me.FebruaryTotals, 1)
+	assert.Equal(t, 7.0, data.Me.FebruaryTotals[0].Total)
+
+	// the arguments are validated as the requests of the other routes are
+	result = rt.graphQL(t, addSpending, map[string]interface{}{"currency": "EURO", "amount": -1, "kindId": 999}, cookies, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "BAD_USER_INPUT", result.Errors[0].Extensions.Code)
+	assert.ElementsMatch(t, []string{"currency", "amount"}, fieldsOf(result.Errors[0].Extensions.Fields))
+	result = rt.graphQL(t, addSpending, map[string]interface{}{"currency": "EUR", "amount": 1, "kindId": 999}, cookies, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, []string{"kindId"}, fieldsOf(result.Errors[0].Extensions.Fields))
+	result = rt.graphQL(t, `{ me { spends(from: "yesterday") { id } } }`, nil, cookies, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, []string{"from"}, fieldsOf(result.Errors[0].Extensions.Fields))
+
+	result = rt.graphQL(t, `mutation { deleteSpending(id: "missing") }`, nil, cookies, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "NOT_FOUND", result.Errors[0].Extensions.Code)
+}
+
+func TestGraphQL_UsersAreBatched(t *testing.T) {
+	rt, server := newRoutesTest(t)
+	for _, username := range []string{"walker", "runner", "swimmer"} {
+		rt.register(t, username, username+"pass123")
+	}
+	counting := &countingDB{SpenderDB: server.DBClient()}
+	server.SetDBClient(counting)
+	rt.router = server.RouterSetup(make(chan models.Signal, 1), "http://localhost:8080")
+
+	// the users may only read their own data
+	cookies := rt.login(t, "walker", "walkerpass123")
+	result := rt.graphQL(t, `{ users { username } }`, nil, cookies, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "FORBIDDEN", result.Errors[0].Extensions.Code)
+	result = rt.graphQL(t, `{ me { sessions { current } } }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+	assert.JSONEq(t, `{"me": {"sessions": [{"current": true}]}}`, string(result.Data))
+
+	cookies = rt.login(t, "ispend-admin", "adminpass123")
+	result = rt.graphQL(t, `{ users(first: 10) { username spends(first: 10) { id } spendKinds { id } totals { total } } }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+	var data struct {
+		Users []struct {
+			Username   string
+			SpendKinds []models.SpendKindDTO
+		}
+	}
+	require.NoError(t, json.Unmarshal(result.Data, &data))
+	var usernames []string
+	for _, user := range data.Users {
+		usernames = append(usernames, user.Username)
+		assert.NotEmpty(t, user.SpendKinds, user.Username)
+	}
+	assert.Subset(t, usernames, []string{"ispend-admin", "walker", "runner", "swimmer"})
+	// one load for all the users, shared by the spends and the totals
+	assert.Equal(t, int32(1), counting.spendsLoads.Load())
+	assert.Equal(t, int32(1), counting.spendKindsLoads.Load())
+
+	result = rt.graphQL(t, `{ user(username: "nobody") { username } }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+	assert.JSONEq(t, `{"user": null}`, string(result.Data))
+	result = rt.graphQL(t, `{ user(username: "walker") { sessions { id } } }`, nil, cookies, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "FORBIDDEN", result.Errors[0].Extensions.Code)
+
+	result = rt.graphQL(t, `mutation { setRole(username: "walker", role: "read-only") { role } }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+	assert.JSONEq(t, `{"setRole": {"role": "read-only"}}`, string(result.Data))
+	result = rt.graphQL(t, `mutation { setRole(username: "ispend-admin", role: "user") { role } }`, nil, cookies, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "FORBIDDEN", result.Errors[0].Extensions.Code)
+}
+
+func TestGraphQL_Limits(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+	cookies := rt.login(t, "ispend-admin", "adminpass123")
+
+	// 1 + 1000 * (1 + 10 * 2) is over the complexity limit
+	result := rt.graphQL(t, `{ users(first: 1000) { spends(first: 10) { id amount } } }`, nil, cookies, http.StatusBadRequest)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "QUERY_TOO_COMPLEX", result.Errors[0].Extensions.Code)
+	assert.Nil(t, result.Data)
+	result = rt.graphQL(t, `query($first: Int) { users(first: $first) { spends(first: 10) { id } } }`,
+		map[string]interface{}{"first": 1000}, cookies, http.StatusBadRequest)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "QUERY_TOO_COMPLEX", result.Errors[0].Extensions.Code)
+	result = rt.graphQL(t, `{ users(first: 5) { spends(first: 10) { id } } }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+
+	// the fragments count as the fields they spread
+	result = rt.graphQL(t, `{ users(first: 100) { ...spends } } fragment spends on User { spends { id } }`, nil, cookies, http.StatusBadRequest)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "QUERY_TOO_COMPLEX", result.Errors[0].Extensions.Code)
+
+	// the introspection is free, and no field gives away the secrets
+	result = rt.graphQL(t, `{ __schema { types { name fields { name } } } }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+	schema := strings.ToLower(string(result.Data))
+	for _, secret := range []string{"password", "hash", "totp", "token"} {
+		assert.NotContains(t, schema, `"name":"`+secret, secret)
+	}
+
+	result = rt.graphQL(t, `{ me { nope } }`, nil, cookies, http.StatusBadRequest)
+	require.Len(t, result.Errors, 1)
+	result = rt.graphQL(t, `{ me { `, nil, cookies, http.StatusBadRequest)
+	require.Len(t, result.Errors, 1)
+}
+
+func TestGraphQL_Auth(t *testing.T) {
+	rt, _ := newRoutesTest(t)
+
+	result := rt.graphQL(t, `{ me { username } }`, nil, nil, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "UNAUTHENTICATED", result.Errors[0].Extensions.Code)
+
+	// registering needs no login, and the password policy is kept
+	register := `mutation($password: String!) { register(username: "walker", email: "walker@example.com", password: $password) { username emailVerified } }`
+	result = rt.graphQL(t, register, map[string]interface{}{"password": "short"}, nil, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, []string{"password"}, fieldsOf(result.Errors[0].Extensions.Fields))
+	result = rt.graphQL(t, register, map[string]interface{}{"password": "walkerpass123"}, nil, http.StatusOK)
+	require.Empty(t, result.Errors)
+	assert.JSONEq(t, `{"register": {"username": "walker", "emailVerified": false}}`, string(result.Data))
+	result = rt.graphQL(t, register, map[string]interface{}{"password": "walkerpass123"}, nil, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "CONFLICT", result.Errors[0].Extensions.Code)
+
+	// the cookies need the CSRF token, as on the other routes
+	cookies := rt.login(t, "walker", "walkerpass123")
+	var sessionCookies []*http.Cookie
+	for _, cookie := range cookies {
+		if cookie.Name != platform.CSRFCookieName {
+			sessionCookies = append(sessionCookies, cookie)
+		}
+	}
+	result = rt.graphQL(t, `{ me { username } }`, nil, sessionCookies, http.StatusForbidden)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "FORBIDDEN", result.Errors[0].Extensions.Code)
+
+	result = rt.graphQL(t, `mutation { deleteAccount(password: "wrongpass123") }`, nil, cookies, http.StatusOK)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "FORBIDDEN", result.Errors[0].Extensions.Code)
+	result = rt.graphQL(t, `mutation { deleteAccount(password: "walkerpass123") }`, nil, cookies, http.StatusOK)
+	require.Empty(t, result.Errors)
+	assert.JSONEq(t, `{"deleteAccount": true}`, string(result.Data))
+
+	req := httptest.NewRequest("GET", "/graphql", nil)
+	rec := httptest.NewRecorder()
+	rt.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "POST", rec.Header().Get("Allow"))
+}
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// APIV1Prefix is where the /api/v1 API is mounted
+const APIV1Prefix = "/api/v1"
+
+const maxJSONBodySize = 64 * 1024
+
+// APIV1Handler is the versioned JSON REST API. Unlike the older routes, it takes JSON request bodies, answers
+// with the HTTP status codes and the RFC 7807 problem details instead of the models.APIResponse envelope,
+// and has the user's own resources under /me, rather than under its username in the path.
+// Its OpenAPI document is generated from the same operations the routes are set up with.
+type APIV1Handler struct {
+	usersService        *services.UsersService
+	accountService      *services.AccountService
+	loginThrottler      *services.LoginThrottler
+	loginSessionManager *platform.LoginSessionManager
+	secureCookies       bool
+	operations          []platform.APIOperation
+	openAPIDocument     *platform.OpenAPIDocument
+}
+
+func APIV1HandlerSetup(
+	router *mux.Router,
+	usersService *services.UsersService,
+	accountService *services.AccountService,
+	loginThrottler *services.LoginThrottler,
+	loginSessionManager *platform.LoginSessionManager,
+	secureCookies bool,
+) {
+	handler := &APIV1Handler{
+		usersService:        usersService,
+		accountService:      accountService,
+		loginThrottler:      loginThrottler,
+		loginSessionManager: loginSessionManager,
+		secureCookies:       secureCookies,
+	}
+
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/openapi.json", Tag: "meta", Summary: "Get this OpenAPI document",
+		Response: map[string]interface{}{}, Status: http.StatusOK,
+	}, handler.handleGetOpenAPI)
+
+	handler.route(router, platform.APIOperation{
+		Method: "POST", Path: "/users", Tag: "users", Summary: "Register a new user",
+		Request: newUserRequest{}, Response: models.UserDTO{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusConflict, http.StatusUnsupportedMediaType, http.StatusServiceUnavailable},
+	}, handler.handleRegister)
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/users", Tag: "users", Summary: "List all the users",
+		Authenticated: true, Permission: platform.PermManageUsers,
+		Response: []models.UserDTO{}, Status: http.StatusOK,
+	}, handler.handleGetUsers)
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/users/{username}", Tag: "users", Summary: "Get a user",
+		Authenticated: true, Permission: platform.PermManageUsers,
+		Response: models.UserDTO{}, Status: http.StatusOK, Errors: []int{http.StatusNotFound},
+	}, handler.handleGetUser)
+	handler.route(router, platform.APIOperation{
+		Method: "PUT", Path: "/users/{username}/role", Tag: "users", Summary: "Set the role of a user",
+		Authenticated: true, Permission: platform.PermManageUsers,
+		Request: setRoleRequest{}, Status: http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusUnsupportedMediaType},
+	}, handler.handleSetRole)
+
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/me", Tag: "account", Summary: "Get the logged in user",
+		Authenticated: true, Response: models.UserDTO{}, Status: http.StatusOK,
+	}, handler.handleGetMe)
+	handler.route(router, platform.APIOperation{
+		Method: "DELETE", Path: "/me", Tag: "account", Summary: "Delete the account with all its data",
+		Authenticated: true, Permission: platform.PermManageOwnAccount,
+		Request: passwordRequest{}, Status: http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusTooManyRequests, http.StatusUnsupportedMediaType, http.StatusServiceUnavailable},
+	}, handler.handleDeleteMe)
+	handler.route(router, platform.APIOperation{
+		Method: "PATCH", Path: "/me/profile", Tag: "account", Summary: "Change the profile settings sent, keep the others",
+		Authenticated: true, Permission: platform.PermManageOwnAccount,
+		Request: updateProfileRequest{}, Response: models.UserProfile{}, Status: http.StatusOK,
+		Errors: []int{http.StatusBadRequest, http.StatusUnsupportedMediaType},
+	}, handler.handleUpdateProfile)
+	handler.route(router, platform.APIOperation{
+		Method: "PUT", Path: "/me/email", Tag: "account", Summary: "Change the email address, it has to be verified again",
+		Authenticated: true, Permission: platform.PermManageOwnAccount,
+		Request: changeEmailRequest{}, Status: http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusConflict, http.StatusTooManyRequests, http.StatusUnsupportedMediaType, http.StatusServiceUnavailable},
+	}, handler.handleChangeEmail)
+	handler.route(router, platform.APIOperation{
+		Method: "POST", Path: "/me/email/verification", Tag: "account", Summary: "Mail a new email verification link",
+		Authenticated: true, Permission: platform.PermManageOwnAccount,
+		Status: http.StatusAccepted, Errors: []int{http.StatusConflict},
+	}, handler.handleResendVerification)
+	handler.route(router, platform.APIOperation{
+		Method: "PUT", Path: "/me/password", Tag: "account", Summary: "Change the password, ending all the other sessions and tokens",
+		Authenticated: true, Permission: platform.PermManageOwnAccount,
+		Request: changePasswordRequest{}, Status: http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusTooManyRequests, http.StatusUnsupportedMediaType, http.StatusServiceUnavailable},
+	}, handler.handleChangePassword)
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/me/sessions", Tag: "account", Summary: "List the login sessions",
+		Authenticated: true, Permission: platform.PermManageOwnAccount,
+		Response: []models.LoginSessionDTO{}, Status: http.StatusOK,
+	}, handler.handleGetSessions)
+	handler.route(router, platform.APIOperation{
+		Method: "DELETE", Path: "/me/sessions", Tag: "account", Summary: "End all the login sessions but the current one",
+		Authenticated: true, Permission: platform.PermManageOwnAccount,
+		Response: revokedSessionsResponse{}, Status: http.StatusOK,
+	}, handler.handleRevokeOtherSessions)
+	handler.route(router, platform.APIOperation{
+		Method: "DELETE", Path: "/me/sessions/{id}", Tag: "account", Summary: "End a login session",
+		Authenticated: true, Permission: platform.PermManageOwnAccount,
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound},
+	}, handler.handleRevokeSession)
+
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/me/spends", Tag: "spends", Summary: "List the spends",
+		Authenticated: true, Permission: platform.PermReadOwnData,
+		Response: []models.SpendingDTO{}, Status: http.StatusOK,
+	}, handler.handleGetSpends)
+	handler.route(router, platform.APIOperation{
+		Method: "POST", Path: "/me/spends", Tag: "spends", Summary: "Add a spending",
+		Authenticated: true, Permission: platform.PermWriteOwnData,
+		Request: newSpendingRequest{}, Response: models.SpendingDTO{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusUnsupportedMediaType},
+	}, handler.handleNewSpending)
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/me/spends/{id}", Tag: "spends", Summary: "Get a spending",
+		Authenticated: true, Permission: platform.PermReadOwnData,
+		Response: models.SpendingDTO{}, Status: http.StatusOK, Errors: []int{http.StatusNotFound},
+	}, handler.handleGetSpending)
+	handler.route(router, platform.APIOperation{
+		Method: "DELETE", Path: "/me/spends/{id}", Tag: "spends", Summary: "Delete a spending",
+		Authenticated: true, Permission: platform.PermWriteOwnData,
+		Status: http.StatusNoContent, Errors: []int{http.StatusNotFound},
+	}, handler.handleDeleteSpending)
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/me/spend-kinds", Tag: "spends", Summary: "List the spend kinds of the user",
+		Authenticated: true, Permission: platform.PermReadOwnData,
+		Response: []models.SpendKindDTO{}, Status: http.StatusOK,
+	}, handler.handleGetSpendKinds)
+	handler.route(router, platform.APIOperation{
+		Method: "GET", Path: "/spend-kinds", Tag: "spends", Summary: "List the default spend kinds, the new users start with",
+		Authenticated: true, Response: []models.SpendKindDTO{}, Status: http.StatusOK,
+	}, handler.handleGetDefaultSpendKinds)
+
+	handler.openAPIDocument = platform.NewOpenAPIDocument(platform.OpenAPIInfo{
+		Title:   "iSpend API",
+		Version: "1",
+		Description: "Log in with a session cookie from POST /users/login, or get a bearer access token from " +
+			"POST /oauth/token. The errors are RFC 7807 problem details.",
+	}, APIV1Prefix, "/oauth/token", handler.operations)
+
+	// the subrouter's MethodNotAllowedHandler is lost on the way up to the main router (mux v1.7.3),
+	// so the other methods of every path get a route of their own, after the ones of the operations
+	var paths []string
+	allowedMethods := make(map[string][]string)
+	for _, op := range handler.operations {
+		if allowedMethods[op.Path] == nil {
+			paths = append(paths, op.Path)
+		}
+		allowedMethods[op.Path] = append(allowedMethods[op.Path], op.Method)
+	}
+	for _, path := range paths {
+		allow := strings.Join(allowedMethods[path], ", ")
+		router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", allow)
+			platform.SendProblem(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		})
+	}
+
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		platform.SendProblem(w, r, http.StatusNotFound, "unknown path")
+	})
+}
+
+// route sets up the handler of the operation, behind the login and permission the operation needs
+func (handler *APIV1Handler) route(router *mux.Router, op platform.APIOperation, next http.HandlerFunc) {
+	handler.operations = append(handler.operations, op)
+	router.HandleFunc(op.Path, handler.authorize(op, next)).Methods(op.Method)
+}
+
+func (handler *APIV1Handler) authorize(op platform.APIOperation, next http.HandlerFunc) http.HandlerFunc {
+	if !op.Authenticated {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principal(r)
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ispend"`)
+			platform.SendProblem(w, r, http.StatusUnauthorized, "must be logged in")
+			return
+		}
+		if op.Permission != "" && !p.Can(op.Permission) {
+			platform.SendProblem(w, r, http.StatusForbidden, "missing permission "+string(op.Permission))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (handler *APIV1Handler) handleGetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	platform.SendJSON(w, http.StatusOK, handler.openAPIDocument)
+}
+
+// bindJSON decodes the JSON request body into the request and validates it, or answers the request with
+// the problem and returns false
+func bindJSON(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		platform.SendProblem(w, r, http.StatusUnsupportedMediaType, "the request body has to be application/json")
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		switch err := err.(type) {
+		case *http.MaxBytesError:
+			platform.SendProblem(w, r, http.StatusRequestEntityTooLarge, "the request body is too large")
+		case *json.UnmarshalTypeError:
+			platform.SendValidationProblem(w, r, platform.ValidationErrors{platform.InvalidTypeError(err.Field, err.Type)})
+		default:
+			platform.SendProblem(w, r, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		}
+		return false
+	}
+	if decoder.Decode(&struct{}{}) != io.EOF {
+		platform.SendProblem(w, r, http.StatusBadRequest, "the request body has to hold a single JSON object")
+		return false
+	}
+
+	if errs := validateRequest(req); errs != nil {
+		platform.SendValidationProblem(w, r, errs)
+		return false
+	}
+	return true
+}
+
+// sendInternalError logs the error and answers with its code, which the user can report
+func sendInternalError(w http.ResponseWriter, r *http.Request, errorCode string, err error) {
+	log.Errorf("api v1 [%s %s], error %s: %s", r.Method, r.URL.Path, errorCode, err)
+	platform.SendProblem(w, r, http.StatusInternalServerError, "internal server error "+errorCode)
+}
+
+// sendPasswordHasherBusyProblem is sendPasswordHasherBusy answering with the problem details
+func sendPasswordHasherBusyProblem(w http.ResponseWriter, r *http.Request) {
+	setRetryAfter(w, passwordHasherRetryAfter)
+	platform.SendProblem(w, r, http.StatusServiceUnavailable, platform.ErrPasswordHasherBusy.Error())
+}
+
+// checkThrottle is checkLoginThrottle answering with the problem details
+func (handler *APIV1Handler) checkThrottle(w http.ResponseWriter, r *http.Request, username string) bool {
+	wait, err := handler.loginThrottler.Check(r.Context(), username, platform.RequestIP(r))
+	if err != nil {
+		sendInternalError(w, r, "109071", err)
+		return false
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		platform.SendProblem(w, r, http.StatusTooManyRequests, "too many failed logins, try again later")
+		return false
+	}
+	return true
+}
+
+// legacyRoutesDeprecatedAt is when the older routes got deprecated, in favor of /api/v1
+var legacyRoutesDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// legacyRouteSuccessors maps the older routes, by method and route template, to their /api/v1 successors;
+// the route variables of the successors come from the older routes
+var legacyRouteSuccessors = map[string]string{
+	"GET /users":                             APIV1Prefix + "/users",
+	"POST /users":                            APIV1Prefix + "/users",
+	"GET /users/me":                          APIV1Prefix + "/me",
+	"POST /users/verify-email":               APIV1Prefix + "/me/email/verification",
+	"GET /users/{username}/sessions":         APIV1Prefix + "/me/sessions",
+	"DELETE /users/{username}/sessions":      APIV1Prefix + "/me/sessions",
+	"DELETE /users/{username}/sessions/{id}": APIV1Prefix + "/me/sessions/{id}",
+	"PUT /users/{username}/role":             APIV1Prefix + "/users/{username}/role",
+	"PATCH /users/{username}/profile":        APIV1Prefix + "/me/profile",
+	"PUT /users/{username}/email":            APIV1Prefix + "/me/email",
+	"PUT /users/{username}/password":         APIV1Prefix + "/me/password",
+	"GET /users/{username}":                  APIV1Prefix + "/me",
+	"DELETE /users/{username}":               APIV1Prefix + "/me",
+	"POST /spending":                         APIV1Prefix + "/me/spends",
+	"DELETE /spending/{username}/{spendID}":  APIV1Prefix + "/me/spends/{spendID}",
+	"GET /spending/id/{id}/{username}":       APIV1Prefix + "/me/spends/{id}",
+	"GET /spending/all/{username}":           APIV1Prefix + "/me/spends",
+	"GET /spending/kind":                     APIV1Prefix + "/spend-kinds",
+	"GET /spending/kind/{username}":          APIV1Prefix + "/me/spend-kinds",
+}
+
+var routeVarRegex = regexp.MustCompile(`\{([^}:]+)(:[^}]+)?\}`)
+
+// DeprecateLegacyRoutes marks the responses of the older routes having an /api/v1 successor with the
+// Deprecation header of RFC 9745, and links the successor, so the clients know where to move on to;
+// the older routes keep working as they did
+func DeprecateLegacyRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				if successor, ok := legacyRouteSuccessors[r.Method+" "+template]; ok {
+					vars := mux.Vars(r)
+					successor = routeVarRegex.ReplaceAllStringFunc(successor, func(v string) string {
+						return url.PathEscape(vars[routeVarRegex.FindStringSubmatch(v)[1]])
+					})
+					w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyRoutesDeprecatedAt.Unix(), 10))
+					w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
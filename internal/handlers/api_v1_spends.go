@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/gorilla/mux"
+)
+
+func (handler *APIV1Handler) handleGetSpends(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.usersService.GetUser(r.Context(), principal(r).Username)
+	if err != nil {
+		sendInternalError(w, r, "109111", err)
+		return
+	}
+	platform.SendJSON(w, http.StatusOK, models.NewSpendingDTOs(user.Spends))
+}
+
+func (handler *APIV1Handler) handleNewSpending(w http.ResponseWriter, r *http.Request) {
+	var req newSpendingRequest
+	if !bindJSON(w, r, &req) {
+		return
+	}
+
+	username := principal(r).Username
+	spendKind, err := handler.usersService.GetSpendKind(r.Context(), username, req.KindID)
+	if err == platform.ErrNotFound {
+		platform.SendValidationProblem(w, r, unknownSpendKindErrors)
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109112", err)
+		return
+	}
+	user, err := handler.usersService.GetUser(r.Context(), username)
+	if err != nil {
+		sendInternalError(w, r, "109113", err)
+		return
+	}
+
+	spending := models.Spending{
+		Currency:  req.Currency,
+		Amount:    req.Amount,
+		Kind:      spendKind,
+		Timestamp: req.timestamp(time.Now()),
+	}
+	if err := handler.usersService.StoreSpending(r.Context(), user, &spending); err != nil {
+		sendInternalError(w, r, "109114", err)
+		return
+	}
+
+	w.Header().Set("Location", APIV1Prefix+"/me/spends/"+spending.ID)
+	platform.SendJSON(w, http.StatusCreated, models.NewSpendingDTO(&spending))
+}
+
+func (handler *APIV1Handler) handleGetSpending(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.usersService.GetUser(r.Context(), principal(r).Username)
+	if err != nil {
+		sendInternalError(w, r, "109115", err)
+		return
+	}
+
+	spendID := mux.Vars(r)["id"]
+	for i := range user.Spends {
+		if user.Spends[i].ID == spendID {
+			platform.SendJSON(w, http.StatusOK, models.NewSpendingDTO(&user.Spends[i]))
+			return
+		}
+	}
+	platform.SendProblem(w, r, http.StatusNotFound, "spending not found")
+}
+
+func (handler *APIV1Handler) handleDeleteSpending(w http.ResponseWriter, r *http.Request) {
+	err := handler.usersService.DeleteSpending(r.Context(), principal(r).Username, mux.Vars(r)["id"])
+	if err == platform.ErrNotFound {
+		platform.SendProblem(w, r, http.StatusNotFound, "spending not found")
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109116", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *APIV1Handler) handleGetSpendKinds(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.usersService.GetUser(r.Context(), principal(r).Username)
+	if err != nil {
+		sendInternalError(w, r, "109117", err)
+		return
+	}
+	platform.SendJSON(w, http.StatusOK, models.NewSpendKindDTOs(user.SpendKinds))
+}
+
+func (handler *APIV1Handler) handleGetDefaultSpendKinds(w http.ResponseWriter, r *http.Request) {
+	spendKinds, err := handler.usersService.GetAllDefaultSpendKinds(r.Context())
+	if err != nil {
+		sendInternalError(w, r, "109118", err)
+		return
+	}
+	platform.SendJSON(w, http.StatusOK, models.NewSpendKindDTOs(spendKinds))
+}
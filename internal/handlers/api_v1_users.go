@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+type revokedSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+func (handler *APIV1Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req newUserRequest
+	if !bindJSON(w, r, &req) {
+		return
+	}
+
+	user, err := handler.accountService.Register(r.Context(), req.Username, req.Email, req.Password)
+	if platform.IsPasswordPolicyError(err) {
+		platform.SendValidationProblem(w, r, passwordPolicyErrors("password", err))
+		return
+	}
+	if err == platform.ErrAlreadyExists {
+		platform.SendProblem(w, r, http.StatusConflict, "the username or the email is taken")
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusyProblem(w, r)
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109091", err)
+		return
+	}
+
+	w.Header().Set("Location", APIV1Prefix+"/users/"+user.Username)
+	platform.SendJSON(w, http.StatusCreated, models.NewUserDTO(user))
+}
+
+func (handler *APIV1Handler) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := handler.usersService.GetAllUsers(r.Context())
+	if err != nil {
+		sendInternalError(w, r, "109092", err)
+		return
+	}
+	userDTOs := make([]models.UserDTO, 0, len(users))
+	for _, user := range users {
+		userDTOs = append(userDTOs, models.NewUserDTO(user))
+	}
+	platform.SendJSON(w, http.StatusOK, userDTOs)
+}
+
+func (handler *APIV1Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.usersService.GetUser(r.Context(), mux.Vars(r)["username"])
+	if err == platform.ErrNotFound {
+		platform.SendProblem(w, r, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109093", err)
+		return
+	}
+	platform.SendJSON(w, http.StatusOK, models.NewUserDTO(user))
+}
+
+func (handler *APIV1Handler) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	var req setRoleRequest
+	if !bindJSON(w, r, &req) {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	// an admin demoting themselves by mistake could leave no admin at all
+	if username == principal(r).Username {
+		platform.SendProblem(w, r, http.StatusForbidden, "cannot change your own role")
+		return
+	}
+
+	err := handler.usersService.SetRole(r.Context(), username, req.Role)
+	if err == platform.ErrInvalidRole {
+		platform.SendProblem(w, r, http.StatusBadRequest, "invalid role: "+req.Role)
+		return
+	}
+	if err == platform.ErrNotFound {
+		platform.SendProblem(w, r, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109094", err)
+		return
+	}
+
+	log.Infof("user [%s] role set to [%s] by [%s]", username, req.Role, principal(r).Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *APIV1Handler) handleGetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.usersService.GetUser(r.Context(), principal(r).Username)
+	if err != nil {
+		sendInternalError(w, r, "109095", err)
+		return
+	}
+	platform.SendJSON(w, http.StatusOK, models.NewUserDTO(user))
+}
+
+func (handler *APIV1Handler) handleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	var req passwordRequest
+	if !bindJSON(w, r, &req) {
+		return
+	}
+
+	p := principal(r)
+	// the last admin deleting itself would leave no admin at all
+	if p.Role == models.RoleAdmin {
+		platform.SendProblem(w, r, http.StatusForbidden, "an admin cannot delete its own account, another admin has to demote it first")
+		return
+	}
+	if !handler.checkThrottle(w, r, p.Username) {
+		return
+	}
+	err := handler.accountService.DeleteAccount(r.Context(), p.Username, req.Password)
+	if err == platform.ErrWrongPassword {
+		loginFailed(r.Context(), handler.loginThrottler, p.Username, platform.RequestIP(r))
+		platform.SendProblem(w, r, http.StatusForbidden, "wrong password")
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusyProblem(w, r)
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109096", err)
+		return
+	}
+
+	clearSessionCookies(w, handler.secureCookies)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *APIV1Handler) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var req updateProfileRequest
+	if !bindJSON(w, r, &req) {
+		return
+	}
+
+	username := principal(r).Username
+	user, err := handler.usersService.GetUser(r.Context(), username)
+	if err != nil {
+		sendInternalError(w, r, "109097", err)
+		return
+	}
+
+	profile := req.apply(user.Profile)
+	err = handler.usersService.UpdateProfile(r.Context(), username, profile)
+	if isProfileError(err) {
+		platform.SendProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109098", err)
+		return
+	}
+	platform.SendJSON(w, http.StatusOK, profile)
+}
+
+func (handler *APIV1Handler) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var req changeEmailRequest
+	if !bindJSON(w, r, &req) {
+		return
+	}
+
+	username := principal(r).Username
+	if !handler.checkThrottle(w, r, username) {
+		return
+	}
+	err := handler.accountService.ChangeEmail(r.Context(), username, req.Password, req.Email)
+	if err == platform.ErrWrongPassword {
+		loginFailed(r.Context(), handler.loginThrottler, username, platform.RequestIP(r))
+		platform.SendProblem(w, r, http.StatusForbidden, "wrong password")
+		return
+	}
+	if err == platform.ErrAlreadyExists {
+		platform.SendProblem(w, r, http.StatusConflict, "the email is used by another account")
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusyProblem(w, r)
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109099", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *APIV1Handler) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	err := handler.accountService.SendVerificationEmail(r.Context(), principal(r).Username)
+	if err == platform.ErrEmailAlreadyVerified {
+		platform.SendProblem(w, r, http.StatusConflict, "email already verified")
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109100", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (handler *APIV1Handler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+	if !bindJSON(w, r, &req) {
+		return
+	}
+
+	username := principal(r).Username
+	if !handler.checkThrottle(w, r, username) {
+		return
+	}
+	// the session of the request stays, if it came with one, the other ones and all the API tokens end
+	err := handler.accountService.ChangePassword(r.Context(), username, req.OldPassword, req.NewPassword, platform.SessionIDFromRequest(r))
+	if err == platform.ErrWrongPassword {
+		loginFailed(r.Context(), handler.loginThrottler, username, platform.RequestIP(r))
+		platform.SendProblem(w, r, http.StatusForbidden, "wrong password")
+		return
+	}
+	if platform.IsPasswordPolicyError(err) {
+		platform.SendValidationProblem(w, r, passwordPolicyErrors("new_password", err))
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusyProblem(w, r)
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109101", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *APIV1Handler) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	p := principal(r)
+	sessions, err := handler.loginSessionManager.GetAllByUsername(r.Context(), p.Username)
+	if err != nil {
+		sendInternalError(w, r, "109102", err)
+		return
+	}
+	platform.SendJSON(w, http.StatusOK, newLoginSessionDTOs(sessions, p.Session))
+}
+
+func (handler *APIV1Handler) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	revoked, err := handler.loginSessionManager.RemoveOthers(r.Context(), principal(r).Username, platform.SessionIDFromRequest(r))
+	if err != nil {
+		sendInternalError(w, r, "109103", err)
+		return
+	}
+	platform.SendJSON(w, http.StatusOK, revokedSessionsResponse{Revoked: revoked})
+}
+
+func (handler *APIV1Handler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	err := handler.loginSessionManager.RemoveByPublicID(r.Context(), principal(r).Username, mux.Vars(r)["id"])
+	if err == platform.ErrNotFound {
+		platform.SendProblem(w, r, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		sendInternalError(w, r, "109104", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
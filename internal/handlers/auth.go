@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// principal returns who the request is authenticated as, never nil behind requireLogin
+func principal(r *http.Request) *platform.Principal {
+	return platform.PrincipalFromContext(r.Context())
+}
+
+// requireLogin lets only authenticated requests through
+func requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principal(r) == nil {
+			platform.SendAPIErrorResp(w, "must be logged in", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requirePermission lets through only the requests authenticated as a user whose role grants the permission
+func requirePermission(permission platform.Permission, next http.HandlerFunc) http.HandlerFunc {
+	return requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if !principal(r).Can(permission) {
+			platform.SendAPIErrorResp(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireOwner lets through only the requests authenticated as the user from the {username} route
+// variable, with a role granting the permission
+func requireOwner(permission platform.Permission, next http.HandlerFunc) http.HandlerFunc {
+	return requirePermission(permission, func(w http.ResponseWriter, r *http.Request) {
+		if principal(r).Username != mux.Vars(r)["username"] {
+			platform.SendAPIErrorResp(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// setSessionCookies gives the browser the session cookie, which scripts cannot read, and the CSRF
+// cookie, which the web UI scripts read and send back in the CSRF header on state changing requests
+func setSessionCookies(w http.ResponseWriter, sessionID string, maxAge time.Duration, secure bool) {
+	maxAgeSeconds := int(maxAge.Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name:     platform.SessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		MaxAge:   maxAgeSeconds,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     platform.CSRFCookieName,
+		Value:    platform.CSRFToken(sessionID),
+		Path:     "/",
+		MaxAge:   maxAgeSeconds,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// startLoginSession logs the user in on this device, with a session of its own, and tells if that worked;
+// every login gets its own session, so logging out on one device keeps the others logged in
+func startLoginSession(w http.ResponseWriter, r *http.Request, loginSessionManager *platform.LoginSessionManager, username, deviceName string, secure bool) bool {
+	cookieID, err := loginSessionManager.New(r.Context(), username, platform.LoginDevice{
+		Name:      deviceName,
+		UserAgent: r.UserAgent(),
+		IPAddress: platform.RequestIP(r),
+	})
+	if err != nil {
+		log.Errorf("error while creating login session: %s", err.Error())
+		platform.SendAPIErrorResp(w, "server error", http.StatusInternalServerError)
+		return false
+	}
+	setSessionCookies(w, cookieID, loginSessionManager.AbsoluteTTL(), secure)
+	return true
+}
+
+func clearSessionCookies(w http.ResponseWriter, secure bool) {
+	for _, name := range []string{platform.SessionCookieName, platform.CSRFCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == platform.SessionCookieName,
+			Secure:   secure,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// passwordHasherRetryAfter is how long the clients wait when the password hashing has no memory left,
+// about the time the hashes running take to free it
+const passwordHasherRetryAfter = time.Second
+
+// sendPasswordHasherBusy answers the request the password hashing had no memory left for
+func sendPasswordHasherBusy(w http.ResponseWriter) {
+	setRetryAfter(w, passwordHasherRetryAfter)
+	platform.SendAPIErrorResp(w, platform.ErrPasswordHasherBusy.Error(), http.StatusServiceUnavailable)
+}
+
+// setRetryAfter tells the client how long to wait before trying again, in whole seconds
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// checkLoginThrottle answers the request and returns false if the user's logins are throttled, the password
+// confirming flows are throttled as the logins, or they would let the password be guessed around the throttling
+func checkLoginThrottle(w http.ResponseWriter, r *http.Request, loginThrottler *services.LoginThrottler, username string) bool {
+	wait, err := loginThrottler.Check(r.Context(), username, platform.RequestIP(r))
+	if err != nil {
+		log.Errorf("login throttler, error 109071: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109071", http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		platform.SendAPIErrorResp(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// loginFailed counts the failed login for the throttling; the login is refused anyway, so the
+// store's errors are only logged
+func loginFailed(ctx context.Context, loginThrottler *services.LoginThrottler, username, ip string) {
+	if err := loginThrottler.Failed(ctx, username, ip); err != nil {
+		log.Errorf("login throttler, error counting the failed login of [%s]: %s", username, err)
+	}
+}
+
+func loginSucceeded(ctx context.Context, loginThrottler *services.LoginThrottler, username string) {
+	if err := loginThrottler.Succeeded(ctx, username); err != nil {
+		log.Errorf("login throttler, error resetting the failed logins of [%s]: %s", username, err)
+	}
+}
@@ -21,8 +21,8 @@ func DebugHandlerSetup(router *mux.Router, viewsMaker *platform.ViewsMaker, logF
 		logFile:    logFile,
 	}
 
-	router.HandleFunc("", handler.handleGetDebugPage)
-	router.HandleFunc("/logs", handler.handleGetLogs)
+	router.HandleFunc("", requirePermission(platform.PermDebug, handler.handleGetDebugPage))
+	router.HandleFunc("/logs", requirePermission(platform.PermDebug, handler.handleGetLogs))
 }
 
 func (handler *DebugHandler) handleGetDebugPage(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// defaultListComplexity is how many items a list without the first argument counts with
+const defaultListComplexity = 10
+
+// queryComplexity returns the complexity of the operation in the validated document, the number of fields it
+// may resolve, and how deep they nest. Every field counts as one, and the fields within a list as many times
+// as the list may have items: its first argument, or defaultListComplexity. The introspection is free, it's
+// as large as the schema only.
+func queryComplexity(schema *graphql.Schema, doc *ast.Document, operationName string, variables map[string]interface{}) (complexity, depth int) {
+	c := &complexityCounter{
+		fragments: make(map[string]*ast.FragmentDefinition),
+		schema:    schema,
+		variables: variables,
+	}
+	var operation *ast.OperationDefinition
+	for _, definition := range doc.Definitions {
+		switch definition := definition.(type) {
+		case *ast.FragmentDefinition:
+			c.fragments[definition.Name.Value] = definition
+		case *ast.OperationDefinition:
+			if operationName == "" || (definition.Name != nil && definition.Name.Value == operationName) {
+				operation = definition
+			}
+		}
+	}
+	if operation == nil {
+		// executing it fails anyway
+		return 0, 0
+	}
+
+	root := schema.QueryType()
+	if operation.Operation == ast.OperationTypeMutation {
+		root = schema.MutationType()
+	}
+	return c.selectionSet(root, operation.SelectionSet)
+}
+
+type complexityCounter struct {
+	fragments map[string]*ast.FragmentDefinition
+	schema    *graphql.Schema
+	variables map[string]interface{}
+}
+
+// selectionSet returns the complexity and the depth of the selections on the parent type
+func (c *complexityCounter) selectionSet(parent graphql.Type, set *ast.SelectionSet) (complexity, depth int) {
+	if set == nil {
+		return 0, 0
+	}
+	for _, selection := range set.Selections {
+		var selectionComplexity, selectionDepth int
+		switch selection := selection.(type) {
+		case *ast.Field:
+			selectionComplexity, selectionDepth = c.field(parent, selection)
+		case *ast.InlineFragment:
+			fragmentType := parent
+			if selection.TypeCondition != nil {
+				fragmentType = c.schema.Type(selection.TypeCondition.Name.Value)
+			}
+			selectionComplexity, selectionDepth = c.selectionSet(fragmentType, selection.SelectionSet)
+		case *ast.FragmentSpread:
+			fragment := c.fragments[selection.Name.Value]
+			if fragment == nil {
+				continue
+			}
+			selectionComplexity, selectionDepth = c.selectionSet(c.schema.Type(fragment.TypeCondition.Name.Value), fragment.SelectionSet)
+		}
+		complexity += selectionComplexity
+		if selectionDepth > depth {
+			depth = selectionDepth
+		}
+	}
+	return complexity, depth
+}
+
+func (c *complexityCounter) field(parent graphql.Type, field *ast.Field) (complexity, depth int) {
+	if strings.HasPrefix(field.Name.Value, "__") {
+		return 0, 0
+	}
+	fields, ok := parent.(interface {
+		Fields() graphql.FieldDefinitionMap
+	})
+	if !ok {
+		return 1, 1
+	}
+	definition := fields.Fields()[field.Name.Value]
+	if definition == nil {
+		return 1, 1
+	}
+
+	fieldType, isList := unwrapType(definition.Type)
+	childrenComplexity, childrenDepth := c.selectionSet(fieldType, field.SelectionSet)
+	if isList {
+		// capped, so the lists within lists cannot overflow it
+		childrenComplexity = min(childrenComplexity, math.MaxInt32) * c.listSize(definition, field)
+	}
+	return min(1+childrenComplexity, math.MaxInt32), 1 + childrenDepth
+}
+
+// listSize is how many items the list field may have, as the query asks for with the first argument;
+// a negative one counts as none, the resolvers reject it anyway
+func (c *complexityCounter) listSize(definition *graphql.FieldDefinition, field *ast.Field) int {
+	return min(max(c.firstArgument(definition, field), 0), math.MaxInt32)
+}
+
+func (c *complexityCounter) firstArgument(definition *graphql.FieldDefinition, field *ast.Field) int {
+	for _, argument := range field.Arguments {
+		if argument.Name.Value != "first" {
+			continue
+		}
+		switch value := argument.Value.(type) {
+		case *ast.IntValue:
+			if size, err := strconv.Atoi(value.Value); err == nil {
+				return size
+			}
+		case *ast.Variable:
+			switch size := c.variables[value.Name.Value].(type) {
+			case float64:
+				return int(min(size, math.MaxInt32))
+			case int:
+				return size
+			}
+		}
+	}
+	for _, argument := range definition.Args {
+		if size, ok := argument.DefaultValue.(int); ok && argument.Name() == "first" {
+			return size
+		}
+	}
+	return defaultListComplexity
+}
+
+// unwrapType returns the named type within the non null and list wrappers, and if there's a list among them
+func unwrapType(t graphql.Type) (named graphql.Type, isList bool) {
+	for {
+		switch wrapper := t.(type) {
+		case *graphql.NonNull:
+			t = wrapper.OfType
+		case *graphql.List:
+			t = wrapper.OfType
+			isList = true
+		default:
+			return t, isList
+		}
+	}
+}
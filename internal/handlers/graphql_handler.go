@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/location"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	log "github.com/sirupsen/logrus"
+)
+
+// GraphQLPath is where the GraphQL endpoint is mounted
+const GraphQLPath = "/graphql"
+
+// the codes in the extensions of the GraphQL errors, telling the clients what went wrong
+const (
+	graphQLCodeUnauthenticated    = "UNAUTHENTICATED"
+	graphQLCodeForbidden          = "FORBIDDEN"
+	graphQLCodeBadUserInput       = "BAD_USER_INPUT"
+	graphQLCodeNotFound           = "NOT_FOUND"
+	graphQLCodeConflict           = "CONFLICT"
+	graphQLCodeTooManyRequests    = "TOO_MANY_REQUESTS"
+	graphQLCodeTooComplex         = "QUERY_TOO_COMPLEX"
+	graphQLCodeBadRequest         = "BAD_REQUEST"
+	graphQLCodeInternal           = "INTERNAL_SERVER_ERROR"
+	graphQLCodeServiceUnavailable = "SERVICE_UNAVAILABLE"
+)
+
+// GraphQLHandler serves the users, their spends, spend kinds and the totals of the spends per kind, in one
+// round trip, and changes them with the same operations /api/v1 has; logging in stays with the REST routes.
+// The spends and spend kinds of all the users in a query are loaded at once, see platform.BatchLoader, and the
+// queries over the complexity or depth limits are rejected before they run.
+type GraphQLHandler struct {
+	db                  db.SpenderDB
+	usersService        *services.UsersService
+	accountService      *services.AccountService
+	loginThrottler      *services.LoginThrottler
+	loginSessionManager *platform.LoginSessionManager
+	secureCookies       bool
+	maxComplexity       int
+	maxDepth            int
+	schema              graphql.Schema
+}
+
+func GraphQLHandlerSetup(
+	router *mux.Router,
+	spenderDB db.SpenderDB,
+	usersService *services.UsersService,
+	accountService *services.AccountService,
+	loginThrottler *services.LoginThrottler,
+	loginSessionManager *platform.LoginSessionManager,
+	secureCookies bool,
+	maxComplexity int,
+	maxDepth int,
+) {
+	handler := &GraphQLHandler{
+		db:                  spenderDB,
+		usersService:        usersService,
+		accountService:      accountService,
+		loginThrottler:      loginThrottler,
+		loginSessionManager: loginSessionManager,
+		secureCookies:       secureCookies,
+		maxComplexity:       maxComplexity,
+		maxDepth:            maxDepth,
+	}
+
+	var err error
+	handler.schema, err = handler.newSchema()
+	if err != nil {
+		log.Fatalf("cannot create the GraphQL schema: %s", err)
+	}
+
+	router.HandleFunc(GraphQLPath, handler.handleGraphQL).Methods("POST")
+	// without it, the other methods would end up with the unknown paths
+	router.HandleFunc(GraphQLPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", "POST")
+		SendGraphQLError(w, http.StatusMethodNotAllowed, "the GraphQL requests have to be POSTed")
+	})
+}
+
+// graphQLRequestBody is the JSON body of a GraphQL request, as in the GraphQL over HTTP spec
+type graphQLRequestBody struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLResponse is graphql.Result without the data, for the requests which did not run at all
+type graphQLResponse struct {
+	Errors []gqlerrors.FormattedError `json:"errors"`
+}
+
+func (handler *GraphQLHandler) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		SendGraphQLError(w, http.StatusUnsupportedMediaType, "the request body has to be application/json")
+		return
+	}
+
+	var body graphQLRequestBody
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	if err := decoder.Decode(&body); err != nil {
+		SendGraphQLError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(body.Query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		platform.SendJSON(w, http.StatusBadRequest, graphQLResponse{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+	if validation := graphql.ValidateDocument(&handler.schema, doc, nil); !validation.IsValid {
+		platform.SendJSON(w, http.StatusBadRequest, graphQLResponse{Errors: validation.Errors})
+		return
+	}
+	if err := handler.checkLimits(doc, body.OperationName, body.Variables); err != nil {
+		platform.SendJSON(w, http.StatusBadRequest, graphQLResponse{Errors: []gqlerrors.FormattedError{*err}})
+		return
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        handler.schema,
+		AST:           doc,
+		OperationName: body.OperationName,
+		Args:          body.Variables,
+		Context:       handler.newRequestContext(w, r),
+	})
+	platform.SendJSON(w, http.StatusOK, result)
+}
+
+// checkLimits returns the error of an operation over the complexity or the depth limit, nil if it's within both
+func (handler *GraphQLHandler) checkLimits(doc *ast.Document, operationName string, variables map[string]interface{}) *gqlerrors.FormattedError {
+	complexity, depth := queryComplexity(&handler.schema, doc, operationName, variables)
+	var message string
+	switch {
+	case depth > handler.maxDepth:
+		message = fmt.Sprintf("the query is %d levels deep, the most allowed is %d", depth, handler.maxDepth)
+	case complexity > handler.maxComplexity:
+		message = fmt.Sprintf("the query has a complexity of %d, the most allowed is %d; ask for fewer items with the first arguments", complexity, handler.maxComplexity)
+	default:
+		return nil
+	}
+	return &gqlerrors.FormattedError{
+		Message:   message,
+		Locations: []location.SourceLocation{},
+		Extensions: map[string]interface{}{
+			"code":          graphQLCodeTooComplex,
+			"complexity":    complexity,
+			"maxComplexity": handler.maxComplexity,
+			"depth":         depth,
+			"maxDepth":      handler.maxDepth,
+		},
+	}
+}
+
+// SendGraphQLError answers a GraphQL request which cannot run at all with the error, shaped as the
+// errors of the GraphQL responses
+func SendGraphQLError(w http.ResponseWriter, status int, message string) {
+	code := graphQLCodeBadRequest
+	switch status {
+	case http.StatusUnauthorized:
+		code = graphQLCodeUnauthenticated
+	case http.StatusForbidden:
+		code = graphQLCodeForbidden
+	case http.StatusInternalServerError:
+		code = graphQLCodeInternal
+	}
+	platform.SendJSON(w, status, graphQLResponse{Errors: []gqlerrors.FormattedError{{
+		Message:    message,
+		Locations:  []location.SourceLocation{},
+		Extensions: map[string]interface{}{"code": code},
+	}}})
+}
+
+// graphQLError is an error of a resolver, with the code in its extensions; the field errors are
+// the ones of the arguments of a mutation
+type graphQLError struct {
+	message string
+	code    string
+	fields  []models.FieldError
+}
+
+func (err *graphQLError) Error() string {
+	return err.message
+}
+
+func (err *graphQLError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{"code": err.code}
+	if len(err.fields) > 0 {
+		extensions["fields"] = err.fields
+	}
+	return extensions
+}
+
+func newGraphQLError(code, message string) error {
+	return &graphQLError{message: message, code: code}
+}
+
+// graphQLInternalError logs the error and returns the one with its code, which the user can report
+func graphQLInternalError(errorCode string, err error) error {
+	log.Errorf("graphql, error %s: %s", errorCode, err)
+	return newGraphQLError(graphQLCodeInternal, "internal server error "+errorCode)
+}
+
+// graphQLRequest is the HTTP request a GraphQL operation came with, and the loaders of the data it reads;
+// the resolvers find it in their context
+type graphQLRequest struct {
+	w          http.ResponseWriter
+	r          *http.Request
+	spends     *platform.BatchLoader[[]models.Spending]
+	spendKinds *platform.BatchLoader[[]models.SpendKind]
+}
+
+type graphQLRequestKey struct{}
+
+func (handler *GraphQLHandler) newRequestContext(w http.ResponseWriter, r *http.Request) context.Context {
+	return context.WithValue(r.Context(), graphQLRequestKey{}, &graphQLRequest{
+		w:          w,
+		r:          r,
+		spends:     platform.NewBatchLoader(handler.db.GetSpendsOfUsers),
+		spendKinds: platform.NewBatchLoader(handler.db.GetSpendKindsOfUsers),
+	})
+}
+
+func graphQLRequestFrom(ctx context.Context) *graphQLRequest {
+	return ctx.Value(graphQLRequestKey{}).(*graphQLRequest)
+}
@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/graphql-go/graphql"
+	log "github.com/sirupsen/logrus"
+)
+
+// The mutations are the operations of /api/v1, taking its requests as the arguments, in camel case.
+
+func nonNullString() *graphql.ArgumentConfig {
+	return &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}
+}
+
+func (handler *GraphQLHandler) newMutationType(userType *graphql.Object) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"register": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "Register a new user",
+				Args: graphql.FieldConfigArgument{
+					"username": nonNullString(),
+					"email":    nonNullString(),
+					"password": nonNullString(),
+				},
+				Resolve: handler.resolveRegister,
+			},
+			"setRole": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "Set the role of a user, for the admins",
+				Args: graphql.FieldConfigArgument{
+					"username": nonNullString(),
+					"role":     nonNullString(),
+				},
+				Resolve: handler.resolveSetRole,
+			},
+			"updateProfile": &graphql.Field{
+				Type:        graphql.NewNonNull(profileType),
+				Description: "Change the profile settings given, keep the others",
+				Args: graphql.FieldConfigArgument{
+					"displayName":     &graphql.ArgumentConfig{Type: graphql.String},
+					"defaultCurrency": &graphql.ArgumentConfig{Type: graphql.String},
+					"timezone":        &graphql.ArgumentConfig{Type: graphql.String},
+					"locale":          &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: handler.resolveUpdateProfile,
+			},
+			"changeEmail": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "Change the email address, it has to be verified again",
+				Args: graphql.FieldConfigArgument{
+					"email":    nonNullString(),
+					"password": nonNullString(),
+				},
+				Resolve: handler.resolveChangeEmail,
+			},
+			"resendVerificationEmail": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Mail a new email verification link",
+				Resolve:     handler.resolveResendVerification,
+			},
+			"changePassword": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Change the password, ending all the other sessions and tokens",
+				Args: graphql.FieldConfigArgument{
+					"oldPassword": nonNullString(),
+					"newPassword": nonNullString(),
+				},
+				Resolve: handler.resolveChangePassword,
+			},
+			"revokeSession": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "End a login session",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: handler.resolveRevokeSession,
+			},
+			"revokeOtherSessions": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "End all the login sessions but the current one, returns how many ended",
+				Resolve:     handler.resolveRevokeOtherSessions,
+			},
+			"deleteAccount": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Delete the account with all its data",
+				Args: graphql.FieldConfigArgument{
+					"password": nonNullString(),
+				},
+				Resolve: handler.resolveDeleteAccount,
+			},
+			"addSpending": &graphql.Field{
+				Type:        graphql.NewNonNull(spendingType),
+				Description: "Add a spending",
+				Args: graphql.FieldConfigArgument{
+					"currency": nonNullString(),
+					"amount":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Float)},
+					"kindId":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"date":     &graphql.ArgumentConfig{Type: graphql.String, Description: "The day of the spending like 2026-01-31, today if it's missing"},
+				},
+				Resolve: handler.resolveAddSpending,
+			},
+			"deleteSpending": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Delete a spending",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: handler.resolveDeleteSpending,
+			},
+		},
+	})
+}
+
+func (handler *GraphQLHandler) resolveRegister(params graphql.ResolveParams) (interface{}, error) {
+	var req newUserRequest
+	if err := bindArgs(params.Args, &req); err != nil {
+		return nil, err
+	}
+
+	user, err := handler.accountService.Register(params.Context, req.Username, req.Email, req.Password)
+	if platform.IsPasswordPolicyError(err) {
+		return nil, graphQLValidationError(passwordPolicyErrors("password", err))
+	}
+	if err == platform.ErrAlreadyExists {
+		return nil, newGraphQLError(graphQLCodeConflict, "the username or the email is taken")
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		return nil, passwordHasherBusy(params.Context)
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109128", err)
+	}
+	return user, nil
+}
+
+func (handler *GraphQLHandler) resolveSetRole(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermManageUsers)
+	if err != nil {
+		return nil, err
+	}
+	var req setRoleRequest
+	if err := bindArgs(params.Args, &req); err != nil {
+		return nil, err
+	}
+
+	username := params.Args["username"].(string)
+	// an admin demoting themselves by mistake could leave no admin at all
+	if username == p.Username {
+		return nil, newGraphQLError(graphQLCodeForbidden, "cannot change your own role")
+	}
+	err = handler.usersService.SetRole(params.Context, username, req.Role)
+	if err == platform.ErrNotFound {
+		return nil, newGraphQLError(graphQLCodeNotFound, "user not found")
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109129", err)
+	}
+	log.Infof("user [%s] role set to [%s] by [%s]", username, req.Role, p.Username)
+
+	user, err := handler.db.GetUser(params.Context, username, false)
+	if err != nil {
+		return nil, graphQLInternalError("109130", err)
+	}
+	return user, nil
+}
+
+func (handler *GraphQLHandler) resolveUpdateProfile(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermManageOwnAccount)
+	if err != nil {
+		return nil, err
+	}
+	var req updateProfileRequest
+	if err := bindArgs(params.Args, &req); err != nil {
+		return nil, err
+	}
+
+	user, err := handler.usersService.GetUser(params.Context, p.Username)
+	if err != nil {
+		return nil, graphQLInternalError("109131", err)
+	}
+	profile := req.apply(user.Profile)
+	err = handler.usersService.UpdateProfile(params.Context, p.Username, profile)
+	if isProfileError(err) {
+		return nil, newGraphQLError(graphQLCodeBadUserInput, err.Error())
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109132", err)
+	}
+	return profile, nil
+}
+
+func (handler *GraphQLHandler) resolveChangeEmail(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermManageOwnAccount)
+	if err != nil {
+		return nil, err
+	}
+	var req changeEmailRequest
+	if err := bindArgs(params.Args, &req); err != nil {
+		return nil, err
+	}
+
+	if err := handler.checkThrottle(params.Context, p.Username); err != nil {
+		return nil, err
+	}
+	err = handler.accountService.ChangeEmail(params.Context, p.Username, req.Password, req.Email)
+	if err == platform.ErrWrongPassword {
+		return nil, handler.wrongPassword(params.Context, p.Username)
+	}
+	if err == platform.ErrAlreadyExists {
+		return nil, newGraphQLError(graphQLCodeConflict, "the email is used by another account")
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		return nil, passwordHasherBusy(params.Context)
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109133", err)
+	}
+
+	user, err := handler.db.GetUser(params.Context, p.Username, false)
+	if err != nil {
+		return nil, graphQLInternalError("109134", err)
+	}
+	return user, nil
+}
+
+func (handler *GraphQLHandler) resolveResendVerification(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermManageOwnAccount)
+	if err != nil {
+		return nil, err
+	}
+	err = handler.accountService.SendVerificationEmail(params.Context, p.Username)
+	if err == platform.ErrEmailAlreadyVerified {
+		return nil, newGraphQLError(graphQLCodeConflict, "email already verified")
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109135", err)
+	}
+	return true, nil
+}
+
+func (handler *GraphQLHandler) resolveChangePassword(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermManageOwnAccount)
+	if err != nil {
+		return nil, err
+	}
+	var req changePasswordRequest
+	if err := bindArgs(params.Args, &req); err != nil {
+		return nil, err
+	}
+
+	if err := handler.checkThrottle(params.Context, p.Username); err != nil {
+		return nil, err
+	}
+	// the session of the request stays, if it came with one, the other ones and all the API tokens end
+	sessionID := platform.SessionIDFromRequest(graphQLRequestFrom(params.Context).r)
+	err = handler.accountService.ChangePassword(params.Context, p.Username, req.OldPassword, req.NewPassword, sessionID)
+	if err == platform.ErrWrongPassword {
+		return nil, handler.wrongPassword(params.Context, p.Username)
+	}
+	if platform.IsPasswordPolicyError(err) {
+		return nil, graphQLValidationError(passwordPolicyErrors("new_password", err))
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		return nil, passwordHasherBusy(params.Context)
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109136", err)
+	}
+	return true, nil
+}
+
+func (handler *GraphQLHandler) resolveRevokeSession(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermManageOwnAccount)
+	if err != nil {
+		return nil, err
+	}
+	err = handler.loginSessionManager.RemoveByPublicID(params.Context, p.Username, params.Args["id"].(string))
+	if err == platform.ErrNotFound {
+		return nil, newGraphQLError(graphQLCodeNotFound, "session not found")
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109137", err)
+	}
+	return true, nil
+}
+
+func (handler *GraphQLHandler) resolveRevokeOtherSessions(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermManageOwnAccount)
+	if err != nil {
+		return nil, err
+	}
+	sessionID := platform.SessionIDFromRequest(graphQLRequestFrom(params.Context).r)
+	revoked, err := handler.loginSessionManager.RemoveOthers(params.Context, p.Username, sessionID)
+	if err != nil {
+		return nil, graphQLInternalError("109138", err)
+	}
+	return revoked, nil
+}
+
+func (handler *GraphQLHandler) resolveDeleteAccount(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermManageOwnAccount)
+	if err != nil {
+		return nil, err
+	}
+	var req passwordRequest
+	if err := bindArgs(params.Args, &req); err != nil {
+		return nil, err
+	}
+
+	// the last admin deleting itself would leave no admin at all
+	if p.Role == models.RoleAdmin {
+		return nil, newGraphQLError(graphQLCodeForbidden, "an admin cannot delete its own account, another admin has to demote it first")
+	}
+	if err := handler.checkThrottle(params.Context, p.Username); err != nil {
+		return nil, err
+	}
+	err = handler.accountService.DeleteAccount(params.Context, p.Username, req.Password)
+	if err == platform.ErrWrongPassword {
+		return nil, handler.wrongPassword(params.Context, p.Username)
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		return nil, passwordHasherBusy(params.Context)
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109139", err)
+	}
+
+	clearSessionCookies(graphQLRequestFrom(params.Context).w, handler.secureCookies)
+	return true, nil
+}
+
+func (handler *GraphQLHandler) resolveAddSpending(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermWriteOwnData)
+	if err != nil {
+		return nil, err
+	}
+	var req newSpendingRequest
+	if err := bindArgs(params.Args, &req); err != nil {
+		return nil, err
+	}
+
+	spendKind, err := handler.usersService.GetSpendKind(params.Context, p.Username, req.KindID)
+	if err == platform.ErrNotFound {
+		return nil, graphQLValidationError(unknownSpendKindErrors)
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109140", err)
+	}
+	user, err := handler.usersService.GetUser(params.Context, p.Username)
+	if err != nil {
+		return nil, graphQLInternalError("109141", err)
+	}
+
+	spending := models.Spending{
+		Currency:  req.Currency,
+		Amount:    req.Amount,
+		Kind:      spendKind,
+		Timestamp: req.timestamp(time.Now()),
+	}
+	if err := handler.usersService.StoreSpending(params.Context, user, &spending); err != nil {
+		return nil, graphQLInternalError("109142", err)
+	}
+	return spending, nil
+}
+
+func (handler *GraphQLHandler) resolveDeleteSpending(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, platform.PermWriteOwnData)
+	if err != nil {
+		return nil, err
+	}
+	err = handler.usersService.DeleteSpending(params.Context, p.Username, params.Args["id"].(string))
+	if err == platform.ErrNotFound {
+		return nil, newGraphQLError(graphQLCodeNotFound, "spending not found")
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109143", err)
+	}
+	return true, nil
+}
+
+// checkThrottle returns the error if the user's logins are throttled, the mutations confirmed with the
+// password are throttled as the logins, see checkLoginThrottle
+func (handler *GraphQLHandler) checkThrottle(ctx context.Context, username string) error {
+	req := graphQLRequestFrom(ctx)
+	wait, err := handler.loginThrottler.Check(ctx, username, platform.RequestIP(req.r))
+	if err != nil {
+		return graphQLInternalError("109071", err)
+	}
+	if wait > 0 {
+		setRetryAfter(req.w, wait)
+		return newGraphQLError(graphQLCodeTooManyRequests, "too many failed logins, try again later")
+	}
+	return nil
+}
+
+// wrongPassword counts the wrong password as a failed login, and returns its error
+func (handler *GraphQLHandler) wrongPassword(ctx context.Context, username string) error {
+	loginFailed(ctx, handler.loginThrottler, username, platform.RequestIP(graphQLRequestFrom(ctx).r))
+	return newGraphQLError(graphQLCodeForbidden, "wrong password")
+}
+
+// passwordHasherBusy is the error of the operations the password hashing had no memory left for
+func passwordHasherBusy(ctx context.Context) error {
+	setRetryAfter(graphQLRequestFrom(ctx).w, passwordHasherRetryAfter)
+	return newGraphQLError(graphQLCodeServiceUnavailable, platform.ErrPasswordHasherBusy.Error())
+}
@@ -0,0 +1,463 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/graphql-go/graphql"
+)
+
+// The fields of the GraphQL types are resolved from the models' fields of the same name, see
+// graphql.DefaultResolveFn, so the secrets of the models stay out as long as the types do not name them.
+
+var spendKindType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "SpendKind",
+	Fields: graphql.Fields{
+		"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var spendingType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Spending",
+	Fields: graphql.Fields{
+		"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"currency":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"amount":    &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+		"kind":      &graphql.Field{Type: graphql.NewNonNull(spendKindType)},
+		"timestamp": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+	},
+})
+
+// kindTotal is what the user spent on a kind in a currency, the spends in different currencies are not added up
+type kindTotal struct {
+	Kind     models.SpendKind
+	Currency string
+	Total    float64
+	Count    int
+}
+
+var kindTotalType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "KindTotal",
+	Description: "The total of the spends of a kind in a currency",
+	Fields: graphql.Fields{
+		"kind":     &graphql.Field{Type: graphql.NewNonNull(spendKindType)},
+		"currency": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"total":    &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+		"count":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "The number of the spends"},
+	},
+})
+
+var profileType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Profile",
+	Fields: graphql.Fields{
+		"displayName":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"defaultCurrency": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"timezone":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"locale":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var loginSessionType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "LoginSession",
+	Fields: graphql.Fields{
+		"id":         &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"deviceName": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"userAgent":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"ipAddress":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"createdAt":  &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		"lastSeen":   &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		"current":    &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Description: "If the request came with this session"},
+	},
+})
+
+// spendsArgs picks the spends of a user to list; the dates are the days in UTC, both of them included
+type spendsArgs struct {
+	First  int    `json:"first" validate:"min=0"`
+	Offset int    `json:"offset" validate:"min=0"`
+	KindID int    `json:"kind_id,omitempty" validate:"min=1"`
+	From   string `json:"from,omitempty" validate:"date"`
+	To     string `json:"to,omitempty" validate:"date"`
+}
+
+// filter returns the spends of the kind between the dates, all of them without the arguments
+func (args *spendsArgs) filter(spends []models.Spending) []models.Spending {
+	// validated already
+	from, _ := time.Parse(platform.DateLayout, args.From)
+	to, _ := time.Parse(platform.DateLayout, args.To)
+	filtered := make([]models.Spending, 0, len(spends))
+	for _, spending := range spends {
+		if args.KindID != 0 && spending.Kind.ID != args.KindID {
+			continue
+		}
+		if args.From != "" && spending.Timestamp.Before(from) {
+			continue
+		}
+		if args.To != "" && !spending.Timestamp.Before(to.AddDate(0, 0, 1)) {
+			continue
+		}
+		filtered = append(filtered, spending)
+	}
+	return filtered
+}
+
+// page returns the first spends after the offset
+func (args *spendsArgs) page(spends []models.Spending) []models.Spending {
+	if args.Offset >= len(spends) {
+		return []models.Spending{}
+	}
+	spends = spends[args.Offset:]
+	if args.First < len(spends) {
+		spends = spends[:args.First]
+	}
+	return spends
+}
+
+// kindTotals adds up the spends per kind and currency, ordered by the kind and then the currency
+func kindTotals(spends []models.Spending) []kindTotal {
+	type totalKey struct {
+		kindID   int
+		currency string
+	}
+	totalsByKey := make(map[totalKey]*kindTotal)
+	var totals []*kindTotal
+	for _, spending := range spends {
+		key := totalKey{kindID: spending.Kind.ID, currency: spending.Currency}
+		total, ok := totalsByKey[key]
+		if !ok {
+			total = &kindTotal{Kind: *spending.Kind, Currency: spending.Currency}
+			totalsByKey[key] = total
+			totals = append(totals, total)
+		}
+		total.Total += float64(spending.Amount)
+		total.Count++
+	}
+
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Kind.ID != totals[j].Kind.ID {
+			return totals[i].Kind.ID < totals[j].Kind.ID
+		}
+		return totals[i].Currency < totals[j].Currency
+	})
+	result := make([]kindTotal, 0, len(totals))
+	for _, total := range totals {
+		result = append(result, *total)
+	}
+	return result
+}
+
+var spendsFilterArgs = graphql.FieldConfigArgument{
+	"kindId": &graphql.ArgumentConfig{Type: graphql.Int, Description: "Only the spends of the kind"},
+	"from":   &graphql.ArgumentConfig{Type: graphql.String, Description: "Only the spends since the day, like 2026-01-31 in UTC"},
+	"to":     &graphql.ArgumentConfig{Type: graphql.String, Description: "Only the spends until the day, like 2026-01-31 in UTC, included"},
+}
+
+func (handler *GraphQLHandler) newUserType() *graphql.Object {
+	spendsArgsConfig := graphql.FieldConfigArgument{
+		"first":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 100, Description: "How many spends to list at most"},
+		"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0, Description: "How many spends to skip"},
+	}
+	for name, arg := range spendsFilterArgs {
+		spendsArgsConfig[name] = arg
+	}
+
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"username":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"email":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"emailVerified": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"role":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"profile":       &graphql.Field{Type: graphql.NewNonNull(profileType)},
+			"spends": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(spendingType))),
+				Description: "The spends in the order they were added",
+				Args:        spendsArgsConfig,
+				Resolve:     handler.resolveSpends,
+			},
+			"spendKinds": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(spendKindType))),
+				Resolve: handler.resolveSpendKinds,
+			},
+			"totals": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(kindTotalType))),
+				Description: "The totals of the spends per kind and currency",
+				Args:        spendsFilterArgs,
+				Resolve:     handler.resolveTotals,
+			},
+			"sessions": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(loginSessionType))),
+				Description: "The login sessions, of the logged in user only",
+				Resolve:     handler.resolveSessions,
+			},
+		},
+	})
+}
+
+func (handler *GraphQLHandler) newSchema() (graphql.Schema, error) {
+	userType := handler.newUserType()
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"me": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "The logged in user",
+				Resolve:     handler.resolveMe,
+			},
+			"user": &graphql.Field{
+				Type:        userType,
+				Description: "A user, for the admins",
+				Args: graphql.FieldConfigArgument{
+					"username": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: handler.resolveUser,
+			},
+			"users": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType))),
+				Description: "All the users in the order they registered, for the admins",
+				Args: graphql.FieldConfigArgument{
+					"first":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20, Description: "How many users to list at most"},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0, Description: "How many users to skip"},
+				},
+				Resolve: handler.resolveUsers,
+			},
+			"defaultSpendKinds": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(spendKindType))),
+				Description: "The spend kinds the new users start with",
+				Resolve:     handler.resolveDefaultSpendKinds,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    queryType,
+		Mutation: handler.newMutationType(userType),
+	})
+}
+
+func (handler *GraphQLHandler) resolveMe(params graphql.ResolveParams) (interface{}, error) {
+	p, err := graphQLPrincipal(params.Context, "")
+	if err != nil {
+		return nil, err
+	}
+	user, err := handler.db.GetUser(params.Context, p.Username, false)
+	if err != nil {
+		return nil, graphQLInternalError("109120", err)
+	}
+	return user, nil
+}
+
+func (handler *GraphQLHandler) resolveUser(params graphql.ResolveParams) (interface{}, error) {
+	if _, err := graphQLPrincipal(params.Context, platform.PermManageUsers); err != nil {
+		return nil, err
+	}
+	user, err := handler.db.GetUser(params.Context, params.Args["username"].(string), false)
+	if err == platform.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphQLInternalError("109121", err)
+	}
+	return user, nil
+}
+
+// usersArgs pages through the users
+type usersArgs struct {
+	First  int `json:"first" validate:"min=0"`
+	Offset int `json:"offset" validate:"min=0"`
+}
+
+func (handler *GraphQLHandler) resolveUsers(params graphql.ResolveParams) (interface{}, error) {
+	if _, err := graphQLPrincipal(params.Context, platform.PermManageUsers); err != nil {
+		return nil, err
+	}
+	var args usersArgs
+	if err := bindArgs(params.Args, &args); err != nil {
+		return nil, err
+	}
+
+	users, err := handler.db.GetAllUsers(params.Context, false)
+	if err != nil {
+		return nil, graphQLInternalError("109122", err)
+	}
+	if args.Offset >= len(users) {
+		return models.Users{}, nil
+	}
+	users = users[args.Offset:]
+	if args.First < len(users) {
+		users = users[:args.First]
+	}
+	return users, nil
+}
+
+func (handler *GraphQLHandler) resolveDefaultSpendKinds(params graphql.ResolveParams) (interface{}, error) {
+	if _, err := graphQLPrincipal(params.Context, ""); err != nil {
+		return nil, err
+	}
+	spendKinds, err := handler.usersService.GetAllDefaultSpendKinds(params.Context)
+	if err != nil {
+		return nil, graphQLInternalError("109123", err)
+	}
+	return models.NewSpendKindDTOs(spendKinds), nil
+}
+
+func (handler *GraphQLHandler) resolveSpends(params graphql.ResolveParams) (interface{}, error) {
+	user := params.Source.(*models.User)
+	if err := checkDataReader(params.Context, user.Username); err != nil {
+		return nil, err
+	}
+	var args spendsArgs
+	if err := bindArgs(params.Args, &args); err != nil {
+		return nil, err
+	}
+
+	load := graphQLRequestFrom(params.Context).spends.Load(params.Context, user.Username)
+	return func() (interface{}, error) {
+		spends, err := load()
+		if err != nil {
+			return nil, graphQLInternalError("109124", err)
+		}
+		return args.page(args.filter(spends)), nil
+	}, nil
+}
+
+func (handler *GraphQLHandler) resolveSpendKinds(params graphql.ResolveParams) (interface{}, error) {
+	user := params.Source.(*models.User)
+	if err := checkDataReader(params.Context, user.Username); err != nil {
+		return nil, err
+	}
+
+	load := graphQLRequestFrom(params.Context).spendKinds.Load(params.Context, user.Username)
+	return func() (interface{}, error) {
+		spendKinds, err := load()
+		if err != nil {
+			return nil, graphQLInternalError("109125", err)
+		}
+		return models.NewSpendKindDTOs(spendKinds), nil
+	}, nil
+}
+
+func (handler *GraphQLHandler) resolveTotals(params graphql.ResolveParams) (interface{}, error) {
+	user := params.Source.(*models.User)
+	if err := checkDataReader(params.Context, user.Username); err != nil {
+		return nil, err
+	}
+	var args spendsArgs
+	if err := bindArgs(params.Args, &args); err != nil {
+		return nil, err
+	}
+
+	// the same spends the spends field loads, if the query asks for both
+	load := graphQLRequestFrom(params.Context).spends.Load(params.Context, user.Username)
+	return func() (interface{}, error) {
+		spends, err := load()
+		if err != nil {
+			return nil, graphQLInternalError("109126", err)
+		}
+		return kindTotals(args.filter(spends)), nil
+	}, nil
+}
+
+func (handler *GraphQLHandler) resolveSessions(params graphql.ResolveParams) (interface{}, error) {
+	user := params.Source.(*models.User)
+	p, err := graphQLPrincipal(params.Context, platform.PermManageOwnAccount)
+	if err != nil {
+		return nil, err
+	}
+	if p.Username != user.Username {
+		return nil, newGraphQLError(graphQLCodeForbidden, "only the user can see its login sessions")
+	}
+
+	sessions, err := handler.loginSessionManager.GetAllByUsername(params.Context, p.Username)
+	if err != nil {
+		return nil, graphQLInternalError("109127", err)
+	}
+	return newLoginSessionDTOs(sessions, p.Session), nil
+}
+
+// graphQLPrincipal returns the principal of the request, or the error if it's not logged in,
+// or its role does not grant the permission, unless it's empty
+func graphQLPrincipal(ctx context.Context, permission platform.Permission) (*platform.Principal, error) {
+	p := platform.PrincipalFromContext(ctx)
+	if p == nil {
+		return nil, newGraphQLError(graphQLCodeUnauthenticated, "must be logged in")
+	}
+	if permission != "" && !p.Can(permission) {
+		return nil, newGraphQLError(graphQLCodeForbidden, "missing permission "+string(permission))
+	}
+	return p, nil
+}
+
+// checkDataReader returns the error if the principal may not read the spends and spend kinds of the user;
+// the users read their own ones, and the admins everyone's, as they do with GET /api/v1/users/{username}
+func checkDataReader(ctx context.Context, username string) error {
+	p, err := graphQLPrincipal(ctx, "")
+	if err != nil {
+		return err
+	}
+	if p.Can(platform.PermManageUsers) || (p.Username == username && p.Can(platform.PermReadOwnData)) {
+		return nil
+	}
+	return newGraphQLError(graphQLCodeForbidden, "cannot read the data of the user")
+}
+
+// bindArgs sets the request from the arguments, named as the request's JSON fields in camel case, and validates
+// it as the other routes do; the field errors name the arguments
+func bindArgs(args map[string]interface{}, req interface{}) error {
+	fields := make(map[string]interface{}, len(args))
+	for name, value := range args {
+		fields[snakeCase(name)] = value
+	}
+	data, err := json.Marshal(fields)
+	if err == nil {
+		err = json.Unmarshal(data, req)
+	}
+	if err != nil {
+		return graphQLInternalError("109119", err)
+	}
+
+	if errs := validateRequest(req); errs != nil {
+		return graphQLValidationError(errs)
+	}
+	return nil
+}
+
+// graphQLValidationError is the error of the field errors, named as the arguments
+func graphQLValidationError(errs platform.ValidationErrors) error {
+	fields := make(platform.ValidationErrors, 0, len(errs))
+	for _, fieldErr := range errs {
+		fieldErr.Field = camelCase(fieldErr.Field)
+		fields = append(fields, fieldErr)
+	}
+	return &graphQLError{message: fields.Error(), code: graphQLCodeBadUserInput, fields: fields}
+}
+
+// camelCase is the GraphQL name of a JSON field, like kindId of kind_id
+func camelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// snakeCase is the JSON name of a GraphQL field, like kind_id of kindId
+func snakeCase(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			b.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
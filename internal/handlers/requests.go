@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+)
+
+// The requests of both the web UI routes, which send them as forms, and /api/v1, which sends them as JSON;
+// the form values are named as the JSON fields, and the validate tags hold the rules, see platform.Validate.
+
+type loginRequest struct {
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+	TOTPCode string `json:"totp_code,omitempty"`
+	// as long as the login session manager keeps it
+	DeviceName string `json:"device_name,omitempty" validate:"maxlen=64"`
+}
+
+type usernameRequest struct {
+	Username string `json:"username" validate:"required"`
+}
+
+type tokenRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type newUserRequest struct {
+	// as long as the username columns are
+	Username string `json:"username" validate:"required,maxlen=35"`
+	Email    string `json:"email" validate:"required,email"`
+	// the password policy is up to the service
+	Password string `json:"password" validate:"required"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type setRoleRequest struct {
+	Role string `json:"role" validate:"required,oneof=user admin read-only"`
+}
+
+// passwordRequest confirms a change of the account with the password
+type passwordRequest struct {
+	Password string `json:"password" validate:"required"`
+}
+
+// updateProfileRequest has only the profile fields to change, the missing ones stay as they are
+type updateProfileRequest struct {
+	DisplayName     *string `json:"display_name,omitempty" validate:"maxlen=64"`
+	DefaultCurrency *string `json:"default_currency,omitempty" validate:"currency"`
+	Timezone        *string `json:"timezone,omitempty" validate:"timezone"`
+	Locale          *string `json:"locale,omitempty" validate:"locale"`
+}
+
+func (req *updateProfileRequest) normalize() {
+	for _, value := range []*string{req.DisplayName, req.DefaultCurrency, req.Timezone, req.Locale} {
+		if value != nil {
+			*value = strings.TrimSpace(*value)
+		}
+	}
+}
+
+// apply returns the profile with the fields of the request changed
+func (req *updateProfileRequest) apply(profile models.UserProfile) models.UserProfile {
+	for _, field := range []struct {
+		value  *string
+		target *string
+	}{
+		{req.DisplayName, &profile.DisplayName},
+		{req.DefaultCurrency, &profile.DefaultCurrency},
+		{req.Timezone, &profile.Timezone},
+		{req.Locale, &profile.Locale},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+		}
+	}
+	return profile
+}
+
+type changeEmailRequest struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+type changePasswordRequest struct {
+	OldPassword string `json:"old_password" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type newSpendingRequest struct {
+	Currency string  `json:"currency" validate:"required,currency"`
+	Amount   float32 `json:"amount" validate:"required,min=0,max=1000000000"`
+	KindID   int     `json:"kind_id" validate:"required,min=1"`
+	// Date is the day of the spending, today if it's missing
+	Date string `json:"date,omitempty" validate:"date"`
+}
+
+func (req *newSpendingRequest) normalize() {
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+}
+
+// timestamp is the time of the spending, now or, for the spending of another day, the start of that day in UTC
+func (req *newSpendingRequest) timestamp(now time.Time) time.Time {
+	if req.Date == "" {
+		return now
+	}
+	// validated already
+	date, _ := time.Parse(platform.DateLayout, req.Date)
+	return date
+}
+
+// unknownSpendKindErrors are the errors of a spending whose kind is not one of the user's
+var unknownSpendKindErrors = platform.ValidationErrors{{Field: "kind_id", Code: "not_found", Message: "is not a spend kind of the user"}}
+
+// passwordPolicyErrors are the errors of the field with a new password the password policy rejects
+func passwordPolicyErrors(field string, err error) platform.ValidationErrors {
+	return platform.ValidationErrors{{Field: field, Code: "password_policy", Message: err.Error()}}
+}
+
+// normalizer is a request which tidies up its values, before they are validated
+type normalizer interface {
+	normalize()
+}
+
+// validateRequest normalizes and validates the decoded request, and returns the errors of its fields
+func validateRequest(req interface{}) platform.ValidationErrors {
+	if n, ok := req.(normalizer); ok {
+		n.normalize()
+	}
+	return platform.Validate(req)
+}
+
+// bindForm decodes the form into the request and validates it, or answers the request with the errors
+// of its fields and returns false
+func bindForm(w http.ResponseWriter, form url.Values, req interface{}) bool {
+	errs := platform.DecodeForm(form, req)
+	if errs == nil {
+		errs = validateRequest(req)
+	}
+	if errs != nil {
+		platform.SendAPIValidationErrorResp(w, errs)
+		return false
+	}
+	return true
+}
+
+// parseForm parses the form of the request, or answers the request with the error and returns false
+func parseForm(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		platform.SendAPIErrorResp(w, "cannot parse the form", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/2beens/ispend/internal/services"
@@ -14,33 +13,24 @@ import (
 )
 
 type SpendingHandler struct {
-	usersService        *services.UsersService
-	loginSessionManager *platform.LoginSessionManager
+	usersService *services.UsersService
 }
 
-func SpendingHandlerSetup(router *mux.Router, usersService *services.UsersService, loginSessionManager *platform.LoginSessionManager) {
+func SpendingHandlerSetup(router *mux.Router, usersService *services.UsersService) {
 	handler := &SpendingHandler{
-		usersService:        usersService,
-		loginSessionManager: loginSessionManager,
+		usersService: usersService,
 	}
 
-	router.HandleFunc("", handler.handleNewSpending).Methods("POST")
-	router.HandleFunc("/{username}/{spendID}", handler.handleDeleteSpending).Methods("DELETE")
-	router.HandleFunc("/id/{id}/{username}", handler.handleGetUserSpendingByID).Methods("GET")
-	router.HandleFunc("/all/{username}", handler.handleGetUserSpends).Methods("GET")
+	router.HandleFunc("", requirePermission(platform.PermWriteOwnData, handler.handleNewSpending)).Methods("POST")
+	router.HandleFunc("/{username}/{spendID}", requireOwner(platform.PermWriteOwnData, handler.handleDeleteSpending)).Methods("DELETE")
+	router.HandleFunc("/id/{id}/{username}", requireOwner(platform.PermReadOwnData, handler.handleGetUserSpendingByID)).Methods("GET")
+	router.HandleFunc("/all/{username}", requireOwner(platform.PermReadOwnData, handler.handleGetUserSpends)).Methods("GET")
 }
 
 func (handler *SpendingHandler) handleGetUserSpendingByID(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
-	sessionID := r.Header.Get("X-Ispend-SessionID")
-	if handler.loginSessionManager.IsUserNotLoggedIn(sessionID, username) {
-		platform.SendAPIErrorResp(w, "must be logged in", http.StatusUnauthorized)
-		return
-	}
-
-	spendID := vars["id"]
-	user, err := handler.usersService.GetUser(username)
+	username := principal(r).Username
+	spendID := mux.Vars(r)["id"]
+	user, err := handler.usersService.GetUser(r.Context(), username)
 	if err != nil {
 		platform.SendAPIErrorResp(w, err.Error(), http.StatusBadRequest)
 		return
@@ -48,7 +38,7 @@ func (handler *SpendingHandler) handleGetUserSpendingByID(w http.ResponseWriter,
 
 	for i := range user.Spends {
 		if user.Spends[i].ID == spendID {
-			platform.SendAPIOKRespWithData(w, "success", user.Spends[i])
+			platform.SendAPIOKRespWithData(w, "success", models.NewSpendingDTO(&user.Spends[i]))
 			return
 		}
 	}
@@ -57,44 +47,24 @@ func (handler *SpendingHandler) handleGetUserSpendingByID(w http.ResponseWriter,
 }
 
 func (handler *SpendingHandler) handleGetUserSpends(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
-	sessionID := r.Header.Get("X-Ispend-SessionID")
-	if handler.loginSessionManager.IsUserNotLoggedIn(sessionID, username) {
-		platform.SendAPIErrorResp(w, "must be logged in", http.StatusUnauthorized)
-		return
-	}
-
-	user, err := handler.usersService.GetUser(username)
+	user, err := handler.usersService.GetUser(r.Context(), principal(r).Username)
 	if err != nil {
 		platform.SendAPIErrorResp(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	platform.SendAPIOKRespWithData(w, "success", user.Spends)
+	platform.SendAPIOKRespWithData(w, "success", models.NewSpendingDTOs(user.Spends))
 }
 
 func (handler *SpendingHandler) handleDeleteSpending(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
-	if username == "" {
-		platform.SendAPIErrorResp(w, "missing username", http.StatusBadRequest)
-		return
-	}
-
-	sessionID := r.Header.Get("X-Ispend-SessionID")
-	if handler.loginSessionManager.IsUserNotLoggedIn(sessionID, username) {
-		platform.SendAPIErrorResp(w, "must be logged in", http.StatusUnauthorized)
-		return
-	}
-
-	spendID := vars["spendID"]
+	username := principal(r).Username
+	spendID := mux.Vars(r)["spendID"]
 	if spendID == "" {
 		platform.SendAPIErrorResp(w, "missing spending ID", http.StatusBadRequest)
 		return
 	}
 
-	err := handler.usersService.DeleteSpending(username, spendID)
+	err := handler.usersService.DeleteSpending(r.Context(), username, spendID)
 	if err != nil {
 		if err == platform.ErrNotFound {
 			platform.SendAPIErrorResp(w, "not found", http.StatusNotFound)
@@ -107,45 +77,26 @@ func (handler *SpendingHandler) handleDeleteSpending(w http.ResponseWriter, r *h
 }
 
 func (handler *SpendingHandler) handleNewSpending(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
-		return
-	}
-
-	username := r.FormValue("username")
-	if username == "" {
-		platform.SendAPIErrorResp(w, "missing username", http.StatusBadRequest)
+	var req newSpendingRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
 		return
 	}
 
-	sessionID := r.Header.Get("X-Ispend-SessionID")
-	if handler.loginSessionManager.IsUserNotLoggedIn(sessionID, username) {
-		platform.SendAPIErrorResp(w, "must be logged in", http.StatusUnauthorized)
-		return
-	}
+	// the spending always goes to the logged user, whatever the username form value says
+	username := principal(r).Username
 
-	currency := r.FormValue("currency")
-	if currency == "" {
-		platform.SendAPIErrorResp(w, "missing/wrong currency", http.StatusBadRequest)
-		return
-	}
-	amountParam := r.FormValue("amount")
-	amount, err := strconv.ParseFloat(amountParam, 32)
-	if err != nil {
-		log.Errorf("new spending, error 9004: %s", err.Error())
-		platform.SendAPIErrorResp(w, "missing/wrong amount", http.StatusBadRequest)
+	spendKind, err := handler.usersService.GetSpendKind(r.Context(), username, req.KindID)
+	if err == platform.ErrNotFound {
+		platform.SendAPIValidationErrorResp(w, unknownSpendKindErrors)
 		return
 	}
-	kindIdParam := r.FormValue("kind_id")
-	kindId, _ := strconv.Atoi(kindIdParam)
-	spendKind, err := handler.usersService.GetSpendKind(username, kindId)
 	if err != nil {
 		log.Errorf("new spending, error 9005: %s", err.Error())
-		platform.SendAPIErrorResp(w, "missing/wrong spending kind ID", http.StatusBadRequest)
+		platform.SendAPIErrorResp(w, "server error 9005", http.StatusInternalServerError)
 		return
 	}
 
-	user, err := handler.usersService.GetUser(username)
+	user, err := handler.usersService.GetUser(r.Context(), username)
 	if err != nil && err != platform.ErrNotFound {
 		log.Errorf("new spending, error 9003: %s", err.Error())
 		platform.SendAPIErrorResp(w, "server error 9003", http.StatusInternalServerError)
@@ -157,16 +108,14 @@ func (handler *SpendingHandler) handleNewSpending(w http.ResponseWriter, r *http
 	}
 
 	spending := models.Spending{
-		//ID:       GenerateRandomString(10),
-		Currency: currency,
-		Amount:   float32(amount),
-		Kind:     spendKind,
-		// more accurate would be to take the client timestamp
-		Timestamp: time.Now(),
+		Currency:  req.Currency,
+		Amount:    req.Amount,
+		Kind:      spendKind,
+		Timestamp: req.timestamp(time.Now()),
 	}
 
 	// will also add this spending to user.spends
-	err = handler.usersService.StoreSpending(user, spending)
+	err = handler.usersService.StoreSpending(r.Context(), user, &spending)
 	if err != nil {
 		log.Errorf("new spending, error 9004: %s", err.Error())
 		platform.SendAPIErrorResp(w, "server error 9004", http.StatusInternalServerError)
@@ -4,47 +4,40 @@ import (
 	"net/http"
 
 	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
 	"github.com/2beens/ispend/internal/platform"
 	"github.com/gorilla/mux"
 )
 
 type SpendKindHandler struct {
-	db                  db.SpenderDB
-	loginSessionHandler *platform.LoginSessionManager
+	db db.SpenderDB
 }
 
-func SpendKindHandlerSetup(router *mux.Router, db db.SpenderDB, loginSessionManager *platform.LoginSessionManager) {
+func SpendKindHandlerSetup(router *mux.Router, db db.SpenderDB) {
 	handler := &SpendKindHandler{
-		db:                  db,
-		loginSessionHandler: loginSessionManager,
+		db: db,
 	}
 
-	router.HandleFunc("", handler.handleGetDefSpendKinds).Methods("GET")
-	router.HandleFunc("/{username}", handler.handleGetSpendKinds).Methods("GET")
+	router.HandleFunc("", requireLogin(handler.handleGetDefSpendKinds)).Methods("GET")
+	router.HandleFunc("/{username}", requireOwner(platform.PermReadOwnData, handler.handleGetSpendKinds)).Methods("GET")
 }
 
 func (handler *SpendKindHandler) handleGetDefSpendKinds(w http.ResponseWriter, r *http.Request) {
-	//TODO: check logged
-
 	//TODO: don't go directly to DB
 
-	spKinds, err := handler.db.GetAllDefaultSpendKinds()
+	spKinds, err := handler.db.GetAllDefaultSpendKinds(r.Context())
 	if err != nil {
 		platform.SendAPIErrorResp(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	platform.SendAPIOKRespWithData(w, "success", spKinds)
+	platform.SendAPIOKRespWithData(w, "success", models.NewSpendKindDTOs(spKinds))
 }
 
 func (handler *SpendKindHandler) handleGetSpendKinds(w http.ResponseWriter, r *http.Request) {
-	//TODO: check logged
-
-	vars := mux.Vars(r)
-	username := vars["username"]
-	spKinds, err := handler.db.GetSpendKinds(username)
+	spKinds, err := handler.db.GetSpendKinds(r.Context(), principal(r).Username)
 	if err != nil {
 		platform.SendAPIErrorResp(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	platform.SendAPIOKRespWithData(w, "success", spKinds)
+	platform.SendAPIOKRespWithData(w, "success", models.NewSpendKindDTOs(spKinds))
 }
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenHandler is the OAuth2 style token API for clients which cannot keep a cookie session, e.g. mobile apps.
+// Its responses follow RFC 6749 and RFC 7009 instead of the models.APIResponse envelope, so that
+// any OAuth2 client library can talk to it.
+type TokenHandler struct {
+	usersService   *services.UsersService
+	totpService    *services.TOTPService
+	loginThrottler *services.LoginThrottler
+	tokenIssuer    *platform.TokenIssuer
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func TokenHandlerSetup(
+	router *mux.Router,
+	usersService *services.UsersService,
+	totpService *services.TOTPService,
+	loginThrottler *services.LoginThrottler,
+	tokenIssuer *platform.TokenIssuer,
+) {
+	handler := &TokenHandler{
+		usersService:   usersService,
+		totpService:    totpService,
+		loginThrottler: loginThrottler,
+		tokenIssuer:    tokenIssuer,
+	}
+
+	router.HandleFunc("/oauth/token", handler.handleToken).Methods("POST")
+	router.HandleFunc("/oauth/revoke", handler.handleRevoke).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", handler.handleJWKS).Methods("GET")
+}
+
+func (handler *TokenHandler) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		sendOAuthError(w, "invalid_request", "cannot parse the form", http.StatusBadRequest)
+		return
+	}
+
+	var pair *platform.TokenPair
+	var err error
+	switch grantType := r.PostFormValue("grant_type"); grantType {
+	case "password":
+		username := r.PostFormValue("username")
+		password := r.PostFormValue("password")
+		if username == "" || password == "" {
+			sendOAuthError(w, "invalid_request", "missing username or password", http.StatusBadRequest)
+			return
+		}
+		ip := platform.RequestIP(r)
+		var wait time.Duration
+		wait, err = handler.loginThrottler.Check(r.Context(), username, ip)
+		if err == nil && wait > 0 {
+			setRetryAfter(w, wait)
+			sendOAuthError(w, "slow_down", "too many failed logins, try again later", http.StatusTooManyRequests)
+			return
+		}
+		if err == nil {
+			_, err = handler.usersService.Authenticate(r.Context(), username, password)
+			if err == platform.ErrNotFound || err == platform.ErrWrongPassword {
+				loginFailed(r.Context(), handler.loginThrottler, username, ip)
+				sendOAuthError(w, "invalid_grant", "wrong username/password", http.StatusBadRequest)
+				return
+			}
+			if err == platform.ErrPasswordHasherBusy {
+				setRetryAfter(w, passwordHasherRetryAfter)
+				sendOAuthError(w, "temporarily_unavailable", err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if err == nil {
+			err = handler.totpService.Verify(r.Context(), username, r.PostFormValue("totp_code"))
+			if err == platform.ErrTOTPRequired {
+				// the client asks for the code and sends it with the password again, as totp_code
+				sendOAuthError(w, "mfa_required", err.Error(), http.StatusForbidden)
+				return
+			}
+			if err == platform.ErrWrongTOTPCode {
+				loginFailed(r.Context(), handler.loginThrottler, username, ip)
+				sendOAuthError(w, "invalid_grant", err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err == nil {
+			loginSucceeded(r.Context(), handler.loginThrottler, username)
+			pair, err = handler.tokenIssuer.Issue(r.Context(), username)
+		}
+	case "refresh_token":
+		refreshToken := r.PostFormValue("refresh_token")
+		if refreshToken == "" {
+			sendOAuthError(w, "invalid_request", "missing refresh_token", http.StatusBadRequest)
+			return
+		}
+		pair, err = handler.tokenIssuer.Refresh(r.Context(), refreshToken)
+		if err == platform.ErrInvalidToken || err == platform.ErrRefreshTokenReused {
+			sendOAuthError(w, "invalid_grant", "invalid refresh token", http.StatusBadRequest)
+			return
+		}
+	case "":
+		sendOAuthError(w, "invalid_request", "missing grant_type", http.StatusBadRequest)
+		return
+	default:
+		sendOAuthError(w, "unsupported_grant_type", "unsupported grant type: "+grantType, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("token endpoint, error 10801: %s", err)
+		sendOAuthError(w, "server_error", "", http.StatusInternalServerError)
+		return
+	}
+
+	sendOAuthJSON(w, tokenResponse{
+		AccessToken:  pair.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(pair.AccessTokenTTL.Seconds()),
+		RefreshToken: pair.RefreshToken,
+	}, http.StatusOK)
+}
+
+func (handler *TokenHandler) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		sendOAuthError(w, "invalid_request", "cannot parse the form", http.StatusBadRequest)
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		sendOAuthError(w, "invalid_request", "missing token", http.StatusBadRequest)
+		return
+	}
+
+	if err := handler.tokenIssuer.Revoke(r.Context(), token); err != nil {
+		log.Errorf("revoke endpoint, error 10802: %s", err)
+		sendOAuthError(w, "server_error", "", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (handler *TokenHandler) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// clients refetch it anyway when a token comes with a key ID they don't know yet
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(handler.tokenIssuer.JWKS()); err != nil {
+		log.Errorf("jwks endpoint, error 10803: %s", err)
+	}
+}
+
+func sendOAuthError(w http.ResponseWriter, code, description string, status int) {
+	sendOAuthJSON(w, oauthErrorResponse{Error: code, ErrorDescription: description}, status)
+}
+
+func sendOAuthJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("oauth response error: %s", err)
+	}
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// TOTPHandler manages the two-factor authentication of the users, the codes are checked at login by UsersHandler
+type TOTPHandler struct {
+	totpService *services.TOTPService
+}
+
+func TOTPHandlerSetup(router *mux.Router, totpService *services.TOTPService) {
+	handler := &TOTPHandler{
+		totpService: totpService,
+	}
+
+	router.HandleFunc("/{username}/totp", requireOwner(platform.PermManageOwnAccount, handler.handleGetStatus)).Methods("GET")
+	router.HandleFunc("/{username}/totp", requireOwner(platform.PermManageOwnAccount, handler.handleEnroll)).Methods("POST")
+	router.HandleFunc("/{username}/totp/qr.png", requireOwner(platform.PermManageOwnAccount, handler.handleQRCode)).Methods("GET")
+	router.HandleFunc("/{username}/totp/enable", requireOwner(platform.PermManageOwnAccount, handler.handleEnable)).Methods("POST")
+	router.HandleFunc("/{username}/totp/disable", requireOwner(platform.PermManageOwnAccount, handler.handleDisable)).Methods("POST")
+	router.HandleFunc("/{username}/totp/recovery-codes", requireOwner(platform.PermManageOwnAccount, handler.handleRegenerateRecoveryCodes)).Methods("POST")
+}
+
+func (handler *TOTPHandler) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := handler.totpService.Status(r.Context(), principal(r).Username)
+	if err != nil {
+		log.Errorf("get totp status error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109051", http.StatusInternalServerError)
+		return
+	}
+	platform.SendAPIOKRespWithData(w, "success", status)
+}
+
+func (handler *TOTPHandler) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := handler.totpService.Enroll(r.Context(), principal(r).Username)
+	if err == platform.ErrTOTPAlreadyEnabled {
+		platform.SendAPIErrorResp(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Errorf("totp enroll error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109052", http.StatusInternalServerError)
+		return
+	}
+	platform.SendAPIOKRespWithData(w, "scan the QR code and confirm with a code from the app", enrollment)
+}
+
+func (handler *TOTPHandler) handleQRCode(w http.ResponseWriter, r *http.Request) {
+	png, err := handler.totpService.QRCode(r.Context(), principal(r).Username)
+	if err == platform.ErrTOTPAlreadyEnabled || err == platform.ErrTOTPNotEnrolled {
+		platform.SendAPIErrorResp(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("totp qr code error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109053", http.StatusInternalServerError)
+		return
+	}
+
+	// the QR code holds the secret
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(png); err != nil {
+		log.Errorf("totp qr code write error: %s", err)
+	}
+}
+
+func (handler *TOTPHandler) handleEnable(w http.ResponseWriter, r *http.Request) {
+	code, ok := totpCodeFromForm(w, r)
+	if !ok {
+		return
+	}
+
+	recoveryCodes, err := handler.totpService.Enable(r.Context(), principal(r).Username, code)
+	if !handler.checkTOTPError(w, err, "109054") {
+		return
+	}
+	platform.SendAPIOKRespWithData(w, "two-factor authentication enabled, keep the recovery codes safe", recoveryCodes)
+}
+
+func (handler *TOTPHandler) handleDisable(w http.ResponseWriter, r *http.Request) {
+	code, ok := totpCodeFromForm(w, r)
+	if !ok {
+		return
+	}
+
+	err := handler.totpService.Disable(r.Context(), principal(r).Username, code)
+	if !handler.checkTOTPError(w, err, "109055") {
+		return
+	}
+	platform.SendAPIOKResp(w, "two-factor authentication disabled")
+}
+
+func (handler *TOTPHandler) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	code, ok := totpCodeFromForm(w, r)
+	if !ok {
+		return
+	}
+
+	recoveryCodes, err := handler.totpService.RegenerateRecoveryCodes(r.Context(), principal(r).Username, code)
+	if !handler.checkTOTPError(w, err, "109056") {
+		return
+	}
+	platform.SendAPIOKRespWithData(w, "new recovery codes, the old ones do not work anymore", recoveryCodes)
+}
+
+// checkTOTPError sends the error response for err, and tells if there was none
+func (handler *TOTPHandler) checkTOTPError(w http.ResponseWriter, err error, errorCode string) bool {
+	switch err {
+	case nil:
+		return true
+	case platform.ErrWrongTOTPCode:
+		platform.SendAPIErrorResp(w, err.Error(), http.StatusBadRequest)
+	case platform.ErrTOTPAlreadyEnabled, platform.ErrTOTPNotEnabled, platform.ErrTOTPNotEnrolled:
+		platform.SendAPIErrorResp(w, err.Error(), http.StatusConflict)
+	default:
+		log.Errorf("totp error %s: %s", errorCode, err)
+		platform.SendAPIErrorResp(w, "internal server error "+errorCode, http.StatusInternalServerError)
+	}
+	return false
+}
+
+func totpCodeFromForm(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req totpCodeRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
+		return "", false
+	}
+	return req.Code, true
+}
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/2beens/ispend/internal/models"
 	"github.com/2beens/ispend/internal/platform"
@@ -10,50 +12,60 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const maxDeleteFormSize = 4096
+
 type UsersHandler struct {
 	router              *mux.Router
 	usersService        *services.UsersService
+	accountService      *services.AccountService
+	totpService         *services.TOTPService
+	loginThrottler      *services.LoginThrottler
 	loginSessionManager *platform.LoginSessionManager
+	secureCookies       bool
 }
 
-func UsersHandlerSetup(router *mux.Router, usersService *services.UsersService, loginSessionManager *platform.LoginSessionManager) {
+func UsersHandlerSetup(
+	router *mux.Router,
+	usersService *services.UsersService,
+	accountService *services.AccountService,
+	totpService *services.TOTPService,
+	loginThrottler *services.LoginThrottler,
+	loginSessionManager *platform.LoginSessionManager,
+	secureCookies bool,
+) {
 	handler := &UsersHandler{
 		router:              router,
 		usersService:        usersService,
+		accountService:      accountService,
+		totpService:         totpService,
+		loginThrottler:      loginThrottler,
 		loginSessionManager: loginSessionManager,
+		secureCookies:       secureCookies,
 	}
 
-	router.HandleFunc("", handler.handleGetAllUsers).Methods("GET")
+	router.HandleFunc("", requirePermission(platform.PermManageUsers, handler.handleGetAllUsers)).Methods("GET")
 	router.HandleFunc("", handler.handleNewUser).Methods("POST")
-	router.HandleFunc("/me/{username}/{cookie}", handler.handleGetMe).Methods("GET")
+	router.HandleFunc("/me", requireLogin(handler.handleGetMe)).Methods("GET")
 	router.HandleFunc("/login", handler.handleLogin).Methods("POST")
-	router.HandleFunc("/login/check", handler.handleCheckSessionID).Methods("POST")
+	router.HandleFunc("/login/check", handler.handleCheckSessionID).Methods("GET")
 	router.HandleFunc("/logout", handler.handleLogout).Methods("POST")
-	router.HandleFunc("/{username}", handler.handleGetUser).Methods("GET")
+	router.HandleFunc("/verify-email", handler.handleVerifyEmail).Methods("GET")
+	router.HandleFunc("/verify-email", requirePermission(platform.PermManageOwnAccount, handler.handleResendVerification)).Methods("POST")
+	router.HandleFunc("/password/forgot", handler.handleForgotPassword).Methods("POST")
+	router.HandleFunc("/password/reset", handler.handleResetPassword).Methods("POST")
+	router.HandleFunc("/{username}/sessions", requireOwner(platform.PermManageOwnAccount, handler.handleGetSessions)).Methods("GET")
+	router.HandleFunc("/{username}/sessions", requireOwner(platform.PermManageOwnAccount, handler.handleRevokeOtherSessions)).Methods("DELETE")
+	router.HandleFunc("/{username}/sessions/{id}", requireOwner(platform.PermManageOwnAccount, handler.handleRevokeSession)).Methods("DELETE")
+	router.HandleFunc("/{username}/role", requirePermission(platform.PermManageUsers, handler.handleSetRole)).Methods("PUT")
+	router.HandleFunc("/{username}/profile", requireOwner(platform.PermManageOwnAccount, handler.handleUpdateProfile)).Methods("PATCH")
+	router.HandleFunc("/{username}/email", requireOwner(platform.PermManageOwnAccount, handler.handleChangeEmail)).Methods("PUT")
+	router.HandleFunc("/{username}/password", requireOwner(platform.PermManageOwnAccount, handler.handleChangePassword)).Methods("PUT")
+	router.HandleFunc("/{username}", requireOwner(platform.PermReadOwnData, handler.handleGetUser)).Methods("GET")
+	router.HandleFunc("/{username}", requireOwner(platform.PermManageOwnAccount, handler.handleDeleteAccount)).Methods("DELETE")
 }
 
 func (handler *UsersHandler) handleGetMe(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
-	// TODO: cookie should be transported via body/header, not query param
-	cookie := vars["cookie"]
-	if username == "" {
-		platform.SendAPIErrorResp(w, "wrong username", http.StatusBadRequest)
-		return
-	}
-	if cookie == "" {
-		platform.SendAPIErrorResp(w, "must be logged in", http.StatusBadRequest)
-		return
-	}
-
-	loginSession, err := handler.loginSessionManager.GetBySessionID(cookie)
-	if err != nil {
-		platform.SendAPIErrorResp(w, "server error 9001", http.StatusInternalServerError)
-		log.Warnf("error [%s]: %s", r.URL.Path, err.Error())
-		return
-	}
-
-	user, err := handler.usersService.GetUser(loginSession.Username)
+	user, err := handler.usersService.GetUser(r.Context(), principal(r).Username)
 	if err != nil {
 		platform.SendAPIErrorResp(w, "server error 9002", http.StatusInternalServerError)
 		log.Warnf("error [%s]: %s", r.URL.Path, err.Error())
@@ -65,220 +77,478 @@ func (handler *UsersHandler) handleGetMe(w http.ResponseWriter, r *http.Request)
 }
 
 func (handler *UsersHandler) handleGetAllUsers(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+	users, err := handler.usersService.GetAllUsers(r.Context())
+	if err != nil {
+		platform.SendAPIErrorResp(w, "internal server error 10002", http.StatusInternalServerError)
+		log.Warnf("error getting all users [handleGetAllUsers]: %s", err.Error())
+		return
+	}
+	userDTOs := make([]models.UserDTO, 0, len(users))
+	for _, user := range users {
+		userDTOs = append(userDTOs, models.NewUserDTO(user))
+	}
+	platform.SendAPIOKRespWithData(w, "success", userDTOs)
+}
+
+func (handler *UsersHandler) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	var req setRoleRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
 		return
 	}
 
-	username := r.FormValue("username")
-	sessionID := r.Header.Get("X-Ispend-SessionID")
-	if handler.loginSessionManager.IsUserNotLoggedIn(sessionID, username) {
-		platform.SendAPIErrorResp(w, "must be logged in", http.StatusUnauthorized)
+	username := mux.Vars(r)["username"]
+	// an admin demoting themselves by mistake could leave no admin at all
+	if username == principal(r).Username {
+		platform.SendAPIErrorResp(w, "cannot change your own role", http.StatusForbidden)
 		return
 	}
 
-	users, err := handler.usersService.GetAllUsers()
+	err := handler.usersService.SetRole(r.Context(), username, req.Role)
+	if err == platform.ErrInvalidRole {
+		platform.SendAPIErrorResp(w, "invalid role: "+req.Role, http.StatusBadRequest)
+		return
+	}
+	if err == platform.ErrNotFound {
+		platform.SendAPIErrorResp(w, "error, user does not exists", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		platform.SendAPIErrorResp(w, "internal server error 10002", http.StatusInternalServerError)
-		log.Warnf("error getting all users [handleGetAllUsers]: %s", err.Error())
+		log.Errorf("set user role error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109031", http.StatusInternalServerError)
 		return
 	}
-	platform.SendAPIOKRespWithData(w, "success", users)
+
+	log.Infof("user [%s] role set to [%s] by [%s]", username, req.Role, principal(r).Username)
+	platform.SendAPIOKResp(w, "success")
 }
 
 func (handler *UsersHandler) handleGetUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
-	user, err := handler.usersService.GetUser(username)
+	user, err := handler.usersService.GetUser(r.Context(), principal(r).Username)
 	if err != nil {
 		platform.SendAPIErrorResp(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	platform.SendAPIOKRespWithData(w, "success", user)
+	platform.SendAPIOKRespWithData(w, "success", models.NewUserDTO(user))
 }
 
 func (handler *UsersHandler) handleLogout(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+	p := principal(r)
+	if p == nil || p.Session == nil {
+		// the session is gone already, make sure the browser forgets it too
+		clearSessionCookies(w, handler.secureCookies)
+		platform.SendAPIErrorResp(w, "error, session not found", http.StatusNotFound)
 		return
 	}
 
-	cookieId := r.FormValue("sessionId")
-	if cookieId == "" {
-		platform.SendAPIErrorResp(w, "missing sessionId", http.StatusBadRequest)
+	log.Tracef(" > logout user: [%s]", p.Username)
+
+	err := handler.loginSessionManager.RemoveSession(r.Context(), platform.SessionIDFromRequest(r))
+	if err != nil && err != platform.ErrNotFound {
+		log.Errorf("logout error: %s", err.Error())
+		platform.SendAPIErrorResp(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-	username := r.FormValue("username")
-	if username == "" {
-		platform.SendAPIErrorResp(w, "missing username", http.StatusBadRequest)
+
+	clearSessionCookies(w, handler.secureCookies)
+	platform.SendAPIOKResp(w, "success")
+}
+
+func (handler *UsersHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
 		return
 	}
+	username, password := req.Username, req.Password
 
-	log.Tracef(" > logout user: [%s][%s]", username, cookieId)
+	// checked before the password, so the throttled logins don't even cost the hashing
+	if !checkLoginThrottle(w, r, handler.loginThrottler, username) {
+		return
+	}
 
-	session, err := handler.loginSessionManager.GetBySessionID(cookieId)
+	ip := platform.RequestIP(r)
+	_, err := handler.usersService.Authenticate(r.Context(), username, password)
+	if err == platform.ErrNotFound {
+		loginFailed(r.Context(), handler.loginThrottler, username, ip)
+		platform.SendAPIErrorResp(w, "error, user does not exists", http.StatusBadRequest)
+		return
+	}
+	if err == platform.ErrWrongPassword {
+		loginFailed(r.Context(), handler.loginThrottler, username, ip)
+		platform.SendAPIErrorResp(w, "wrong username/password", http.StatusBadRequest)
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusy(w)
+		return
+	}
 	if err != nil {
-		if err == platform.ErrNotFound {
-			platform.SendAPIErrorResp(w, "error, session not found", http.StatusNotFound)
-		} else {
-			log.Errorf("logout error: %s", err.Error())
-			platform.SendAPIErrorResp(w, "internal server error", http.StatusInternalServerError)
-		}
+		log.Errorf("error while logging user: %s", err.Error())
+		platform.SendAPIErrorResp(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
-	if session.Username != username {
-		log.Errorf("error 10102, s. username [%s], username: %s", session.Username, username)
-		platform.SendAPIErrorResp(w, "internal server error", http.StatusInternalServerError)
+	// the second step for the users with two-factor authentication, the web UI asks for the
+	// code when it sees totp_required, and sends it together with the password again
+	err = handler.totpService.Verify(r.Context(), username, req.TOTPCode)
+	if err == platform.ErrTOTPRequired {
+		platform.SendAPIResp(w, models.APIResponse{
+			Status:  http.StatusUnauthorized,
+			Message: err.Error(),
+			IsError: true,
+			Data:    map[string]bool{"totp_required": true},
+		})
+		return
+	}
+	if err == platform.ErrWrongTOTPCode {
+		loginFailed(r.Context(), handler.loginThrottler, username, ip)
+		platform.SendAPIErrorResp(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Errorf("error while checking the two-factor code: %s", err.Error())
+		platform.SendAPIErrorResp(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	loginSucceeded(r.Context(), handler.loginThrottler, username)
+	if !startLoginSession(w, r, handler.loginSessionManager, username, req.DeviceName, handler.secureCookies) {
+		return
+	}
+	platform.SendAPIOKResp(w, "success")
+}
+
+func (handler *UsersHandler) handleNewUser(w http.ResponseWriter, r *http.Request) {
+	var req newUserRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
 		return
 	}
 
-	err = handler.loginSessionManager.Remove(session.Username)
+	log.Tracef("creating new user [%s] ...", req.Username)
+
+	_, err := handler.accountService.Register(r.Context(), req.Username, req.Email, req.Password)
+	if platform.IsPasswordPolicyError(err) {
+		platform.SendAPIValidationErrorResp(w, passwordPolicyErrors("password", err))
+		return
+	}
+	if err == platform.ErrAlreadyExists {
+		platform.SendAPIErrorResp(w, "error, user exists", http.StatusConflict)
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusy(w)
+		return
+	}
 	if err != nil {
-		if err == platform.ErrNotFound {
-			log.Errorf("error 10103, s. username [%s], username: %s", session.Username, username)
-			platform.SendAPIErrorResp(w, "error, session not found", http.StatusNotFound)
-		} else {
-			log.Errorf("logout error: %s", err.Error())
-			platform.SendAPIErrorResp(w, "internal server error", http.StatusInternalServerError)
-		}
+		log.Errorf("error while adding new user: %s", err.Error())
+		platform.SendAPIErrorResp(w, "server error", http.StatusInternalServerError)
+		return
 	}
 
 	platform.SendAPIOKResp(w, "success")
 }
 
-func (handler *UsersHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+func (handler *UsersHandler) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if !bindForm(w, r.URL.Query(), &req) {
 		return
 	}
 
-	password := r.FormValue("password")
-	if password == "" {
-		platform.SendAPIErrorResp(w, "missing password", http.StatusBadRequest)
+	username, err := handler.accountService.VerifyEmail(r.Context(), req.Token)
+	if err == platform.ErrInvalidToken {
+		platform.SendAPIErrorResp(w, "invalid or expired link", http.StatusBadRequest)
 		return
 	}
-	username := r.FormValue("username")
-	if username == "" {
-		platform.SendAPIErrorResp(w, "missing username", http.StatusBadRequest)
+	if err != nil {
+		log.Errorf("verify email error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109041", http.StatusInternalServerError)
 		return
 	}
 
-	user, err := handler.usersService.GetUser(username)
-	if err != nil && err != platform.ErrNotFound {
-		log.Errorf("error while logging user: %s", err.Error())
-		platform.SendAPIErrorResp(w, "server error", http.StatusInternalServerError)
+	log.Debugf("user [%s] verified the email address", username)
+	platform.SendAPIOKResp(w, "email verified")
+}
+
+func (handler *UsersHandler) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	err := handler.accountService.SendVerificationEmail(r.Context(), principal(r).Username)
+	if err == platform.ErrEmailAlreadyVerified {
+		platform.SendAPIErrorResp(w, "email already verified", http.StatusConflict)
 		return
 	}
-	if user == nil {
-		platform.SendAPIErrorResp(w, "error, user does not exists", http.StatusBadRequest)
+	if err != nil {
+		log.Errorf("resend verification email error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109042", http.StatusInternalServerError)
 		return
 	}
-	if !platform.CheckPasswordHash(password, user.Password) {
-		platform.SendAPIErrorResp(w, "wrong username/password", http.StatusBadRequest)
+
+	platform.SendAPIOKResp(w, "success")
+}
+
+func (handler *UsersHandler) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req usernameRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
 		return
 	}
 
-	session, err := handler.loginSessionManager.GetByUsername(username)
-	if err == nil && session != nil {
-		platform.SendAPIOKRespWithData(w, "success", session.SessionID)
+	if err := handler.accountService.RequestPasswordReset(r.Context(), req.Username); err != nil {
+		log.Errorf("password reset request error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109043", http.StatusInternalServerError)
 		return
 	}
 
-	cookieID := handler.loginSessionManager.New(username)
-	platform.SendAPIOKRespWithData(w, "success", cookieID)
+	// the same answer for unknown users, so nobody can find out who has an account
+	platform.SendAPIOKResp(w, "if the user exists and has a verified email address, a reset link is on its way")
 }
 
-func (handler *UsersHandler) handleNewUser(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
-		platform.SendAPIErrorResp(w, "internal server error 109011", http.StatusInternalServerError)
+func (handler *UsersHandler) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
+		return
+	}
+
+	err := handler.accountService.ResetPassword(r.Context(), req.Token, req.Password)
+	if err == platform.ErrInvalidToken {
+		platform.SendAPIErrorResp(w, "invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	if platform.IsPasswordPolicyError(err) {
+		platform.SendAPIValidationErrorResp(w, passwordPolicyErrors("password", err))
 		return
 	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusy(w)
+		return
+	}
+	if err != nil {
+		log.Errorf("password reset error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109044", http.StatusInternalServerError)
+		return
+	}
+
+	// this browser may have been logged in too
+	clearSessionCookies(w, handler.secureCookies)
+	platform.SendAPIOKResp(w, "success")
+}
 
-	password := r.FormValue("password")
-	if password == "" {
-		platform.SendAPIErrorResp(w, "missing password", http.StatusBadRequest)
+// handleUpdateProfile changes only the profile fields sent in the form, the others stay as they are
+func (handler *UsersHandler) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var req updateProfileRequest
+	if !parseForm(w, r) || !bindForm(w, r.PostForm, &req) {
 		return
 	}
 
-	// hash password
-	passwordHash, err := platform.HashPassword(password)
+	username := principal(r).Username
+	user, err := handler.usersService.GetUser(r.Context(), username)
 	if err != nil {
-		log.Errorf("error [getting password hash] while adding new user: %s", err)
-		platform.SendAPIErrorResp(w, "server error 111111", http.StatusInternalServerError)
+		log.Errorf("update profile error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109081", http.StatusInternalServerError)
 		return
 	}
 
-	username := r.FormValue("username")
-	if username == "" {
-		platform.SendAPIErrorResp(w, "missing username", http.StatusBadRequest)
+	profile := req.apply(user.Profile)
+	err = handler.usersService.UpdateProfile(r.Context(), username, profile)
+	if isProfileError(err) {
+		platform.SendAPIErrorResp(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	existingUser, err := handler.usersService.GetUser(username)
-	if err != nil && err != platform.ErrNotFound {
-		log.Errorf("error while adding new user: %s", err.Error())
-		platform.SendAPIErrorResp(w, "server error", http.StatusInternalServerError)
+	if err != nil {
+		log.Errorf("update profile error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109082", http.StatusInternalServerError)
 		return
 	}
-	if existingUser != nil {
-		platform.SendAPIErrorResp(w, "error, user exists", http.StatusConflict)
+
+	platform.SendAPIOKRespWithData(w, "success", profile)
+}
+
+func isProfileError(err error) bool {
+	switch err {
+	case platform.ErrDisplayNameTooLong, platform.ErrInvalidCurrency, platform.ErrInvalidTimezone, platform.ErrInvalidLocale:
+		return true
+	}
+	return false
+}
+
+func (handler *UsersHandler) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var req changeEmailRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
 		return
 	}
 
-	email := r.FormValue("email")
-	if email == "" {
-		log.Tracef("new user - missing email")
+	username := principal(r).Username
+	if !checkLoginThrottle(w, r, handler.loginThrottler, username) {
+		return
+	}
+	err := handler.accountService.ChangeEmail(r.Context(), username, req.Password, req.Email)
+	if err == platform.ErrWrongPassword {
+		loginFailed(r.Context(), handler.loginThrottler, username, platform.RequestIP(r))
+		platform.SendAPIErrorResp(w, "wrong password", http.StatusBadRequest)
+		return
+	}
+	if err == platform.ErrAlreadyExists {
+		platform.SendAPIErrorResp(w, "the email is used by another account", http.StatusConflict)
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusy(w)
+		return
+	}
+	if err != nil {
+		log.Errorf("change email error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109083", http.StatusInternalServerError)
+		return
 	}
 
-	log.Tracef("creating new user [%s], pass [%s] ...", username, passwordHash)
+	platform.SendAPIOKResp(w, "success, check your inbox to verify the new address")
+}
+
+func (handler *UsersHandler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
+		return
+	}
 
-	spKinds, err := handler.usersService.GetAllDefaultSpendKinds()
+	username := principal(r).Username
+	if !checkLoginThrottle(w, r, handler.loginThrottler, username) {
+		return
+	}
+	// this session stays, the other ones and all the API tokens end
+	err := handler.accountService.ChangePassword(r.Context(), username, req.OldPassword, req.NewPassword, platform.SessionIDFromRequest(r))
+	if err == platform.ErrWrongPassword {
+		loginFailed(r.Context(), handler.loginThrottler, username, platform.RequestIP(r))
+		platform.SendAPIErrorResp(w, "wrong password", http.StatusBadRequest)
+		return
+	}
+	if platform.IsPasswordPolicyError(err) {
+		platform.SendAPIValidationErrorResp(w, passwordPolicyErrors("new_password", err))
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusy(w)
+		return
+	}
 	if err != nil {
-		log.Errorf("error getting spend kinds: %s", err.Error())
-		platform.SendAPIErrorResp(w, "server error", http.StatusInternalServerError)
+		log.Errorf("change password error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109084", http.StatusInternalServerError)
 		return
 	}
-	user := models.NewUser(email, username, passwordHash, spKinds)
-	err = handler.usersService.AddUser(user)
+
+	platform.SendAPIOKResp(w, "success")
+}
+
+// handleDeleteAccount erases the user with all its data, the password comes in the urlencoded body
+func (handler *UsersHandler) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	form, err := parseDeleteForm(r)
 	if err != nil {
-		log.Errorf("error while adding new user: %s", err.Error())
-		platform.SendAPIErrorResp(w, "server error", http.StatusInternalServerError)
+		platform.SendAPIErrorResp(w, "cannot parse the form", http.StatusBadRequest)
+		return
+	}
+	var req passwordRequest
+	if !bindForm(w, form, &req) {
+		return
+	}
+
+	p := principal(r)
+	// the last admin deleting itself would leave no admin at all
+	if p.Role == models.RoleAdmin {
+		platform.SendAPIErrorResp(w, "an admin cannot delete its own account, another admin has to demote it first", http.StatusForbidden)
+		return
+	}
+	if !checkLoginThrottle(w, r, handler.loginThrottler, p.Username) {
+		return
+	}
+	err = handler.accountService.DeleteAccount(r.Context(), p.Username, req.Password)
+	if err == platform.ErrWrongPassword {
+		loginFailed(r.Context(), handler.loginThrottler, p.Username, platform.RequestIP(r))
+		platform.SendAPIErrorResp(w, "wrong password", http.StatusBadRequest)
+		return
+	}
+	if err == platform.ErrPasswordHasherBusy {
+		sendPasswordHasherBusy(w)
+		return
+	}
+	if err != nil {
+		log.Errorf("delete account error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109085", http.StatusInternalServerError)
 		return
 	}
 
+	clearSessionCookies(w, handler.secureCookies)
 	platform.SendAPIOKResp(w, "success")
-	log.Tracef("new user [%s] created", username)
+}
+
+// parseDeleteForm parses the urlencoded body of a DELETE request, which r.ParseForm leaves out
+func parseDeleteForm(r *http.Request) (url.Values, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxDeleteFormSize))
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(string(body))
 }
 
 func (handler *UsersHandler) handleCheckSessionID(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+	var req usernameRequest
+	if !parseForm(w, r) || !bindForm(w, r.Form, &req) {
 		return
 	}
 
-	sessionID := r.FormValue("sessionId")
-	if sessionID == "" {
-		platform.SendAPIErrorResp(w, "missing sessionID", http.StatusBadRequest)
+	if p := principal(r); p == nil || p.Username != req.Username {
+		platform.SendAPIOKResp(w, "false")
 		return
 	}
 
-	username := r.FormValue("username")
-	if username == "" {
-		platform.SendAPIErrorResp(w, "missing username", http.StatusBadRequest)
+	platform.SendAPIOKResp(w, "true")
+}
+
+func (handler *UsersHandler) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	p := principal(r)
+	sessions, err := handler.loginSessionManager.GetAllByUsername(r.Context(), p.Username)
+	if err != nil {
+		log.Errorf("get login sessions error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109021", http.StatusInternalServerError)
 		return
 	}
 
-	session, err := handler.loginSessionManager.GetBySessionID(sessionID)
-	if err != nil && err != platform.ErrNotFound {
-		log.Errorf("check session id error: %s", err)
-		platform.SendAPIErrorResp(w, "internal server error 109013", http.StatusInternalServerError)
+	platform.SendAPIOKRespWithData(w, "success", newLoginSessionDTOs(sessions, p.Session))
+}
+
+// newLoginSessionDTOs marks the current session, the one the request came with, if any
+func newLoginSessionDTOs(sessions []platform.LoginSession, current *platform.LoginSession) []models.LoginSessionDTO {
+	sessionDTOs := make([]models.LoginSessionDTO, 0, len(sessions))
+	for _, session := range sessions {
+		sessionDTOs = append(sessionDTOs, models.LoginSessionDTO{
+			ID:         session.PublicID(),
+			DeviceName: session.DeviceName,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeen:   session.LastSeen,
+			Current:    current != nil && session.TokenHash == current.TokenHash,
+		})
+	}
+	return sessionDTOs
+}
+
+func (handler *UsersHandler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	err := handler.loginSessionManager.RemoveByPublicID(r.Context(), principal(r).Username, mux.Vars(r)["id"])
+	if err != nil {
+		if err == platform.ErrNotFound {
+			platform.SendAPIErrorResp(w, "error, session not found", http.StatusNotFound)
+		} else {
+			log.Errorf("revoke login session error: %s", err)
+			platform.SendAPIErrorResp(w, "internal server error 109022", http.StatusInternalServerError)
+		}
 		return
 	}
-	if err == platform.ErrNotFound || (session != nil && session.Username != username) {
-		platform.SendAPIOKResp(w, "false")
+
+	platform.SendAPIOKResp(w, "success")
+}
+
+func (handler *UsersHandler) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	revoked, err := handler.loginSessionManager.RemoveOthers(r.Context(), principal(r).Username, platform.SessionIDFromRequest(r))
+	if err != nil {
+		log.Errorf("revoke other login sessions error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109023", http.StatusInternalServerError)
 		return
 	}
 
-	platform.SendAPIOKResp(w, "true")
+	platform.SendAPIOKRespWithData(w, "success", revoked)
 }
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPasskeyResponseSize bounds the browser's JSON responses to the passkey ceremonies
+const maxPasskeyResponseSize = 64 << 10
+
+// WebAuthnHandler manages the users' passkeys, and logs them in with those. Each ceremony has two
+// steps: begin gives the browser the options for navigator.credentials, and finish takes its result
+// as the JSON body, together with the ceremony ID from begin in the ceremony query param.
+type WebAuthnHandler struct {
+	webAuthnService     *services.WebAuthnService
+	loginSessionManager *platform.LoginSessionManager
+	secureCookies       bool
+}
+
+func WebAuthnHandlerSetup(
+	router *mux.Router,
+	webAuthnService *services.WebAuthnService,
+	loginSessionManager *platform.LoginSessionManager,
+	secureCookies bool,
+) {
+	handler := &WebAuthnHandler{
+		webAuthnService:     webAuthnService,
+		loginSessionManager: loginSessionManager,
+		secureCookies:       secureCookies,
+	}
+
+	router.HandleFunc("/login/webauthn/begin", handler.handleBeginLogin).Methods("POST")
+	router.HandleFunc("/login/webauthn/finish", handler.handleFinishLogin).Methods("POST")
+	router.HandleFunc("/{username}/webauthn/credentials", requireOwner(platform.PermManageOwnAccount, handler.handleGetCredentials)).Methods("GET")
+	router.HandleFunc("/{username}/webauthn/credentials/{id}", requireOwner(platform.PermManageOwnAccount, handler.handleDeleteCredential)).Methods("DELETE")
+	router.HandleFunc("/{username}/webauthn/register/begin", requireOwner(platform.PermManageOwnAccount, handler.handleBeginRegistration)).Methods("POST")
+	router.HandleFunc("/{username}/webauthn/register/finish", requireOwner(platform.PermManageOwnAccount, handler.handleFinishRegistration)).Methods("POST")
+}
+
+func (handler *WebAuthnHandler) handleGetCredentials(w http.ResponseWriter, r *http.Request) {
+	credentials, err := handler.webAuthnService.Credentials(r.Context(), principal(r).Username)
+	if err != nil {
+		log.Errorf("get passkeys error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109061", http.StatusInternalServerError)
+		return
+	}
+	credentialDTOs := make([]models.WebAuthnCredentialDTO, 0, len(credentials))
+	for i := range credentials {
+		credentialDTOs = append(credentialDTOs, models.NewWebAuthnCredentialDTO(&credentials[i]))
+	}
+	platform.SendAPIOKRespWithData(w, "success", credentialDTOs)
+}
+
+func (handler *WebAuthnHandler) handleDeleteCredential(w http.ResponseWriter, r *http.Request) {
+	credentialID, err := services.DecodeCredentialID(mux.Vars(r)["id"])
+	if err != nil {
+		platform.SendAPIErrorResp(w, "invalid passkey id", http.StatusBadRequest)
+		return
+	}
+	err = handler.webAuthnService.DeleteCredential(r.Context(), principal(r).Username, credentialID)
+	if err == platform.ErrNotFound {
+		platform.SendAPIErrorResp(w, "passkey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("delete passkey error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109062", http.StatusInternalServerError)
+		return
+	}
+	platform.SendAPIOKResp(w, "passkey deleted")
+}
+
+func (handler *WebAuthnHandler) handleBeginRegistration(w http.ResponseWriter, r *http.Request) {
+	if !parseForm(w, r) {
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = "passkey"
+	}
+	if utf8.RuneCountInString(name) > services.MaxPasskeyNameLength {
+		platform.SendAPIErrorResp(w, "passkey name too long", http.StatusBadRequest)
+		return
+	}
+
+	ceremony, err := handler.webAuthnService.BeginRegistration(r.Context(), principal(r).Username, name)
+	if err != nil {
+		log.Errorf("begin passkey registration error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109063", http.StatusInternalServerError)
+		return
+	}
+	platform.SendAPIOKRespWithData(w, "success", ceremony)
+}
+
+func (handler *WebAuthnHandler) handleFinishRegistration(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxPasskeyResponseSize)
+	credential, err := handler.webAuthnService.FinishRegistration(r.Context(), principal(r).Username, r.URL.Query().Get("ceremony"), r.Body)
+	if !handler.checkPasskeyError(w, err, "109064") {
+		return
+	}
+	platform.SendAPIOKRespWithData(w, "passkey added", models.NewWebAuthnCredentialDTO(credential))
+}
+
+func (handler *WebAuthnHandler) handleBeginLogin(w http.ResponseWriter, r *http.Request) {
+	if !parseForm(w, r) {
+		return
+	}
+
+	// without the username, the browser lets the user pick any of its passkeys for the site
+	ceremony, err := handler.webAuthnService.BeginLogin(r.Context(), r.FormValue("username"))
+	if err == platform.ErrNotFound {
+		platform.SendAPIErrorResp(w, "no passkeys for the user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("begin passkey login error: %s", err)
+		platform.SendAPIErrorResp(w, "internal server error 109065", http.StatusInternalServerError)
+		return
+	}
+	platform.SendAPIOKRespWithData(w, "success", ceremony)
+}
+
+// handleFinishLogin logs the user in like the password login does; the passkeys verify
+// the user themselves, so there is no two-factor code to ask for
+func (handler *WebAuthnHandler) handleFinishLogin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxPasskeyResponseSize)
+	username, err := handler.webAuthnService.FinishLogin(r.Context(), r.URL.Query().Get("ceremony"), r.Body)
+	if !handler.checkPasskeyError(w, err, "109066") {
+		return
+	}
+
+	log.Tracef(" > passkey login user: [%s]", username)
+	if !startLoginSession(w, r, handler.loginSessionManager, username, r.URL.Query().Get("device_name"), handler.secureCookies) {
+		return
+	}
+	platform.SendAPIOKResp(w, "success")
+}
+
+// checkPasskeyError sends the error response for err, and tells if there was none
+func (handler *WebAuthnHandler) checkPasskeyError(w http.ResponseWriter, err error, errorCode string) bool {
+	switch err {
+	case nil:
+		return true
+	case platform.ErrPasskeyCeremonyNotFound:
+		platform.SendAPIErrorResp(w, err.Error(), http.StatusBadRequest)
+	case platform.ErrPasskeyRejected:
+		platform.SendAPIErrorResp(w, err.Error(), http.StatusUnauthorized)
+	case platform.ErrAlreadyExists:
+		platform.SendAPIErrorResp(w, "passkey registered already", http.StatusConflict)
+	default:
+		log.Errorf("passkey error %s: %s", errorCode, err)
+		platform.SendAPIErrorResp(w, "internal server error "+errorCode, http.StatusInternalServerError)
+	}
+	return false
+}
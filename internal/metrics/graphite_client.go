@@ -100,7 +100,7 @@ func (gc *GraphiteClient) Connect() error {
 		}
 	}
 
-	address := fmt.Sprintf("%s:%d", gc.Host, gc.Port)
+	address := net.JoinHostPort(gc.Host, strconv.Itoa(gc.Port))
 
 	if gc.Timeout == 0 {
 		gc.Timeout = defaultTimeout * time.Second
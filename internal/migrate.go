@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+const MigrateUsage = `usage: migrate <command>
+	status          > list all migrations and whether they are applied
+	up              > apply all pending migrations
+	down            > roll back the latest applied migration
+	goto <version>  > migrate up or down to the given version (0 drops everything)`
+
+type migratableDB interface {
+	db.SpenderDB
+	Migrator() (*db.Migrator, error)
+}
+
+// RunMigrateCommand executes one of the migrate CLI sub-commands against the configured SQL DB
+func RunMigrateCommand(configData []byte, args []string) error {
+	if len(args) == 0 {
+		return errors.New(MigrateUsage)
+	}
+
+	config, err := platform.NewYamlConfig(configData)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %s", err)
+	}
+	var dbClient migratableDB
+	switch config.DBType {
+	case platform.DBTypePostgres:
+		dbClient = newPostgresDBClient(config, false)
+	case platform.DBTypeSQLite:
+		dbClient = db.NewSQLiteDB(config.SQLite.Path, false)
+	default:
+		return fmt.Errorf("migrations not supported for db type: %s", config.DBType)
+	}
+
+	if err := dbClient.Open(); err != nil {
+		return fmt.Errorf("cannot open DB connection: %s", err)
+	}
+	defer func() {
+		if err := dbClient.Close(); err != nil {
+			log.Errorf("migrate - close DB error: %s", err)
+		}
+	}()
+
+	migrator, err := dbClient.Migrator()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Applied {
+				appliedAt = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return nil
+	case "up":
+		err = migrator.Up()
+	case "down":
+		err = migrator.Down()
+	case "goto":
+		if len(args) < 2 {
+			return errors.New(MigrateUsage)
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid migration version: %s", args[1])
+		}
+		err = migrator.Goto(version)
+	default:
+		return errors.New(MigrateUsage)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, err := migrator.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema at version %d\n", version)
+	return nil
+}
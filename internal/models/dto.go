@@ -4,14 +4,18 @@ import (
 	"time"
 )
 
-// TODO: would rather remove DTOs, and omit JSON transmit of sensitive data like user.password
-//			with `json:"-"`
+// The DTOs are the response models: the handlers send only them, never the models themselves, so a field
+// added to a model stays on the server until a DTO takes it. The secrets in the models, like the password
+// hash, are also tagged with `json:"-"`, in case a model gets sent anyway.
 
 type UserDTO struct {
-	Email      string         `json:"email"`
-	Username   string         `json:"username"`
-	Spends     []SpendingDTO  `json:"spends"`
-	SpendKinds []SpendKindDTO `json:"spending_kinds"`
+	Email         string         `json:"email"`
+	EmailVerified bool           `json:"email_verified"`
+	Username      string         `json:"username"`
+	Role          string         `json:"role"`
+	Profile       UserProfile    `json:"profile"`
+	Spends        []SpendingDTO  `json:"spends"`
+	SpendKinds    []SpendKindDTO `json:"spending_kinds"`
 }
 
 type SpendKindDTO struct {
@@ -28,20 +32,24 @@ type SpendingDTO struct {
 }
 
 func NewUserDTO(user *User) UserDTO {
-	var spendKinds []SpendKindDTO
-	for _, sk := range user.SpendKinds {
-		spendKinds = append(spendKinds, NewSpendKindDTO(&sk))
-	}
-	var spends []SpendingDTO
-	for _, s := range user.Spends {
-		spends = append(spends, NewSpendingDTO(&s))
-	}
 	return UserDTO{
-		Email:      user.Email,
-		Username:   user.Username,
-		SpendKinds: spendKinds,
-		Spends:     spends,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Username:      user.Username,
+		Role:          user.Role,
+		Profile:       user.Profile,
+		SpendKinds:    NewSpendKindDTOs(user.SpendKinds),
+		Spends:        NewSpendingDTOs(user.Spends),
+	}
+}
+
+// NewSpendKindDTOs never returns nil, so an empty list is sent as [] rather than null
+func NewSpendKindDTOs(spendKinds []SpendKind) []SpendKindDTO {
+	dtos := make([]SpendKindDTO, 0, len(spendKinds))
+	for i := range spendKinds {
+		dtos = append(dtos, NewSpendKindDTO(&spendKinds[i]))
 	}
+	return dtos
 }
 
 func NewSpendKindDTO(spendKind *SpendKind) SpendKindDTO {
@@ -51,6 +59,15 @@ func NewSpendKindDTO(spendKind *SpendKind) SpendKindDTO {
 	}
 }
 
+// NewSpendingDTOs never returns nil, so an empty list is sent as [] rather than null
+func NewSpendingDTOs(spends []Spending) []SpendingDTO {
+	dtos := make([]SpendingDTO, 0, len(spends))
+	for i := range spends {
+		dtos = append(dtos, NewSpendingDTO(&spends[i]))
+	}
+	return dtos
+}
+
 func NewSpendingDTO(spending *Spending) SpendingDTO {
 	return SpendingDTO{
 		ID:        spending.ID,
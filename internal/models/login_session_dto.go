@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// LoginSessionDTO is a login session as shown to its user, without the session ID itself
+type LoginSessionDTO struct {
+	ID         string    `json:"id"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeen   time.Time `json:"last_seen"`
+	// Current is set for the session the request came with
+	Current bool `json:"current"`
+}
@@ -5,4 +5,29 @@ type APIResponse struct {
 	IsError bool        `json:"isError"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
+	// Errors are the errors of the request's fields, when it's invalid
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// Problem is an error response of the /api/v1 API, the problem details of RFC 7807
+type Problem struct {
+	// Type is a URI identifying the kind of problem, about:blank when the status says it all
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail explains this occurrence of the problem, for the humans
+	Detail string `json:"detail,omitempty"`
+	// Instance is the path of the request which had the problem
+	Instance string `json:"instance,omitempty"`
+	// Errors are the errors of the request's fields, when it's invalid
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError tells what is wrong with a field of a request. Code is the validation rule the field breaks,
+// e.g. required, min or currency, or invalid for a value of a wrong type; Param is the rule's parameter.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
 }
@@ -1,13 +1,47 @@
 package models
 
+// the roles a user can have, see platform.RoleHasPermission for what each of them can do
+const (
+	RoleUser     = "user"
+	RoleAdmin    = "admin"
+	RoleReadOnly = "read-only"
+)
+
 type Users []*User
 
+// User is the stored user; its Password is the hash of the password, which like the TOTP never leaves the server
 type User struct {
-	Email      string      `json:"email"`
-	Username   string      `json:"username"`
-	Password   string      `json:"password"`
-	Spends     []Spending  `json:"spends"`
-	SpendKinds []SpendKind `json:"spending_kinds"`
+	Email         string      `json:"email"`
+	EmailVerified bool        `json:"email_verified"`
+	Username      string      `json:"username"`
+	Password      string      `json:"-"`
+	Role          string      `json:"role"`
+	TOTP          TOTP        `json:"-"`
+	Profile       UserProfile `json:"profile"`
+	Spends        []Spending  `json:"spends"`
+	SpendKinds    []SpendKind `json:"spending_kinds"`
+}
+
+// TOTP is the two-factor authentication of a user with time based one time passwords (RFC 6238)
+type TOTP struct {
+	// Secret is base32 encoded, set at the enrollment already, before it gets enabled
+	Secret  string
+	Enabled bool
+	// RecoveryCodes are the hashes of the unused codes logging in without the authenticator app
+	RecoveryCodes []string
+	// LastUsedStep is the time step of the last code accepted, so no code works twice
+	LastUsedStep int64
+}
+
+// UserProfile holds the user's own settings, all of them optional
+type UserProfile struct {
+	DisplayName string `json:"display_name"`
+	// DefaultCurrency is preselected for the new spends, an ISO 4217 code like EUR
+	DefaultCurrency string `json:"default_currency"`
+	// Timezone is an IANA time zone name like Europe/Berlin
+	Timezone string `json:"timezone"`
+	// Locale is a BCP 47 language tag like de-DE
+	Locale string `json:"locale"`
 }
 
 func NewUser(email string, username string, password string, spendKinds []SpendKind) *User {
@@ -15,7 +49,17 @@ func NewUser(email string, username string, password string, spendKinds []SpendK
 		Email:      email,
 		Username:   username,
 		Password:   password,
+		Role:       RoleUser,
 		Spends:     []Spending{},
 		SpendKinds: spendKinds,
 	}
 }
+
+// IsValidRole tells if the role is one of the known ones
+func IsValidRole(role string) bool {
+	switch role {
+	case RoleUser, RoleAdmin, RoleReadOnly:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"encoding/base64"
+	"time"
+)
+
+// WebAuthnCredential is a passkey (or a security key) the user registered to log in with
+type WebAuthnCredential struct {
+	ID       []byte `json:"id"`
+	Username string `json:"username"`
+	// UserHandle is the random WebAuthn user ID of the user, the same for all its credentials,
+	// so the passkeys never carry the username
+	UserHandle []byte `json:"user_handle"`
+	// Name is given by the user, to tell the credentials apart
+	Name string `json:"name"`
+	// PublicKey is COSE encoded
+	PublicKey       []byte   `json:"public_key"`
+	AttestationType string   `json:"attestation_type"`
+	Transports      []string `json:"transports"`
+	AAGUID          []byte   `json:"aaguid"`
+	SignCount       uint32   `json:"sign_count"`
+	// BackupEligible tells if the credential can be synced between devices, which never changes
+	BackupEligible bool      `json:"backup_eligible"`
+	BackupState    bool      `json:"backup_state"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+}
+
+// WebAuthnCredentialDTO is a credential as shown to its user, without the key material
+type WebAuthnCredentialDTO struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Synced     bool      `json:"synced"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func NewWebAuthnCredentialDTO(credential *WebAuthnCredential) WebAuthnCredentialDTO {
+	return WebAuthnCredentialDTO{
+		ID:         base64.RawURLEncoding.EncodeToString(credential.ID),
+		Name:       credential.Name,
+		Synced:     credential.BackupState,
+		CreatedAt:  credential.CreatedAt,
+		LastUsedAt: credential.LastUsedAt,
+	}
+}
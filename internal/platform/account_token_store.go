@@ -0,0 +1,121 @@
+package platform
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEmailVerificationTTL = 48 * time.Hour
+	DefaultPasswordResetTTL     = time.Hour
+)
+
+// the purposes of the account tokens, a token is good only for the one it was made for
+const (
+	AccountTokenVerifyEmail   = "verify_email"
+	AccountTokenResetPassword = "reset_password"
+)
+
+// AccountToken is a single use, expiring token mailed to the user, proving it owns the email address
+type AccountToken struct {
+	// TokenHash is the hash of the token, only the email holds the token itself
+	TokenHash string
+	Purpose   string
+	Username  string
+	// Email is the address the token was sent to
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (at *AccountToken) IsExpired(now time.Time) bool {
+	return !now.Before(at.ExpiresAt)
+}
+
+// AccountTokenStore keeps the account tokens until they are used or expire
+type AccountTokenStore interface {
+	Save(ctx context.Context, token *AccountToken) error
+	// Take removes the token and returns it, so out of concurrent requests with the same token only one
+	// gets it; returns ErrNotFound for unknown tokens, but may still return expired ones not swept yet
+	Take(ctx context.Context, tokenHash string) (*AccountToken, error)
+	// DeleteByUsername removes all the user's tokens made for the purpose, and returns their count
+	DeleteByUsername(ctx context.Context, username, purpose string) (int, error)
+	// DeleteExpired removes all tokens expired at the given moment, and returns their count
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// MemoryAccountTokenStore is an AccountTokenStore living only in memory, its tokens are lost on restart
+type MemoryAccountTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]AccountToken
+}
+
+func NewMemoryAccountTokenStore() *MemoryAccountTokenStore {
+	return &MemoryAccountTokenStore{
+		tokens: make(map[string]AccountToken),
+	}
+}
+
+func (s *MemoryAccountTokenStore) Save(ctx context.Context, token *AccountToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.TokenHash] = *token
+	return nil
+}
+
+func (s *MemoryAccountTokenStore) Take(ctx context.Context, tokenHash string) (*AccountToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(s.tokens, tokenHash)
+	return &token, nil
+}
+
+func (s *MemoryAccountTokenStore) DeleteByUsername(ctx context.Context, username, purpose string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for tokenHash, token := range s.tokens {
+		if token.Username == username && token.Purpose == purpose {
+			delete(s.tokens, tokenHash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryAccountTokenStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for tokenHash, token := range s.tokens {
+		if token.IsExpired(now) {
+			delete(s.tokens, tokenHash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
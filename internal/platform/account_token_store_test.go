@@ -0,0 +1,14 @@
+package platform_test
+
+import (
+	"testing"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/platform/sessiontest"
+)
+
+func TestMemoryAccountTokenStore(t *testing.T) {
+	sessiontest.RunAccountTokenConformance(t, func(t *testing.T) platform.AccountTokenStore {
+		return platform.NewMemoryAccountTokenStore()
+	})
+}
@@ -0,0 +1,103 @@
+package platform
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	// SessionCookieName is the HttpOnly cookie holding the session ID
+	SessionCookieName = "ispend_session"
+	// CSRFCookieName is the cookie holding the CSRF token, readable by the web UI scripts,
+	// which send it back in the CSRFHeaderName header with every state changing request
+	CSRFCookieName = "ispend_csrf"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+// Principal is the user a request is authenticated as, either with a session cookie or a bearer access token
+type Principal struct {
+	Username string
+	// Role is the role of the user when the request came, see RoleHasPermission
+	Role string
+	// Session is the login session the request came with, nil for an access token
+	Session *LoginSession
+	// AccessToken holds the claims of the access token the request came with, nil for a session
+	AccessToken *AccessClaims
+}
+
+type principalContextKey struct{}
+
+// NewSessionPrincipal returns the principal authenticated with the login session
+func NewSessionPrincipal(session *LoginSession, role string) *Principal {
+	return &Principal{
+		Username: session.Username,
+		Role:     role,
+		Session:  session,
+	}
+}
+
+// NewTokenPrincipal returns the principal authenticated with the access token
+func NewTokenPrincipal(claims *AccessClaims, role string) *Principal {
+	return &Principal{
+		Username:    claims.Subject,
+		Role:        role,
+		AccessToken: claims,
+	}
+}
+
+// WithPrincipal returns a copy of ctx holding the principal the request is authenticated as
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal the request is authenticated as, or nil
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// SessionIDFromRequest returns the session ID from the session cookie, or an empty string
+func SessionIDFromRequest(r *http.Request) string {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// BearerTokenFromRequest returns the token from the "Authorization: Bearer" header, or an empty string
+func BearerTokenFromRequest(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// CSRFToken returns the CSRF token belonging to the session. It is derived from the session ID,
+// which is secret to everyone but the browser holding the cookie, so no other site can make one
+// up, while knowing the CSRF token tells nothing about the session ID.
+func CSRFToken(sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(sessionID))
+	mac.Write([]byte("ispend csrf token"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ValidCSRFToken tells in constant time if csrfToken is the CSRF token of the session
+func ValidCSRFToken(sessionID, csrfToken string) bool {
+	return subtle.ConstantTimeCompare([]byte(CSRFToken(sessionID)), []byte(csrfToken)) == 1
+}
+
+// IsStateChangingMethod tells if requests with the HTTP method need the CSRF protection
+func IsStateChangingMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
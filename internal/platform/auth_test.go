@@ -0,0 +1,61 @@
+package platform_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSRFToken(t *testing.T) {
+	sessionID1, err := platform.NewToken()
+	require.NoError(t, err)
+	sessionID2, err := platform.NewToken()
+	require.NoError(t, err)
+
+	csrfToken1 := platform.CSRFToken(sessionID1)
+	assert.Equal(t, csrfToken1, platform.CSRFToken(sessionID1))
+	assert.NotEqual(t, csrfToken1, platform.CSRFToken(sessionID2))
+	assert.NotContains(t, csrfToken1, sessionID1)
+
+	assert.True(t, platform.ValidCSRFToken(sessionID1, csrfToken1))
+	assert.False(t, platform.ValidCSRFToken(sessionID2, csrfToken1))
+	assert.False(t, platform.ValidCSRFToken(sessionID1, ""))
+	assert.False(t, platform.ValidCSRFToken(sessionID1, sessionID1))
+}
+
+func TestSessionIDFromRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Equal(t, "", platform.SessionIDFromRequest(r))
+
+	r.AddCookie(&http.Cookie{Name: platform.SessionCookieName, Value: "v1.abc"})
+	assert.Equal(t, "v1.abc", platform.SessionIDFromRequest(r))
+}
+
+func TestPrincipalContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, platform.PrincipalFromContext(ctx))
+
+	session := &platform.LoginSession{Username: "u1"}
+	principal := platform.NewSessionPrincipal(session, models.RoleUser)
+	assert.Equal(t, "u1", principal.Username)
+	assert.Equal(t, models.RoleUser, principal.Role)
+	assert.Equal(t, session, principal.Session)
+
+	ctx = platform.WithPrincipal(ctx, principal)
+	assert.Equal(t, principal, platform.PrincipalFromContext(ctx))
+}
+
+func TestIsStateChangingMethod(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions} {
+		assert.False(t, platform.IsStateChangingMethod(method), method)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		assert.True(t, platform.IsStateChangingMethod(method), method)
+	}
+}
@@ -0,0 +1,68 @@
+package platform
+
+import (
+	"context"
+	"sync"
+)
+
+// BatchLoader loads values by their keys in batches, like the DataLoader of GraphQL.js: the keys asked for
+// are only collected at first, and the first value needed fetches all the keys collected so far at once,
+// so resolving a field of every item in a list takes one fetch rather than one per item. The values are
+// kept, so a BatchLoader lives only as long as a single request, whose data it may not see change.
+type BatchLoader[V any] struct {
+	fetch   func(ctx context.Context, keys []string) (map[string]V, error)
+	mutex   sync.Mutex
+	pending []string
+	queued  map[string]bool
+	values  map[string]V
+	errs    map[string]error
+}
+
+// NewBatchLoader returns a loader getting the values with fetch, which leaves the keys without a value out
+// of its result; they get the zero value
+func NewBatchLoader[V any](fetch func(ctx context.Context, keys []string) (map[string]V, error)) *BatchLoader[V] {
+	return &BatchLoader[V]{
+		fetch:  fetch,
+		queued: make(map[string]bool),
+		values: make(map[string]V),
+		errs:   make(map[string]error),
+	}
+}
+
+// Load queues the key for the next fetch, and returns the function waiting for its value
+func (l *BatchLoader[V]) Load(ctx context.Context, key string) func() (V, error) {
+	l.mutex.Lock()
+	_, loaded := l.values[key]
+	if !loaded && l.errs[key] == nil && !l.queued[key] {
+		l.pending = append(l.pending, key)
+		l.queued[key] = true
+	}
+	l.mutex.Unlock()
+
+	return func() (V, error) {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.queued[key] {
+			l.dispatch(ctx)
+		}
+		return l.values[key], l.errs[key]
+	}
+}
+
+// dispatch fetches all the pending keys; the mutex has to be locked
+func (l *BatchLoader[V]) dispatch(ctx context.Context) {
+	keys := l.pending
+	l.pending = nil
+	for _, key := range keys {
+		delete(l.queued, key)
+	}
+
+	values, err := l.fetch(ctx, keys)
+	for _, key := range keys {
+		if err != nil {
+			l.errs[key] = err
+			continue
+		}
+		l.values[key] = values[key]
+	}
+}
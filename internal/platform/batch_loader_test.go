@@ -0,0 +1,81 @@
+package platform_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchLoader(t *testing.T) {
+	ctx := context.Background()
+	var fetched [][]string
+	loader := platform.NewBatchLoader(func(ctx context.Context, keys []string) (map[string]string, error) {
+		fetched = append(fetched, keys)
+		values := make(map[string]string)
+		for _, key := range keys {
+			if key != "unknown" {
+				values[key] = strings.ToUpper(key)
+			}
+		}
+		return values, nil
+	})
+
+	// the keys are collected, then fetched at once, each of them once
+	walker := loader.Load(ctx, "walker")
+	runner := loader.Load(ctx, "runner")
+	walkerAgain := loader.Load(ctx, "walker")
+	unknown := loader.Load(ctx, "unknown")
+	assert.Empty(t, fetched)
+
+	value, err := runner()
+	require.NoError(t, err)
+	assert.Equal(t, "RUNNER", value)
+	value, err = walker()
+	require.NoError(t, err)
+	assert.Equal(t, "WALKER", value)
+	value, err = walkerAgain()
+	require.NoError(t, err)
+	assert.Equal(t, "WALKER", value)
+	value, err = unknown()
+	require.NoError(t, err)
+	assert.Empty(t, value)
+	assert.Equal(t, [][]string{{"walker", "runner", "unknown"}}, fetched)
+
+	// the values fetched are kept, only the new keys are fetched
+	walker = loader.Load(ctx, "walker")
+	swimmer := loader.Load(ctx, "swimmer")
+	value, err = swimmer()
+	require.NoError(t, err)
+	assert.Equal(t, "SWIMMER", value)
+	value, err = walker()
+	require.NoError(t, err)
+	assert.Equal(t, "WALKER", value)
+	assert.Equal(t, [][]string{{"walker", "runner", "unknown"}, {"swimmer"}}, fetched)
+}
+
+func TestBatchLoader_Error(t *testing.T) {
+	ctx := context.Background()
+	fetchErr := errors.New("db is down")
+	fetches := 0
+	loader := platform.NewBatchLoader(func(ctx context.Context, keys []string) (map[string]int, error) {
+		fetches++
+		return nil, fetchErr
+	})
+
+	walker := loader.Load(ctx, "walker")
+	runner := loader.Load(ctx, "runner")
+	_, err := walker()
+	assert.Equal(t, fetchErr, err)
+	_, err = runner()
+	assert.Equal(t, fetchErr, err)
+
+	// the error is kept for the rest of the request too
+	_, err = loader.Load(ctx, "walker")()
+	assert.Equal(t, fetchErr, err)
+	assert.Equal(t, 1, fetches)
+}
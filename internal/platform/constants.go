@@ -7,6 +7,26 @@ import (
 )
 
 var ErrNotFound = errors.New("not found")
+var ErrAlreadyExists = errors.New("already exists")
+var ErrWrongPassword = errors.New("wrong password")
+var ErrInvalidRole = errors.New("invalid role")
+var ErrEmailAlreadyVerified = errors.New("email already verified")
+var ErrTOTPRequired = errors.New("two-factor code required")
+var ErrWrongTOTPCode = errors.New("wrong two-factor code")
+var ErrTOTPAlreadyEnabled = errors.New("two-factor authentication already enabled")
+var ErrTOTPNotEnabled = errors.New("two-factor authentication not enabled")
+var ErrTOTPNotEnrolled = errors.New("two-factor authentication enrollment not started")
+var ErrPasskeyCeremonyNotFound = errors.New("passkey ceremony not found or expired")
+var ErrPasskeyRejected = errors.New("passkey rejected")
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+var ErrPasswordHasherBusy = errors.New("too many passwords are being checked, try again in a moment")
+var ErrPasswordTooShort = errors.New("password too short")
+var ErrPasswordTooLong = errors.New("password too long")
+var ErrPasswordBreached = errors.New("password found in a data breach, choose another one")
+var ErrDisplayNameTooLong = errors.New("display name too long")
+var ErrInvalidCurrency = errors.New("invalid currency, expected a 3 letter code like EUR")
+var ErrInvalidTimezone = errors.New("invalid time zone, expected a name like Europe/Berlin")
+var ErrInvalidLocale = errors.New("invalid locale, expected a language tag like de-DE")
 
 var EmptySignal = models.Signal{}
 
@@ -0,0 +1,23 @@
+package platform
+
+import "time"
+
+// SetNow replaces the clock of the manager, so the tests can travel in time
+func (manager *LoginSessionManager) SetNow(now func() time.Time) {
+	manager.now = now
+}
+
+// SetNow replaces the clock of the issuer, so the tests can travel in time
+func (i *TokenIssuer) SetNow(now func() time.Time) {
+	i.now = now
+}
+
+// ReserveMemory takes memory from the argon2id budget of the hasher, as a running hash would
+func (h *PasswordHasher) ReserveMemory(memory uint32) bool {
+	return h.reserveMemory(memory)
+}
+
+// ReleaseMemory gives memory taken with ReserveMemory back to the budget
+func (h *PasswordHasher) ReleaseMemory(memory uint32) {
+	h.releaseMemory(memory)
+}
@@ -0,0 +1,138 @@
+package platform
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// signingKey is an ES256 key signing the access tokens, known to clients by its ID (the JWT kid)
+type signingKey struct {
+	id         string
+	privateKey *ecdsa.PrivateKey
+	// retiredAt is when a newer key took over, zero for the current key
+	retiredAt time.Time
+}
+
+// keySet holds the key signing new tokens, and the retired keys the tokens still valid were signed with
+type keySet struct {
+	mu      sync.RWMutex
+	current *signingKey
+	retired []*signingKey
+}
+
+// JWK is the public part of a signing key, in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKSet is what the JWKS endpoint serves, so clients can verify the access tokens themselves
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func newSigningKey() (*signingKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &signingKey{
+		id:         hex.EncodeToString(id),
+		privateKey: privateKey,
+	}, nil
+}
+
+// rotate makes a new key the current one, and drops the retired keys which
+// retired longer than maxTokenAge ago, as no valid token is signed with them anymore
+func (ks *keySet) rotate(now time.Time, maxTokenAge time.Duration) error {
+	key, err := newSigningKey()
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	var retired []*signingKey
+	for _, k := range ks.retired {
+		if now.Sub(k.retiredAt) <= maxTokenAge {
+			retired = append(retired, k)
+		}
+	}
+	if ks.current != nil {
+		ks.current.retiredAt = now
+		retired = append(retired, ks.current)
+	}
+	ks.current = key
+	ks.retired = retired
+
+	return nil
+}
+
+func (ks *keySet) signing() *signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.current
+}
+
+// find returns the current or a retired key with the ID, or nil
+func (ks *keySet) find(keyID string) *signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.current != nil && ks.current.id == keyID {
+		return ks.current
+	}
+	for _, k := range ks.retired {
+		if k.id == keyID {
+			return k
+		}
+	}
+	return nil
+}
+
+func (ks *keySet) jwks() JWKSet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	if ks.current != nil {
+		set.Keys = append(set.Keys, ks.current.jwk())
+	}
+	for i := len(ks.retired) - 1; i >= 0; i-- {
+		set.Keys = append(set.Keys, ks.retired[i].jwk())
+	}
+	return set
+}
+
+func (k *signingKey) jwk() JWK {
+	// uncompressed point: 0x04 | X | Y, 32 bytes each on P-256
+	point, err := k.privateKey.PublicKey.Bytes()
+	if err != nil {
+		// cannot happen for a key generated on a known curve
+		panic(err)
+	}
+	return JWK{
+		KeyType:   "EC",
+		Curve:     "P-256",
+		X:         base64.RawURLEncoding.EncodeToString(point[1:33]),
+		Y:         base64.RawURLEncoding.EncodeToString(point[33:65]),
+		KeyID:     k.id,
+		Use:       "sig",
+		Algorithm: "ES256",
+	}
+}
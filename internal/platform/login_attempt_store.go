@@ -0,0 +1,108 @@
+package platform
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LoginFailures counts the failed logins in a row for a subject, a username or an IP address
+type LoginFailures struct {
+	Subject      string
+	Count        int
+	LastFailedAt time.Time
+	// ExpiresAt is when the failures are forgotten, if no other one comes before
+	ExpiresAt time.Time
+}
+
+func (lf *LoginFailures) IsExpired(now time.Time) bool {
+	return !now.Before(lf.ExpiresAt)
+}
+
+// LoginAttemptStore keeps the failed logins, so the logins can be throttled
+type LoginAttemptStore interface {
+	// Get returns the subject's failures, or ErrNotFound if there are none; may still return expired ones not swept yet
+	Get(ctx context.Context, subject string) (*LoginFailures, error)
+	// AddFailure counts one more failure for the subject and returns the updated count, atomically, so concurrent
+	// failures all get counted; the count starts over if the previous failures have expired, and they expire ttl after now
+	AddFailure(ctx context.Context, subject string, now time.Time, ttl time.Duration) (*LoginFailures, error)
+	// Reset forgets the subject's failures
+	Reset(ctx context.Context, subject string) error
+	// DeleteExpired removes all the failures expired at the given moment, and returns the count of subjects removed
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// MemoryLoginAttemptStore is a LoginAttemptStore living only in memory, its failures are forgotten on restart
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	failures map[string]LoginFailures
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{
+		failures: make(map[string]LoginFailures),
+	}
+}
+
+func (s *MemoryLoginAttemptStore) Get(ctx context.Context, subject string) (*LoginFailures, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures, ok := s.failures[subject]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &failures, nil
+}
+
+func (s *MemoryLoginAttemptStore) AddFailure(ctx context.Context, subject string, now time.Time, ttl time.Duration) (*LoginFailures, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures, ok := s.failures[subject]
+	if !ok || failures.IsExpired(now) {
+		failures = LoginFailures{Subject: subject}
+	}
+	failures.Count++
+	failures.LastFailedAt = now
+	failures.ExpiresAt = now.Add(ttl)
+	s.failures[subject] = failures
+	return &failures, nil
+}
+
+func (s *MemoryLoginAttemptStore) Reset(ctx context.Context, subject string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, subject)
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for subject, failures := range s.failures {
+		if failures.IsExpired(now) {
+			delete(s.failures, subject)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
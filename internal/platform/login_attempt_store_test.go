@@ -0,0 +1,14 @@
+package platform_test
+
+import (
+	"testing"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/platform/sessiontest"
+)
+
+func TestMemoryLoginAttemptStore(t *testing.T) {
+	sessiontest.RunLoginAttemptConformance(t, func(t *testing.T) platform.LoginAttemptStore {
+		return platform.NewMemoryLoginAttemptStore()
+	})
+}
@@ -1,6 +1,45 @@
 package platform
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
 type LoginSession struct {
-	Username  string
-	SessionID string
+	Username string
+	// TokenHash is the hash of the session token, only the client knows the token itself
+	TokenHash string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	// ExpiresAt is when the session expires if not used again, zero if it never expires
+	ExpiresAt time.Time
+
+	// the device the user logged in from
+	DeviceName string
+	UserAgent  string
+	IPAddress  string
+}
+
+// LoginDevice describes where a login comes from, so the user can tell the sessions apart
+type LoginDevice struct {
+	Name      string
+	UserAgent string
+	IPAddress string
+}
+
+func (ls *LoginSession) IsExpired(now time.Time) bool {
+	return !ls.ExpiresAt.IsZero() && !now.Before(ls.ExpiresAt)
+}
+
+// HasSessionID tells in constant time if sessionID is the token of this session
+func (ls *LoginSession) HasSessionID(sessionID string) bool {
+	return TokenMatchesHash(sessionID, ls.TokenHash)
+}
+
+// PublicID identifies the session towards the user, e.g. when listing or revoking it,
+// without revealing anything the session could be looked up by
+func (ls *LoginSession) PublicID() string {
+	hash := sha256.Sum256([]byte(ls.TokenHash))
+	return hex.EncodeToString(hash[:8])
 }
@@ -1,54 +1,203 @@
 package platform
 
+import (
+	"context"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultSessionIdleTTL     = 30 * time.Minute
+	DefaultSessionAbsoluteTTL = 7 * 24 * time.Hour
+
+	// sessionTouchInterval limits how often a used session's last seen time gets written
+	// to the store, so not every single request is a write to the DB or redis
+	sessionTouchInterval = time.Minute
+
+	maxDeviceNameLength = 64
+	maxUserAgentLength  = 512
+)
+
+// LoginSessionManager creates, checks and expires the login sessions kept in its SessionStore. A session
+// expires when it's not used for idleTTL, or absoluteTTL after creation no matter what; 0 turns each off.
 type LoginSessionManager struct {
-	loginSessions map[string]LoginSession
+	store       SessionStore
+	idleTTL     time.Duration
+	absoluteTTL time.Duration
+	now         func() time.Time
+
+	chStopSweeper chan struct{}
+	sweeperWg     sync.WaitGroup
 }
 
-func NewLoginSessionHandler() *LoginSessionManager {
+func NewLoginSessionManager(store SessionStore, idleTTL, absoluteTTL time.Duration) *LoginSessionManager {
 	return &LoginSessionManager{
-		loginSessions: make(map[string]LoginSession),
+		store:       store,
+		idleTTL:     idleTTL,
+		absoluteTTL: absoluteTTL,
+		now:         time.Now,
 	}
 }
 
-func (manager *LoginSessionManager) New(username string) string {
-	sessionID := GenerateRandomString(45)
-	loginSession := LoginSession{
-		Username:  username,
-		SessionID: sessionID,
+// AbsoluteTTL returns the longest a session can live, 0 meaning forever
+func (manager *LoginSessionManager) AbsoluteTTL() time.Duration {
+	return manager.absoluteTTL
+}
+
+// New starts a new session for the user, next to the ones the user already has on other devices,
+// and returns its session ID - a secret token, which the server keeps only the hash of
+func (manager *LoginSessionManager) New(ctx context.Context, username string, device LoginDevice) (string, error) {
+	sessionID, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	tokenHash, err := HashToken(sessionID)
+	if err != nil {
+		return "", err
 	}
 
-	manager.loginSessions[username] = loginSession
+	now := manager.now().UTC()
+	loginSession := &LoginSession{
+		Username:   username,
+		TokenHash:  tokenHash,
+		CreatedAt:  now,
+		LastSeen:   now,
+		DeviceName: truncate(device.Name, maxDeviceNameLength),
+		UserAgent:  truncate(device.UserAgent, maxUserAgentLength),
+		IPAddress:  device.IPAddress,
+	}
+	loginSession.ExpiresAt = manager.expiresAt(loginSession)
 
-	return sessionID
+	if err := manager.store.Save(ctx, loginSession); err != nil {
+		return "", err
+	}
+	return sessionID, nil
 }
 
-func (manager *LoginSessionManager) Remove(username string) error {
-	if _, ok := manager.loginSessions[username]; !ok {
+// Remove ends all sessions of the user
+func (manager *LoginSessionManager) Remove(ctx context.Context, username string) error {
+	sessions, err := manager.store.GetByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
 		return ErrNotFound
 	}
-	delete(manager.loginSessions, username)
+	for _, session := range sessions {
+		if err := manager.store.Delete(ctx, session.TokenHash); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
 	return nil
 }
 
-func (manager *LoginSessionManager) GetByUsername(username string) (*LoginSession, error) {
-	if ls, ok := manager.loginSessions[username]; ok {
-		return &ls, nil
+// RemoveSession ends a single session, e.g. on logout
+func (manager *LoginSessionManager) RemoveSession(ctx context.Context, sessionID string) error {
+	tokenHash, err := HashToken(sessionID)
+	if err != nil {
+		return ErrNotFound
+	}
+	return manager.store.Delete(ctx, tokenHash)
+}
+
+// RemoveByPublicID ends the user's session with the given public ID, returning ErrNotFound if the user has no such session
+func (manager *LoginSessionManager) RemoveByPublicID(ctx context.Context, username, publicID string) error {
+	sessions, err := manager.store.GetByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.PublicID() == publicID {
+			return manager.store.Delete(ctx, session.TokenHash)
+		}
+	}
+	return ErrNotFound
+}
+
+// RemoveOthers ends all sessions of the user except the given one, and returns how many were ended
+func (manager *LoginSessionManager) RemoveOthers(ctx context.Context, username, keepSessionID string) (int, error) {
+	sessions, err := manager.store.GetByUsername(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, session := range sessions {
+		if session.HasSessionID(keepSessionID) {
+			continue
+		}
+		err := manager.store.Delete(ctx, session.TokenHash)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// GetAllByUsername returns all active sessions of the user, oldest first
+func (manager *LoginSessionManager) GetAllByUsername(ctx context.Context, username string) ([]LoginSession, error) {
+	sessions, err := manager.store.GetByUsername(ctx, username)
+	if err != nil {
+		return nil, err
 	}
-	return nil, ErrNotFound
+	now := manager.now()
+	activeSessions := make([]LoginSession, 0, len(sessions))
+	for _, session := range sessions {
+		if !session.IsExpired(now) {
+			activeSessions = append(activeSessions, session)
+		}
+	}
+	return activeSessions, nil
 }
 
-func (manager *LoginSessionManager) GetBySessionID(sessionID string) (*LoginSession, error) {
-	for _, ls := range manager.loginSessions {
-		if ls.SessionID == sessionID {
-			return &ls, nil
+// GetBySessionID returns the active session, and marks it as just used
+func (manager *LoginSessionManager) GetBySessionID(ctx context.Context, sessionID string) (*LoginSession, error) {
+	tokenHash, err := HashToken(sessionID)
+	if err != nil {
+		// malformed, or made by a scheme no longer supported - either way no such session
+		return nil, ErrNotFound
+	}
+
+	session, err := manager.store.Get(ctx, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	// the store lookup by hash may well be a DB index scan, so check again in constant time
+	if !session.HasSessionID(sessionID) {
+		return nil, ErrNotFound
+	}
+
+	now := manager.now().UTC()
+	if session.IsExpired(now) {
+		if err := manager.store.Delete(ctx, tokenHash); err != nil && err != ErrNotFound {
+			log.Errorf("delete expired session error: %s", err)
+		}
+		return nil, ErrNotFound
+	}
+
+	if now.Sub(session.LastSeen) >= sessionTouchInterval {
+		session.LastSeen = now
+		session.ExpiresAt = manager.expiresAt(session)
+		if err := manager.store.Save(ctx, session); err != nil {
+			return nil, err
 		}
 	}
-	return nil, ErrNotFound
+
+	return session, nil
 }
 
-func (manager *LoginSessionManager) IsUserLoggedIn(sessionID, username string) bool {
-	session, err := manager.GetBySessionID(sessionID)
+func (manager *LoginSessionManager) IsUserLoggedIn(ctx context.Context, sessionID, username string) bool {
+	session, err := manager.GetBySessionID(ctx, sessionID)
 	if err != nil {
+		if err != ErrNotFound {
+			log.Errorf("get login session error: %s", err)
+		}
 		return false
 	}
 	if session.Username != username {
@@ -57,6 +206,73 @@ func (manager *LoginSessionManager) IsUserLoggedIn(sessionID, username string) b
 	return true
 }
 
-func (manager *LoginSessionManager) IsUserNotLoggedIn(sessionID, username string) bool {
-	return !manager.IsUserLoggedIn(sessionID, username)
+// SweepExpired deletes all expired sessions from the store
+func (manager *LoginSessionManager) SweepExpired(ctx context.Context) (int, error) {
+	return manager.store.DeleteExpired(ctx, manager.now().UTC())
+}
+
+// StartSweeper sweeps the expired sessions every interval, until StopSweeper is called
+func (manager *LoginSessionManager) StartSweeper(interval time.Duration) {
+	manager.chStopSweeper = make(chan struct{})
+	manager.sweeperWg.Add(1)
+
+	go func() {
+		defer manager.sweeperWg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := manager.SweepExpired(context.Background())
+				if err != nil {
+					log.Errorf("login sessions sweeper error: %s", err)
+				} else if deleted > 0 {
+					log.Debugf("login sessions sweeper: deleted %d expired sessions", deleted)
+				}
+			case <-manager.chStopSweeper:
+				return
+			}
+		}
+	}()
+}
+
+func (manager *LoginSessionManager) StopSweeper() {
+	if manager.chStopSweeper == nil {
+		return
+	}
+	close(manager.chStopSweeper)
+	manager.sweeperWg.Wait()
+	manager.chStopSweeper = nil
+}
+
+func (manager *LoginSessionManager) expiresAt(session *LoginSession) time.Time {
+	var expiresAt time.Time
+	if manager.idleTTL > 0 {
+		expiresAt = session.LastSeen.Add(manager.idleTTL)
+	}
+	if manager.absoluteTTL > 0 {
+		absoluteExpiresAt := session.CreatedAt.Add(manager.absoluteTTL)
+		if expiresAt.IsZero() || absoluteExpiresAt.Before(expiresAt) {
+			expiresAt = absoluteExpiresAt
+		}
+	}
+	return expiresAt
+}
+
+// truncate cuts the string to its first maxLength characters, never within one, as the columns count
+// the characters and reject invalid UTF-8
+func truncate(s string, maxLength int) string {
+	if utf8.RuneCountInString(s) <= maxLength {
+		return s
+	}
+	runes := 0
+	for i := range s {
+		if runes == maxLength {
+			return s[:i]
+		}
+		runes++
+	}
+	return s
 }
@@ -1,74 +1,313 @@
 package platform_test
 
 import (
+	"context"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/platform/sessiontest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestLoginSessionManager(t *testing.T) {
-	sessionManager := platform.NewLoginSessionHandler()
+	sessionManager := platform.NewLoginSessionManager(platform.NewMemorySessionStore(), platform.DefaultSessionIdleTTL, platform.DefaultSessionAbsoluteTTL)
 	require.NotNil(t, sessionManager)
+	ctx := context.Background()
 
 	username1 := "u1"
 	username2 := "u2"
 	username3 := "u3-not-added"
 
-	sessionId1 := sessionManager.New(username1)
+	sessionId1, err := sessionManager.New(ctx, username1, platform.LoginDevice{})
+	require.NoError(t, err)
 	assert.True(t, len(sessionId1) > 0)
-	sessionId2 := sessionManager.New(username2)
+	sessionId2, err := sessionManager.New(ctx, username2, platform.LoginDevice{})
+	require.NoError(t, err)
 	assert.True(t, len(sessionId2) > 0)
 	sessionId3 := "not-existing-sessionID"
 
 	// assert logged in
-	isLoggedUser1 := sessionManager.IsUserLoggedIn(sessionId1, username1)
+	isLoggedUser1 := sessionManager.IsUserLoggedIn(ctx, sessionId1, username1)
 	assert.True(t, isLoggedUser1)
-	isLoggedUser2 := sessionManager.IsUserLoggedIn(sessionId2, username2)
+	isLoggedUser2 := sessionManager.IsUserLoggedIn(ctx, sessionId2, username2)
 	assert.True(t, isLoggedUser2)
-	isLoggedUser3 := sessionManager.IsUserLoggedIn(sessionId3, username3)
+	isLoggedUser3 := sessionManager.IsUserLoggedIn(ctx, sessionId3, username3)
 	assert.False(t, isLoggedUser3)
-	isLoggedUser12 := sessionManager.IsUserLoggedIn(sessionId1, username2)
+	isLoggedUser12 := sessionManager.IsUserLoggedIn(ctx, sessionId1, username2)
 	assert.False(t, isLoggedUser12)
 
 	// get by session id
-	session1, err := sessionManager.GetBySessionID(sessionId1)
+	session1, err := sessionManager.GetBySessionID(ctx, sessionId1)
 	assert.NoError(t, err)
 	assert.NotNil(t, session1)
-	assert.Equal(t, sessionId1, session1.SessionID)
+	assert.True(t, session1.HasSessionID(sessionId1))
 	assert.Equal(t, username1, session1.Username)
-	session2, err := sessionManager.GetBySessionID(sessionId2)
+	session2, err := sessionManager.GetBySessionID(ctx, sessionId2)
 	assert.NoError(t, err)
 	assert.NotNil(t, session2)
-	assert.Equal(t, sessionId2, session2.SessionID)
+	assert.True(t, session2.HasSessionID(sessionId2))
 	assert.Equal(t, username2, session2.Username)
-	session3, err := sessionManager.GetBySessionID(sessionId3)
+	session3, err := sessionManager.GetBySessionID(ctx, sessionId3)
 	assert.Equal(t, platform.ErrNotFound, err)
 	assert.Nil(t, session3)
 
-	// get by username
-	session1, err = sessionManager.GetByUsername(username1)
+	// get all by username
+	sessions, err := sessionManager.GetAllByUsername(ctx, username1)
 	assert.NoError(t, err)
-	assert.NotNil(t, session1)
-	assert.Equal(t, sessionId1, session1.SessionID)
-	assert.Equal(t, username1, session1.Username)
-	session2, err = sessionManager.GetByUsername(username2)
+	require.Len(t, sessions, 1)
+	assert.True(t, sessions[0].HasSessionID(sessionId1))
+	assert.Equal(t, username1, sessions[0].Username)
+	sessions, err = sessionManager.GetAllByUsername(ctx, username3)
 	assert.NoError(t, err)
-	assert.NotNil(t, session2)
-	assert.Equal(t, sessionId2, session2.SessionID)
-	assert.Equal(t, username2, session2.Username)
-	session3, err = sessionManager.GetByUsername(username3)
-	assert.Equal(t, platform.ErrNotFound, err)
-	assert.Nil(t, session3)
+	assert.Empty(t, sessions)
 
 	// remove session
-	err = sessionManager.Remove(username1)
+	err = sessionManager.Remove(ctx, username1)
+	assert.NoError(t, err)
+	sessions, err = sessionManager.GetAllByUsername(ctx, username1)
 	assert.NoError(t, err)
-	session1, err = sessionManager.GetByUsername(username1)
+	assert.Empty(t, sessions)
+	session1, err = sessionManager.GetBySessionID(ctx, sessionId1)
 	assert.Equal(t, platform.ErrNotFound, err)
 	assert.Nil(t, session1)
-	session1, err = sessionManager.GetBySessionID(sessionId1)
+}
+
+func TestLoginSessionManager_MultipleDevices(t *testing.T) {
+	sessionManager := platform.NewLoginSessionManager(platform.NewMemorySessionStore(), platform.DefaultSessionIdleTTL, platform.DefaultSessionAbsoluteTTL)
+	now := time.Now()
+	sessionManager.SetNow(func() time.Time { return now })
+	ctx := context.Background()
+
+	laptop := platform.LoginDevice{Name: "laptop", UserAgent: "Mozilla/5.0 (X11; Linux x86_64)", IPAddress: "192.0.2.1"}
+	phone := platform.LoginDevice{Name: "phone", UserAgent: "Mozilla/5.0 (iPhone)", IPAddress: "192.0.2.2"}
+	tablet := platform.LoginDevice{Name: "tablet", UserAgent: "Mozilla/5.0 (iPad)", IPAddress: "192.0.2.3"}
+
+	laptopSessionID, err := sessionManager.New(ctx, "u1", laptop)
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	phoneSessionID, err := sessionManager.New(ctx, "u1", phone)
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	tabletSessionID, err := sessionManager.New(ctx, "u1", tablet)
+	require.NoError(t, err)
+	otherSessionID, err := sessionManager.New(ctx, "u2", laptop)
+	require.NoError(t, err)
+	assert.NotEqual(t, laptopSessionID, phoneSessionID)
+
+	// logging in again on another device keeps the first one logged in
+	assert.True(t, sessionManager.IsUserLoggedIn(ctx, laptopSessionID, "u1"))
+	assert.True(t, sessionManager.IsUserLoggedIn(ctx, phoneSessionID, "u1"))
+
+	sessions, err := sessionManager.GetAllByUsername(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 3)
+	assert.Equal(t, "laptop", sessions[0].DeviceName)
+	assert.Equal(t, laptop.UserAgent, sessions[0].UserAgent)
+	assert.Equal(t, laptop.IPAddress, sessions[0].IPAddress)
+	assert.Equal(t, "phone", sessions[1].DeviceName)
+	assert.Equal(t, "tablet", sessions[2].DeviceName)
+	assert.NotEqual(t, sessions[0].PublicID(), sessions[1].PublicID())
+	assert.NotContains(t, sessions[0].PublicID(), laptopSessionID)
+
+	// logout on the phone only
+	require.NoError(t, sessionManager.RemoveSession(ctx, phoneSessionID))
+	assert.False(t, sessionManager.IsUserLoggedIn(ctx, phoneSessionID, "u1"))
+	assert.True(t, sessionManager.IsUserLoggedIn(ctx, laptopSessionID, "u1"))
+
+	// revoke by public ID, which must be the user's own
+	tabletSession, err := sessionManager.GetBySessionID(ctx, tabletSessionID)
+	require.NoError(t, err)
+	assert.Equal(t, platform.ErrNotFound, sessionManager.RemoveByPublicID(ctx, "u2", tabletSession.PublicID()))
+	require.NoError(t, sessionManager.RemoveByPublicID(ctx, "u1", tabletSession.PublicID()))
+	assert.False(t, sessionManager.IsUserLoggedIn(ctx, tabletSessionID, "u1"))
+
+	// revoke all the others
+	_, err = sessionManager.New(ctx, "u1", phone)
+	require.NoError(t, err)
+	_, err = sessionManager.New(ctx, "u1", tablet)
+	require.NoError(t, err)
+	revoked, err := sessionManager.RemoveOthers(ctx, "u1", laptopSessionID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, revoked)
+	sessions, err = sessionManager.GetAllByUsername(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.True(t, sessions[0].HasSessionID(laptopSessionID))
+	assert.True(t, sessionManager.IsUserLoggedIn(ctx, otherSessionID, "u2"))
+}
+
+func TestLoginSessionManager_TruncatesDevice(t *testing.T) {
+	sessionManager := platform.NewLoginSessionManager(platform.NewMemorySessionStore(), platform.DefaultSessionIdleTTL, platform.DefaultSessionAbsoluteTTL)
+	ctx := context.Background()
+
+	// the characters of 2 and 3 bytes must not be cut in half
+	device := platform.LoginDevice{
+		Name:      strings.Repeat("ž", 100),
+		UserAgent: "Mozilla/5.0 " + strings.Repeat("日本", 300),
+		IPAddress: "192.0.2.1",
+	}
+	_, err := sessionManager.New(ctx, "u1", device)
+	require.NoError(t, err)
+
+	sessions, err := sessionManager.GetAllByUsername(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, strings.Repeat("ž", 64), sessions[0].DeviceName)
+	assert.True(t, utf8.ValidString(sessions[0].UserAgent))
+	assert.Equal(t, 512, utf8.RuneCountInString(sessions[0].UserAgent))
+	assert.True(t, strings.HasPrefix(device.UserAgent, sessions[0].UserAgent))
+}
+
+func TestLoginSessionManager_StoresOnlyTokenHashes(t *testing.T) {
+	store := platform.NewMemorySessionStore()
+	sessionManager := platform.NewLoginSessionManager(store, platform.DefaultSessionIdleTTL, platform.DefaultSessionAbsoluteTTL)
+	ctx := context.Background()
+
+	sessionID, err := sessionManager.New(ctx, "u1", platform.LoginDevice{})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sessionID, platform.CurrentTokenVersion+"."))
+
+	_, err = store.Get(ctx, sessionID)
 	assert.Equal(t, platform.ErrNotFound, err)
-	assert.Nil(t, session1)
+	sessions, err := store.GetByUsername(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.NotEqual(t, sessionID, sessions[0].TokenHash)
+	assert.NotContains(t, sessions[0].PublicID(), sessionID)
+
+	// the hash itself is no good as a session ID
+	assert.False(t, sessionManager.IsUserLoggedIn(ctx, sessions[0].TokenHash, "u1"))
+	assert.Equal(t, platform.ErrNotFound, sessionManager.RemoveSession(ctx, sessions[0].TokenHash))
+	assert.True(t, sessionManager.IsUserLoggedIn(ctx, sessionID, "u1"))
+}
+
+func TestLoginSessionManager_IdleTTL(t *testing.T) {
+	sessionManager := platform.NewLoginSessionManager(platform.NewMemorySessionStore(), 30*time.Minute, 0)
+	now := time.Now()
+	sessionManager.SetNow(func() time.Time { return now })
+	ctx := context.Background()
+
+	sessionID, err := sessionManager.New(ctx, "u1", platform.LoginDevice{})
+	require.NoError(t, err)
+
+	// each use keeps the session alive for another idle TTL
+	for i := 0; i < 5; i++ {
+		now = now.Add(20 * time.Minute)
+		assert.True(t, sessionManager.IsUserLoggedIn(ctx, sessionID, "u1"))
+	}
+
+	now = now.Add(31 * time.Minute)
+	assert.False(t, sessionManager.IsUserLoggedIn(ctx, sessionID, "u1"))
+	sessions, err := sessionManager.GetAllByUsername(ctx, "u1")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestLoginSessionManager_AbsoluteTTL(t *testing.T) {
+	sessionManager := platform.NewLoginSessionManager(platform.NewMemorySessionStore(), 30*time.Minute, 2*time.Hour)
+	now := time.Now()
+	sessionManager.SetNow(func() time.Time { return now })
+	ctx := context.Background()
+
+	sessionID, err := sessionManager.New(ctx, "u1", platform.LoginDevice{})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		now = now.Add(20 * time.Minute)
+		assert.True(t, sessionManager.IsUserLoggedIn(ctx, sessionID, "u1"))
+	}
+
+	// still used, but too old
+	now = now.Add(21 * time.Minute)
+	assert.False(t, sessionManager.IsUserLoggedIn(ctx, sessionID, "u1"))
+}
+
+func TestLoginSessionManager_SweepExpired(t *testing.T) {
+	store := platform.NewMemorySessionStore()
+	sessionManager := platform.NewLoginSessionManager(store, time.Hour, 0)
+	now := time.Now()
+	sessionManager.SetNow(func() time.Time { return now })
+	ctx := context.Background()
+
+	sessionID1, err := sessionManager.New(ctx, "u1", platform.LoginDevice{})
+	require.NoError(t, err)
+	now = now.Add(30 * time.Minute)
+	sessionID2, err := sessionManager.New(ctx, "u2", platform.LoginDevice{})
+	require.NoError(t, err)
+
+	now = now.Add(45 * time.Minute)
+	deleted, err := sessionManager.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	assert.False(t, sessionManager.IsUserLoggedIn(ctx, sessionID1, "u1"))
+	sessions, err := store.GetByUsername(ctx, "u1")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	assert.True(t, sessionManager.IsUserLoggedIn(ctx, sessionID2, "u2"))
+}
+
+func TestLoginSessionManager_Sweeper(t *testing.T) {
+	store := platform.NewMemorySessionStore()
+	sessionManager := platform.NewLoginSessionManager(store, time.Millisecond, 0)
+	ctx := context.Background()
+
+	sessionID, err := sessionManager.New(ctx, "u1", platform.LoginDevice{})
+	require.NoError(t, err)
+	tokenHash, err := platform.HashToken(sessionID)
+	require.NoError(t, err)
+
+	sessionManager.StartSweeper(5 * time.Millisecond)
+	defer sessionManager.StopSweeper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := store.Get(ctx, tokenHash); err == platform.ErrNotFound {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("expired session not swept")
+}
+
+// TestLoginSessionManager_Concurrent is meant to be run with the race detector
+func TestLoginSessionManager_Concurrent(t *testing.T) {
+	sessionManager := platform.NewLoginSessionManager(platform.NewMemorySessionStore(), platform.DefaultSessionIdleTTL, platform.DefaultSessionAbsoluteTTL)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			username := "u" + string(rune('a'+i))
+			for j := 0; j < 50; j++ {
+				sessionID, err := sessionManager.New(ctx, username, platform.LoginDevice{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !sessionManager.IsUserLoggedIn(ctx, sessionID, username) {
+					t.Errorf("user %s not logged in", username)
+					return
+				}
+				if _, err := sessionManager.SweepExpired(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	sessiontest.RunConformance(t, func(t *testing.T) platform.SessionStore {
+		return platform.NewMemorySessionStore()
+	})
 }
@@ -0,0 +1,133 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const MailerSMTP = "smtp"
+const MailerOutbox = "outbox"
+
+// Email is a plain text email to a single recipient
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the emails
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// SMTPMailer sends the emails through an SMTP server, using STARTTLS when the server offers it
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a mailer sending from the given address, e.g. "ispend <no-reply@ispend.de>";
+// without a username it does not authenticate
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	mailer := &SMTPMailer{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		from: from,
+	}
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, email Email) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %s", err)
+	}
+	message, err := formatEmail(m.from, email)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, from.Address, []string{email.To}, message)
+}
+
+// OutboxMailer sends nothing, it only appends the emails to a file, or writes them to the log without
+// one; it's meant for developing and testing locally, where the links in the emails are clicked by hand
+type OutboxMailer struct {
+	mu   sync.Mutex
+	file string
+	from string
+}
+
+func NewOutboxMailer(file, from string) *OutboxMailer {
+	return &OutboxMailer{
+		file: file,
+		from: from,
+	}
+}
+
+func (m *OutboxMailer) Send(ctx context.Context, email Email) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	message, err := formatEmail(m.from, email)
+	if err != nil {
+		return err
+	}
+
+	if m.file == "" {
+		log.Infof("outbox mailer:\n%s", message)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(message, "\r\n"...)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// formatEmail returns the email as an RFC 5322 message
+func formatEmail(from string, email Email) ([]byte, error) {
+	to, err := mail.ParseAddress(email.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient address: %s", err)
+	}
+	// a header value with a line break would let it add headers of its own
+	if strings.ContainsAny(from+email.Subject, "\r\n") {
+		return nil, errors.New("line break in the email headers")
+	}
+
+	var sb strings.Builder
+	sb.WriteString("From: " + from + "\r\n")
+	sb.WriteString("To: " + to.String() + "\r\n")
+	sb.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", email.Subject) + "\r\n")
+	sb.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	sb.WriteString("\r\n")
+	sb.WriteString(strings.ReplaceAll(strings.ReplaceAll(email.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(sb.String()), nil
+}
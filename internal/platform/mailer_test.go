@@ -0,0 +1,49 @@
+package platform_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxMailer(t *testing.T) {
+	outbox := filepath.Join(t.TempDir(), "outbox.log")
+	mailer := platform.NewOutboxMailer(outbox, "ispend <no-reply@ispend.de>")
+	ctx := context.Background()
+
+	require.NoError(t, mailer.Send(ctx, platform.Email{
+		To:      "u1@ispend.de",
+		Subject: "Welcome",
+		Body:    "line 1\nline 2",
+	}))
+	require.NoError(t, mailer.Send(ctx, platform.Email{
+		To:      "u2@ispend.de",
+		Subject: "Welcome again",
+		Body:    "hi",
+	}))
+
+	content, err := os.ReadFile(outbox)
+	require.NoError(t, err)
+	messages := string(content)
+	assert.Contains(t, messages, "From: ispend <no-reply@ispend.de>\r\n")
+	assert.Contains(t, messages, "To: <u1@ispend.de>\r\n")
+	assert.Contains(t, messages, "Subject: Welcome\r\n")
+	assert.Contains(t, messages, "\r\n\r\nline 1\r\nline 2")
+	assert.Contains(t, messages, "To: <u2@ispend.de>\r\n")
+	assert.Equal(t, 2, strings.Count(messages, "MIME-Version: 1.0"))
+}
+
+func TestOutboxMailer_RejectsBadHeaders(t *testing.T) {
+	mailer := platform.NewOutboxMailer(filepath.Join(t.TempDir(), "outbox.log"), "ispend <no-reply@ispend.de>")
+	ctx := context.Background()
+
+	assert.Error(t, mailer.Send(ctx, platform.Email{To: "not an address", Subject: "s"}))
+	assert.Error(t, mailer.Send(ctx, platform.Email{To: "u1@ispend.de\r\nBcc: u2@ispend.de", Subject: "s"}))
+	assert.Error(t, mailer.Send(ctx, platform.Email{To: "u1@ispend.de", Subject: "s\r\nBcc: u2@ispend.de"}))
+}
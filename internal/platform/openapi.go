@@ -0,0 +1,354 @@
+package platform
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/2beens/ispend/internal/models"
+)
+
+// APIOperation describes an operation of the /api/v1 API; the API's OpenAPI document is generated from them,
+// so it cannot drift away from the routes
+type APIOperation struct {
+	Method string
+	// Path is the route template relative to the API root, e.g. /me/spends/{id}
+	Path    string
+	Tag     string
+	Summary string
+	// Authenticated operations need a login, either a session cookie or a bearer access token
+	Authenticated bool
+	// Permission is what the role of the user has to grant, for the authenticated operations
+	Permission Permission
+	// Request is a value of the JSON request body type, nil for no body
+	Request interface{}
+	// Response is a value of the JSON response body type, nil for no body
+	Response interface{}
+	// Status is the status of the success
+	Status int
+	// Errors are the statuses of the problems the operation can answer with,
+	// besides the ones of the authentication and the internal errors
+	Errors []int
+}
+
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Servers    []OpenAPIServer                         `json:"servers"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+type OpenAPIOperation struct {
+	Summary     string                      `json:"summary"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []OpenAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+type OpenAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *OpenAPISchema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*OpenAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]OpenAPISecurityScheme `json:"securitySchemes"`
+}
+
+// OpenAPISchema is the subset of the JSON schema the Go types need
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Minimum              *float64                  `json:"minimum,omitempty"`
+	Maximum              *float64                  `json:"maximum,omitempty"`
+	MinLength            *int                      `json:"minLength,omitempty"`
+	MaxLength            *int                      `json:"maxLength,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty"`
+}
+
+type OpenAPISecurityScheme struct {
+	Type        string             `json:"type"`
+	Description string             `json:"description,omitempty"`
+	In          string             `json:"in,omitempty"`
+	Name        string             `json:"name,omitempty"`
+	Flows       *OpenAPIOAuthFlows `json:"flows,omitempty"`
+}
+
+type OpenAPIOAuthFlows struct {
+	Password *OpenAPIOAuthFlow `json:"password,omitempty"`
+}
+
+type OpenAPIOAuthFlow struct {
+	TokenURL   string            `json:"tokenUrl"`
+	RefreshURL string            `json:"refreshUrl,omitempty"`
+	Scopes     map[string]string `json:"scopes"`
+}
+
+var openAPIPathParamRegex = regexp.MustCompile(`\{([^}:]+)(:[^}]+)?\}`)
+
+// NewOpenAPIDocument generates the OpenAPI 3 document of the API served at serverURL, with the JSON
+// schemas of the request and response types of the operations; the access tokens come from tokenURL
+func NewOpenAPIDocument(info OpenAPIInfo, serverURL, tokenURL string, operations []APIOperation) *OpenAPIDocument {
+	generator := &schemaGenerator{schemas: make(map[string]*OpenAPISchema)}
+	problemSchema := generator.schemaOf(reflect.TypeOf(models.Problem{}))
+
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    info,
+		Servers: []OpenAPIServer{{URL: serverURL}},
+		Paths:   make(map[string]map[string]*OpenAPIOperation),
+		Components: OpenAPIComponents{
+			Schemas: generator.schemas,
+			SecuritySchemes: map[string]OpenAPISecurityScheme{
+				"oauth2": {
+					Type:        "oauth2",
+					Description: "bearer access tokens, for the clients which cannot keep a cookie session",
+					Flows: &OpenAPIOAuthFlows{
+						Password: &OpenAPIOAuthFlow{TokenURL: tokenURL, RefreshURL: tokenURL, Scopes: map[string]string{}},
+					},
+				},
+				"cookieAuth": {
+					Type:        "apiKey",
+					Description: "the login session of the web UI; the state changing requests need the " + CSRFHeaderName + " header too",
+					In:          "cookie",
+					Name:        SessionCookieName,
+				},
+			},
+		},
+	}
+
+	for _, op := range operations {
+		path := openAPIPathParamRegex.ReplaceAllString(op.Path, "{$1}")
+		operation := &OpenAPIOperation{
+			Summary:   op.Summary,
+			Responses: make(map[string]*OpenAPIResponse),
+		}
+		if op.Tag != "" {
+			operation.Tags = []string{op.Tag}
+		}
+		for _, match := range openAPIPathParamRegex.FindAllStringSubmatch(op.Path, -1) {
+			operation.Parameters = append(operation.Parameters, OpenAPIParameter{
+				Name:     match[1],
+				In:       "path",
+				Required: true,
+				Schema:   &OpenAPISchema{Type: "string"},
+			})
+		}
+		if op.Request != nil {
+			operation.RequestBody = &OpenAPIRequestBody{
+				Required: true,
+				Content:  map[string]OpenAPIMediaType{"application/json": {Schema: generator.schemaOf(reflect.TypeOf(op.Request))}},
+			}
+		}
+
+		success := &OpenAPIResponse{Description: http.StatusText(op.Status)}
+		if op.Response != nil {
+			success.Content = map[string]OpenAPIMediaType{"application/json": {Schema: generator.schemaOf(reflect.TypeOf(op.Response))}}
+		}
+		operation.Responses[strconv.Itoa(op.Status)] = success
+
+		errorStatuses := append([]int{}, op.Errors...)
+		if op.Authenticated {
+			operation.Security = []map[string][]string{{"oauth2": {}}, {"cookieAuth": {}}}
+			errorStatuses = append(errorStatuses, http.StatusUnauthorized)
+			if op.Permission != "" {
+				operation.Description = "Needs the permission `" + string(op.Permission) + "`."
+				errorStatuses = append(errorStatuses, http.StatusForbidden)
+			}
+		}
+		errorStatuses = append(errorStatuses, http.StatusInternalServerError)
+		for _, status := range errorStatuses {
+			operation.Responses[strconv.Itoa(status)] = &OpenAPIResponse{
+				Description: http.StatusText(status),
+				Content:     map[string]OpenAPIMediaType{ProblemContentType: {Schema: problemSchema}},
+			}
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*OpenAPIOperation)
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = operation
+	}
+
+	return doc
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaGenerator makes the JSON schemas of the Go types the way encoding/json marshals them,
+// the named structs go to the components and are referenced
+type schemaGenerator struct {
+	schemas map[string]*OpenAPISchema
+}
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) *OpenAPISchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &OpenAPISchema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &OpenAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &OpenAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		// encoding/json sends the bytes base64 encoded
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &OpenAPISchema{Type: "string", Format: "byte"}
+		}
+		return &OpenAPISchema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := schemaName(t)
+		ref := &OpenAPISchema{Ref: "#/components/schemas/" + name}
+		if _, ok := g.schemas[name]; ok {
+			return ref
+		}
+		// taken before the fields are looked at, so the recursive types end
+		g.schemas[name] = &OpenAPISchema{}
+		*g.schemas[name] = *g.structSchema(t)
+		return ref
+	default:
+		// interfaces can hold anything
+		return &OpenAPISchema{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) *OpenAPISchema {
+	schema := &OpenAPISchema{Type: "object", Properties: make(map[string]*OpenAPISchema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		// the fields of an embedded struct are marshaled as the struct's own, even when its type is unexported
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := g.structSchema(field.Type)
+			for propertyName, property := range embedded.Properties {
+				schema.Properties[propertyName] = property
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		property := g.schemaOf(field.Type)
+		required := !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Ptr
+		if property.Ref == "" {
+			required = describeValidation(property, field.Tag.Get("validate")) || required
+		}
+		schema.Properties[name] = property
+		if required {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+// describeValidation adds the rules of the validate tag to the schema, as far as JSON schema can tell them,
+// and tells if the value is required
+func describeValidation(schema *OpenAPISchema, tag string) bool {
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		ruleName, param, _ := strings.Cut(rule, "=")
+		switch ruleName {
+		case "required":
+			required = true
+		case "min":
+			schema.Minimum = newFloat(parseNumberParam(param))
+		case "max":
+			schema.Maximum = newFloat(parseNumberParam(param))
+		case "minlen":
+			schema.MinLength = newInt(int(parseNumberParam(param)))
+		case "maxlen":
+			schema.MaxLength = newInt(int(parseNumberParam(param)))
+		case "oneof":
+			schema.Enum = strings.Fields(param)
+		case "currency":
+			schema.Pattern = currencyRegex.String()
+		case "date":
+			schema.Format = "date"
+		case "email":
+			schema.Format = "email"
+		}
+	}
+	return required
+}
+
+func newFloat(f float64) *float64 {
+	return &f
+}
+
+func newInt(i int) *int {
+	return &i
+}
+
+// schemaName is the name of the type, capitalized, as the unexported request types are not any less public
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
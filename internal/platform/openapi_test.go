@@ -0,0 +1,103 @@
+package platform_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type openAPITestBase struct {
+	Created time.Time `json:"created"`
+}
+
+type openAPITestNode struct {
+	openAPITestBase
+	Name     string             `json:"name"`
+	Note     string             `json:"note,omitempty"`
+	Parent   *openAPITestNode   `json:"parent"`
+	Children []openAPITestNode  `json:"children"`
+	Labels   map[string]float64 `json:"labels"`
+	Avatar   []byte             `json:"avatar"`
+	Secret   string             `json:"-"`
+	Count    int64
+	hidden   bool
+}
+
+func newTestOpenAPIDocument() *platform.OpenAPIDocument {
+	return platform.NewOpenAPIDocument(platform.OpenAPIInfo{Title: "test", Version: "1"}, "/api", "/token", []platform.APIOperation{
+		{
+			Method: "GET", Path: "/nodes", Summary: "list the nodes",
+			Response: []openAPITestNode{}, Status: http.StatusOK,
+		},
+		{
+			Method: "PUT", Path: "/nodes/{name}/parent/{parent:[a-z]+}", Summary: "set the parent",
+			Authenticated: true, Permission: platform.PermWriteOwnData,
+			Request: &openAPITestNode{}, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound},
+		},
+	})
+}
+
+func TestNewOpenAPIDocument_Schemas(t *testing.T) {
+	doc := newTestOpenAPIDocument()
+
+	node := doc.Components.Schemas["OpenAPITestNode"]
+	require.NotNil(t, node)
+	assert.Equal(t, "object", node.Type)
+	assert.ElementsMatch(t, []string{"created", "name", "children", "labels", "avatar", "Count"}, node.Required)
+	assert.ElementsMatch(t, []string{"created", "name", "note", "parent", "children", "labels", "avatar", "Count"}, keys(node.Properties))
+
+	assert.Equal(t, &platform.OpenAPISchema{Type: "string", Format: "date-time"}, node.Properties["created"])
+	assert.Equal(t, &platform.OpenAPISchema{Ref: "#/components/schemas/OpenAPITestNode"}, node.Properties["parent"])
+	assert.Equal(t, "array", node.Properties["children"].Type)
+	assert.Equal(t, "#/components/schemas/OpenAPITestNode", node.Properties["children"].Items.Ref)
+	assert.Equal(t, &platform.OpenAPISchema{Type: "number", Format: "double"}, node.Properties["labels"].AdditionalProperties)
+	assert.Equal(t, &platform.OpenAPISchema{Type: "string", Format: "byte"}, node.Properties["avatar"])
+	assert.Equal(t, &platform.OpenAPISchema{Type: "integer", Format: "int64"}, node.Properties["Count"])
+
+	// the embedded struct is flattened, it has no schema of its own
+	assert.NotContains(t, doc.Components.Schemas, "OpenAPITestBase")
+	assert.Contains(t, doc.Components.Schemas, "Problem")
+}
+
+func TestNewOpenAPIDocument_Operations(t *testing.T) {
+	doc := newTestOpenAPIDocument()
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	assert.Equal(t, "/token", doc.Components.SecuritySchemes["oauth2"].Flows.Password.TokenURL)
+
+	list := doc.Paths["/nodes"]["get"]
+	require.NotNil(t, list)
+	assert.Empty(t, list.Security)
+	assert.Nil(t, list.RequestBody)
+	assert.ElementsMatch(t, []string{"200", "500"}, keys(list.Responses))
+	assert.Equal(t, "array", list.Responses["200"].Content["application/json"].Schema.Type)
+
+	// the patterns of the route variables are not part of the path
+	setParent := doc.Paths["/nodes/{name}/parent/{parent}"]["put"]
+	require.NotNil(t, setParent)
+	require.Len(t, setParent.Parameters, 2)
+	assert.Equal(t, "name", setParent.Parameters[0].Name)
+	assert.Equal(t, "parent", setParent.Parameters[1].Name)
+	assert.True(t, setParent.Parameters[1].Required)
+	assert.Equal(t, "#/components/schemas/OpenAPITestNode", setParent.RequestBody.Content["application/json"].Schema.Ref)
+	assert.Equal(t, []map[string][]string{{"oauth2": {}}, {"cookieAuth": {}}}, setParent.Security)
+	assert.Contains(t, setParent.Description, string(platform.PermWriteOwnData))
+	assert.ElementsMatch(t, []string{"204", "401", "403", "404", "500"}, keys(setParent.Responses))
+	assert.Empty(t, setParent.Responses["204"].Content)
+	assert.Equal(t, "#/components/schemas/Problem", setParent.Responses["403"].Content[platform.ProblemContentType].Schema.Ref)
+
+	_, err := json.Marshal(doc)
+	assert.NoError(t, err)
+}
+
+func keys[V any](m map[string]V) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,202 @@
+package platform
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the algorithms the passwords can be hashed with
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+// Argon2Params are the argon2id cost parameters, see RFC 9106
+type Argon2Params struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params is the second recommended option of RFC 9106, for memory constrained environments
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// DefaultArgon2MemoryBudget is the memory, in KiB, the argon2id hashes can take at once when the config
+// and GOMEMLIMIT leave it open: four hashes with the DefaultArgon2Params
+const DefaultArgon2MemoryBudget = 4 * 64 * 1024
+
+// DefaultBcryptCost is the cost the passwords were always hashed with, before argon2id
+const DefaultBcryptCost = 14
+
+// PasswordHasher hashes the new passwords with the configured algorithm and parameters, and verifies the
+// passwords against the hashes of any supported algorithm and parameters. The hashes are self-describing:
+// argon2id ones in the PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>, and bcrypt
+// ones in its own modular crypt format, e.g. $2a$14$<salt and hash>, which the PHC format comes from.
+// Every argon2id hash takes its memory parameter in RAM while it runs, so the hashes running at once share
+// a memory budget, and the ones it has no room for fail with ErrPasswordHasherBusy instead of waiting.
+type PasswordHasher struct {
+	algorithm  string
+	argon2     Argon2Params
+	bcryptCost int
+
+	// in KiB, as the argon2id memory parameter
+	memoryBudget uint64
+	memoryMutex  sync.Mutex
+	memoryInUse  uint64
+}
+
+func NewPasswordHasher(algorithm string, argon2Params Argon2Params, bcryptCost int, argon2MemoryBudget uint64) (*PasswordHasher, error) {
+	switch algorithm {
+	case PasswordHashArgon2id:
+		if argon2Params.Memory == 0 || argon2Params.Iterations == 0 || argon2Params.Parallelism == 0 ||
+			argon2Params.SaltLength == 0 || argon2Params.KeyLength == 0 {
+			return nil, fmt.Errorf("invalid argon2id parameters: %+v", argon2Params)
+		}
+	case PasswordHashBcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("invalid bcrypt cost: %d", bcryptCost)
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm: %s", algorithm)
+	}
+	if argon2MemoryBudget == 0 {
+		return nil, fmt.Errorf("invalid argon2id memory budget: %d", argon2MemoryBudget)
+	}
+
+	return &PasswordHasher{
+		algorithm:    algorithm,
+		argon2:       argon2Params,
+		bcryptCost:   bcryptCost,
+		memoryBudget: argon2MemoryBudget,
+	}, nil
+}
+
+// NewDefaultPasswordHasher hashes with argon2id and the DefaultArgon2Params
+func NewDefaultPasswordHasher() *PasswordHasher {
+	return &PasswordHasher{
+		algorithm:    PasswordHashArgon2id,
+		argon2:       DefaultArgon2Params,
+		bcryptCost:   DefaultBcryptCost,
+		memoryBudget: DefaultArgon2MemoryBudget,
+	}
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.algorithm == PasswordHashBcrypt {
+		// bcrypt uses only the first 72 bytes, the rest would not count
+		if len(password) > 72 {
+			return "", ErrPasswordTooLong
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, h.argon2.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	if !h.reserveMemory(h.argon2.Memory) {
+		return "", ErrPasswordHasherBusy
+	}
+	defer h.releaseMemory(h.argon2.Memory)
+	key := argon2.IDKey([]byte(password), salt, h.argon2.Iterations, h.argon2.Memory, h.argon2.Parallelism, h.argon2.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.argon2.Memory,
+		h.argon2.Iterations,
+		h.argon2.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify tells if the password matches the hash, and if so, whether the hash should be replaced
+// by a new one because it was made with another algorithm or other parameters than the current ones
+func (h *PasswordHasher) Verify(password, hash string) (ok bool, needsRehash bool, err error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, false, err
+		}
+		if !h.reserveMemory(params.Memory) {
+			return false, false, ErrPasswordHasherBusy
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		h.releaseMemory(params.Memory)
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false, nil
+		}
+		params.SaltLength = uint32(len(salt))
+		return true, h.algorithm != PasswordHashArgon2id || params != h.argon2, nil
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false, ErrUnknownPasswordHash
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, h.algorithm != PasswordHashBcrypt || cost != h.bcryptCost, nil
+}
+
+// reserveMemory takes the memory of an argon2id hash, in KiB, from the budget, and tells if there was room for it;
+// a hash alone always runs, even one of older parameters bigger than the whole budget, or it could never be verified
+func (h *PasswordHasher) reserveMemory(memory uint32) bool {
+	h.memoryMutex.Lock()
+	defer h.memoryMutex.Unlock()
+	if h.memoryInUse > 0 && h.memoryInUse+uint64(memory) > h.memoryBudget {
+		return false
+	}
+	h.memoryInUse += uint64(memory)
+	return true
+}
+
+func (h *PasswordHasher) releaseMemory(memory uint32) {
+	h.memoryMutex.Lock()
+	defer h.memoryMutex.Unlock()
+	h.memoryInUse -= uint64(memory)
+}
+
+func parseArgon2Hash(hash string) (params Argon2Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
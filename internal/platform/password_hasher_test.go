@@ -0,0 +1,179 @@
+package platform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters, the tests need not be slow
+var testArgon2Params = platform.Argon2Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestPasswordHasher_Argon2id(t *testing.T) {
+	hasher, err := platform.NewPasswordHasher(platform.PasswordHashArgon2id, testArgon2Params, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	require.NoError(t, err)
+
+	raw := "myinspirationsucks"
+	hashedPass, err := hasher.Hash(raw)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hashedPass, "$argon2id$v=19$m=64,t=1,p=1$"), hashedPass)
+	assert.Len(t, strings.Split(hashedPass, "$"), 6)
+
+	otherHash, err := hasher.Hash(raw)
+	require.NoError(t, err)
+	assert.NotEqual(t, hashedPass, otherHash, "every hash has its own salt")
+
+	ok, needsRehash, err := hasher.Verify(raw, hashedPass)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, needsRehash)
+
+	ok, needsRehash, err = hasher.Verify("myinspirationstillsucks", hashedPass)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, needsRehash)
+}
+
+func TestPasswordHasher_Bcrypt(t *testing.T) {
+	hasher, err := platform.NewPasswordHasher(platform.PasswordHashBcrypt, testArgon2Params, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	require.NoError(t, err)
+
+	raw := "myinspirationsucks"
+	hashedPass, err := hasher.Hash(raw)
+	require.NoError(t, err)
+	assert.Len(t, hashedPass, 60)
+
+	ok, needsRehash, err := hasher.Verify(raw, hashedPass)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, needsRehash)
+
+	ok, _, err = hasher.Verify("myinspirationstillsucks", hashedPass)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = hasher.Hash(strings.Repeat("a", 73))
+	assert.Equal(t, platform.ErrPasswordTooLong, err)
+}
+
+func TestPasswordHasher_NeedsRehash(t *testing.T) {
+	raw := "myinspirationsucks"
+	// the hashes made before argon2id, with the old hard-coded cost
+	legacyHash, err := bcrypt.GenerateFromPassword([]byte(raw), bcrypt.MinCost+1)
+	require.NoError(t, err)
+
+	argon2Hasher, err := platform.NewPasswordHasher(platform.PasswordHashArgon2id, testArgon2Params, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	require.NoError(t, err)
+	ok, needsRehash, err := argon2Hasher.Verify(raw, string(legacyHash))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash, "bcrypt hash with argon2id configured")
+
+	// a wrong password never asks for a rehash
+	ok, needsRehash, err = argon2Hasher.Verify("wrong", string(legacyHash))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, needsRehash)
+
+	bcryptHasher, err := platform.NewPasswordHasher(platform.PasswordHashBcrypt, testArgon2Params, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	require.NoError(t, err)
+	_, needsRehash, err = bcryptHasher.Verify(raw, string(legacyHash))
+	require.NoError(t, err)
+	assert.True(t, needsRehash, "bcrypt hash with another cost")
+
+	argon2Hash, err := argon2Hasher.Hash(raw)
+	require.NoError(t, err)
+	_, needsRehash, err = bcryptHasher.Verify(raw, argon2Hash)
+	require.NoError(t, err)
+	assert.True(t, needsRehash, "argon2id hash with bcrypt configured")
+
+	strongerParams := testArgon2Params
+	strongerParams.Iterations = 2
+	strongerHasher, err := platform.NewPasswordHasher(platform.PasswordHashArgon2id, strongerParams, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	require.NoError(t, err)
+	ok, needsRehash, err = strongerHasher.Verify(raw, argon2Hash)
+	require.NoError(t, err)
+	assert.True(t, ok, "the old parameters still verify")
+	assert.True(t, needsRehash, "argon2id hash with other parameters")
+}
+
+func TestPasswordHasher_MemoryBudget(t *testing.T) {
+	// room for two hashes at once
+	hasher, err := platform.NewPasswordHasher(platform.PasswordHashArgon2id, testArgon2Params, bcrypt.MinCost, 2*uint64(testArgon2Params.Memory))
+	require.NoError(t, err)
+	hashedPass, err := hasher.Hash("myinspirationsucks")
+	require.NoError(t, err)
+
+	require.True(t, hasher.ReserveMemory(testArgon2Params.Memory))
+	ok, _, err := hasher.Verify("myinspirationsucks", hashedPass)
+	require.NoError(t, err)
+	assert.True(t, ok, "one more hash fits")
+
+	require.True(t, hasher.ReserveMemory(testArgon2Params.Memory))
+	_, err = hasher.Hash("myinspirationsucks")
+	assert.Equal(t, platform.ErrPasswordHasherBusy, err)
+	ok, _, err = hasher.Verify("myinspirationsucks", hashedPass)
+	assert.Equal(t, platform.ErrPasswordHasherBusy, err)
+	assert.False(t, ok)
+
+	// bcrypt takes next to no memory
+	bcryptHasher, err := platform.NewPasswordHasher(platform.PasswordHashBcrypt, testArgon2Params, bcrypt.MinCost, 2*uint64(testArgon2Params.Memory))
+	require.NoError(t, err)
+	require.True(t, bcryptHasher.ReserveMemory(2*testArgon2Params.Memory))
+	bcryptHash, err := bcryptHasher.Hash("myinspirationsucks")
+	require.NoError(t, err)
+	ok, _, err = bcryptHasher.Verify("myinspirationsucks", bcryptHash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	hasher.ReleaseMemory(testArgon2Params.Memory)
+	ok, _, err = hasher.Verify("myinspirationsucks", hashedPass)
+	require.NoError(t, err)
+	assert.True(t, ok, "the budget has room again")
+	hasher.ReleaseMemory(testArgon2Params.Memory)
+
+	// a hash bigger than the whole budget still runs alone
+	smallHasher, err := platform.NewPasswordHasher(platform.PasswordHashArgon2id, testArgon2Params, bcrypt.MinCost, uint64(testArgon2Params.Memory)/2)
+	require.NoError(t, err)
+	ok, _, err = smallHasher.Verify("myinspirationsucks", hashedPass)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestPasswordHasher_InvalidHash(t *testing.T) {
+	hasher := platform.NewDefaultPasswordHasher()
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=64,t=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$not base64!$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$",
+	} {
+		ok, _, err := hasher.Verify("password", hash)
+		assert.Equal(t, platform.ErrUnknownPasswordHash, err, hash)
+		assert.False(t, ok, hash)
+	}
+}
+
+func TestNewPasswordHasher_InvalidConfig(t *testing.T) {
+	_, err := platform.NewPasswordHasher("md5", testArgon2Params, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	assert.Error(t, err)
+	_, err = platform.NewPasswordHasher(platform.PasswordHashArgon2id, platform.Argon2Params{}, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	assert.Error(t, err)
+	_, err = platform.NewPasswordHasher(platform.PasswordHashBcrypt, testArgon2Params, 2, platform.DefaultArgon2MemoryBudget)
+	assert.Error(t, err)
+	_, err = platform.NewPasswordHasher(platform.PasswordHashArgon2id, testArgon2Params, bcrypt.MinCost, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package platform
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const DefaultPasswordMinLength = 8
+
+// DefaultPasswordMaxLength keeps the hashing of huge passwords from being used against the server
+const DefaultPasswordMaxLength = 128
+
+// PasswordPolicy says which passwords the users can choose, on registration and on a password change.
+// Following NIST SP 800-63B, it asks for a length and rejects the passwords known from data breaches,
+// rather than for a mix of character classes.
+type PasswordPolicy struct {
+	// MinLength and MaxLength are in characters, not bytes
+	MinLength int
+	MaxLength int
+	// breached holds the uppercase hex SHA-1 of the breached passwords, the form they're published in
+	breached map[string]struct{}
+}
+
+func NewPasswordPolicy(minLength, maxLength int) *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength: minLength,
+		MaxLength: maxLength,
+		breached:  make(map[string]struct{}),
+	}
+}
+
+// LoadBreachedPasswords reads the breached passwords from the file, see ReadBreachedPasswords
+func (p *PasswordPolicy) LoadBreachedPasswords(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return p.ReadBreachedPasswords(file)
+}
+
+// ReadBreachedPasswords adds the breached passwords, one per line, and returns how many it read. A line is
+// either the password itself, or its hex SHA-1 with an optional ":<count>" as in the Have I Been Pwned
+// downloads; empty lines and lines starting with # are skipped.
+func (p *PasswordPolicy) ReadBreachedPasswords(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			p.breached[strings.ToUpper(hash)] = struct{}{}
+		} else {
+			p.breached[passwordSHA1(line)] = struct{}{}
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// Check returns ErrPasswordTooShort, ErrPasswordTooLong or ErrPasswordBreached if the password is not allowed
+func (p *PasswordPolicy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return ErrPasswordTooShort
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return ErrPasswordTooLong
+	}
+	if _, found := p.breached[passwordSHA1(password)]; found {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
+// IsPasswordPolicyError tells if the error is a password rejected by the PasswordPolicy,
+// so the user can be told to choose another one
+func IsPasswordPolicyError(err error) bool {
+	return err == ErrPasswordTooShort || err == ErrPasswordTooLong || err == ErrPasswordBreached
+}
+
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,82 @@
+package platform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	policy := platform.NewPasswordPolicy(8, 20)
+	read, err := policy.ReadBreachedPasswords(strings.NewReader(
+		"# common passwords\n" +
+			"password123\n" +
+			"\n" +
+			"qwertyuiop\r\n" +
+			// SHA-1 of "iloveyou2", as in the Have I Been Pwned downloads
+			"EBE53C61982711F13AF8BBC09844E4E2849268BA:12\n" +
+			// SHA-1 of "letmein!!", lowercase without a count
+			"e83e1e868521db26bf715b3d727e4133255f687e\n",
+	))
+	require.NoError(t, err)
+	assert.Equal(t, 4, read)
+
+	testCases := []struct {
+		name     string
+		password string
+		expected error
+	}{
+		{"ok", "correct horse", nil},
+		{"min length", "12345678", nil},
+		{"max length", strings.Repeat("x", 20), nil},
+		{"empty", "", platform.ErrPasswordTooShort},
+		{"too short", "1234567", platform.ErrPasswordTooShort},
+		{"too long", strings.Repeat("x", 21), platform.ErrPasswordTooLong},
+		// characters count, not bytes
+		{"multibyte", "ünïcödé", platform.ErrPasswordTooShort},
+		{"multibyte ok", "ünïcödé!", nil},
+		{"breached", "password123", platform.ErrPasswordBreached},
+		{"breached with CRLF line", "qwertyuiop", platform.ErrPasswordBreached},
+		{"breached SHA-1 with count", "iloveyou2", platform.ErrPasswordBreached},
+		{"breached SHA-1 lowercase", "letmein!!", platform.ErrPasswordBreached},
+		{"case matters", "Password123", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, policy.Check(tc.password))
+		})
+	}
+}
+
+func TestPasswordPolicy_BreachedHashes(t *testing.T) {
+	policy := platform.NewPasswordPolicy(1, 0)
+	_, err := policy.ReadBreachedPasswords(strings.NewReader(
+		// SHA-1 of "password", uppercase as published, and of "123456", lowercase
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\n" +
+			"7c4a8d09ca3762af61e59520943dc26494f8941b\n",
+	))
+	require.NoError(t, err)
+
+	assert.Equal(t, platform.ErrPasswordBreached, policy.Check("password"))
+	assert.Equal(t, platform.ErrPasswordBreached, policy.Check("123456"))
+	assert.NoError(t, policy.Check("1234567"))
+	// no max length
+	assert.NoError(t, policy.Check(strings.Repeat("x", 1000)))
+}
+
+func TestPasswordPolicy_LoadBreachedPasswords(t *testing.T) {
+	policy := platform.NewPasswordPolicy(1, 0)
+	_, err := policy.LoadBreachedPasswords(t.TempDir() + "/missing.txt")
+	assert.Error(t, err)
+}
+
+func TestIsPasswordPolicyError(t *testing.T) {
+	assert.True(t, platform.IsPasswordPolicyError(platform.ErrPasswordTooShort))
+	assert.True(t, platform.IsPasswordPolicyError(platform.ErrPasswordTooLong))
+	assert.True(t, platform.IsPasswordPolicyError(platform.ErrPasswordBreached))
+	assert.False(t, platform.IsPasswordPolicyError(platform.ErrNotFound))
+	assert.False(t, platform.IsPasswordPolicyError(nil))
+}
@@ -0,0 +1,55 @@
+package platform
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/2beens/ispend/internal/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProblemContentType is the media type of the RFC 7807 problem details
+const ProblemContentType = "application/problem+json"
+
+// SendJSON sends the data as the JSON response body, with the HTTP status; the /api/v1 responses
+// carry no envelope, the status is only in the HTTP status line
+func SendJSON(w http.ResponseWriter, status int, data interface{}) {
+	sendJSON(w, status, "application/json", data)
+}
+
+// SendProblem sends the RFC 7807 problem details of the failed request, with the HTTP status
+func SendProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	sendJSON(w, status, ProblemContentType, models.Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+// SendValidationProblem sends the problem of an invalid request, with the errors of its fields
+func SendValidationProblem(w http.ResponseWriter, r *http.Request, errs ValidationErrors) {
+	sendJSON(w, http.StatusBadRequest, ProblemContentType, models.Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(http.StatusBadRequest),
+		Status:   http.StatusBadRequest,
+		Detail:   errs.Error(),
+		Instance: r.URL.Path,
+		Errors:   errs,
+	})
+}
+
+func sendJSON(w http.ResponseWriter, status int, contentType string, data interface{}) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		log.Warnf("#120414 failed to send API response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if _, err := w.Write(dataBytes); err != nil {
+		log.Warnf("#120415 failed to send API response: %s", err)
+	}
+}
@@ -0,0 +1,45 @@
+package platform
+
+import "github.com/2beens/ispend/internal/models"
+
+// Permission is something a principal may do, granted to it by the role of its user
+type Permission string
+
+const (
+	// PermReadOwnData allows reading the user's own spends and spend kinds
+	PermReadOwnData Permission = "own_data:read"
+	// PermWriteOwnData allows adding and deleting the user's own spends
+	PermWriteOwnData Permission = "own_data:write"
+	// PermManageOwnAccount allows managing the user's own account, e.g. its login sessions
+	PermManageOwnAccount Permission = "own_account:manage"
+	// PermManageUsers allows listing all the users and changing their roles
+	PermManageUsers Permission = "users:manage"
+	// PermDebug allows the debug pages, which show the server logs
+	PermDebug Permission = "debug"
+	// PermShutdown allows shutting the server down
+	PermShutdown Permission = "server:shutdown"
+)
+
+var rolePermissions = map[string][]Permission{
+	models.RoleReadOnly: {PermReadOwnData, PermManageOwnAccount},
+	models.RoleUser:     {PermReadOwnData, PermWriteOwnData, PermManageOwnAccount},
+	models.RoleAdmin: {
+		PermReadOwnData, PermWriteOwnData, PermManageOwnAccount,
+		PermManageUsers, PermDebug, PermShutdown,
+	},
+}
+
+// RoleHasPermission tells if the role grants the permission; unknown roles grant nothing
+func RoleHasPermission(role string, permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Can tells if the principal's role grants the permission
+func (p *Principal) Can(permission Permission) bool {
+	return p != nil && RoleHasPermission(p.Role, permission)
+}
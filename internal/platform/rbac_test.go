@@ -0,0 +1,58 @@
+package platform_test
+
+import (
+	"testing"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleHasPermission(t *testing.T) {
+	tests := []struct {
+		role    string
+		allowed []platform.Permission
+		denied  []platform.Permission
+	}{
+		{
+			role:    models.RoleAdmin,
+			allowed: []platform.Permission{platform.PermReadOwnData, platform.PermWriteOwnData, platform.PermManageOwnAccount, platform.PermManageUsers, platform.PermDebug, platform.PermShutdown},
+		},
+		{
+			role:    models.RoleUser,
+			allowed: []platform.Permission{platform.PermReadOwnData, platform.PermWriteOwnData, platform.PermManageOwnAccount},
+			denied:  []platform.Permission{platform.PermManageUsers, platform.PermDebug, platform.PermShutdown},
+		},
+		{
+			role:    models.RoleReadOnly,
+			allowed: []platform.Permission{platform.PermReadOwnData, platform.PermManageOwnAccount},
+			denied:  []platform.Permission{platform.PermWriteOwnData, platform.PermManageUsers, platform.PermDebug, platform.PermShutdown},
+		},
+		{
+			role:   "",
+			denied: []platform.Permission{platform.PermReadOwnData, platform.PermWriteOwnData, platform.PermManageUsers},
+		},
+		{
+			role:   "superuser",
+			denied: []platform.Permission{platform.PermReadOwnData, platform.PermManageUsers, platform.PermShutdown},
+		},
+	}
+
+	for _, tc := range tests {
+		for _, permission := range tc.allowed {
+			assert.True(t, platform.RoleHasPermission(tc.role, permission), "%s: %s", tc.role, permission)
+		}
+		for _, permission := range tc.denied {
+			assert.False(t, platform.RoleHasPermission(tc.role, permission), "%s: %s", tc.role, permission)
+		}
+	}
+}
+
+func TestPrincipalCan(t *testing.T) {
+	var nobody *platform.Principal
+	assert.False(t, nobody.Can(platform.PermReadOwnData))
+
+	principal := platform.NewSessionPrincipal(&platform.LoginSession{Username: "u1"}, models.RoleReadOnly)
+	assert.True(t, principal.Can(platform.PermReadOwnData))
+	assert.False(t, principal.Can(platform.PermWriteOwnData))
+}
@@ -0,0 +1,177 @@
+package platform
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RefreshToken is a single use token exchanged for new access and refresh tokens. All the tokens
+// rotated from the one given out at login make a family, which lives as long as that first token.
+type RefreshToken struct {
+	// TokenHash is the hash of the token, only the client knows the token itself
+	TokenHash string
+	FamilyID  string
+	Username  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// UsedAt is when the token was exchanged for a new one, zero while it can still be used
+	UsedAt time.Time
+}
+
+func (rt *RefreshToken) IsExpired(now time.Time) bool {
+	return !now.Before(rt.ExpiresAt)
+}
+
+func (rt *RefreshToken) IsUsed() bool {
+	return !rt.UsedAt.IsZero()
+}
+
+// RefreshTokenStore keeps the refresh tokens, used ones included, so a reused token gets recognized.
+// Get returns ErrNotFound for unknown tokens, but may still return expired ones not swept yet.
+type RefreshTokenStore interface {
+	Save(ctx context.Context, token *RefreshToken) error
+	Get(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	// MarkUsed marks the token used at usedAt if nobody did it before, and tells if it was the one who did,
+	// so out of concurrent requests with the same token only one gets to rotate it
+	MarkUsed(ctx context.Context, tokenHash string, usedAt time.Time) (bool, error)
+	// DeleteFamily removes all the tokens of the family, and returns their count
+	DeleteFamily(ctx context.Context, familyID string) (int, error)
+	// DeleteByUsername removes all the tokens of the user, and returns their count
+	DeleteByUsername(ctx context.Context, username string) (int, error)
+	// DeleteExpired removes all tokens expired at the given moment, and returns their count
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// MemoryRefreshTokenStore is a RefreshTokenStore living only in memory, its tokens are lost on restart
+type MemoryRefreshTokenStore struct {
+	mu       sync.Mutex
+	tokens   map[string]RefreshToken
+	families map[string]map[string]struct{}
+}
+
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{
+		tokens:   make(map[string]RefreshToken),
+		families: make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *MemoryRefreshTokenStore) Save(ctx context.Context, token *RefreshToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.tokens[token.TokenHash]; ok && existing.FamilyID != token.FamilyID {
+		s.unindex(existing)
+	}
+	s.tokens[token.TokenHash] = *token
+	family, ok := s.families[token.FamilyID]
+	if !ok {
+		family = make(map[string]struct{})
+		s.families[token.FamilyID] = family
+	}
+	family[token.TokenHash] = struct{}{}
+
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) Get(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+func (s *MemoryRefreshTokenStore) MarkUsed(ctx context.Context, tokenHash string, usedAt time.Time) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[tokenHash]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if token.IsUsed() {
+		return false, nil
+	}
+	token.UsedAt = usedAt
+	s.tokens[tokenHash] = token
+	return true, nil
+}
+
+func (s *MemoryRefreshTokenStore) DeleteFamily(ctx context.Context, familyID string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	family := s.families[familyID]
+	for tokenHash := range family {
+		delete(s.tokens, tokenHash)
+	}
+	delete(s.families, familyID)
+	return len(family), nil
+}
+
+func (s *MemoryRefreshTokenStore) DeleteByUsername(ctx context.Context, username string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, token := range s.tokens {
+		if token.Username == username {
+			s.unindex(token)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryRefreshTokenStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, token := range s.tokens {
+		if token.IsExpired(now) {
+			s.unindex(token)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// unindex must be called with s.mu held
+func (s *MemoryRefreshTokenStore) unindex(token RefreshToken) {
+	delete(s.tokens, token.TokenHash)
+	family := s.families[token.FamilyID]
+	delete(family, token.TokenHash)
+	if len(family) == 0 {
+		delete(s.families, token.FamilyID)
+	}
+}
@@ -0,0 +1,143 @@
+package platform
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionStore keeps the login sessions, while the LoginSessionManager decides when they expire.
+// Get returns ErrNotFound for unknown sessions, but may still return expired ones not swept yet.
+type SessionStore interface {
+	// Save creates the session or overwrites the existing one with the same token hash
+	Save(ctx context.Context, session *LoginSession) error
+	Get(ctx context.Context, tokenHash string) (*LoginSession, error)
+	// GetByUsername returns all sessions of the user, oldest first
+	GetByUsername(ctx context.Context, username string) ([]LoginSession, error)
+	Delete(ctx context.Context, tokenHash string) error
+	// DeleteExpired removes all sessions expired at the given moment, and returns their count
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// MemorySessionStore is a SessionStore living only in memory, its sessions are lost on restart
+type MemorySessionStore struct {
+	mu         sync.RWMutex
+	sessions   map[string]LoginSession
+	byUsername map[string]map[string]struct{}
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:   make(map[string]LoginSession),
+		byUsername: make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *MemorySessionStore) Save(ctx context.Context, session *LoginSession) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.sessions[session.TokenHash]; ok && existing.Username != session.Username {
+		s.unindex(existing)
+	}
+	s.sessions[session.TokenHash] = *session
+	userSessions, ok := s.byUsername[session.Username]
+	if !ok {
+		userSessions = make(map[string]struct{})
+		s.byUsername[session.Username] = userSessions
+	}
+	userSessions[session.TokenHash] = struct{}{}
+
+	return nil
+}
+
+func (s *MemorySessionStore) Get(ctx context.Context, tokenHash string) (*LoginSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &session, nil
+}
+
+func (s *MemorySessionStore) GetByUsername(ctx context.Context, username string) ([]LoginSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sessions []LoginSession
+	for tokenHash := range s.byUsername[username] {
+		sessions = append(sessions, s.sessions[tokenHash])
+	}
+	SortLoginSessions(sessions)
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) Delete(ctx context.Context, tokenHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[tokenHash]
+	if !ok {
+		return ErrNotFound
+	}
+	s.unindex(session)
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for tokenHash, session := range s.sessions {
+		if session.IsExpired(now) {
+			s.unindex(session)
+			delete(s.sessions, tokenHash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// unindex removes the session from the username index, must be called with s.mu held
+func (s *MemorySessionStore) unindex(session LoginSession) {
+	userSessions := s.byUsername[session.Username]
+	delete(userSessions, session.TokenHash)
+	if len(userSessions) == 0 {
+		delete(s.byUsername, session.Username)
+	}
+}
+
+// SortLoginSessions sorts the sessions oldest first, the way all the stores return them
+func SortLoginSessions(sessions []LoginSession) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].TokenHash < sessions[j].TokenHash
+		}
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+}
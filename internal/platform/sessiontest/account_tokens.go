@@ -0,0 +1,141 @@
+package sessiontest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RunAccountTokenConformance runs the suite every platform.AccountTokenStore implementation must pass,
+// calling newStore for a fresh store in every sub-test
+func RunAccountTokenConformance(t *testing.T, newStore func(t *testing.T) platform.AccountTokenStore) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store platform.AccountTokenStore)
+	}{
+		{"SaveAndTake", testAccountTokenSaveAndTake},
+		{"DeleteByUsername", testAccountTokenDeleteByUsername},
+		{"DeleteExpired", testAccountTokenDeleteExpired},
+		{"ConcurrentTake", testAccountTokenConcurrentTake},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStore(t))
+		})
+	}
+}
+
+// newAccountToken returns a token expiring in an hour, with times rounded so all stores keep them exactly
+func newAccountToken(username, purpose string, createdAt time.Time) *platform.AccountToken {
+	createdAt = createdAt.UTC().Truncate(time.Second)
+	return &platform.AccountToken{
+		TokenHash: newID("account"),
+		Purpose:   purpose,
+		Username:  username,
+		Email:     username + "@ispend.de",
+		CreatedAt: createdAt,
+		ExpiresAt: createdAt.Add(time.Hour),
+	}
+}
+
+func testAccountTokenSaveAndTake(t *testing.T, store platform.AccountTokenStore) {
+	ctx := context.Background()
+	token := newAccountToken(newID("user"), platform.AccountTokenVerifyEmail, time.Now())
+	require.NoError(t, store.Save(ctx, token))
+
+	taken, err := store.Take(ctx, token.TokenHash)
+	require.NoError(t, err)
+	require.NotNil(t, taken)
+	assert.Equal(t, token.TokenHash, taken.TokenHash)
+	assert.Equal(t, token.Purpose, taken.Purpose)
+	assert.Equal(t, token.Username, taken.Username)
+	assert.Equal(t, token.Email, taken.Email)
+	assert.True(t, token.CreatedAt.Equal(taken.CreatedAt), "created at: %s != %s", token.CreatedAt, taken.CreatedAt)
+	assert.True(t, token.ExpiresAt.Equal(taken.ExpiresAt), "expires at: %s != %s", token.ExpiresAt, taken.ExpiresAt)
+
+	// single use
+	_, err = store.Take(ctx, token.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Take(ctx, newID("unknown"))
+	assert.Equal(t, platform.ErrNotFound, err)
+}
+
+func testAccountTokenDeleteByUsername(t *testing.T, store platform.AccountTokenStore) {
+	ctx := context.Background()
+	username := newID("user")
+	reset1 := newAccountToken(username, platform.AccountTokenResetPassword, time.Now())
+	reset2 := newAccountToken(username, platform.AccountTokenResetPassword, time.Now())
+	verify := newAccountToken(username, platform.AccountTokenVerifyEmail, time.Now())
+	otherReset := newAccountToken(newID("user"), platform.AccountTokenResetPassword, time.Now())
+	for _, token := range []*platform.AccountToken{reset1, reset2, verify, otherReset} {
+		require.NoError(t, store.Save(ctx, token))
+	}
+
+	deleted, err := store.DeleteByUsername(ctx, username, platform.AccountTokenResetPassword)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	_, err = store.Take(ctx, reset1.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Take(ctx, reset2.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Take(ctx, verify.TokenHash)
+	assert.NoError(t, err)
+	_, err = store.Take(ctx, otherReset.TokenHash)
+	assert.NoError(t, err)
+}
+
+func testAccountTokenDeleteExpired(t *testing.T, store platform.AccountTokenStore) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	expired := newAccountToken(newID("user"), platform.AccountTokenVerifyEmail, now.Add(-2*time.Hour))
+	expired.ExpiresAt = now.Add(-time.Second)
+	active := newAccountToken(newID("user"), platform.AccountTokenVerifyEmail, now)
+	require.NoError(t, store.Save(ctx, expired))
+	require.NoError(t, store.Save(ctx, active))
+
+	_, err := store.DeleteExpired(ctx, now)
+	require.NoError(t, err)
+
+	_, err = store.Take(ctx, expired.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Take(ctx, active.TokenHash)
+	assert.NoError(t, err)
+}
+
+func testAccountTokenConcurrentTake(t *testing.T, store platform.AccountTokenStore) {
+	ctx := context.Background()
+	token := newAccountToken(newID("user"), platform.AccountTokenResetPassword, time.Now())
+	require.NoError(t, store.Save(ctx, token))
+
+	const workers = 8
+	var taken int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Take(ctx, token.TokenHash)
+			if err == platform.ErrNotFound {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			atomic.AddInt64(&taken, 1)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), taken)
+}
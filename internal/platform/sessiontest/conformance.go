@@ -0,0 +1,216 @@
+// Package sessiontest holds the conformance test suite every platform.SessionStore implementation must pass.
+//
+// It only ever touches sessions of users it creates itself, so it can run against
+// a store already holding some sessions.
+package sessiontest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var counter int64
+
+// RunConformance runs the whole suite, calling newStore for a fresh store in every sub-test
+func RunConformance(t *testing.T, newStore func(t *testing.T) platform.SessionStore) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store platform.SessionStore)
+	}{
+		{"SaveAndGet", testSaveAndGet},
+		{"Overwrite", testOverwrite},
+		{"GetByUsername", testGetByUsername},
+		{"Delete", testDelete},
+		{"DeleteExpired", testDeleteExpired},
+		{"NeverExpires", testNeverExpires},
+		{"Concurrent", testConcurrent},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStore(t))
+		})
+	}
+}
+
+// newID returns a username or session ID not used by any other test in this process
+func newID(prefix string) string {
+	return fmt.Sprintf("%s%d_%d", prefix, time.Now().UnixNano()%1e6, atomic.AddInt64(&counter, 1))
+}
+
+// newSession returns a session expiring in an hour, with times rounded so all stores keep them exactly
+func newSession(username string, createdAt time.Time) *platform.LoginSession {
+	createdAt = createdAt.UTC().Truncate(time.Second)
+	return &platform.LoginSession{
+		Username:  username,
+		TokenHash: newID("session"),
+		CreatedAt: createdAt,
+		LastSeen:  createdAt,
+		ExpiresAt: createdAt.Add(time.Hour),
+
+		DeviceName: "laptop",
+		UserAgent:  "Mozilla/5.0 (X11; Linux x86_64)",
+		IPAddress:  "192.0.2.1",
+	}
+}
+
+func assertSessionEqual(t *testing.T, expected *platform.LoginSession, actual *platform.LoginSession) {
+	t.Helper()
+	require.NotNil(t, actual)
+	assert.Equal(t, expected.TokenHash, actual.TokenHash)
+	assert.Equal(t, expected.Username, actual.Username)
+	assert.True(t, expected.CreatedAt.Equal(actual.CreatedAt), "created at: %s != %s", expected.CreatedAt, actual.CreatedAt)
+	assert.True(t, expected.LastSeen.Equal(actual.LastSeen), "last seen: %s != %s", expected.LastSeen, actual.LastSeen)
+	assert.True(t, expected.ExpiresAt.Equal(actual.ExpiresAt), "expires at: %s != %s", expected.ExpiresAt, actual.ExpiresAt)
+	assert.Equal(t, expected.DeviceName, actual.DeviceName)
+	assert.Equal(t, expected.UserAgent, actual.UserAgent)
+	assert.Equal(t, expected.IPAddress, actual.IPAddress)
+}
+
+func testSaveAndGet(t *testing.T, store platform.SessionStore) {
+	ctx := context.Background()
+	session := newSession(newID("user"), time.Now())
+	require.NoError(t, store.Save(ctx, session))
+
+	stored, err := store.Get(ctx, session.TokenHash)
+	require.NoError(t, err)
+	assertSessionEqual(t, session, stored)
+
+	_, err = store.Get(ctx, newID("unknown"))
+	assert.Equal(t, platform.ErrNotFound, err)
+}
+
+func testOverwrite(t *testing.T, store platform.SessionStore) {
+	ctx := context.Background()
+	session := newSession(newID("user"), time.Now())
+	require.NoError(t, store.Save(ctx, session))
+
+	session.LastSeen = session.LastSeen.Add(time.Minute)
+	session.ExpiresAt = session.ExpiresAt.Add(time.Minute)
+	require.NoError(t, store.Save(ctx, session))
+
+	stored, err := store.Get(ctx, session.TokenHash)
+	require.NoError(t, err)
+	assertSessionEqual(t, session, stored)
+
+	sessions, err := store.GetByUsername(ctx, session.Username)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+}
+
+func testGetByUsername(t *testing.T, store platform.SessionStore) {
+	ctx := context.Background()
+	username := newID("user")
+	now := time.Now()
+	session2 := newSession(username, now)
+	session1 := newSession(username, now.Add(-time.Minute))
+	otherSession := newSession(newID("user"), now)
+	require.NoError(t, store.Save(ctx, session2))
+	require.NoError(t, store.Save(ctx, session1))
+	require.NoError(t, store.Save(ctx, otherSession))
+
+	sessions, err := store.GetByUsername(ctx, username)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assertSessionEqual(t, session1, &sessions[0])
+	assertSessionEqual(t, session2, &sessions[1])
+
+	sessions, err = store.GetByUsername(ctx, newID("unknown"))
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func testDelete(t *testing.T, store platform.SessionStore) {
+	ctx := context.Background()
+	username := newID("user")
+	session1 := newSession(username, time.Now())
+	session2 := newSession(username, time.Now())
+	require.NoError(t, store.Save(ctx, session1))
+	require.NoError(t, store.Save(ctx, session2))
+
+	require.NoError(t, store.Delete(ctx, session1.TokenHash))
+	assert.Equal(t, platform.ErrNotFound, store.Delete(ctx, session1.TokenHash))
+
+	_, err := store.Get(ctx, session1.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	sessions, err := store.GetByUsername(ctx, username)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, session2.TokenHash, sessions[0].TokenHash)
+}
+
+func testDeleteExpired(t *testing.T, store platform.SessionStore) {
+	ctx := context.Background()
+	username := newID("user")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	expired := newSession(username, now.Add(-2*time.Hour))
+	expired.ExpiresAt = now.Add(-time.Second)
+	active := newSession(username, now)
+	require.NoError(t, store.Save(ctx, expired))
+	require.NoError(t, store.Save(ctx, active))
+
+	_, err := store.DeleteExpired(ctx, now)
+	require.NoError(t, err)
+
+	_, err = store.Get(ctx, expired.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	sessions, err := store.GetByUsername(ctx, username)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, active.TokenHash, sessions[0].TokenHash)
+}
+
+func testNeverExpires(t *testing.T, store platform.SessionStore) {
+	ctx := context.Background()
+	session := newSession(newID("user"), time.Now())
+	session.ExpiresAt = time.Time{}
+	require.NoError(t, store.Save(ctx, session))
+
+	_, err := store.DeleteExpired(ctx, time.Now().Add(100*365*24*time.Hour))
+	require.NoError(t, err)
+
+	stored, err := store.Get(ctx, session.TokenHash)
+	require.NoError(t, err)
+	assert.True(t, stored.ExpiresAt.IsZero())
+}
+
+func testConcurrent(t *testing.T, store platform.SessionStore) {
+	ctx := context.Background()
+	username := newID("user")
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := newSession(username, time.Now())
+			if err := store.Save(ctx, session); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := store.Get(ctx, session.TokenHash); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := store.GetByUsername(ctx, username); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sessions, err := store.GetByUsername(ctx, username)
+	require.NoError(t, err)
+	assert.Len(t, sessions, workers)
+}
@@ -0,0 +1,139 @@
+package sessiontest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RunLoginAttemptConformance runs the suite every platform.LoginAttemptStore implementation must pass,
+// calling newStore for a fresh store in every sub-test
+func RunLoginAttemptConformance(t *testing.T, newStore func(t *testing.T) platform.LoginAttemptStore) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store platform.LoginAttemptStore)
+	}{
+		{"AddFailureAndGet", testLoginAttemptAddFailureAndGet},
+		{"ExpiredFailuresStartOver", testLoginAttemptExpiredFailuresStartOver},
+		{"Reset", testLoginAttemptReset},
+		{"DeleteExpired", testLoginAttemptDeleteExpired},
+		{"ConcurrentAddFailure", testLoginAttemptConcurrentAddFailure},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStore(t))
+		})
+	}
+}
+
+func testLoginAttemptAddFailureAndGet(t *testing.T, store platform.LoginAttemptStore) {
+	ctx := context.Background()
+	subject := "user:" + newID("user")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	_, err := store.Get(ctx, subject)
+	assert.Equal(t, platform.ErrNotFound, err)
+
+	for i := 1; i <= 3; i++ {
+		failures, err := store.AddFailure(ctx, subject, now.Add(time.Duration(i)*time.Second), time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, i, failures.Count)
+	}
+
+	failures, err := store.Get(ctx, subject)
+	require.NoError(t, err)
+	assert.Equal(t, subject, failures.Subject)
+	assert.Equal(t, 3, failures.Count)
+	assert.True(t, now.Add(3*time.Second).Equal(failures.LastFailedAt), "last failed at: %s", failures.LastFailedAt)
+	assert.True(t, now.Add(3*time.Second+time.Hour).Equal(failures.ExpiresAt), "expires at: %s", failures.ExpiresAt)
+
+	// the subjects are counted apart
+	otherFailures, err := store.AddFailure(ctx, "ip:"+newID("ip"), now, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, otherFailures.Count)
+}
+
+func testLoginAttemptExpiredFailuresStartOver(t *testing.T, store platform.LoginAttemptStore) {
+	ctx := context.Background()
+	subject := "user:" + newID("user")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	_, err := store.AddFailure(ctx, subject, now, time.Minute)
+	require.NoError(t, err)
+	_, err = store.AddFailure(ctx, subject, now.Add(time.Second), time.Minute)
+	require.NoError(t, err)
+
+	failures, err := store.AddFailure(ctx, subject, now.Add(2*time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures.Count)
+}
+
+func testLoginAttemptReset(t *testing.T, store platform.LoginAttemptStore) {
+	ctx := context.Background()
+	subject := "user:" + newID("user")
+	otherSubject := "user:" + newID("user")
+	now := time.Now()
+
+	_, err := store.AddFailure(ctx, subject, now, time.Hour)
+	require.NoError(t, err)
+	_, err = store.AddFailure(ctx, otherSubject, now, time.Hour)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Reset(ctx, subject))
+	_, err = store.Get(ctx, subject)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Get(ctx, otherSubject)
+	assert.NoError(t, err)
+
+	// nothing to forget is fine too
+	assert.NoError(t, store.Reset(ctx, "user:"+newID("unknown")))
+}
+
+func testLoginAttemptDeleteExpired(t *testing.T, store platform.LoginAttemptStore) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	expired := "ip:" + newID("ip")
+	active := "ip:" + newID("ip")
+
+	_, err := store.AddFailure(ctx, expired, now.Add(-2*time.Hour), time.Hour)
+	require.NoError(t, err)
+	_, err = store.AddFailure(ctx, active, now, time.Hour)
+	require.NoError(t, err)
+
+	_, err = store.DeleteExpired(ctx, now)
+	require.NoError(t, err)
+
+	_, err = store.Get(ctx, expired)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Get(ctx, active)
+	assert.NoError(t, err)
+}
+
+func testLoginAttemptConcurrentAddFailure(t *testing.T, store platform.LoginAttemptStore) {
+	ctx := context.Background()
+	subject := "user:" + newID("user")
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.AddFailure(ctx, subject, time.Now(), time.Hour); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	failures, err := store.Get(ctx, subject)
+	require.NoError(t, err)
+	assert.Equal(t, workers, failures.Count)
+}
@@ -0,0 +1,198 @@
+package sessiontest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RunRefreshTokenConformance runs the suite every platform.RefreshTokenStore implementation must pass,
+// calling newStore for a fresh store in every sub-test
+func RunRefreshTokenConformance(t *testing.T, newStore func(t *testing.T) platform.RefreshTokenStore) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store platform.RefreshTokenStore)
+	}{
+		{"SaveAndGet", testRefreshTokenSaveAndGet},
+		{"MarkUsed", testRefreshTokenMarkUsed},
+		{"DeleteFamily", testRefreshTokenDeleteFamily},
+		{"DeleteByUsername", testRefreshTokenDeleteByUsername},
+		{"DeleteExpired", testRefreshTokenDeleteExpired},
+		{"ConcurrentMarkUsed", testRefreshTokenConcurrentMarkUsed},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStore(t))
+		})
+	}
+}
+
+// newRefreshToken returns a token expiring in an hour, with times rounded so all stores keep them exactly
+func newRefreshToken(familyID string, createdAt time.Time) *platform.RefreshToken {
+	createdAt = createdAt.UTC().Truncate(time.Second)
+	return &platform.RefreshToken{
+		TokenHash: newID("refresh"),
+		FamilyID:  familyID,
+		Username:  newID("user"),
+		CreatedAt: createdAt,
+		ExpiresAt: createdAt.Add(time.Hour),
+	}
+}
+
+func assertRefreshTokenEqual(t *testing.T, expected *platform.RefreshToken, actual *platform.RefreshToken) {
+	t.Helper()
+	require.NotNil(t, actual)
+	assert.Equal(t, expected.TokenHash, actual.TokenHash)
+	assert.Equal(t, expected.FamilyID, actual.FamilyID)
+	assert.Equal(t, expected.Username, actual.Username)
+	assert.True(t, expected.CreatedAt.Equal(actual.CreatedAt), "created at: %s != %s", expected.CreatedAt, actual.CreatedAt)
+	assert.True(t, expected.ExpiresAt.Equal(actual.ExpiresAt), "expires at: %s != %s", expected.ExpiresAt, actual.ExpiresAt)
+	assert.True(t, expected.UsedAt.Equal(actual.UsedAt), "used at: %s != %s", expected.UsedAt, actual.UsedAt)
+}
+
+func testRefreshTokenSaveAndGet(t *testing.T, store platform.RefreshTokenStore) {
+	ctx := context.Background()
+	token := newRefreshToken(newID("family"), time.Now())
+	require.NoError(t, store.Save(ctx, token))
+
+	stored, err := store.Get(ctx, token.TokenHash)
+	require.NoError(t, err)
+	assertRefreshTokenEqual(t, token, stored)
+	assert.False(t, stored.IsUsed())
+
+	_, err = store.Get(ctx, newID("unknown"))
+	assert.Equal(t, platform.ErrNotFound, err)
+}
+
+func testRefreshTokenMarkUsed(t *testing.T, store platform.RefreshTokenStore) {
+	ctx := context.Background()
+	token := newRefreshToken(newID("family"), time.Now())
+	require.NoError(t, store.Save(ctx, token))
+
+	usedAt := time.Now().UTC().Truncate(time.Second)
+	marked, err := store.MarkUsed(ctx, token.TokenHash, usedAt)
+	require.NoError(t, err)
+	assert.True(t, marked)
+
+	marked, err = store.MarkUsed(ctx, token.TokenHash, usedAt.Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, marked)
+
+	stored, err := store.Get(ctx, token.TokenHash)
+	require.NoError(t, err)
+	token.UsedAt = usedAt
+	assertRefreshTokenEqual(t, token, stored)
+
+	_, err = store.MarkUsed(ctx, newID("unknown"), usedAt)
+	assert.Equal(t, platform.ErrNotFound, err)
+}
+
+func testRefreshTokenDeleteFamily(t *testing.T, store platform.RefreshTokenStore) {
+	ctx := context.Background()
+	familyID := newID("family")
+	token1 := newRefreshToken(familyID, time.Now())
+	token2 := newRefreshToken(familyID, time.Now())
+	otherToken := newRefreshToken(newID("family"), time.Now())
+	require.NoError(t, store.Save(ctx, token1))
+	require.NoError(t, store.Save(ctx, token2))
+	require.NoError(t, store.Save(ctx, otherToken))
+
+	deleted, err := store.DeleteFamily(ctx, familyID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	_, err = store.Get(ctx, token1.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Get(ctx, token2.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Get(ctx, otherToken.TokenHash)
+	assert.NoError(t, err)
+
+	deleted, err = store.DeleteFamily(ctx, newID("unknown"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func testRefreshTokenDeleteByUsername(t *testing.T, store platform.RefreshTokenStore) {
+	ctx := context.Background()
+	username := newID("user")
+	token1 := newRefreshToken(newID("family"), time.Now())
+	token1.Username = username
+	token2 := newRefreshToken(token1.FamilyID, time.Now())
+	token2.Username = username
+	token3 := newRefreshToken(newID("family"), time.Now())
+	token3.Username = username
+	otherToken := newRefreshToken(newID("family"), time.Now())
+	for _, token := range []*platform.RefreshToken{token1, token2, token3, otherToken} {
+		require.NoError(t, store.Save(ctx, token))
+	}
+
+	deleted, err := store.DeleteByUsername(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+
+	for _, token := range []*platform.RefreshToken{token1, token2, token3} {
+		_, err = store.Get(ctx, token.TokenHash)
+		assert.Equal(t, platform.ErrNotFound, err)
+	}
+	_, err = store.Get(ctx, otherToken.TokenHash)
+	assert.NoError(t, err)
+
+	deleted, err = store.DeleteByUsername(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func testRefreshTokenDeleteExpired(t *testing.T, store platform.RefreshTokenStore) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	expired := newRefreshToken(newID("family"), now.Add(-2*time.Hour))
+	expired.ExpiresAt = now.Add(-time.Second)
+	active := newRefreshToken(newID("family"), now)
+	require.NoError(t, store.Save(ctx, expired))
+	require.NoError(t, store.Save(ctx, active))
+
+	_, err := store.DeleteExpired(ctx, now)
+	require.NoError(t, err)
+
+	_, err = store.Get(ctx, expired.TokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = store.Get(ctx, active.TokenHash)
+	assert.NoError(t, err)
+}
+
+func testRefreshTokenConcurrentMarkUsed(t *testing.T, store platform.RefreshTokenStore) {
+	ctx := context.Background()
+	token := newRefreshToken(newID("family"), time.Now())
+	require.NoError(t, store.Save(ctx, token))
+
+	const workers = 8
+	var marked int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := store.MarkUsed(ctx, token.TokenHash, time.Now())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				atomic.AddInt64(&marked, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), marked)
+}
@@ -0,0 +1,79 @@
+package platform
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Secret tokens (session IDs and alike) look like "v1.<base64url random bytes>". The version
+// tells how the token was made and how it's hashed, so a new scheme can be introduced while
+// the tokens already given out keep working until they expire.
+const CurrentTokenVersion = "v1"
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type tokenScheme struct {
+	entropyBytes int
+	hash         func(token string) string
+}
+
+var tokenSchemes = map[string]tokenScheme{
+	// 256 bits of entropy leave nothing to brute force, so a plain, unsalted SHA-256 is enough
+	"v1": {
+		entropyBytes: 32,
+		hash: func(token string) string {
+			hash := sha256.Sum256([]byte(token))
+			return hex.EncodeToString(hash[:])
+		},
+	},
+}
+
+// NewToken generates a new secret token from crypto/rand, in the current format
+func NewToken() (string, error) {
+	scheme := tokenSchemes[CurrentTokenVersion]
+	randomBytes := make([]byte, scheme.entropyBytes)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return CurrentTokenVersion + "." + base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// HashToken returns the hash to store server side instead of the token itself,
+// or ErrInvalidToken if the token is not in any known format
+func HashToken(token string) (string, error) {
+	scheme, err := parseToken(token)
+	if err != nil {
+		return "", err
+	}
+	return scheme.hash(token), nil
+}
+
+// TokenMatchesHash tells in constant time if the token is the one the hash was made from
+func TokenMatchesHash(token, hash string) bool {
+	tokenHash, err := HashToken(token)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hash)) == 1
+}
+
+func parseToken(token string) (tokenScheme, error) {
+	version, encoded, ok := strings.Cut(token, ".")
+	if !ok {
+		return tokenScheme{}, ErrInvalidToken
+	}
+	scheme, ok := tokenSchemes[version]
+	if !ok {
+		return tokenScheme{}, ErrInvalidToken
+	}
+	randomBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(randomBytes) != scheme.entropyBytes {
+		return tokenScheme{}, ErrInvalidToken
+	}
+	return scheme, nil
+}
@@ -0,0 +1,396 @@
+package platform
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultAccessTokenTTL      = 15 * time.Minute
+	DefaultRefreshTokenTTL     = 30 * 24 * time.Hour
+	DefaultKeyRotationInterval = 24 * time.Hour
+)
+
+// ErrRefreshTokenReused means an already rotated refresh token came again: either the client
+// or someone who stole it is replaying it, so its whole family has been revoked
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// AccessClaims are the claims of an access token; the subject is the username
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	// FamilyID is the refresh token family the access token was issued with
+	FamilyID string `json:"sid"`
+	// IssuedAtNano is the issue time in Unix nanoseconds, the issued at claim has only seconds,
+	// too coarse to tell the tokens issued before a RevokeUser from the ones issued right after it
+	IssuedAtNano int64 `json:"iat_ns"`
+}
+
+// TokenPair is what a client gets at login and with every refresh
+type TokenPair struct {
+	AccessToken string
+	// AccessTokenTTL is how long the access token is valid for
+	AccessTokenTTL time.Duration
+	RefreshToken   string
+}
+
+// TokenIssuer issues short lived, ES256 signed JWT access tokens, and single use refresh tokens
+// kept hashed in its RefreshTokenStore. The signing keys live only in memory and get rotated,
+// the retired ones are published in the JWKS until all the tokens they signed expire.
+//
+// Revoked families and access tokens are remembered in memory only, until their access tokens
+// expire: running more than one server would need a shared revocation list and signing keys.
+type TokenIssuer struct {
+	issuer     string
+	store      RefreshTokenStore
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	keys       *keySet
+	revoked    *revocationList
+	now        func() time.Time
+
+	chStop chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewTokenIssuer(issuer string, store RefreshTokenStore, accessTTL, refreshTTL time.Duration) (*TokenIssuer, error) {
+	tokenIssuer := &TokenIssuer{
+		issuer:     issuer,
+		store:      store,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		keys:       &keySet{},
+		revoked:    newRevocationList(),
+		now:        time.Now,
+	}
+	if err := tokenIssuer.RotateKeys(); err != nil {
+		return nil, err
+	}
+	return tokenIssuer, nil
+}
+
+// Issue starts a new refresh token family for the user, e.g. on login with a password
+func (i *TokenIssuer) Issue(ctx context.Context, username string) (*TokenPair, error) {
+	familyID, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	return i.issue(ctx, username, familyID, i.now().UTC().Add(i.refreshTTL))
+}
+
+// Refresh exchanges the refresh token for a new pair; the refresh token cannot be used again after that
+func (i *TokenIssuer) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	token, err := i.getRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	now := i.now().UTC()
+	if token.IsExpired(now) {
+		return nil, ErrInvalidToken
+	}
+
+	rotated := false
+	if !token.IsUsed() {
+		rotated, err = i.store.MarkUsed(ctx, token.TokenHash, now)
+		if err == ErrNotFound {
+			return nil, ErrInvalidToken
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !rotated {
+		log.Warnf("refresh token reused [user: %s], revoking its family", token.Username)
+		if err := i.revokeFamily(ctx, token.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	return i.issue(ctx, token.Username, token.FamilyID, token.ExpiresAt)
+}
+
+// Revoke revokes a refresh token or an access token together with its whole family; unknown
+// and invalid tokens are ignored, as there is nothing to revoke (see RFC 7009)
+func (i *TokenIssuer) Revoke(ctx context.Context, token string) error {
+	if _, err := HashToken(token); err == nil {
+		refreshToken, err := i.getRefreshToken(ctx, token)
+		if err == ErrInvalidToken {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return i.revokeFamily(ctx, refreshToken.FamilyID)
+	}
+
+	claims, err := i.Verify(token)
+	if err != nil {
+		return nil
+	}
+	i.revoked.add(claims.ID, claims.ExpiresAt.Time)
+	return i.revokeFamily(ctx, claims.FamilyID)
+}
+
+// RevokeUser revokes all the refresh tokens of the user, and all its access tokens issued until now,
+// e.g. after a password reset
+func (i *TokenIssuer) RevokeUser(ctx context.Context, username string) error {
+	now := i.now()
+	i.revoked.addSubject(username, now, now.Add(i.accessTTL))
+	_, err := i.store.DeleteByUsername(ctx, username)
+	return err
+}
+
+// Verify checks the access token, and returns its claims if it's valid and not revoked
+func (i *TokenIssuer) Verify(accessToken string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		key := i.keys.find(keyID)
+		if key == nil {
+			return nil, errors.New("unknown signing key")
+		}
+		return &key.privateKey.PublicKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}),
+		jwt.WithIssuer(i.issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithTimeFunc(i.now),
+	)
+	if err != nil {
+		log.Debugf("invalid access token: %s", err)
+		return nil, ErrInvalidToken
+	}
+	if claims.Subject == "" || claims.ID == "" || claims.FamilyID == "" || claims.IssuedAtNano == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	now := i.now()
+	if i.revoked.has(claims.ID, now) || i.revoked.has(claims.FamilyID, now) ||
+		i.revoked.hasSubject(claims.Subject, time.Unix(0, claims.IssuedAtNano), now) {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// RotateKeys makes a new key sign the access tokens from now on
+func (i *TokenIssuer) RotateKeys() error {
+	return i.keys.rotate(i.now(), i.accessTTL)
+}
+
+// JWKS returns the public keys of all the access tokens not expired yet
+func (i *TokenIssuer) JWKS() JWKSet {
+	return i.keys.jwks()
+}
+
+func (i *TokenIssuer) AccessTokenTTL() time.Duration {
+	return i.accessTTL
+}
+
+// SweepExpired deletes the expired refresh tokens from the store, and forgets the revocations no longer needed
+func (i *TokenIssuer) SweepExpired(ctx context.Context) (int, error) {
+	now := i.now()
+	i.revoked.prune(now)
+	return i.store.DeleteExpired(ctx, now.UTC())
+}
+
+// Start rotates the signing keys and sweeps the expired refresh tokens periodically, until Stop is called
+func (i *TokenIssuer) Start(keyRotationInterval, sweepInterval time.Duration) {
+	i.chStop = make(chan struct{})
+	i.wg.Add(1)
+
+	go func() {
+		defer i.wg.Done()
+
+		rotationTicker := time.NewTicker(keyRotationInterval)
+		defer rotationTicker.Stop()
+		sweepTicker := time.NewTicker(sweepInterval)
+		defer sweepTicker.Stop()
+
+		for {
+			select {
+			case <-rotationTicker.C:
+				if err := i.RotateKeys(); err != nil {
+					log.Errorf("token issuer: key rotation error: %s", err)
+				} else {
+					log.Debugf("token issuer: signing key rotated")
+				}
+			case <-sweepTicker.C:
+				deleted, err := i.SweepExpired(context.Background())
+				if err != nil {
+					log.Errorf("token issuer: sweeper error: %s", err)
+				} else if deleted > 0 {
+					log.Debugf("token issuer: deleted %d expired refresh tokens", deleted)
+				}
+			case <-i.chStop:
+				return
+			}
+		}
+	}()
+}
+
+func (i *TokenIssuer) Stop() {
+	if i.chStop == nil {
+		return
+	}
+	close(i.chStop)
+	i.wg.Wait()
+	i.chStop = nil
+}
+
+func (i *TokenIssuer) issue(ctx context.Context, username, familyID string, familyExpiresAt time.Time) (*TokenPair, error) {
+	refreshToken, err := NewToken()
+	if err != nil {
+		return nil, err
+	}
+	tokenHash, err := HashToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	now := i.now().UTC()
+	err = i.store.Save(ctx, &RefreshToken{
+		TokenHash: tokenHash,
+		FamilyID:  familyID,
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: familyExpiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokenID, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	key := i.keys.signing()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.issuer,
+			Subject:   username,
+			ID:        tokenID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(i.accessTTL)),
+		},
+		FamilyID:     familyID,
+		IssuedAtNano: now.UnixNano(),
+	})
+	token.Header["kid"] = key.id
+	accessToken, err := token.SignedString(key.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:    accessToken,
+		AccessTokenTTL: i.accessTTL,
+		RefreshToken:   refreshToken,
+	}, nil
+}
+
+func (i *TokenIssuer) getRefreshToken(ctx context.Context, refreshToken string) (*RefreshToken, error) {
+	tokenHash, err := HashToken(refreshToken)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	token, err := i.store.Get(ctx, tokenHash)
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !TokenMatchesHash(refreshToken, token.TokenHash) {
+		return nil, ErrInvalidToken
+	}
+	return token, nil
+}
+
+// revokeFamily deletes the family's refresh tokens, and rejects its access tokens until they expire
+func (i *TokenIssuer) revokeFamily(ctx context.Context, familyID string) error {
+	i.revoked.add(familyID, i.now().Add(i.accessTTL))
+	_, err := i.store.DeleteFamily(ctx, familyID)
+	return err
+}
+
+func newRandomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// revocationList remembers the revoked access token and family IDs, and the subjects whose tokens issued
+// before some moment are revoked, until the tokens expire anyway
+type revocationList struct {
+	mu       sync.Mutex
+	until    map[string]time.Time
+	subjects map[string]subjectRevocation
+}
+
+type subjectRevocation struct {
+	issuedBefore time.Time
+	until        time.Time
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		until:    make(map[string]time.Time),
+		subjects: make(map[string]subjectRevocation),
+	}
+}
+
+func (rl *revocationList) addSubject(subject string, issuedBefore, until time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.subjects[subject] = subjectRevocation{issuedBefore: issuedBefore, until: until}
+}
+
+func (rl *revocationList) hasSubject(subject string, issuedAt, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	revocation, ok := rl.subjects[subject]
+	// the tokens issued at the very moment of the revocation were issued before the call too
+	return ok && now.Before(revocation.until) && !issuedAt.After(revocation.issuedBefore)
+}
+
+func (rl *revocationList) add(id string, until time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if until.After(rl.until[id]) {
+		rl.until[id] = until
+	}
+}
+
+func (rl *revocationList) has(id string, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	until, ok := rl.until[id]
+	return ok && now.Before(until)
+}
+
+func (rl *revocationList) prune(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for id, until := range rl.until {
+		if !now.Before(until) {
+			delete(rl.until, id)
+		}
+	}
+	for subject, revocation := range rl.subjects {
+		if !now.Before(revocation.until) {
+			delete(rl.subjects, subject)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package platform_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/platform/sessiontest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTokenIssuer(t *testing.T) (*platform.TokenIssuer, *time.Time) {
+	issuer, err := platform.NewTokenIssuer("ispend-test", platform.NewMemoryRefreshTokenStore(), 15*time.Minute, 24*time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	issuer.SetNow(func() time.Time { return now })
+	return issuer, &now
+}
+
+func TestTokenIssuer_IssueAndVerify(t *testing.T) {
+	issuer, _ := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	pair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, pair.AccessTokenTTL)
+	assert.True(t, strings.HasPrefix(pair.RefreshToken, platform.CurrentTokenVersion+"."))
+
+	claims, err := issuer.Verify(pair.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "u1", claims.Subject)
+	assert.Equal(t, "ispend-test", claims.Issuer)
+	assert.NotEmpty(t, claims.ID)
+	assert.NotEmpty(t, claims.FamilyID)
+
+	_, err = issuer.Verify(pair.RefreshToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+	_, err = issuer.Verify("")
+	assert.Equal(t, platform.ErrInvalidToken, err)
+}
+
+func TestTokenIssuer_RejectsForgedTokens(t *testing.T) {
+	issuer, _ := newTestTokenIssuer(t)
+	otherIssuer, _ := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	pair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+
+	// signed by another server with its own keys
+	otherPair, err := otherIssuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	_, err = issuer.Verify(otherPair.AccessToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	// the payload changed to another user
+	parts := strings.Split(pair.AccessToken, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), `"u1"`, `"u2"`, 1)))
+	_, err = issuer.Verify(strings.Join(parts, "."))
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	// unsigned
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"iss": "ispend-test", "sub": "u1", "jti": "1", "sid": "1",
+		"iat": time.Now().Unix(), "iat_ns": time.Now().UnixNano(), "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = issuer.Verify(unsigned)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+}
+
+func TestTokenIssuer_AccessTokenExpires(t *testing.T) {
+	issuer, now := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	pair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+
+	*now = now.Add(14 * time.Minute)
+	_, err = issuer.Verify(pair.AccessToken)
+	assert.NoError(t, err)
+
+	*now = now.Add(2 * time.Minute)
+	_, err = issuer.Verify(pair.AccessToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	// but the refresh token still gets a new one
+	pair, err = issuer.Refresh(ctx, pair.RefreshToken)
+	require.NoError(t, err)
+	_, err = issuer.Verify(pair.AccessToken)
+	assert.NoError(t, err)
+}
+
+func TestTokenIssuer_RefreshRotates(t *testing.T) {
+	issuer, now := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	pair1, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	claims1, err := issuer.Verify(pair1.AccessToken)
+	require.NoError(t, err)
+
+	*now = now.Add(time.Minute)
+	pair2, err := issuer.Refresh(ctx, pair1.RefreshToken)
+	require.NoError(t, err)
+	assert.NotEqual(t, pair1.RefreshToken, pair2.RefreshToken)
+	claims2, err := issuer.Verify(pair2.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "u1", claims2.Subject)
+	assert.Equal(t, claims1.FamilyID, claims2.FamilyID)
+	assert.NotEqual(t, claims1.ID, claims2.ID)
+
+	pair3, err := issuer.Refresh(ctx, pair2.RefreshToken)
+	require.NoError(t, err)
+	_, err = issuer.Verify(pair3.AccessToken)
+	assert.NoError(t, err)
+}
+
+func TestTokenIssuer_RefreshTokenReuseRevokesFamily(t *testing.T) {
+	issuer, _ := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	pair1, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	otherPair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+
+	pair2, err := issuer.Refresh(ctx, pair1.RefreshToken)
+	require.NoError(t, err)
+
+	// e.g. stolen before the legit client rotated it
+	_, err = issuer.Refresh(ctx, pair1.RefreshToken)
+	assert.Equal(t, platform.ErrRefreshTokenReused, err)
+
+	_, err = issuer.Refresh(ctx, pair2.RefreshToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+	_, err = issuer.Verify(pair2.AccessToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+	_, err = issuer.Verify(pair1.AccessToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	// other logins of the user are not affected
+	_, err = issuer.Verify(otherPair.AccessToken)
+	assert.NoError(t, err)
+	_, err = issuer.Refresh(ctx, otherPair.RefreshToken)
+	assert.NoError(t, err)
+}
+
+func TestTokenIssuer_RefreshTokenExpires(t *testing.T) {
+	issuer, now := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	pair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+
+	// rotating does not prolong the family
+	*now = now.Add(23 * time.Hour)
+	pair, err = issuer.Refresh(ctx, pair.RefreshToken)
+	require.NoError(t, err)
+
+	*now = now.Add(time.Hour)
+	_, err = issuer.Refresh(ctx, pair.RefreshToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	_, err = issuer.Refresh(ctx, "v1.unknown")
+	assert.Equal(t, platform.ErrInvalidToken, err)
+}
+
+func TestTokenIssuer_Revoke(t *testing.T) {
+	issuer, _ := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	// by refresh token
+	pair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	require.NoError(t, issuer.Revoke(ctx, pair.RefreshToken))
+	_, err = issuer.Verify(pair.AccessToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+	_, err = issuer.Refresh(ctx, pair.RefreshToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	// by access token
+	pair, err = issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	require.NoError(t, issuer.Revoke(ctx, pair.AccessToken))
+	_, err = issuer.Verify(pair.AccessToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+	_, err = issuer.Refresh(ctx, pair.RefreshToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	// unknown tokens are fine
+	assert.NoError(t, issuer.Revoke(ctx, "v1.unknown"))
+	assert.NoError(t, issuer.Revoke(ctx, "garbage"))
+}
+
+func TestTokenIssuer_RevokeUser(t *testing.T) {
+	issuer, now := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	pair1, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	pair2, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	otherPair, err := issuer.Issue(ctx, "u2")
+	require.NoError(t, err)
+
+	*now = now.Add(2 * time.Second)
+	require.NoError(t, issuer.RevokeUser(ctx, "u1"))
+	for _, pair := range []*platform.TokenPair{pair1, pair2} {
+		_, err = issuer.Verify(pair.AccessToken)
+		assert.Equal(t, platform.ErrInvalidToken, err)
+		_, err = issuer.Refresh(ctx, pair.RefreshToken)
+		assert.Equal(t, platform.ErrInvalidToken, err)
+	}
+	_, err = issuer.Verify(otherPair.AccessToken)
+	assert.NoError(t, err)
+
+	// logging in again works
+	*now = now.Add(time.Second)
+	pair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	_, err = issuer.Verify(pair.AccessToken)
+	assert.NoError(t, err)
+}
+
+func TestTokenIssuer_RevokeUser_SameSecond(t *testing.T) {
+	issuer, now := newTestTokenIssuer(t)
+	ctx := context.Background()
+	*now = now.Truncate(time.Second).Add(100 * time.Millisecond)
+
+	before, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	*now = now.Add(300 * time.Millisecond)
+	atRevocation, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	require.NoError(t, issuer.RevokeUser(ctx, "u1"))
+	for _, pair := range []*platform.TokenPair{before, atRevocation} {
+		_, err = issuer.Verify(pair.AccessToken)
+		assert.Equal(t, platform.ErrInvalidToken, err)
+	}
+
+	// within the same second, but after the revocation
+	*now = now.Add(300 * time.Millisecond)
+	after, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	_, err = issuer.Verify(after.AccessToken)
+	assert.NoError(t, err)
+}
+
+func TestTokenIssuer_KeyRotation(t *testing.T) {
+	issuer, now := newTestTokenIssuer(t)
+	ctx := context.Background()
+
+	oldPair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	oldKeyID := keyID(t, oldPair.AccessToken)
+
+	require.NoError(t, issuer.RotateKeys())
+	newPair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	newKeyID := keyID(t, newPair.AccessToken)
+	assert.NotEqual(t, oldKeyID, newKeyID)
+
+	// the tokens signed with the retired key are still good
+	_, err = issuer.Verify(oldPair.AccessToken)
+	assert.NoError(t, err)
+	jwks := issuer.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	assert.Equal(t, newKeyID, jwks.Keys[0].KeyID)
+	assert.Equal(t, oldKeyID, jwks.Keys[1].KeyID)
+
+	// once they all expired, the retired key goes away
+	*now = now.Add(16 * time.Minute)
+	require.NoError(t, issuer.RotateKeys())
+	jwks = issuer.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	assert.NotEqual(t, oldKeyID, jwks.Keys[0].KeyID)
+	assert.Equal(t, newKeyID, jwks.Keys[1].KeyID)
+}
+
+func TestTokenIssuer_JWKSVerifiesTokens(t *testing.T) {
+	issuer, _ := newTestTokenIssuer(t)
+	pair, err := issuer.Issue(context.Background(), "u1")
+	require.NoError(t, err)
+
+	// what a client does with the JWKS
+	jwks := issuer.JWKS()
+	require.Len(t, jwks.Keys, 1)
+	jwk := jwks.Keys[0]
+	assert.Equal(t, "EC", jwk.KeyType)
+	assert.Equal(t, "P-256", jwk.Curve)
+	assert.Equal(t, "ES256", jwk.Algorithm)
+
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	require.NoError(t, err)
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	require.NoError(t, err)
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	token, err := jwt.Parse(pair.AccessToken, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwk.KeyID, token.Header["kid"])
+		return publicKey, nil
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	require.NoError(t, err)
+	subject, err := token.Claims.GetSubject()
+	require.NoError(t, err)
+	assert.Equal(t, "u1", subject)
+}
+
+func TestTokenIssuer_SweepExpired(t *testing.T) {
+	store := platform.NewMemoryRefreshTokenStore()
+	issuer, err := platform.NewTokenIssuer("ispend-test", store, 15*time.Minute, time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	issuer.SetNow(func() time.Time { return now })
+	ctx := context.Background()
+
+	pair, err := issuer.Issue(ctx, "u1")
+	require.NoError(t, err)
+	_, err = issuer.Refresh(ctx, pair.RefreshToken)
+	require.NoError(t, err)
+
+	deleted, err := issuer.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	now = now.Add(time.Hour)
+	deleted, err = issuer.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+}
+
+func TestMemoryRefreshTokenStore(t *testing.T) {
+	sessiontest.RunRefreshTokenConformance(t, func(t *testing.T) platform.RefreshTokenStore {
+		return platform.NewMemoryRefreshTokenStore()
+	})
+}
+
+func keyID(t *testing.T, accessToken string) string {
+	token, _, err := jwt.NewParser().ParseUnverified(accessToken, jwt.MapClaims{})
+	require.NoError(t, err)
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
@@ -0,0 +1,59 @@
+package platform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewToken(t *testing.T) {
+	token1, err := platform.NewToken()
+	require.NoError(t, err)
+	token2, err := platform.NewToken()
+	require.NoError(t, err)
+
+	assert.NotEqual(t, token1, token2)
+	assert.True(t, strings.HasPrefix(token1, platform.CurrentTokenVersion+"."))
+	// 32 random bytes, base64url encoded without padding
+	assert.Len(t, token1, len(platform.CurrentTokenVersion)+1+43)
+}
+
+func TestHashToken(t *testing.T) {
+	token, err := platform.NewToken()
+	require.NoError(t, err)
+
+	hash, err := platform.HashToken(token)
+	require.NoError(t, err)
+	assert.NotContains(t, hash, token)
+	hashAgain, err := platform.HashToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, hash, hashAgain)
+
+	assert.True(t, platform.TokenMatchesHash(token, hash))
+	otherToken, err := platform.NewToken()
+	require.NoError(t, err)
+	assert.False(t, platform.TokenMatchesHash(otherToken, hash))
+}
+
+func TestHashToken_Invalid(t *testing.T) {
+	token, err := platform.NewToken()
+	require.NoError(t, err)
+
+	for _, invalidToken := range []string{
+		"",
+		"not-a-token",
+		"v1.",
+		"v1.too-short",
+		"v1." + strings.Repeat("+", 43),
+		"v0" + strings.TrimPrefix(token, platform.CurrentTokenVersion),
+		strings.TrimPrefix(token, platform.CurrentTokenVersion+"."),
+		token + "A",
+	} {
+		_, err := platform.HashToken(invalidToken)
+		assert.Equal(t, platform.ErrInvalidToken, err, invalidToken)
+		assert.False(t, platform.TokenMatchesHash(invalidToken, ""), invalidToken)
+	}
+}
@@ -0,0 +1,108 @@
+package platform_test
+
+import (
+	"bytes"
+	"encoding/base32"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	// the SHA1 vectors of RFC 6238 appendix B, cut to 6 digits
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := platform.TOTPCode(secret, platform.TOTPStep(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, expected, code, "time %d", unix)
+	}
+
+	_, err := platform.TOTPCode("not base32!", 1)
+	assert.Error(t, err)
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := platform.NewTOTPSecret()
+	require.NoError(t, err)
+	now := time.Now()
+	step := platform.TOTPStep(now)
+
+	code, err := platform.TOTPCode(secret, step)
+	require.NoError(t, err)
+	usedStep, ok := platform.ValidateTOTP(secret, code, now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, step, usedStep)
+
+	// no replay
+	_, ok = platform.ValidateTOTP(secret, code, now, usedStep)
+	assert.False(t, ok)
+
+	// one step of skew is fine, two are not
+	previousCode, err := platform.TOTPCode(secret, step-1)
+	require.NoError(t, err)
+	_, ok = platform.ValidateTOTP(secret, previousCode, now, 0)
+	assert.True(t, ok)
+	oldCode, err := platform.TOTPCode(secret, step-2)
+	require.NoError(t, err)
+	if oldCode != code && oldCode != previousCode {
+		_, ok = platform.ValidateTOTP(secret, oldCode, now, 0)
+		assert.False(t, ok)
+	}
+
+	for _, badCode := range []string{"", "12345", "1234567", "abcdef"} {
+		_, ok = platform.ValidateTOTP(secret, badCode, now, 0)
+		assert.False(t, ok, badCode)
+	}
+}
+
+func TestTOTPURIAndQRCode(t *testing.T) {
+	uri := platform.TOTPURI("iSpend", "user 1", "JBSWY3DPEHPK3PXP")
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", parsed.Scheme)
+	assert.Equal(t, "totp", parsed.Host)
+	assert.Equal(t, "/iSpend:user 1", parsed.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", parsed.Query().Get("secret"))
+	assert.Equal(t, "iSpend", parsed.Query().Get("issuer"))
+	assert.Equal(t, "6", parsed.Query().Get("digits"))
+	assert.Equal(t, "30", parsed.Query().Get("period"))
+
+	pngBytes, err := platform.TOTPQRCode(uri, 256)
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(pngBytes))
+	require.NoError(t, err)
+	assert.Equal(t, 256, img.Bounds().Dx())
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := platform.NewRecoveryCodes()
+	require.NoError(t, err)
+	require.Len(t, codes, platform.RecoveryCodesCount)
+	require.Len(t, hashes, platform.RecoveryCodesCount)
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		assert.False(t, seen[code])
+		seen[code] = true
+		assert.NotEqual(t, code, hashes[i])
+		assert.Equal(t, i, platform.MatchRecoveryCode(code, hashes))
+	}
+
+	// typed without dashes, in upper case
+	assert.Equal(t, 3, platform.MatchRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[3], "-", "")), hashes))
+	assert.Equal(t, -1, platform.MatchRecoveryCode("aaaa-bbbb-cccc-dddd", hashes))
+	assert.Equal(t, -1, platform.MatchRecoveryCode(codes[0], nil))
+}
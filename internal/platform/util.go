@@ -1,37 +1,42 @@
 package platform
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"io"
-	"math"
-	"math/rand"
+	"math/big"
+	"net"
+	"net/http"
 
 	"github.com/2beens/ispend/internal/models"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// GenerateRandomString returns a random alphanumeric string made with crypto/rand,
+// secret tokens should rather come from NewToken though
 func GenerateRandomString(length int) string {
-	text := ""
-	possible := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	const possible = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
-	for i := 0; i < length; i++ {
-		possibleLen := float64(len(possible))
-		nextPossible := math.Floor(rand.Float64() * possibleLen)
-		text += string(possible[int(nextPossible)])
+	text := make([]byte, length)
+	for i := range text {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(possible))))
+		if err != nil {
+			// crypto/rand never fails on the supported platforms
+			panic(err)
+		}
+		text[i] = possible[n.Int64()]
 	}
 
-	return text
+	return string(text)
 }
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
-}
-
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+// RequestIP returns the IP address of the client, as seen by the server
+func RequestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func SendAPIResp(w io.Writer, data interface{}) {
@@ -61,3 +66,9 @@ func SendAPIErrorResp(w io.Writer, message string, status int) {
 	apiErr := models.APIResponse{Status: status, Message: message, IsError: true}
 	SendAPIResp(w, apiErr)
 }
+
+// SendAPIValidationErrorResp sends the error response of an invalid request, with the errors of its fields
+func SendAPIValidationErrorResp(w io.Writer, errs ValidationErrors) {
+	apiErr := models.APIResponse{Status: http.StatusBadRequest, Message: errs.Error(), IsError: true, Errors: errs}
+	SendAPIResp(w, apiErr)
+}
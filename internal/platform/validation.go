@@ -0,0 +1,316 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/2beens/ispend/internal/models"
+)
+
+// MaxEmailLength is the longest email address possible, see RFC 5321
+const MaxEmailLength = 254
+
+// DateLayout is the layout of the dates in the requests
+const DateLayout = "2006-01-02"
+
+var (
+	currencyRegex = regexp.MustCompile(`^[A-Za-z]{3}$`)
+	// a BCP 47 language tag, roughly: the language, then the optional script, region and variants
+	localeRegex = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+)
+
+// ValidationErrors lists what is wrong with the fields of a request, at most one error per field
+type ValidationErrors []models.FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, fieldErr := range errs {
+		messages = append(messages, fieldErr.Field+": "+fieldErr.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validationRule checks a value which is set, and returns what is wrong with it, or an empty string
+type validationRule func(value reflect.Value, param string) string
+
+// validationRules are the rules of the validate struct tags, besides required; the rules of a field are separated
+// by commas, and the parameter follows the rule's name after =, e.g. validate:"required,min=0"
+var validationRules = map[string]validationRule{
+	// min and max are the range of a number
+	"min": func(value reflect.Value, param string) string {
+		n := number(value)
+		if !isFinite(n) {
+			return notFiniteMessage
+		}
+		if n < parseNumberParam(param) {
+			return "must be at least " + param
+		}
+		return ""
+	},
+	"max": func(value reflect.Value, param string) string {
+		n := number(value)
+		if !isFinite(n) {
+			return notFiniteMessage
+		}
+		if n > parseNumberParam(param) {
+			return "must be at most " + param
+		}
+		return ""
+	},
+	// minlen and maxlen are the range of the length of a string, in characters
+	"minlen": func(value reflect.Value, param string) string {
+		if utf8.RuneCountInString(value.String()) < int(parseNumberParam(param)) {
+			return "must be at least " + param + " characters long"
+		}
+		return ""
+	},
+	"maxlen": func(value reflect.Value, param string) string {
+		if utf8.RuneCountInString(value.String()) > int(parseNumberParam(param)) {
+			return "must be at most " + param + " characters long"
+		}
+		return ""
+	},
+	// oneof has the allowed values separated by spaces, e.g. oneof=user admin
+	"oneof": func(value reflect.Value, param string) string {
+		options := strings.Fields(param)
+		for _, option := range options {
+			if value.String() == option {
+				return ""
+			}
+		}
+		return "must be one of: " + strings.Join(options, ", ")
+	},
+	"currency": func(value reflect.Value, _ string) string {
+		if !IsCurrencyCode(value.String()) {
+			return "must be a 3 letter currency code like EUR"
+		}
+		return ""
+	},
+	"date": func(value reflect.Value, _ string) string {
+		if _, err := time.Parse(DateLayout, value.String()); err != nil {
+			return "must be a date like 2026-01-31"
+		}
+		return ""
+	},
+	"email": func(value reflect.Value, _ string) string {
+		if !IsEmailAddress(value.String()) {
+			return "must be an email address"
+		}
+		return ""
+	},
+	"timezone": func(value reflect.Value, _ string) string {
+		if !IsTimezone(value.String()) {
+			return "must be a time zone like Europe/Berlin"
+		}
+		return ""
+	},
+	"locale": func(value reflect.Value, _ string) string {
+		if !IsLocale(value.String()) {
+			return "must be a language tag like de-DE"
+		}
+		return ""
+	},
+}
+
+// Validate checks the fields of the struct v points to against the rules in their validate tags, and returns
+// an error for each field breaking one, or nil. The fields are named in the errors as in JSON. A field is
+// required when it's not the zero value, or a nil pointer; the other rules check only the fields which are set.
+// Validate panics on an unknown rule, it's a mistake in the request type.
+func Validate(v interface{}) ValidationErrors {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	var errs ValidationErrors
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if fieldErr := validateField(field, value.Field(i)); fieldErr != nil {
+			errs = append(errs, *fieldErr)
+		}
+	}
+	return errs
+}
+
+func validateField(field reflect.StructField, value reflect.Value) *models.FieldError {
+	tag := field.Tag.Get("validate")
+	if tag == "" {
+		return nil
+	}
+
+	name := FieldName(field)
+	for _, rule := range strings.Split(tag, ",") {
+		ruleName, param, _ := strings.Cut(rule, "=")
+		if ruleName == "required" {
+			if value.IsZero() {
+				return &models.FieldError{Field: name, Code: "required", Message: "is required"}
+			}
+			continue
+		}
+
+		check, ok := validationRules[ruleName]
+		if !ok {
+			panic(fmt.Sprintf("unknown validation rule [%s] of the field %s", ruleName, field.Name))
+		}
+		if value.IsZero() {
+			continue
+		}
+		if message := check(reflect.Indirect(value), param); message != "" {
+			return &models.FieldError{Field: name, Code: ruleName, Message: message, Param: param}
+		}
+	}
+	return nil
+}
+
+// FieldName is the name of the struct field in JSON
+func FieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// DecodeForm sets the fields of the struct dst points to from the form values named as the fields in JSON,
+// and returns an error for each value which is not of its field's type; the values not in the form leave
+// their fields as they are, so a pointer field tells if the value was sent at all
+func DecodeForm(form url.Values, dst interface{}) ValidationErrors {
+	value := reflect.ValueOf(dst).Elem()
+	var errs ValidationErrors
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		values, ok := form[FieldName(field)]
+		if !ok || !field.IsExported() {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		if fieldValue.Kind() == reflect.Ptr {
+			fieldValue.Set(reflect.New(field.Type.Elem()))
+			fieldValue = fieldValue.Elem()
+		}
+		if err := setFormValue(fieldValue, values[0]); err != nil {
+			errs = append(errs, InvalidTypeError(FieldName(field), field.Type))
+		}
+	}
+	return errs
+}
+
+func setFormValue(value reflect.Value, formValue string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(formValue)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(formValue)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(formValue, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(formValue, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(formValue, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		// ParseFloat takes NaN and Inf, which no amount is and JSON cannot encode
+		if !isFinite(f) {
+			return errNotFinite
+		}
+		value.SetFloat(f)
+	default:
+		panic("cannot decode a form value into a " + value.Type().String())
+	}
+	return nil
+}
+
+// InvalidTypeError is the error of a field whose value is not of the field's type t
+func InvalidTypeError(field string, t reflect.Type) models.FieldError {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	message := "must be a " + t.String()
+	switch t.Kind() {
+	case reflect.String:
+		message = "must be a string"
+	case reflect.Bool:
+		message = "must be true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		message = "must be a whole number"
+	case reflect.Float32, reflect.Float64:
+		message = "must be a number"
+	case reflect.Slice, reflect.Array:
+		message = "must be a list"
+	case reflect.Struct, reflect.Map:
+		message = "must be an object"
+	}
+	return models.FieldError{Field: field, Code: "invalid", Message: message}
+}
+
+func number(value reflect.Value) float64 {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	}
+	panic("not a number: " + value.Type().String())
+}
+
+// notFiniteMessage is the message of the NaN and infinite numbers, they are neither below nor above any range
+const notFiniteMessage = "must be a finite number"
+
+var errNotFinite = errors.New("not a finite number")
+
+func isFinite(n float64) bool {
+	return !math.IsNaN(n) && !math.IsInf(n, 0)
+}
+
+func parseNumberParam(param string) float64 {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		panic("invalid validation rule parameter: " + param)
+	}
+	return n
+}
+
+// IsCurrencyCode tells if the currency looks like an ISO 4217 code, which has 3 letters
+func IsCurrencyCode(currency string) bool {
+	return currencyRegex.MatchString(currency)
+}
+
+// IsEmailAddress tells if the email is a bare address, the verification and reset emails go to it
+func IsEmailAddress(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email && len(email) <= MaxEmailLength
+}
+
+// IsTimezone tells if the timezone is the name of one in the IANA database
+func IsTimezone(timezone string) bool {
+	// Local would be whatever the server runs in
+	_, err := time.LoadLocation(timezone)
+	return err == nil && timezone != "Local" && timezone != ""
+}
+
+// IsLocale tells if the locale is a language tag
+func IsLocale(locale string) bool {
+	return localeRegex.MatchString(locale)
+}
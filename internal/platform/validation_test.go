@@ -0,0 +1,265 @@
+package platform_test
+
+import (
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type validationTestRequest struct {
+	Name     string   `json:"name" validate:"required,minlen=2,maxlen=5"`
+	Amount   float32  `json:"amount" validate:"required,min=0,max=100"`
+	Count    int      `json:"count,omitempty" validate:"min=1"`
+	Role     string   `json:"role,omitempty" validate:"oneof=user admin"`
+	Currency string   `json:"currency,omitempty" validate:"currency"`
+	Date     string   `json:"date,omitempty" validate:"date"`
+	Email    *string  `json:"email,omitempty" validate:"email"`
+	Timezone string   `json:"timezone,omitempty" validate:"timezone"`
+	Locale   string   `json:"locale,omitempty" validate:"locale"`
+	Ratio    *float64 `json:"ratio" validate:"required"`
+	Note     string
+}
+
+func newValidationTestRequest() validationTestRequest {
+	ratio := 0.0
+	return validationTestRequest{Name: "walk", Amount: 12.5, Ratio: &ratio}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(req *validationTestRequest)
+		errs   platform.ValidationErrors
+	}{
+		{
+			name:   "valid",
+			change: func(req *validationTestRequest) {},
+		},
+		{
+			name: "all the optional values valid",
+			change: func(req *validationTestRequest) {
+				email := "walker@example.com"
+				*req = validationTestRequest{
+					Name: "wälk", Amount: 100, Count: 3, Role: "admin", Currency: "EUR", Date: "2026-02-28",
+					Email: &email, Timezone: "Europe/Berlin", Locale: "sr-Latn-RS", Ratio: req.Ratio,
+				}
+			},
+		},
+		{
+			name:   "missing required values",
+			change: func(req *validationTestRequest) { *req = validationTestRequest{} },
+			errs: platform.ValidationErrors{
+				{Field: "name", Code: "required", Message: "is required"},
+				{Field: "amount", Code: "required", Message: "is required"},
+				{Field: "ratio", Code: "required", Message: "is required"},
+			},
+		},
+		{
+			name:   "string too short",
+			change: func(req *validationTestRequest) { req.Name = "w" },
+			errs:   platform.ValidationErrors{{Field: "name", Code: "minlen", Message: "must be at least 2 characters long", Param: "2"}},
+		},
+		{
+			name:   "string too long",
+			change: func(req *validationTestRequest) { req.Name = "walker" },
+			errs:   platform.ValidationErrors{{Field: "name", Code: "maxlen", Message: "must be at most 5 characters long", Param: "5"}},
+		},
+		{
+			name:   "number below the range",
+			change: func(req *validationTestRequest) { req.Amount = -0.5 },
+			errs:   platform.ValidationErrors{{Field: "amount", Code: "min", Message: "must be at least 0", Param: "0"}},
+		},
+		{
+			name:   "number above the range",
+			change: func(req *validationTestRequest) { req.Amount = 100.5 },
+			errs:   platform.ValidationErrors{{Field: "amount", Code: "max", Message: "must be at most 100", Param: "100"}},
+		},
+		{
+			name:   "NaN is not within the range",
+			change: func(req *validationTestRequest) { req.Amount = float32(math.NaN()) },
+			errs:   platform.ValidationErrors{{Field: "amount", Code: "min", Message: "must be a finite number", Param: "0"}},
+		},
+		{
+			name:   "infinity is not within the range",
+			change: func(req *validationTestRequest) { req.Amount = float32(math.Inf(1)) },
+			errs:   platform.ValidationErrors{{Field: "amount", Code: "min", Message: "must be a finite number", Param: "0"}},
+		},
+		{
+			name:   "optional number below the range",
+			change: func(req *validationTestRequest) { req.Count = -1 },
+			errs:   platform.ValidationErrors{{Field: "count", Code: "min", Message: "must be at least 1", Param: "1"}},
+		},
+		{
+			name:   "not one of the enum",
+			change: func(req *validationTestRequest) { req.Role = "root" },
+			errs:   platform.ValidationErrors{{Field: "role", Code: "oneof", Message: "must be one of: user, admin", Param: "user admin"}},
+		},
+		{
+			name:   "invalid currency",
+			change: func(req *validationTestRequest) { req.Currency = "EURO" },
+			errs:   platform.ValidationErrors{{Field: "currency", Code: "currency", Message: "must be a 3 letter currency code like EUR"}},
+		},
+		{
+			name:   "invalid date",
+			change: func(req *validationTestRequest) { req.Date = "2026-02-30" },
+			errs:   platform.ValidationErrors{{Field: "date", Code: "date", Message: "must be a date like 2026-01-31"}},
+		},
+		{
+			name: "invalid email behind a pointer",
+			change: func(req *validationTestRequest) {
+				email := "Walker <walker@example.com>"
+				req.Email = &email
+			},
+			errs: platform.ValidationErrors{{Field: "email", Code: "email", Message: "must be an email address"}},
+		},
+		{
+			name: "email too long",
+			change: func(req *validationTestRequest) {
+				email := strings.Repeat("w", platform.MaxEmailLength) + "@example.com"
+				req.Email = &email
+			},
+			errs: platform.ValidationErrors{{Field: "email", Code: "email", Message: "must be an email address"}},
+		},
+		{
+			name:   "the server's own time zone",
+			change: func(req *validationTestRequest) { req.Timezone = "Local" },
+			errs:   platform.ValidationErrors{{Field: "timezone", Code: "timezone", Message: "must be a time zone like Europe/Berlin"}},
+		},
+		{
+			name:   "invalid locale",
+			change: func(req *validationTestRequest) { req.Locale = "de_DE" },
+			errs:   platform.ValidationErrors{{Field: "locale", Code: "locale", Message: "must be a language tag like de-DE"}},
+		},
+		{
+			name: "one error per field, in the order of the fields",
+			change: func(req *validationTestRequest) {
+				req.Name = ""
+				req.Date = "yesterday"
+				req.Amount = 1000
+			},
+			errs: platform.ValidationErrors{
+				{Field: "name", Code: "required", Message: "is required"},
+				{Field: "amount", Code: "max", Message: "must be at most 100", Param: "100"},
+				{Field: "date", Code: "date", Message: "must be a date like 2026-01-31"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newValidationTestRequest()
+			tt.change(&req)
+			assert.Equal(t, tt.errs, platform.Validate(&req))
+		})
+	}
+}
+
+func TestValidate_UnknownRule(t *testing.T) {
+	req := struct {
+		Name string `validate:"required,shiny"`
+	}{Name: "walker"}
+	assert.Panics(t, func() { platform.Validate(&req) })
+}
+
+func TestValidationErrors_Error(t *testing.T) {
+	errs := platform.ValidationErrors{
+		{Field: "name", Code: "required", Message: "is required"},
+		{Field: "amount", Code: "min", Message: "must be at least 0", Param: "0"},
+	}
+	assert.Equal(t, "name: is required; amount: must be at least 0", errs.Error())
+}
+
+func TestDecodeForm(t *testing.T) {
+	tests := []struct {
+		name string
+		form url.Values
+		want validationTestRequest
+		errs platform.ValidationErrors
+	}{
+		{
+			name: "all the types",
+			form: url.Values{
+				"name": {"walk"}, "amount": {"12.5"}, "count": {"3"}, "email": {"walker@example.com"}, "ratio": {"0"}, "Note": {"hi"},
+			},
+			want: validationTestRequest{Name: "walk", Amount: 12.5, Count: 3, Email: newString("walker@example.com"), Ratio: newFloat64(0), Note: "hi"},
+		},
+		{
+			name: "the missing values leave the pointers nil, the unknown ones are ignored",
+			form: url.Values{"name": {"walk"}, "username": {"walker"}},
+			want: validationTestRequest{Name: "walk"},
+		},
+		{
+			name: "an empty value sets the pointer",
+			form: url.Values{"email": {""}},
+			want: validationTestRequest{Email: newString("")},
+		},
+		{
+			name: "values not of the types",
+			form: url.Values{"name": {"walk"}, "amount": {"12,5"}, "count": {"3.5"}, "ratio": {"half"}},
+			want: validationTestRequest{Name: "walk", Ratio: newFloat64(0)},
+			errs: platform.ValidationErrors{
+				{Field: "amount", Code: "invalid", Message: "must be a number"},
+				{Field: "count", Code: "invalid", Message: "must be a whole number"},
+				{Field: "ratio", Code: "invalid", Message: "must be a number"},
+			},
+		},
+		{
+			name: "NaN and infinite numbers",
+			form: url.Values{"name": {"walk"}, "amount": {"NaN"}, "ratio": {"-Inf"}},
+			want: validationTestRequest{Name: "walk", Ratio: newFloat64(0)},
+			errs: platform.ValidationErrors{
+				{Field: "amount", Code: "invalid", Message: "must be a number"},
+				{Field: "ratio", Code: "invalid", Message: "must be a number"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req validationTestRequest
+			errs := platform.DecodeForm(tt.form, &req)
+			assert.Equal(t, tt.errs, errs)
+			assert.Equal(t, tt.want, req)
+		})
+	}
+}
+
+func TestValidate_OpenAPISchema(t *testing.T) {
+	var req validationTestRequest
+	errs := platform.Validate(&req)
+	require.Len(t, errs, 3)
+
+	// a rule the schema can tell is in the OpenAPI document too
+	doc := platform.NewOpenAPIDocument(platform.OpenAPIInfo{}, "/api", "/token", []platform.APIOperation{
+		{Method: "POST", Path: "/requests", Summary: "validate", Request: &req, Status: 204, Errors: []int{400}},
+	})
+	schema := doc.Components.Schemas["ValidationTestRequest"]
+	require.NotNil(t, schema)
+	assert.ElementsMatch(t, []string{"name", "amount", "ratio", "Note"}, schema.Required)
+	assert.Equal(t, 2, *schema.Properties["name"].MinLength)
+	assert.Equal(t, 5, *schema.Properties["name"].MaxLength)
+	assert.Equal(t, 0.0, *schema.Properties["amount"].Minimum)
+	assert.Equal(t, 100.0, *schema.Properties["amount"].Maximum)
+	assert.Equal(t, []string{"user", "admin"}, schema.Properties["role"].Enum)
+	assert.NotEmpty(t, schema.Properties["currency"].Pattern)
+	assert.Equal(t, "date", schema.Properties["date"].Format)
+	assert.Equal(t, "email", schema.Properties["email"].Format)
+
+	problem := doc.Components.Schemas["Problem"]
+	require.NotNil(t, problem)
+	assert.Equal(t, "#/components/schemas/FieldError", problem.Properties["errors"].Items.Ref)
+	assert.ElementsMatch(t, []string{"field", "code", "message"}, doc.Components.Schemas["FieldError"].Required)
+}
+
+func newString(s string) *string {
+	return &s
+}
+
+func newFloat64(f float64) *float64 {
+	return &f
+}
@@ -1,17 +1,30 @@
 package platform
 
 import (
+	"math"
+	"runtime/debug"
+	"time"
+
 	"gopkg.in/yaml.v2"
 )
 
 const DBTypePostgres = "postgres"
 const DBTypeInMemory = "mem"
+const DBTypeSQLite = "sqlite"
+const SessionStoreInMemory = "mem"
+const SessionStoreDB = "db"
+const SessionStoreRedis = "redis"
 const PostgresProduction = "production"
 const PostgresDev = "dev"
+const DefaultRequestTimeout = 10 * time.Second
+const DefaultGraphQLMaxComplexity = 1000
+const DefaultGraphQLMaxDepth = 8
 
 type YamlConfig struct {
 	MuteRequestPathLogs bool   `yaml:"mute_request_path_logs"`
+	RequestTimeout      int    `yaml:"request_timeout"`
 	PingTimeout         int    `yaml:"db_ping_timeout"`
+	AutoMigrate         bool   `yaml:"db_auto_migrate"`
 	DBType              string `yaml:"dbtype"`
 	// TODO: should have one general env variable
 	PostgresEnv string `yaml:"postgres_env"`
@@ -22,6 +35,99 @@ type YamlConfig struct {
 		Port    int
 	}
 
+	SQLite struct {
+		Path string
+	} `yaml:"sqlite"`
+
+	InMemory struct {
+		// File is the snapshot file, the DB lives only in memory if it's empty
+		File             string
+		SnapshotInterval int  `yaml:"snapshot_interval"`
+		OpLog            bool `yaml:"op_log"`
+	} `yaml:"mem"`
+
+	Sessions struct {
+		// Store is one of mem | db | redis, db meaning the SQL DB from dbtype
+		Store         string
+		IdleTTL       int `yaml:"idle_ttl"`
+		AbsoluteTTL   int `yaml:"absolute_ttl"`
+		SweepInterval int `yaml:"sweep_interval"`
+		Redis         struct {
+			Addr string
+			DB   int
+		}
+	}
+
+	Auth struct {
+		// CookieSecure marks the session cookies as https only; turn it off only for local development
+		CookieSecure *bool `yaml:"cookie_secure"`
+		// EmailVerificationTTL and PasswordResetTTL are how long the links mailed to the users work, in seconds
+		EmailVerificationTTL int `yaml:"email_verification_ttl"`
+		PasswordResetTTL     int `yaml:"password_reset_ttl"`
+		// LoginLockoutThreshold failed logins in a row lock the user out for LoginLockoutDuration seconds
+		LoginLockoutThreshold int `yaml:"login_lockout_threshold"`
+		LoginLockoutDuration  int `yaml:"login_lockout_duration"`
+
+		// Password configures how the passwords are hashed, and which ones the users can choose
+		Password struct {
+			// Algorithm is argon2id or bcrypt, the new passwords are hashed with it; the hashes of the other
+			// one, or with other parameters, still work and are replaced on the next login
+			Algorithm string
+			Argon2    struct {
+				// Memory is in KiB
+				Memory      uint32
+				Iterations  uint32
+				Parallelism uint8
+				// MemoryBudget is the memory, in KiB, the hashes running at once can take together
+				MemoryBudget uint64 `yaml:"memory_budget"`
+			} `yaml:"argon2"`
+			BcryptCost int `yaml:"bcrypt_cost"`
+			MinLength  int `yaml:"min_length"`
+			MaxLength  int `yaml:"max_length"`
+			// BreachedPasswordsFile lists the passwords the users cannot choose, see PasswordPolicy.ReadBreachedPasswords
+			BreachedPasswordsFile string `yaml:"breached_passwords_file"`
+		}
+	}
+
+	// BaseURL is where the users reach the server, for the links in the emails
+	BaseURL string `yaml:"base_url"`
+
+	Mail struct {
+		// Type is smtp, or outbox which only writes the emails to the OutboxFile (or the log without one)
+		Type       string
+		From       string
+		OutboxFile string `yaml:"outbox_file"`
+		// the SMTP password comes from the ISPEND_SMTP_PASSWORD env var
+		SMTP struct {
+			Host     string
+			Port     int
+			Username string
+		} `yaml:"smtp"`
+	}
+
+	// Admin is the user made admin on the first start, with the password from the ISPEND_ADMIN_PASSWORD env var
+	Admin struct {
+		Username string
+		Email    string
+	}
+
+	// Tokens configures the JWT access and refresh tokens for the API clients, e.g. mobile apps;
+	// the refresh tokens are kept in the store configured for the sessions
+	Tokens struct {
+		Issuer              string
+		AccessTTL           int `yaml:"access_ttl"`
+		RefreshTTL          int `yaml:"refresh_ttl"`
+		KeyRotationInterval int `yaml:"key_rotation_interval"`
+	}
+
+	// GraphQL limits the queries to /graphql, which are rejected before they run if they would be too costly
+	GraphQL struct {
+		// MaxComplexity is the most fields a query may resolve, the fields within a list counted once per item
+		MaxComplexity int `yaml:"max_complexity"`
+		// MaxDepth is how deep the fields of a query may nest
+		MaxDepth int `yaml:"max_depth"`
+	} `yaml:"graphql"`
+
 	DBProd struct {
 		Host    string
 		Port    int
@@ -47,6 +153,174 @@ func NewYamlConfig(yamlContent []byte) (*YamlConfig, error) {
 	return yc, nil
 }
 
+// GetRequestTimeout returns the deadline of a single request, including all its DB queries
+func (c *YamlConfig) GetRequestTimeout() time.Duration {
+	if c.RequestTimeout <= 0 {
+		return DefaultRequestTimeout
+	}
+	return time.Duration(c.RequestTimeout) * time.Second
+}
+
+func (c *YamlConfig) GetGraphQLMaxComplexity() int {
+	if c.GraphQL.MaxComplexity <= 0 {
+		return DefaultGraphQLMaxComplexity
+	}
+	return c.GraphQL.MaxComplexity
+}
+
+func (c *YamlConfig) GetGraphQLMaxDepth() int {
+	if c.GraphQL.MaxDepth <= 0 {
+		return DefaultGraphQLMaxDepth
+	}
+	return c.GraphQL.MaxDepth
+}
+
+// GetInMemorySnapshotInterval returns how often the persistent in memory DB is saved, 0 meaning only on shutdown
+func (c *YamlConfig) GetInMemorySnapshotInterval() time.Duration {
+	if c.InMemory.SnapshotInterval <= 0 {
+		return 0
+	}
+	return time.Duration(c.InMemory.SnapshotInterval) * time.Second
+}
+
+// GetSessionIdleTTL returns how long an unused login session stays valid, a negative value in the config means forever
+func (c *YamlConfig) GetSessionIdleTTL() time.Duration {
+	return configTTL(c.Sessions.IdleTTL, DefaultSessionIdleTTL)
+}
+
+// GetSessionAbsoluteTTL returns how long a login session stays valid at most, a negative value in the config means forever
+func (c *YamlConfig) GetSessionAbsoluteTTL() time.Duration {
+	return configTTL(c.Sessions.AbsoluteTTL, DefaultSessionAbsoluteTTL)
+}
+
+func (c *YamlConfig) GetSessionSweepInterval() time.Duration {
+	if c.Sessions.SweepInterval <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.Sessions.SweepInterval) * time.Second
+}
+
+func (c *YamlConfig) GetTokenIssuer() string {
+	if c.Tokens.Issuer == "" {
+		return "ispend"
+	}
+	return c.Tokens.Issuer
+}
+
+func (c *YamlConfig) GetAccessTokenTTL() time.Duration {
+	return configDuration(c.Tokens.AccessTTL, DefaultAccessTokenTTL)
+}
+
+func (c *YamlConfig) GetRefreshTokenTTL() time.Duration {
+	return configDuration(c.Tokens.RefreshTTL, DefaultRefreshTokenTTL)
+}
+
+func (c *YamlConfig) GetKeyRotationInterval() time.Duration {
+	return configDuration(c.Tokens.KeyRotationInterval, DefaultKeyRotationInterval)
+}
+
+// IsCookieSecure tells if the session cookies are sent over https only, the default
+func (c *YamlConfig) IsCookieSecure() bool {
+	return c.Auth.CookieSecure == nil || *c.Auth.CookieSecure
+}
+
+func (c *YamlConfig) GetEmailVerificationTTL() time.Duration {
+	return configDuration(c.Auth.EmailVerificationTTL, DefaultEmailVerificationTTL)
+}
+
+func (c *YamlConfig) GetPasswordResetTTL() time.Duration {
+	return configDuration(c.Auth.PasswordResetTTL, DefaultPasswordResetTTL)
+}
+
+func (c *YamlConfig) GetPasswordHashAlgorithm() string {
+	if c.Auth.Password.Algorithm == "" {
+		return PasswordHashArgon2id
+	}
+	return c.Auth.Password.Algorithm
+}
+
+// GetPasswordArgon2Params returns the argon2id parameters from the config, the defaults for the missing ones
+func (c *YamlConfig) GetPasswordArgon2Params() Argon2Params {
+	params := DefaultArgon2Params
+	if c.Auth.Password.Argon2.Memory > 0 {
+		params.Memory = c.Auth.Password.Argon2.Memory
+	}
+	if c.Auth.Password.Argon2.Iterations > 0 {
+		params.Iterations = c.Auth.Password.Argon2.Iterations
+	}
+	if c.Auth.Password.Argon2.Parallelism > 0 {
+		params.Parallelism = c.Auth.Password.Argon2.Parallelism
+	}
+	return params
+}
+
+// GetPasswordArgon2MemoryBudget returns the argon2id memory budget from the config; when it is missing,
+// a quarter of GOMEMLIMIT if that is set, or DefaultArgon2MemoryBudget
+func (c *YamlConfig) GetPasswordArgon2MemoryBudget() uint64 {
+	if c.Auth.Password.Argon2.MemoryBudget > 0 {
+		return c.Auth.Password.Argon2.MemoryBudget
+	}
+	// a negative input only reads the limit
+	if limit := debug.SetMemoryLimit(-1); limit < math.MaxInt64 {
+		return max(uint64(limit)/1024/4, uint64(c.GetPasswordArgon2Params().Memory))
+	}
+	return DefaultArgon2MemoryBudget
+}
+
+func (c *YamlConfig) GetPasswordBcryptCost() int {
+	if c.Auth.Password.BcryptCost <= 0 {
+		return DefaultBcryptCost
+	}
+	return c.Auth.Password.BcryptCost
+}
+
+func (c *YamlConfig) GetPasswordMinLength() int {
+	if c.Auth.Password.MinLength <= 0 {
+		return DefaultPasswordMinLength
+	}
+	return c.Auth.Password.MinLength
+}
+
+func (c *YamlConfig) GetPasswordMaxLength() int {
+	if c.Auth.Password.MaxLength <= 0 {
+		return DefaultPasswordMaxLength
+	}
+	return c.Auth.Password.MaxLength
+}
+
+// GetBaseURL returns the configured base URL, or the local one on the given port
+func (c *YamlConfig) GetBaseURL(port string) string {
+	if c.BaseURL != "" {
+		return c.BaseURL
+	}
+	return "http://" + IPAddress + ":" + port
+}
+
+func (c *YamlConfig) GetMailFrom() string {
+	if c.Mail.From == "" {
+		return "iSpend <no-reply@ispend.local>"
+	}
+	return c.Mail.From
+}
+
+// configDuration returns the seconds from the config, or the default if they're not positive
+func configDuration(seconds int, defaultDuration time.Duration) time.Duration {
+	if seconds <= 0 {
+		return defaultDuration
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func configTTL(seconds int, defaultTTL time.Duration) time.Duration {
+	if seconds < 0 {
+		return 0
+	}
+	if seconds == 0 {
+		return defaultTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func (c *YamlConfig) GetPostgresHost() string {
 	if c.PostgresEnv == PostgresProduction {
 		return c.DBProd.Host
@@ -21,11 +21,19 @@ import (
 	"github.com/2beens/ispend/internal/platform"
 	"github.com/2beens/ispend/internal/services"
 	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
 	log "github.com/sirupsen/logrus"
 )
 
 type Server struct {
 	loginSessionManager *platform.LoginSessionManager
+	tokenIssuer         *platform.TokenIssuer
+	accountTokenStore   platform.AccountTokenStore
+	accountService      *services.AccountService
+	loginThrottler      *services.LoginThrottler
+	passwordHasher      *platform.PasswordHasher
+	passwordPolicy      *platform.PasswordPolicy
+	mailer              platform.Mailer
 	graphiteClient      *metrics.GraphiteClient
 	dbClient            db.SpenderDB
 	config              *platform.YamlConfig
@@ -34,8 +42,7 @@ type Server struct {
 
 func NewServer(configData []byte, logFile string) (*Server, error) {
 	server := &Server{
-		loginSessionManager: platform.NewLoginSessionHandler(),
-		logFile:             logFile,
+		logFile: logFile,
 	}
 
 	var err error
@@ -55,21 +62,8 @@ func NewServer(configData []byte, logFile string) (*Server, error) {
 		server.graphiteClient = metrics.NewGraphiteNop(server.config.Graphite.Host, server.config.Graphite.Port)
 	}
 
-	dbPassword := os.Getenv("ISPEND_POSTGRESS_PASSWORD")
-	if len(dbPassword) == 0 {
-		log.Warn("DB password is empty string...")
-	}
-
 	if server.config.DBType == platform.DBTypePostgres {
-		server.dbClient = db.NewPostgresDBClient(
-			server.config.GetPostgresHost(),
-			server.config.GetPostgresPort(),
-			server.config.GetPostgresDBName(),
-			server.config.GetPostgresDBUsername(),
-			dbPassword,
-			server.config.GetPostgresDBSSLMode(),
-			server.config.PingTimeout,
-		)
+		server.dbClient = newPostgresDBClient(server.config, server.config.AutoMigrate)
 
 		err := server.dbClient.Open()
 		if err != nil {
@@ -77,6 +71,28 @@ func NewServer(configData []byte, logFile string) (*Server, error) {
 		}
 
 		log.Debugln(" > usersService: using Postgres usersService")
+	} else if server.config.DBType == platform.DBTypeSQLite {
+		server.dbClient = db.NewSQLiteDB(server.config.SQLite.Path, server.config.AutoMigrate)
+
+		err := server.dbClient.Open()
+		if err != nil {
+			log.Fatalf("cannot open sqlite DB: %s", err.Error())
+		}
+
+		log.Debugln(" > usersService: using SQLite usersService")
+	} else if server.config.DBType == platform.DBTypeInMemory && server.config.InMemory.File != "" {
+		server.dbClient = db.NewPersistentInMemoryDB(
+			server.config.InMemory.File,
+			server.config.GetInMemorySnapshotInterval(),
+			server.config.InMemory.OpLog,
+		)
+
+		err := server.dbClient.Open()
+		if err != nil {
+			log.Fatalf("cannot open in memory DB file: %s", err.Error())
+		}
+
+		log.Debugln(" > usersService: using persistent in memory usersService")
 	} else if server.config.DBType == platform.DBTypeInMemory {
 		server.dbClient = db.NewInMemoryDB()
 		log.Debugln(" > usersService: using in memory usersService")
@@ -84,16 +100,190 @@ func NewServer(configData []byte, logFile string) (*Server, error) {
 		return nil, errors.New(fmt.Sprintf("unknown usersService type from config: %s", server.config.DBType))
 	}
 
+	server.passwordHasher, err = platform.NewPasswordHasher(
+		server.config.GetPasswordHashAlgorithm(),
+		server.config.GetPasswordArgon2Params(),
+		server.config.GetPasswordBcryptCost(),
+		server.config.GetPasswordArgon2MemoryBudget(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create password hasher: %s", err)
+	}
+	server.passwordPolicy, err = server.newPasswordPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := server.bootstrapAdmin(context.Background(), server.dbClient); err != nil {
+		return nil, fmt.Errorf("cannot bootstrap the admin: %s", err)
+	}
+
+	stores, err := server.newAuthStores()
+	if err != nil {
+		return nil, err
+	}
+	server.accountTokenStore = stores.accountTokens
+	server.loginSessionManager = platform.NewLoginSessionManager(
+		stores.sessions,
+		server.config.GetSessionIdleTTL(),
+		server.config.GetSessionAbsoluteTTL(),
+	)
+	server.tokenIssuer, err = platform.NewTokenIssuer(
+		server.config.GetTokenIssuer(),
+		stores.refreshTokens,
+		server.config.GetAccessTokenTTL(),
+		server.config.GetRefreshTokenTTL(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create token issuer: %s", err)
+	}
+
+	usernamePolicy, ipPolicy := server.loginThrottlePolicies()
+	server.loginThrottler = services.NewLoginThrottler(stores.loginAttempts, server.graphiteClient, usernamePolicy, ipPolicy)
+
+	server.mailer, err = server.newMailer()
+	if err != nil {
+		return nil, err
+	}
+
 	return server, nil
 }
 
+// authStores keeps the login sessions, the tokens and the failed logins, all of them in the backend configured for the sessions
+type authStores struct {
+	sessions      platform.SessionStore
+	refreshTokens platform.RefreshTokenStore
+	accountTokens platform.AccountTokenStore
+	loginAttempts platform.LoginAttemptStore
+}
+
+func (s *Server) newAuthStores() (*authStores, error) {
+	switch s.config.Sessions.Store {
+	case "", platform.SessionStoreInMemory:
+		log.Debugln(" > sessions: using in memory session store")
+		return &authStores{
+			sessions:      platform.NewMemorySessionStore(),
+			refreshTokens: platform.NewMemoryRefreshTokenStore(),
+			accountTokens: platform.NewMemoryAccountTokenStore(),
+			loginAttempts: platform.NewMemoryLoginAttemptStore(),
+		}, nil
+	case platform.SessionStoreDB:
+		sqlDB, ok := s.dbClient.(interface {
+			SessionStore() *db.SQLSessionStore
+			RefreshTokenStore() *db.SQLRefreshTokenStore
+			AccountTokenStore() *db.SQLAccountTokenStore
+			LoginAttemptStore() *db.SQLLoginAttemptStore
+		})
+		if !ok {
+			return nil, fmt.Errorf("session store [%s] needs a SQL DB, not [%s]", s.config.Sessions.Store, s.config.DBType)
+		}
+		log.Debugln(" > sessions: using DB session store")
+		return &authStores{
+			sessions:      sqlDB.SessionStore(),
+			refreshTokens: sqlDB.RefreshTokenStore(),
+			accountTokens: sqlDB.AccountTokenStore(),
+			loginAttempts: sqlDB.LoginAttemptStore(),
+		}, nil
+	case platform.SessionStoreRedis:
+		redisClient := redis.NewClient(&redis.Options{
+			Addr:     s.config.Sessions.Redis.Addr,
+			Password: os.Getenv("ISPEND_REDIS_PASSWORD"),
+			DB:       s.config.Sessions.Redis.DB,
+		})
+		pingTimeout := time.Duration(s.config.PingTimeout) * time.Second
+		if pingTimeout <= 0 {
+			pingTimeout = 10 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		defer cancel()
+		if err := redisClient.Ping(ctx).Err(); err != nil {
+			return nil, fmt.Errorf("cannot connect to redis [%s]: %s", s.config.Sessions.Redis.Addr, err)
+		}
+		log.Debugf(" > sessions: using redis session store [%s]", s.config.Sessions.Redis.Addr)
+		return &authStores{
+			sessions:      db.NewRedisSessionStore(redisClient, "ispend:"),
+			refreshTokens: db.NewRedisRefreshTokenStore(redisClient, "ispend:"),
+			accountTokens: db.NewRedisAccountTokenStore(redisClient, "ispend:"),
+			loginAttempts: db.NewRedisLoginAttemptStore(redisClient, "ispend:"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown session store type from config: %s", s.config.Sessions.Store)
+	}
+}
+
+// loginThrottlePolicies returns the default throttling of the logins, with the lockout from the config
+func (s *Server) loginThrottlePolicies() (usernamePolicy, ipPolicy services.LoginThrottlePolicy) {
+	usernamePolicy = services.DefaultUsernameThrottlePolicy
+	ipPolicy = services.DefaultIPThrottlePolicy
+	if s.config.Auth.LoginLockoutThreshold > 0 {
+		usernamePolicy.LockoutThreshold = s.config.Auth.LoginLockoutThreshold
+	}
+	if s.config.Auth.LoginLockoutDuration > 0 {
+		usernamePolicy.LockoutDuration = time.Duration(s.config.Auth.LoginLockoutDuration) * time.Second
+		ipPolicy.LockoutDuration = usernamePolicy.LockoutDuration
+	}
+	return usernamePolicy, ipPolicy
+}
+
+func (s *Server) newPasswordPolicy() (*platform.PasswordPolicy, error) {
+	policy := platform.NewPasswordPolicy(s.config.GetPasswordMinLength(), s.config.GetPasswordMaxLength())
+	if s.config.Auth.Password.BreachedPasswordsFile == "" {
+		log.Debugln(" > passwords: no breached passwords file, checking only the length")
+		return policy, nil
+	}
+	count, err := policy.LoadBreachedPasswords(s.config.Auth.Password.BreachedPasswordsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load breached passwords: %s", err)
+	}
+	log.Debugf(" > passwords: loaded %d breached passwords", count)
+	return policy, nil
+}
+
+func (s *Server) newMailer() (platform.Mailer, error) {
+	switch s.config.Mail.Type {
+	case "", platform.MailerOutbox:
+		log.Debugf(" > mail: using outbox [%s]", s.config.Mail.OutboxFile)
+		return platform.NewOutboxMailer(s.config.Mail.OutboxFile, s.config.GetMailFrom()), nil
+	case platform.MailerSMTP:
+		log.Debugf(" > mail: using SMTP server [%s:%d]", s.config.Mail.SMTP.Host, s.config.Mail.SMTP.Port)
+		return platform.NewSMTPMailer(
+			s.config.Mail.SMTP.Host,
+			s.config.Mail.SMTP.Port,
+			s.config.Mail.SMTP.Username,
+			os.Getenv("ISPEND_SMTP_PASSWORD"),
+			s.config.GetMailFrom(),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown mail type from config: %s", s.config.Mail.Type)
+	}
+}
+
+func newPostgresDBClient(config *platform.YamlConfig, autoMigrate bool) *db.PostgresDBClient {
+	dbPassword := os.Getenv("ISPEND_POSTGRESS_PASSWORD")
+	if len(dbPassword) == 0 {
+		log.Warn("DB password is empty string...")
+	}
+
+	return db.NewPostgresDBClient(
+		config.GetPostgresHost(),
+		config.GetPostgresPort(),
+		config.GetPostgresDBName(),
+		config.GetPostgresDBUsername(),
+		dbPassword,
+		config.GetPostgresDBSSLMode(),
+		config.PingTimeout,
+		autoMigrate,
+	)
+}
+
 func (s *Server) getLoggingMiddleware(graphiteClient *metrics.GraphiteClient) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if !s.config.MuteRequestPathLogs {
 				userAgent := r.Header.Get("User-Agent")
-				sessionID := r.Header.Get("X-Ispend-SessionID")
-				log.Tracef(" ====> request [%s] path: [%s] [sessionID: %s] [UA: %s]", r.Method, r.URL.Path, sessionID, userAgent)
+				// never log the session ID itself, it's as good as the password
+				hasSession := platform.SessionIDFromRequest(r) != "" || platform.BearerTokenFromRequest(r) != ""
+				log.Tracef(" ====> request [%s] path: [%s] [session: %t] [UA: %s]", r.Method, r.URL.Path, hasSession, userAgent)
 			}
 
 			path := r.URL.Path
@@ -109,6 +299,92 @@ func (s *Server) getLoggingMiddleware(graphiteClient *metrics.GraphiteClient) fu
 	}
 }
 
+func (s *Server) getRequestTimeoutMiddleware(timeout time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// getAuthMiddleware resolves the bearer access token or the session cookie to the principal in the request
+// context, and rejects cookie authenticated state changing requests which do not carry the session's CSRF
+// token; which routes need a principal is up to the routes themselves. The user's role is looked up with
+// every request, so a changed role applies to the sessions and tokens already out there too.
+func (s *Server) getAuthMiddleware(usersService *services.UsersService) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the browser never adds the bearer token by itself, so it needs no CSRF protection
+			if accessToken := platform.BearerTokenFromRequest(r); accessToken != "" {
+				claims, err := s.tokenIssuer.Verify(accessToken)
+				if err != nil {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					sendAuthError(w, r, "invalid access token", http.StatusUnauthorized)
+					return
+				}
+				role, err := usersService.GetRole(claims.Subject)
+				if err != nil {
+					// the user is gone
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					sendAuthError(w, r, "invalid access token", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(platform.WithPrincipal(r.Context(), platform.NewTokenPrincipal(claims, role))))
+				return
+			}
+
+			sessionID := platform.SessionIDFromRequest(r)
+			if sessionID == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			session, err := s.loginSessionManager.GetBySessionID(r.Context(), sessionID)
+			if err != nil {
+				if err != platform.ErrNotFound {
+					log.Errorf("auth middleware, error 10601: %s", err)
+					sendAuthError(w, r, "internal server error 10601", http.StatusInternalServerError)
+					return
+				}
+				// expired or revoked, the request goes on as not logged in
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if platform.IsStateChangingMethod(r.Method) && !platform.ValidCSRFToken(sessionID, r.Header.Get(platform.CSRFHeaderName)) {
+				log.Warnf("auth middleware: missing or invalid CSRF token [%s %s]", r.Method, r.URL.Path)
+				sendAuthError(w, r, "invalid CSRF token", http.StatusForbidden)
+				return
+			}
+
+			role, err := usersService.GetRole(session.Username)
+			if err != nil {
+				// the user is gone, and so are its sessions
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(platform.WithPrincipal(r.Context(), platform.NewSessionPrincipal(session, role))))
+		})
+	}
+}
+
+// sendAuthError answers the /api/v1 requests with a problem, the GraphQL ones with a GraphQL error,
+// and the older routes with the error response they always had
+func sendAuthError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if strings.HasPrefix(r.URL.Path, handlers.APIV1Prefix+"/") {
+		platform.SendProblem(w, r, status, message)
+		return
+	}
+	if r.URL.Path == handlers.GraphQLPath {
+		handlers.SendGraphQLError(w, status, message)
+		return
+	}
+	platform.SendAPIErrorResp(w, message, status)
+}
+
 func (s *Server) getPanicRecoverMiddleware(graphiteClient *metrics.GraphiteClient) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -132,7 +408,7 @@ func (s *Server) getPanicRecoverMiddleware(graphiteClient *metrics.GraphiteClien
 	}
 }
 
-func (s *Server) routerSetup(db db.SpenderDB, graphiteClient *metrics.GraphiteClient, chInterrupt chan models.Signal) (r *mux.Router) {
+func (s *Server) routerSetup(db db.SpenderDB, graphiteClient *metrics.GraphiteClient, chInterrupt chan models.Signal, baseURL string) (r *mux.Router) {
 	r = mux.NewRouter()
 
 	// server static files
@@ -159,26 +435,72 @@ func (s *Server) routerSetup(db db.SpenderDB, graphiteClient *metrics.GraphiteCl
 	r.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
 		viewsMaker.RenderView(w, "register", nil)
 	})
+	r.HandleFunc("/reset-password", func(w http.ResponseWriter, r *http.Request) {
+		viewsMaker.RenderView(w, "reset_password", nil)
+	})
 
 	r.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
 		platform.SendAPIOKResp(w, "Oh yeah...")
 	})
 
+	usersService := services.NewUsersService(db, graphiteClient, s.passwordHasher, s.passwordPolicy)
+	totpService := services.NewTOTPService(usersService, s.config.GetTokenIssuer())
+	webAuthnService, err := services.NewWebAuthnService(usersService, db, "iSpend", baseURL)
+	if err != nil {
+		log.Fatalf("cannot initialize the passkeys: %s", err)
+	}
+	s.accountService = services.NewAccountService(
+		usersService,
+		s.accountTokenStore,
+		s.mailer,
+		s.loginSessionManager,
+		s.tokenIssuer,
+		s.loginThrottler,
+		baseURL,
+		s.config.GetEmailVerificationTTL(),
+		s.config.GetPasswordResetTTL(),
+	)
+
 	r.HandleFunc("/harakiri", func(w http.ResponseWriter, r *http.Request) {
+		principal := platform.PrincipalFromContext(r.Context())
+		if principal == nil {
+			platform.SendAPIErrorResp(w, "must be logged in", http.StatusUnauthorized)
+			return
+		}
+		if !principal.Can(platform.PermShutdown) {
+			platform.SendAPIErrorResp(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		log.Warnf("harakiri requested by [%s]", principal.Username)
 		chInterrupt <- platform.EmptySignal
 		platform.SendAPIOKResp(w, "Goodbye cruel world...")
-	})
+	}).Methods("POST")
 
-	usersService := services.NewUsersService(db, graphiteClient)
+	apiV1Router := r.PathPrefix(handlers.APIV1Prefix).Subrouter()
+	handlers.APIV1HandlerSetup(apiV1Router, usersService, s.accountService, s.loginThrottler, s.loginSessionManager, s.config.IsCookieSecure())
 
 	usersRouter := r.PathPrefix("/users").Subrouter()
 	spendingRouter := r.PathPrefix("/spending").Subrouter()
 	spendKindRouter := r.PathPrefix("/spending/kind").Subrouter()
 	debugRouter := r.PathPrefix("/debug").Subrouter()
-	handlers.UsersHandlerSetup(usersRouter, usersService, s.loginSessionManager)
-	handlers.SpendingHandlerSetup(spendingRouter, usersService, s.loginSessionManager)
-	handlers.SpendKindHandlerSetup(spendKindRouter, db, s.loginSessionManager)
+	handlers.UsersHandlerSetup(usersRouter, usersService, s.accountService, totpService, s.loginThrottler, s.loginSessionManager, s.config.IsCookieSecure())
+	handlers.TOTPHandlerSetup(usersRouter, totpService)
+	handlers.WebAuthnHandlerSetup(usersRouter, webAuthnService, s.loginSessionManager, s.config.IsCookieSecure())
+	handlers.SpendingHandlerSetup(spendingRouter, usersService)
+	handlers.SpendKindHandlerSetup(spendKindRouter, db)
 	handlers.DebugHandlerSetup(debugRouter, viewsMaker, s.logFile)
+	handlers.TokenHandlerSetup(r, usersService, totpService, s.loginThrottler, s.tokenIssuer)
+	handlers.GraphQLHandlerSetup(
+		r,
+		db,
+		usersService,
+		s.accountService,
+		s.loginThrottler,
+		s.loginSessionManager,
+		s.config.IsCookieSecure(),
+		s.config.GetGraphQLMaxComplexity(),
+		s.config.GetGraphQLMaxDepth(),
+	)
 
 	// all the rest - unknown paths
 	r.HandleFunc("/{unknown}", func(w http.ResponseWriter, r *http.Request) {
@@ -198,6 +520,10 @@ func (s *Server) routerSetup(db db.SpenderDB, graphiteClient *metrics.GraphiteCl
 
 	r.Use(s.getLoggingMiddleware(graphiteClient))
 	r.Use(s.getPanicRecoverMiddleware(graphiteClient))
+	r.Use(s.getRequestTimeoutMiddleware(s.config.GetRequestTimeout()))
+	r.Use(s.getAuthMiddleware(usersService))
+	// the older routes are kept for the web UI and the clients not moved on to /api/v1 yet
+	r.Use(handlers.DeprecateLegacyRoutes)
 
 	return r
 }
@@ -229,7 +555,12 @@ func (s *Server) Serve(port string) {
 		log.Debugln(http.ListenAndServe(pprofhost+":"+pprofport, nil))
 	}()
 
-	router := s.routerSetup(s.dbClient, s.graphiteClient, chInterrupt)
+	s.loginSessionManager.StartSweeper(s.config.GetSessionSweepInterval())
+	s.tokenIssuer.Start(s.config.GetKeyRotationInterval(), s.config.GetSessionSweepInterval())
+
+	router := s.routerSetup(s.dbClient, s.graphiteClient, chInterrupt, s.config.GetBaseURL(port))
+	s.accountService.StartSweeper(s.config.GetSessionSweepInterval())
+	s.loginThrottler.StartSweeper(s.config.GetSessionSweepInterval())
 
 	ipAndPort := fmt.Sprintf("%s:%s", platform.IPAddress, port)
 
@@ -242,7 +573,9 @@ func (s *Server) Serve(port string) {
 
 	go func() {
 		log.Infof(" > server listening on: [%s]", ipAndPort)
-		log.Fatal(httpServer.ListenAndServe())
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
 	select {
@@ -257,21 +590,27 @@ func (s *Server) Serve(port string) {
 func (s *Server) gracefulShutdown(httpServer *http.Server, dbClient db.SpenderDB) {
 	log.Debug("graceful shutdown initiated ...")
 
-	err := dbClient.Close()
-	if err != nil {
-		log.Warnf("failed to close postgres DB: " + err.Error())
-	} else {
-		log.Debug("postgres DB connection closed ...")
-	}
-
+	// stop serving first, so no request writes to the DB after it's closed (and possibly snapshotted)
 	maxWaitDuration := time.Second * 15
 	ctx, cancel := context.WithTimeout(context.Background(), maxWaitDuration)
 	defer cancel()
-	err = httpServer.Shutdown(ctx)
+	err := httpServer.Shutdown(ctx)
 	if err != nil {
 		log.Error(" >>> failed to gracefully shutdown")
 	}
 
+	s.loginSessionManager.StopSweeper()
+	s.tokenIssuer.Stop()
+	s.accountService.StopSweeper()
+	s.loginThrottler.StopSweeper()
+
+	err = dbClient.Close()
+	if err != nil {
+		log.Warnf("failed to close DB: %s", err)
+	} else {
+		log.Debug("DB connection closed ...")
+	}
+
 	log.Warn("server shut down")
 	os.Exit(0)
 }
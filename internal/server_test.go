@@ -0,0 +1,224 @@
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/2beens/ispend/internal"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+dbtype: mem
+graphite:
+  enabled: false
+sessions:
+  store: mem
+auth:
+  cookie_secure: false
+  password:
+    algorithm: argon2id
+    argon2:
+      memory: 64
+      iterations: 1
+      parallelism: 1
+    breached_passwords_file: cmd/breached-passwords.txt
+mail:
+  type: outbox
+admin:
+  username: ispend-admin
+`
+
+// secretJSONKeys are the fields no response may have, whatever their value
+var secretJSONKeys = map[string]bool{
+	"password":      true,
+	"password_hash": true,
+	"totp":          true,
+	"public_key":    true,
+}
+
+var routeVarRegex = regexp.MustCompile(`\{([^}:]+)(:[^}]+)?\}`)
+
+type routesTest struct {
+	router *mux.Router
+}
+
+func newRoutesTest(t *testing.T) (*routesTest, *internal.Server) {
+	// the views and the breached passwords are found from the repo root, as when the server runs
+	t.Chdir("..")
+	t.Setenv("ISPEND_ADMIN_PASSWORD", "adminpass123")
+
+	// the logs are served on /debug/logs, so they have to keep the secrets too
+	logFile := filepath.Join(t.TempDir(), "ispend.log")
+	file, err := os.Create(logFile)
+	require.NoError(t, err)
+	prevOutput, prevLevel := log.StandardLogger().Out, log.GetLevel()
+	log.SetOutput(file)
+	log.SetLevel(log.TraceLevel)
+	t.Cleanup(func() {
+		log.SetOutput(prevOutput)
+		log.SetLevel(prevLevel)
+		file.Close()
+	})
+
+	server, err := internal.NewServer([]byte(testConfig), logFile)
+	require.NoError(t, err)
+	router := server.RouterSetup(make(chan models.Signal, 1), "http://localhost:8080")
+	return &routesTest{router: router}, server
+}
+
+func (rt *routesTest) send(method, path string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+		if cookie.Name == platform.CSRFCookieName {
+			req.Header.Set(platform.CSRFHeaderName, cookie.Value)
+		}
+	}
+	rec := httptest.NewRecorder()
+	rt.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func (rt *routesTest) login(t *testing.T, username, password string) []*http.Cookie {
+	rec := rt.send("POST", "/users/login", url.Values{"username": {username}, "password": {password}}, nil)
+	require.Contains(t, rec.Body.String(), `"isError":false`)
+	return rec.Result().Cookies()
+}
+
+func TestRoutes_NoSecretsInResponses(t *testing.T) {
+	rt, server := newRoutesTest(t)
+
+	rec := rt.send("POST", "/users", url.Values{
+		"username": {"walker"},
+		"email":    {"walker@example.com"},
+		"password": {"walkerpass123"},
+	}, nil)
+	require.Contains(t, rec.Body.String(), `"isError":false`)
+	cookies := rt.login(t, "walker", "walkerpass123")
+	rec = rt.send("GET", "/spending/kind/walker", nil, cookies)
+	var spendKinds struct {
+		Data []models.SpendKindDTO `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &spendKinds))
+	require.NotEmpty(t, spendKinds.Data)
+	rec = rt.send("POST", "/spending", url.Values{
+		"currency": {"EUR"},
+		"amount":   {"12.5"},
+		"kind_id":  {strconv.Itoa(spendKinds.Data[0].ID)},
+	}, cookies)
+	var newSpending models.APIResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &newSpending))
+	require.False(t, newSpending.IsError, newSpending.Message)
+	spendID := newSpending.Data.(string)
+
+	users, err := server.DBClient().GetAllUsers(context.Background(), false)
+	require.NoError(t, err)
+	var passwordHashes []string
+	for _, user := range users {
+		// the debugging users have no real hashes
+		if strings.HasPrefix(user.Password, "$") {
+			passwordHashes = append(passwordHashes, user.Password)
+		}
+	}
+	require.Len(t, passwordHashes, 2)
+
+	// the user on its own data, and the admin on the user's data
+	principals := []struct {
+		username string
+		password string
+	}{
+		{"walker", "walkerpass123"},
+		{"ispend-admin", "adminpass123"},
+	}
+
+	requests := 0
+	err = rt.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET", "POST"}
+		}
+		path := routeVarRegex.ReplaceAllStringFunc(template, func(v string) string {
+			switch routeVarRegex.FindStringSubmatch(v)[1] {
+			case "username":
+				return "walker"
+			case "id", "spendID":
+				return spendID
+			default:
+				return "x"
+			}
+		})
+
+		for _, method := range methods {
+			for _, p := range principals {
+				// every request with a new session, in case the one before logged out
+				rec := rt.send(method, path, url.Values{}, rt.login(t, p.username, p.password))
+				requests++
+				body := rec.Body.String()
+				for _, hash := range passwordHashes {
+					assert.NotContains(t, body, hash, "%s %s as %s", method, path, p.username)
+				}
+				// the API document names the password fields of the requests, it has no values
+				if !strings.HasSuffix(path, "/openapi.json") {
+					assertNoSecretKeys(t, rec.Body.Bytes(), method+" "+path+" as "+p.username)
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Greater(t, requests, 50)
+}
+
+func assertNoSecretKeys(t *testing.T, body []byte, request string) {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		// a page or the logs, looked at by value only
+		return
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			for key, nested := range value {
+				assert.False(t, secretJSONKeys[strings.ToLower(key)], "%s: response has the secret field [%s]", request, key)
+				walk(nested)
+			}
+		case []interface{}:
+			for _, nested := range value {
+				walk(nested)
+			}
+		}
+	}
+	walk(data)
+}
+
+func TestUserJSON_NoPassword(t *testing.T) {
+	user := models.NewUser("user@example.com", "user", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5", nil)
+	user.TOTP.Secret = "JBSWY3DPEHPK3PXP"
+	data, err := json.Marshal(user)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), user.Password)
+	assert.NotContains(t, string(data), user.TOTP.Secret)
+	assertNoSecretKeys(t, data, "user")
+}
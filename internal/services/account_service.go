@@ -0,0 +1,391 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+// AccountService runs the flows where the user proves it owns its email address: the email verification
+// after registering, and the password reset. Both mail the user a single use token, which expires.
+// It also runs the changes of the account's credentials, and the deletion of the account.
+type AccountService struct {
+	usersService        *UsersService
+	tokens              platform.AccountTokenStore
+	mailer              platform.Mailer
+	loginSessionManager *platform.LoginSessionManager
+	tokenIssuer         *platform.TokenIssuer
+	loginThrottler      *LoginThrottler
+	// baseURL is where the links in the emails point to, e.g. https://ispend.de
+	baseURL         string
+	verificationTTL time.Duration
+	resetTTL        time.Duration
+	now             func() time.Time
+
+	chStopSweeper chan struct{}
+	sweeperWg     sync.WaitGroup
+}
+
+func NewAccountService(
+	usersService *UsersService,
+	tokens platform.AccountTokenStore,
+	mailer platform.Mailer,
+	loginSessionManager *platform.LoginSessionManager,
+	tokenIssuer *platform.TokenIssuer,
+	loginThrottler *LoginThrottler,
+	baseURL string,
+	verificationTTL, resetTTL time.Duration,
+) *AccountService {
+	return &AccountService{
+		usersService:        usersService,
+		tokens:              tokens,
+		mailer:              mailer,
+		loginSessionManager: loginSessionManager,
+		tokenIssuer:         tokenIssuer,
+		loginThrottler:      loginThrottler,
+		baseURL:             strings.TrimSuffix(baseURL, "/"),
+		verificationTTL:     verificationTTL,
+		resetTTL:            resetTTL,
+		now:                 time.Now,
+	}
+}
+
+// Register adds the new user, with the default spend kinds, and mails it the link verifying its email address;
+// returns platform.ErrAlreadyExists if the username or the email is taken, or the password policy error
+func (as *AccountService) Register(ctx context.Context, username, email, password string) (*models.User, error) {
+	if as.usersService.UserExists(username) {
+		return nil, platform.ErrAlreadyExists
+	}
+	passwordHash, err := as.usersService.HashNewPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	spendKinds, err := as.usersService.GetAllDefaultSpendKinds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user := models.NewUser(email, username, passwordHash, spendKinds)
+	if err := as.usersService.AddUser(ctx, user); err != nil {
+		return nil, err
+	}
+	log.Tracef("new user [%s] created", username)
+
+	// the user can ask for another one if this one gets lost
+	if err := as.SendVerificationEmail(ctx, username); err != nil {
+		log.Errorf("error sending the verification email to new user [%s]: %s", username, err)
+	}
+	return user, nil
+}
+
+// SendVerificationEmail mails the user a link verifying its email address; the links sent before stop working
+func (as *AccountService) SendVerificationEmail(ctx context.Context, username string) error {
+	user, err := as.usersService.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return platform.ErrEmailAlreadyVerified
+	}
+
+	token, err := as.newToken(ctx, platform.AccountTokenVerifyEmail, username, user.Email, as.verificationTTL)
+	if err != nil {
+		return err
+	}
+	return as.mailer.Send(ctx, platform.Email{
+		To:      user.Email,
+		Subject: "Verify your iSpend email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nplease verify your email address by opening this link:\n\n%s\n\nThe link expires in %s.\n",
+			username, as.link("/users/verify-email", token), as.verificationTTL,
+		),
+	})
+}
+
+// VerifyEmail marks the email address of the token's user verified, and returns the username;
+// returns platform.ErrInvalidToken for an unknown, used or expired token
+func (as *AccountService) VerifyEmail(ctx context.Context, token string) (string, error) {
+	accountToken, err := as.takeToken(ctx, platform.AccountTokenVerifyEmail, token)
+	if err != nil {
+		return "", err
+	}
+
+	user, err := as.usersService.GetUser(ctx, accountToken.Username)
+	if err == platform.ErrNotFound {
+		return "", platform.ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	// the token verifies only the address it was sent to
+	if user.Email != accountToken.Email {
+		return "", platform.ErrInvalidToken
+	}
+
+	if err := as.usersService.SetEmailVerified(ctx, user.Username, true); err != nil {
+		return "", err
+	}
+	return user.Username, nil
+}
+
+// RequestPasswordReset mails the user a link to set a new password. Nothing is sent for unknown users
+// and unverified addresses, and the caller tells nobody about it, so the users cannot be enumerated.
+func (as *AccountService) RequestPasswordReset(ctx context.Context, username string) error {
+	user, err := as.usersService.GetUser(ctx, username)
+	if err == platform.ErrNotFound {
+		log.Debugf("password reset requested for unknown user [%s]", username)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !user.EmailVerified {
+		log.Debugf("password reset requested for user [%s] without a verified email", username)
+		return nil
+	}
+
+	token, err := as.newToken(ctx, platform.AccountTokenResetPassword, username, user.Email, as.resetTTL)
+	if err != nil {
+		return err
+	}
+	return as.mailer.Send(ctx, platform.Email{
+		To:      user.Email,
+		Subject: "Reset your iSpend password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nsomeone asked to reset your password. If it was you, set a new one here:\n\n%s\n\n"+
+				"The link expires in %s. If it wasn't you, ignore this email, your password stays the same.\n",
+			username, as.link("/reset-password", token), as.resetTTL,
+		),
+	})
+}
+
+// ResetPassword sets the new password of the token's user, and logs the user out everywhere;
+// returns platform.ErrInvalidToken for an unknown, used or expired token, and the password policy
+// error for a password that cannot be chosen, or platform.ErrPasswordHasherBusy, without using up the token
+func (as *AccountService) ResetPassword(ctx context.Context, token, newPassword string) error {
+	passwordHash, err := as.usersService.HashNewPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	accountToken, err := as.takeToken(ctx, platform.AccountTokenResetPassword, token)
+	if err != nil {
+		return err
+	}
+
+	username := accountToken.Username
+	err = as.usersService.SetPassword(ctx, username, passwordHash)
+	if err == platform.ErrNotFound {
+		return platform.ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+
+	// whoever knew the old password must not stay logged in
+	if _, err := as.tokens.DeleteByUsername(ctx, username, platform.AccountTokenResetPassword); err != nil {
+		return err
+	}
+	if err := as.loginSessionManager.Remove(ctx, username); err != nil && err != platform.ErrNotFound {
+		return err
+	}
+	return as.tokenIssuer.RevokeUser(ctx, username)
+}
+
+// ChangeEmail sets the user's new email address once the password is confirmed, and mails the new address a
+// verification link; the old address gets a notice, and the password reset links sent to it stop working.
+// Returns platform.ErrWrongPassword for a wrong password, and platform.ErrAlreadyExists if another user has the address.
+func (as *AccountService) ChangeEmail(ctx context.Context, username, password, newEmail string) error {
+	user, err := as.usersService.Authenticate(ctx, username, password)
+	if err != nil {
+		return err
+	}
+	if user.Email == newEmail {
+		return nil
+	}
+
+	if err := as.usersService.SetEmail(ctx, username, newEmail); err != nil {
+		return err
+	}
+	if _, err := as.tokens.DeleteByUsername(ctx, username, platform.AccountTokenResetPassword); err != nil {
+		return err
+	}
+
+	// the owner of the old address learns about it, in case it was not them
+	err = as.mailer.Send(ctx, platform.Email{
+		To:      user.Email,
+		Subject: "Your iSpend email address was changed",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nthe email address of your iSpend account was changed to %s.\n\n"+
+				"If it wasn't you, reset your password and change the address back right away.\n",
+			username, newEmail,
+		),
+	})
+	if err != nil {
+		log.Errorf("change email [%s]: cannot notify the old address: %s", username, err)
+	}
+
+	return as.SendVerificationEmail(ctx, username)
+}
+
+// ChangePassword sets the user's new password once the old one is confirmed, and logs the user out everywhere
+// but in the session keepSessionID (empty for none), the one the password is changed from; the API tokens
+// are all revoked. Returns platform.ErrWrongPassword for a wrong old password, and the password policy error
+// for a new password that cannot be chosen.
+func (as *AccountService) ChangePassword(ctx context.Context, username, oldPassword, newPassword, keepSessionID string) error {
+	if err := as.usersService.CheckNewPassword(newPassword); err != nil {
+		return err
+	}
+	if _, err := as.usersService.Authenticate(ctx, username, oldPassword); err != nil {
+		return err
+	}
+
+	passwordHash, err := as.usersService.HashNewPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	if err := as.usersService.SetPassword(ctx, username, passwordHash); err != nil {
+		return err
+	}
+
+	// whoever knew the old password must not stay logged in
+	if _, err := as.tokens.DeleteByUsername(ctx, username, platform.AccountTokenResetPassword); err != nil {
+		return err
+	}
+	if _, err := as.loginSessionManager.RemoveOthers(ctx, username, keepSessionID); err != nil {
+		return err
+	}
+	return as.tokenIssuer.RevokeUser(ctx, username)
+}
+
+// DeleteAccount erases the user with all its data once the password is confirmed: the spends, spend kinds and
+// passkeys in the DB, and the sessions, API tokens, mailed tokens and failed logins in the auth stores, so
+// nothing of the user is left, and a new user of the same name starts from scratch.
+// Returns platform.ErrWrongPassword for a wrong password.
+func (as *AccountService) DeleteAccount(ctx context.Context, username, password string) error {
+	if _, err := as.usersService.Authenticate(ctx, username, password); err != nil {
+		return err
+	}
+	if err := as.usersService.DeleteUser(ctx, username); err != nil {
+		return err
+	}
+
+	if err := as.loginSessionManager.Remove(ctx, username); err != nil && err != platform.ErrNotFound {
+		return err
+	}
+	if err := as.tokenIssuer.RevokeUser(ctx, username); err != nil {
+		return err
+	}
+	for _, purpose := range []string{platform.AccountTokenVerifyEmail, platform.AccountTokenResetPassword} {
+		if _, err := as.tokens.DeleteByUsername(ctx, username, purpose); err != nil {
+			return err
+		}
+	}
+	if err := as.loginThrottler.Forget(ctx, username); err != nil {
+		return err
+	}
+
+	log.Infof("account service: deleted user [%s] with all its data", username)
+	return nil
+}
+
+// SweepExpired deletes all expired account tokens from the store
+func (as *AccountService) SweepExpired(ctx context.Context) (int, error) {
+	return as.tokens.DeleteExpired(ctx, as.now().UTC())
+}
+
+// StartSweeper sweeps the expired account tokens every interval, until StopSweeper is called
+func (as *AccountService) StartSweeper(interval time.Duration) {
+	as.chStopSweeper = make(chan struct{})
+	as.sweeperWg.Add(1)
+
+	go func() {
+		defer as.sweeperWg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := as.SweepExpired(context.Background())
+				if err != nil {
+					log.Errorf("account tokens sweeper error: %s", err)
+				} else if deleted > 0 {
+					log.Debugf("account tokens sweeper: deleted %d expired tokens", deleted)
+				}
+			case <-as.chStopSweeper:
+				return
+			}
+		}
+	}()
+}
+
+func (as *AccountService) StopSweeper() {
+	if as.chStopSweeper == nil {
+		return
+	}
+	close(as.chStopSweeper)
+	as.sweeperWg.Wait()
+	as.chStopSweeper = nil
+}
+
+// newToken makes a new token for the purpose, the user's older ones for the same purpose stop working
+func (as *AccountService) newToken(ctx context.Context, purpose, username, email string, ttl time.Duration) (string, error) {
+	token, err := platform.NewToken()
+	if err != nil {
+		return "", err
+	}
+	tokenHash, err := platform.HashToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := as.tokens.DeleteByUsername(ctx, username, purpose); err != nil {
+		return "", err
+	}
+	now := as.now().UTC()
+	err = as.tokens.Save(ctx, &platform.AccountToken{
+		TokenHash: tokenHash,
+		Purpose:   purpose,
+		Username:  username,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// takeToken uses up the token, and returns it if it's made for the purpose and not expired
+func (as *AccountService) takeToken(ctx context.Context, purpose, token string) (*platform.AccountToken, error) {
+	tokenHash, err := platform.HashToken(token)
+	if err != nil {
+		return nil, platform.ErrInvalidToken
+	}
+	accountToken, err := as.tokens.Take(ctx, tokenHash)
+	if err == platform.ErrNotFound {
+		return nil, platform.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !platform.TokenMatchesHash(token, accountToken.TokenHash) ||
+		accountToken.Purpose != purpose ||
+		accountToken.IsExpired(as.now()) {
+		return nil, platform.ErrInvalidToken
+	}
+	return accountToken, nil
+}
+
+func (as *AccountService) link(path, token string) string {
+	return as.baseURL + path + "?token=" + url.QueryEscape(token)
+}
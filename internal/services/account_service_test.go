@@ -0,0 +1,342 @@
+package services_test
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/metrics"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testMailer struct {
+	mu     sync.Mutex
+	emails []platform.Email
+}
+
+func (m *testMailer) Send(ctx context.Context, email platform.Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emails = append(m.emails, email)
+	return nil
+}
+
+var tokenLinkRegex = regexp.MustCompile(`\?token=(\S+)`)
+
+// lastToken returns the token from the link in the last email sent
+func (m *testMailer) lastToken(t *testing.T) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.NotEmpty(t, m.emails)
+	match := tokenLinkRegex.FindStringSubmatch(m.emails[len(m.emails)-1].Body)
+	require.Len(t, match, 2)
+	token, err := url.QueryUnescape(match[1])
+	require.NoError(t, err)
+	return token
+}
+
+func (m *testMailer) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.emails)
+}
+
+type accountServiceTest struct {
+	usersService        *services.UsersService
+	accountService      *services.AccountService
+	mailer              *testMailer
+	loginSessionManager *platform.LoginSessionManager
+	tokenIssuer         *platform.TokenIssuer
+	accountTokens       *platform.MemoryAccountTokenStore
+	loginAttempts       *platform.MemoryLoginAttemptStore
+	loginThrottler      *services.LoginThrottler
+}
+
+func newAccountServiceTest(t *testing.T) *accountServiceTest {
+	usersService := getUserServiceTest()
+	mailer := &testMailer{}
+	loginSessionManager := platform.NewLoginSessionManager(platform.NewMemorySessionStore(), platform.DefaultSessionIdleTTL, platform.DefaultSessionAbsoluteTTL)
+	tokenIssuer, err := platform.NewTokenIssuer("ispend", platform.NewMemoryRefreshTokenStore(), platform.DefaultAccessTokenTTL, platform.DefaultRefreshTokenTTL)
+	require.NoError(t, err)
+	accountTokens := platform.NewMemoryAccountTokenStore()
+	loginAttempts := platform.NewMemoryLoginAttemptStore()
+	loginThrottler := services.NewLoginThrottler(
+		loginAttempts,
+		metrics.NewGraphiteNop("test.graphite.host", 1000),
+		services.DefaultUsernameThrottlePolicy,
+		services.DefaultIPThrottlePolicy,
+	)
+
+	accountService := services.NewAccountService(
+		usersService,
+		accountTokens,
+		mailer,
+		loginSessionManager,
+		tokenIssuer,
+		loginThrottler,
+		"https://ispend.test/",
+		platform.DefaultEmailVerificationTTL,
+		platform.DefaultPasswordResetTTL,
+	)
+
+	passwordHash, err := usersService.HashNewPassword("oldpass123")
+	require.NoError(t, err)
+	require.NoError(t, usersService.AddUser(context.Background(), models.NewUser("user1@example.com", "user1", passwordHash, nil)))
+
+	return &accountServiceTest{
+		usersService:        usersService,
+		accountService:      accountService,
+		mailer:              mailer,
+		loginSessionManager: loginSessionManager,
+		tokenIssuer:         tokenIssuer,
+		accountTokens:       accountTokens,
+		loginAttempts:       loginAttempts,
+		loginThrottler:      loginThrottler,
+	}
+}
+
+func TestAccountService_VerifyEmail(t *testing.T) {
+	ast := newAccountServiceTest(t)
+	ctx := context.Background()
+
+	require.NoError(t, ast.accountService.SendVerificationEmail(ctx, "user1"))
+	require.Equal(t, 1, ast.mailer.count())
+	assert.Equal(t, "user1@example.com", ast.mailer.emails[0].To)
+	assert.Contains(t, ast.mailer.emails[0].Body, "https://ispend.test/users/verify-email?token=")
+	token := ast.mailer.lastToken(t)
+
+	username, err := ast.accountService.VerifyEmail(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", username)
+	user, err := ast.usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.True(t, user.EmailVerified)
+
+	// single use
+	_, err = ast.accountService.VerifyEmail(ctx, token)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	assert.Equal(t, platform.ErrEmailAlreadyVerified, ast.accountService.SendVerificationEmail(ctx, "user1"))
+	assert.Equal(t, platform.ErrNotFound, ast.accountService.SendVerificationEmail(ctx, "nobody"))
+}
+
+func TestAccountService_VerifyEmail_InvalidTokens(t *testing.T) {
+	ast := newAccountServiceTest(t)
+	ctx := context.Background()
+
+	_, err := ast.accountService.VerifyEmail(ctx, "not-a-token")
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	// a new email makes the old link stop working
+	require.NoError(t, ast.accountService.SendVerificationEmail(ctx, "user1"))
+	oldToken := ast.mailer.lastToken(t)
+	require.NoError(t, ast.accountService.SendVerificationEmail(ctx, "user1"))
+	newToken := ast.mailer.lastToken(t)
+	_, err = ast.accountService.VerifyEmail(ctx, oldToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	// expired
+	ast.accountService.SetNow(func() time.Time {
+		return time.Now().Add(platform.DefaultEmailVerificationTTL + time.Minute)
+	})
+	_, err = ast.accountService.VerifyEmail(ctx, newToken)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+	user, err := ast.usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.False(t, user.EmailVerified)
+
+	deleted, err := ast.accountService.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func TestAccountService_ResetPassword(t *testing.T) {
+	ast := newAccountServiceTest(t)
+	ctx := context.Background()
+
+	// nothing is sent for unknown users and unverified emails
+	require.NoError(t, ast.accountService.RequestPasswordReset(ctx, "nobody"))
+	require.NoError(t, ast.accountService.RequestPasswordReset(ctx, "user1"))
+	assert.Equal(t, 0, ast.mailer.count())
+
+	require.NoError(t, ast.usersService.SetEmailVerified(ctx, "user1", true))
+	sessionID, err := ast.loginSessionManager.New(ctx, "user1", platform.LoginDevice{})
+	require.NoError(t, err)
+	tokenPair, err := ast.tokenIssuer.Issue(ctx, "user1")
+	require.NoError(t, err)
+
+	require.NoError(t, ast.accountService.RequestPasswordReset(ctx, "user1"))
+	require.Equal(t, 1, ast.mailer.count())
+	assert.Contains(t, ast.mailer.emails[0].Body, "https://ispend.test/reset-password?token=")
+	token := ast.mailer.lastToken(t)
+
+	// a reset token does not verify emails
+	_, err = ast.accountService.VerifyEmail(ctx, token)
+	assert.Equal(t, platform.ErrInvalidToken, err)
+
+	require.NoError(t, ast.accountService.RequestPasswordReset(ctx, "user1"))
+	token = ast.mailer.lastToken(t)
+	// make sure the access token was issued in an earlier second than the revocation
+	time.Sleep(time.Second)
+	require.NoError(t, ast.accountService.ResetPassword(ctx, token, "newpass123"))
+
+	_, err = ast.usersService.Authenticate(ctx, "user1", "oldpass123")
+	assert.Equal(t, platform.ErrWrongPassword, err)
+	_, err = ast.usersService.Authenticate(ctx, "user1", "newpass123")
+	assert.NoError(t, err)
+
+	// logged out everywhere
+	assert.False(t, ast.loginSessionManager.IsUserLoggedIn(ctx, sessionID, "user1"))
+	_, err = ast.tokenIssuer.Verify(tokenPair.AccessToken)
+	assert.Error(t, err)
+	_, err = ast.tokenIssuer.Refresh(ctx, tokenPair.RefreshToken)
+	assert.Error(t, err)
+
+	// single use
+	assert.Equal(t, platform.ErrInvalidToken, ast.accountService.ResetPassword(ctx, token, "otherpass123"))
+}
+
+func TestAccountService_ResetPassword_PasswordPolicy(t *testing.T) {
+	ast := newAccountServiceTest(t)
+	ctx := context.Background()
+
+	require.NoError(t, ast.usersService.SetEmailVerified(ctx, "user1", true))
+	require.NoError(t, ast.accountService.RequestPasswordReset(ctx, "user1"))
+	token := ast.mailer.lastToken(t)
+
+	assert.Equal(t, platform.ErrPasswordTooShort, ast.accountService.ResetPassword(ctx, token, "short"))
+	assert.Equal(t, platform.ErrPasswordBreached, ast.accountService.ResetPassword(ctx, token, "password123"))
+	_, err := ast.usersService.Authenticate(ctx, "user1", "oldpass123")
+	assert.NoError(t, err)
+
+	// a rejected password does not use up the link
+	require.NoError(t, ast.accountService.ResetPassword(ctx, token, "newpass123"))
+	_, err = ast.usersService.Authenticate(ctx, "user1", "newpass123")
+	assert.NoError(t, err)
+}
+
+func TestAccountService_ChangeEmail(t *testing.T) {
+	ast := newAccountServiceTest(t)
+	ctx := context.Background()
+
+	require.NoError(t, ast.usersService.SetEmailVerified(ctx, "user1", true))
+	require.NoError(t, ast.accountService.RequestPasswordReset(ctx, "user1"))
+	resetToken := ast.mailer.lastToken(t)
+
+	assert.Equal(t, platform.ErrWrongPassword, ast.accountService.ChangeEmail(ctx, "user1", "wrongpass", "new@example.com"))
+	// lazar from the debugging data has it already
+	assert.Equal(t, platform.ErrAlreadyExists, ast.accountService.ChangeEmail(ctx, "user1", "oldpass123", "lazar@serjspends.de"))
+	assert.Equal(t, 1, ast.mailer.count())
+
+	require.NoError(t, ast.accountService.ChangeEmail(ctx, "user1", "oldpass123", "new@example.com"))
+	user, err := ast.usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, "new@example.com", user.Email)
+	assert.False(t, user.EmailVerified)
+
+	// a notice to the old address, and the verification link to the new one
+	require.Equal(t, 3, ast.mailer.count())
+	assert.Equal(t, "user1@example.com", ast.mailer.emails[1].To)
+	assert.Contains(t, ast.mailer.emails[1].Body, "new@example.com")
+	assert.Equal(t, "new@example.com", ast.mailer.emails[2].To)
+	username, err := ast.accountService.VerifyEmail(ctx, ast.mailer.lastToken(t))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", username)
+	user, err = ast.usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.True(t, user.EmailVerified)
+
+	// the reset link sent to the old address stopped working
+	assert.Equal(t, platform.ErrInvalidToken, ast.accountService.ResetPassword(ctx, resetToken, "newpass123"))
+
+	// the same address again changes nothing
+	require.NoError(t, ast.accountService.ChangeEmail(ctx, "user1", "oldpass123", "new@example.com"))
+	assert.Equal(t, 3, ast.mailer.count())
+}
+
+func TestAccountService_ChangePassword(t *testing.T) {
+	ast := newAccountServiceTest(t)
+	ctx := context.Background()
+
+	currentSessionID, err := ast.loginSessionManager.New(ctx, "user1", platform.LoginDevice{})
+	require.NoError(t, err)
+	otherSessionID, err := ast.loginSessionManager.New(ctx, "user1", platform.LoginDevice{})
+	require.NoError(t, err)
+	tokenPair, err := ast.tokenIssuer.Issue(ctx, "user1")
+	require.NoError(t, err)
+
+	assert.Equal(t, platform.ErrWrongPassword, ast.accountService.ChangePassword(ctx, "user1", "wrongpass", "newpass123", currentSessionID))
+	assert.Equal(t, platform.ErrPasswordTooShort, ast.accountService.ChangePassword(ctx, "user1", "oldpass123", "short", currentSessionID))
+	assert.Equal(t, platform.ErrPasswordBreached, ast.accountService.ChangePassword(ctx, "user1", "oldpass123", "password123", currentSessionID))
+	assert.True(t, ast.loginSessionManager.IsUserLoggedIn(ctx, otherSessionID, "user1"))
+
+	// make sure the access token was issued in an earlier second than the revocation
+	time.Sleep(time.Second)
+	require.NoError(t, ast.accountService.ChangePassword(ctx, "user1", "oldpass123", "newpass123", currentSessionID))
+	_, err = ast.usersService.Authenticate(ctx, "user1", "oldpass123")
+	assert.Equal(t, platform.ErrWrongPassword, err)
+	_, err = ast.usersService.Authenticate(ctx, "user1", "newpass123")
+	assert.NoError(t, err)
+
+	// only the session the password was changed from stays
+	assert.True(t, ast.loginSessionManager.IsUserLoggedIn(ctx, currentSessionID, "user1"))
+	assert.False(t, ast.loginSessionManager.IsUserLoggedIn(ctx, otherSessionID, "user1"))
+	_, err = ast.tokenIssuer.Verify(tokenPair.AccessToken)
+	assert.Error(t, err)
+	_, err = ast.tokenIssuer.Refresh(ctx, tokenPair.RefreshToken)
+	assert.Error(t, err)
+}
+
+func TestAccountService_DeleteAccount(t *testing.T) {
+	ast := newAccountServiceTest(t)
+	ctx := context.Background()
+
+	sessionID, err := ast.loginSessionManager.New(ctx, "user1", platform.LoginDevice{})
+	require.NoError(t, err)
+	tokenPair, err := ast.tokenIssuer.Issue(ctx, "user1")
+	require.NoError(t, err)
+	require.NoError(t, ast.accountService.SendVerificationEmail(ctx, "user1"))
+	verificationToken := ast.mailer.lastToken(t)
+	require.NoError(t, ast.loginThrottler.Failed(ctx, "user1", "10.0.0.1"))
+
+	assert.Equal(t, platform.ErrWrongPassword, ast.accountService.DeleteAccount(ctx, "user1", "wrongpass"))
+	assert.True(t, ast.usersService.UserExists("user1"))
+
+	time.Sleep(time.Second)
+	require.NoError(t, ast.accountService.DeleteAccount(ctx, "user1", "oldpass123"))
+	assert.False(t, ast.usersService.UserExists("user1"))
+	_, err = ast.usersService.GetUser(ctx, "user1")
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = ast.usersService.GetRole("user1")
+	assert.Equal(t, platform.ErrNotFound, err)
+
+	// nothing of the user is left in the auth stores
+	assert.False(t, ast.loginSessionManager.IsUserLoggedIn(ctx, sessionID, "user1"))
+	_, err = ast.tokenIssuer.Verify(tokenPair.AccessToken)
+	assert.Error(t, err)
+	_, err = ast.tokenIssuer.Refresh(ctx, tokenPair.RefreshToken)
+	assert.Error(t, err)
+	tokenHash, err := platform.HashToken(verificationToken)
+	require.NoError(t, err)
+	_, err = ast.accountTokens.Take(ctx, tokenHash)
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = ast.loginAttempts.Get(ctx, "user:user1")
+	assert.Equal(t, platform.ErrNotFound, err)
+
+	assert.Equal(t, platform.ErrNotFound, ast.accountService.DeleteAccount(ctx, "user1", "oldpass123"))
+
+	// the name can be registered again, from scratch
+	passwordHash, err := ast.usersService.HashNewPassword("otherpass123")
+	require.NoError(t, err)
+	require.NoError(t, ast.usersService.AddUser(ctx, models.NewUser("other@example.com", "user1", passwordHash, nil)))
+	user, err := ast.usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Empty(t, user.Spends)
+}
@@ -0,0 +1,23 @@
+package services
+
+import "time"
+
+// SetNow replaces the clock of the service, so the tests can travel in time
+func (as *AccountService) SetNow(now func() time.Time) {
+	as.now = now
+}
+
+// SetNow replaces the clock of the service, so the tests can travel in time
+func (ts *TOTPService) SetNow(now func() time.Time) {
+	ts.now = now
+}
+
+// SetNow replaces the clock of the service, so the tests can travel in time
+func (ws *WebAuthnService) SetNow(now func() time.Time) {
+	ws.now = now
+}
+
+// SetNow replaces the clock of the throttler, so the tests can travel in time
+func (lt *LoginThrottler) SetNow(now func() time.Time) {
+	lt.now = now
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/2beens/ispend/internal/metrics"
+	"github.com/2beens/ispend/internal/platform"
+	log "github.com/sirupsen/logrus"
+)
+
+// LoginThrottlePolicy says how long the logins of a subject wait after its failed logins in a row
+type LoginThrottlePolicy struct {
+	// FreeFailures is how many failures go without any wait
+	FreeFailures int
+	// BaseDelay is the wait after the first failure past the free ones, doubling with every next one up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutThreshold failures lock the subject out for the LockoutDuration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// FailureTTL is how long the failures are remembered after the last one
+	FailureTTL time.Duration
+}
+
+// Delay returns how long the next login waits after the given count of failures
+func (p LoginThrottlePolicy) Delay(failures int) time.Duration {
+	if p.LockoutThreshold > 0 && failures >= p.LockoutThreshold {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeFailures {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeFailures + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// DefaultUsernameThrottlePolicy lets a user mistype the password a few times, and locks the
+// account out for a while after ten failures, so a password can be guessed only very slowly
+var DefaultUsernameThrottlePolicy = LoginThrottlePolicy{
+	FreeFailures:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	FailureTTL:       time.Hour,
+}
+
+// DefaultIPThrottlePolicy is looser, many users can share an IP address; it stops a single
+// client from guessing the passwords of many users
+var DefaultIPThrottlePolicy = LoginThrottlePolicy{
+	FreeFailures:     20,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 100,
+	LockoutDuration:  15 * time.Minute,
+	FailureTTL:       time.Hour,
+}
+
+// LoginThrottler slows down the password guessing, per username and per IP address. It is asked before
+// the password is checked, so the throttled logins don't cost the password hashing either.
+type LoginThrottler struct {
+	store          platform.LoginAttemptStore
+	graphite       *metrics.GraphiteClient
+	usernamePolicy LoginThrottlePolicy
+	ipPolicy       LoginThrottlePolicy
+
+	chStopSweeper chan struct{}
+	sweeperWg     sync.WaitGroup
+	now           func() time.Time
+}
+
+func NewLoginThrottler(store platform.LoginAttemptStore, graphite *metrics.GraphiteClient, usernamePolicy, ipPolicy LoginThrottlePolicy) *LoginThrottler {
+	return &LoginThrottler{
+		store:          store,
+		graphite:       graphite,
+		usernamePolicy: usernamePolicy,
+		ipPolicy:       ipPolicy,
+		now:            time.Now,
+	}
+}
+
+func usernameSubject(username string) string {
+	return "user:" + username
+}
+
+func ipSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns how long the login of the user from the IP address has to wait, 0 if it can go on now
+func (lt *LoginThrottler) Check(ctx context.Context, username, ip string) (time.Duration, error) {
+	now := lt.now()
+	userWait, err := lt.wait(ctx, usernameSubject(username), lt.usernamePolicy, now)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := lt.wait(ctx, ipSubject(ip), lt.ipPolicy, now)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := userWait
+	if ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		lt.graphite.SimpleSendInt("login.throttled", 1)
+	}
+	return wait, nil
+}
+
+func (lt *LoginThrottler) wait(ctx context.Context, subject string, policy LoginThrottlePolicy, now time.Time) (time.Duration, error) {
+	failures, err := lt.store.Get(ctx, subject)
+	if err == platform.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if failures.IsExpired(now) {
+		return 0, nil
+	}
+	wait := failures.LastFailedAt.Add(policy.Delay(failures.Count)).Sub(now)
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// Failed counts the failed login, a wrong password or a wrong two-factor code, of the user from the IP address
+func (lt *LoginThrottler) Failed(ctx context.Context, username, ip string) error {
+	now := lt.now()
+	lt.graphite.SimpleSendInt("login.failures", 1)
+
+	userFailures, err := lt.store.AddFailure(ctx, usernameSubject(username), now, lt.usernamePolicy.FailureTTL)
+	if err != nil {
+		return err
+	}
+	if userFailures.Count == lt.usernamePolicy.LockoutThreshold {
+		log.Warnf("login throttler: user [%s] locked out after %d failed logins, the last one from [%s]", username, userFailures.Count, ip)
+		lt.graphite.SimpleSendInt("login.lockouts.user", 1)
+	}
+
+	ipFailures, err := lt.store.AddFailure(ctx, ipSubject(ip), now, lt.ipPolicy.FailureTTL)
+	if err != nil {
+		return err
+	}
+	if ipFailures.Count == lt.ipPolicy.LockoutThreshold {
+		log.Warnf("login throttler: IP address [%s] locked out after %d failed logins", ip, ipFailures.Count)
+		lt.graphite.SimpleSendInt("login.lockouts.ip", 1)
+	}
+	return nil
+}
+
+// Succeeded forgets the user's failures; the IP address's are kept, or a client could
+// clear them by logging into its own account between the guesses
+func (lt *LoginThrottler) Succeeded(ctx context.Context, username string) error {
+	lt.graphite.SimpleSendInt("login.successes", 1)
+	return lt.store.Reset(ctx, usernameSubject(username))
+}
+
+// Forget forgets the user's failures without counting a login, e.g. when the user is deleted
+func (lt *LoginThrottler) Forget(ctx context.Context, username string) error {
+	return lt.store.Reset(ctx, usernameSubject(username))
+}
+
+// SweepExpired deletes all expired failures from the store
+func (lt *LoginThrottler) SweepExpired(ctx context.Context) (int, error) {
+	return lt.store.DeleteExpired(ctx, lt.now().UTC())
+}
+
+// StartSweeper sweeps the expired failures every interval, until StopSweeper is called
+func (lt *LoginThrottler) StartSweeper(interval time.Duration) {
+	lt.chStopSweeper = make(chan struct{})
+	lt.sweeperWg.Add(1)
+
+	go func() {
+		defer lt.sweeperWg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := lt.SweepExpired(context.Background())
+				if err != nil {
+					log.Errorf("login failures sweeper error: %s", err)
+				} else if deleted > 0 {
+					log.Debugf("login failures sweeper: deleted %d expired failures", deleted)
+				}
+			case <-lt.chStopSweeper:
+				return
+			}
+		}
+	}()
+}
+
+func (lt *LoginThrottler) StopSweeper() {
+	if lt.chStopSweeper == nil {
+		return
+	}
+	close(lt.chStopSweeper)
+	lt.sweeperWg.Wait()
+	lt.chStopSweeper = nil
+}
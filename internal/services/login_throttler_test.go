@@ -0,0 +1,153 @@
+package services_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/metrics"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testThrottlePolicy = services.LoginThrottlePolicy{
+	FreeFailures:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         10 * time.Second,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	FailureTTL:       time.Hour,
+}
+
+func newLoginThrottlerTest(ipPolicy services.LoginThrottlePolicy) (*services.LoginThrottler, *time.Time) {
+	throttler := services.NewLoginThrottler(
+		platform.NewMemoryLoginAttemptStore(),
+		metrics.NewGraphiteNop("test.graphite.host", 1000),
+		testThrottlePolicy,
+		ipPolicy,
+	)
+	now := time.Now()
+	throttler.SetNow(func() time.Time { return now })
+	return throttler, &now
+}
+
+func TestLoginThrottlePolicy_Delay(t *testing.T) {
+	for _, tc := range []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{9, 10 * time.Second},
+		{10, 15 * time.Minute},
+		{1000, 15 * time.Minute},
+	} {
+		assert.Equal(t, tc.delay, testThrottlePolicy.Delay(tc.failures), "failures: %d", tc.failures)
+	}
+}
+
+func TestLoginThrottler_BackoffAndLockout(t *testing.T) {
+	throttler, now := newLoginThrottlerTest(services.DefaultIPThrottlePolicy)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, throttler.Failed(ctx, "user1", "10.0.0.1"))
+	}
+	wait, err := throttler.Check(ctx, "user1", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait, "the first failures are free")
+
+	require.NoError(t, throttler.Failed(ctx, "user1", "10.0.0.1"))
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, wait)
+
+	// the user is throttled from any IP address, the other users are not
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, wait)
+	wait, err = throttler.Check(ctx, "user2", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	*now = now.Add(time.Second)
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, throttler.Failed(ctx, "user1", "10.0.0.1"))
+	}
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, wait, "locked out")
+
+	*now = now.Add(15 * time.Minute)
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// the failures are remembered, the next one locks the user out again
+	require.NoError(t, throttler.Failed(ctx, "user1", "10.0.0.1"))
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, wait)
+
+	// until they expire
+	*now = now.Add(time.Hour)
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+	require.NoError(t, throttler.Failed(ctx, "user1", "10.0.0.1"))
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestLoginThrottler_SuccessForgetsUserFailures(t *testing.T) {
+	ipPolicy := testThrottlePolicy
+	ipPolicy.FreeFailures = 5
+	throttler, _ := newLoginThrottlerTest(ipPolicy)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, throttler.Failed(ctx, "user1", "10.0.0.1"))
+	}
+	wait, err := throttler.Check(ctx, "user1", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, wait)
+
+	require.NoError(t, throttler.Succeeded(ctx, "user1"))
+	wait, err = throttler.Check(ctx, "user1", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// the IP address's failures stay
+	require.NoError(t, throttler.Failed(ctx, "user2", "10.0.0.1"))
+	wait, err = throttler.Check(ctx, "user3", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, wait)
+}
+
+func TestLoginThrottler_SweepExpired(t *testing.T) {
+	store := platform.NewMemoryLoginAttemptStore()
+	throttler := services.NewLoginThrottler(store, metrics.NewGraphiteNop("test.graphite.host", 1000), testThrottlePolicy, testThrottlePolicy)
+	now := time.Now()
+	throttler.SetNow(func() time.Time { return now })
+	ctx := context.Background()
+
+	require.NoError(t, throttler.Failed(ctx, "user1", "10.0.0.1"))
+	now = now.Add(2 * time.Hour)
+	deleted, err := throttler.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	_, err = store.Get(ctx, "user:user1")
+	assert.Equal(t, platform.ErrNotFound, err)
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+)
+
+// TOTPQRCodeSize is the width and height of the enrollment QR code PNG, in pixels
+const TOTPQRCodeSize = 256
+
+// TOTPEnrollment is what the user needs to add the account to an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPStatus tells the user how its two-factor authentication is set up, without any secrets
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// TOTPService runs the two-factor authentication with time based one time passwords. The user enrolls
+// first, getting a new secret, and enables it only after proving the authenticator app got it right.
+type TOTPService struct {
+	usersService *UsersService
+	// issuer is the name the authenticator apps show next to the codes
+	issuer string
+	// mutex makes the reads and writes of the users' TOTP state atomic, so a code cannot be used twice
+	mutex sync.Mutex
+	now   func() time.Time
+}
+
+func NewTOTPService(usersService *UsersService, issuer string) *TOTPService {
+	return &TOTPService{
+		usersService: usersService,
+		issuer:       issuer,
+		now:          time.Now,
+	}
+}
+
+func (ts *TOTPService) Status(ctx context.Context, username string) (*TOTPStatus, error) {
+	user, err := ts.usersService.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPStatus{
+		Enabled:           user.TOTP.Enabled,
+		RecoveryCodesLeft: len(user.TOTP.RecoveryCodes),
+	}, nil
+}
+
+// Enroll gives the user a new secret, which replaces any not enabled one from before
+func (ts *TOTPService) Enroll(ctx context.Context, username string) (*TOTPEnrollment, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	user, err := ts.usersService.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTP.Enabled {
+		return nil, platform.ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := platform.NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := ts.usersService.SetTOTP(ctx, username, models.TOTP{Secret: secret}); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    platform.TOTPURI(ts.issuer, username, secret),
+	}, nil
+}
+
+// QRCode returns the PNG of the enrollment QR code; once enabled, the secret is not shown anymore
+func (ts *TOTPService) QRCode(ctx context.Context, username string) ([]byte, error) {
+	user, err := ts.usersService.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTP.Enabled {
+		return nil, platform.ErrTOTPAlreadyEnabled
+	}
+	if user.TOTP.Secret == "" {
+		return nil, platform.ErrTOTPNotEnrolled
+	}
+	return platform.TOTPQRCode(platform.TOTPURI(ts.issuer, username, user.TOTP.Secret), TOTPQRCodeSize)
+}
+
+// Enable turns the enrolled two-factor authentication on if the code is right,
+// and returns the recovery codes, the only time they can be seen
+func (ts *TOTPService) Enable(ctx context.Context, username, code string) ([]string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	user, err := ts.usersService.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTP.Enabled {
+		return nil, platform.ErrTOTPAlreadyEnabled
+	}
+	if user.TOTP.Secret == "" {
+		return nil, platform.ErrTOTPNotEnrolled
+	}
+	step, ok := platform.ValidateTOTP(user.TOTP.Secret, code, ts.now(), user.TOTP.LastUsedStep)
+	if !ok {
+		return nil, platform.ErrWrongTOTPCode
+	}
+
+	recoveryCodes, hashes, err := platform.NewRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = ts.usersService.SetTOTP(ctx, username, models.TOTP{
+		Secret:        user.TOTP.Secret,
+		Enabled:       true,
+		RecoveryCodes: hashes,
+		LastUsedStep:  step,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// Disable turns the two-factor authentication off, with a code from the app or a recovery code
+func (ts *TOTPService) Disable(ctx context.Context, username, code string) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	user, err := ts.usersService.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if !user.TOTP.Enabled {
+		return platform.ErrTOTPNotEnabled
+	}
+	if _, ok := ts.check(user.TOTP, code); !ok {
+		return platform.ErrWrongTOTPCode
+	}
+	return ts.usersService.SetTOTP(ctx, username, models.TOTP{})
+}
+
+// RegenerateRecoveryCodes replaces all the recovery codes with new ones, if the code from the app is right
+func (ts *TOTPService) RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	user, err := ts.usersService.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTP.Enabled {
+		return nil, platform.ErrTOTPNotEnabled
+	}
+	step, ok := platform.ValidateTOTP(user.TOTP.Secret, code, ts.now(), user.TOTP.LastUsedStep)
+	if !ok {
+		return nil, platform.ErrWrongTOTPCode
+	}
+
+	recoveryCodes, hashes, err := platform.NewRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	totp := user.TOTP
+	totp.RecoveryCodes = hashes
+	totp.LastUsedStep = step
+	if err := ts.usersService.SetTOTP(ctx, username, totp); err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// Verify checks the second factor at login, which is either a code from the app or a recovery code;
+// both work only once. Returns platform.ErrTOTPRequired if there's no code but the user needs one,
+// and nil for the users without two-factor authentication.
+func (ts *TOTPService) Verify(ctx context.Context, username, code string) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	user, err := ts.usersService.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if !user.TOTP.Enabled {
+		return nil
+	}
+	if code == "" {
+		return platform.ErrTOTPRequired
+	}
+	totp, ok := ts.check(user.TOTP, code)
+	if !ok {
+		return platform.ErrWrongTOTPCode
+	}
+	return ts.usersService.SetTOTP(ctx, username, totp)
+}
+
+// check tells if the code from the app or the recovery code is right, and returns the TOTP state having it used up
+func (ts *TOTPService) check(totp models.TOTP, code string) (models.TOTP, bool) {
+	if step, ok := platform.ValidateTOTP(totp.Secret, code, ts.now(), totp.LastUsedStep); ok {
+		totp.LastUsedStep = step
+		return totp, true
+	}
+
+	index := platform.MatchRecoveryCode(code, totp.RecoveryCodes)
+	if index < 0 {
+		return totp, false
+	}
+	recoveryCodes := make([]string, 0, len(totp.RecoveryCodes)-1)
+	recoveryCodes = append(recoveryCodes, totp.RecoveryCodes[:index]...)
+	totp.RecoveryCodes = append(recoveryCodes, totp.RecoveryCodes[index+1:]...)
+	return totp, true
+}
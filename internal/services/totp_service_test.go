@@ -0,0 +1,143 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTOTPServiceTest(t *testing.T) (*services.TOTPService, *time.Time) {
+	usersService := getUserServiceTest()
+	require.NoError(t, usersService.AddUser(context.Background(), models.NewUser("user1@example.com", "user1", "hash", nil)))
+
+	now := time.Now()
+	totpService := services.NewTOTPService(usersService, "iSpend")
+	totpService.SetNow(func() time.Time { return now })
+	return totpService, &now
+}
+
+func totpCode(t *testing.T, secret string, now time.Time) string {
+	code, err := platform.TOTPCode(secret, platform.TOTPStep(now))
+	require.NoError(t, err)
+	return code
+}
+
+// enableTOTP enrolls and enables the user, and returns the secret and the recovery codes
+func enableTOTP(t *testing.T, totpService *services.TOTPService, now time.Time) (string, []string) {
+	enrollment, err := totpService.Enroll(context.Background(), "user1")
+	require.NoError(t, err)
+	recoveryCodes, err := totpService.Enable(context.Background(), "user1", totpCode(t, enrollment.Secret, now))
+	require.NoError(t, err)
+	return enrollment.Secret, recoveryCodes
+}
+
+func TestTOTPService_Enrollment(t *testing.T) {
+	totpService, now := newTOTPServiceTest(t)
+	ctx := context.Background()
+
+	_, err := totpService.QRCode(ctx, "user1")
+	assert.Equal(t, platform.ErrTOTPNotEnrolled, err)
+	_, err = totpService.Enable(ctx, "user1", "123456")
+	assert.Equal(t, platform.ErrTOTPNotEnrolled, err)
+
+	enrollment, err := totpService.Enroll(ctx, "user1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, enrollment.Secret)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/iSpend:user1?")
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	pngBytes, err := totpService.QRCode(ctx, "user1")
+	require.NoError(t, err)
+	_, err = png.Decode(bytes.NewReader(pngBytes))
+	require.NoError(t, err)
+
+	// not enabled until confirmed, so the login goes on without a code
+	require.NoError(t, totpService.Verify(ctx, "user1", ""))
+	status, err := totpService.Status(ctx, "user1")
+	require.NoError(t, err)
+	assert.False(t, status.Enabled)
+
+	// enrolling again replaces the secret
+	secondEnrollment, err := totpService.Enroll(ctx, "user1")
+	require.NoError(t, err)
+	assert.NotEqual(t, enrollment.Secret, secondEnrollment.Secret)
+
+	_, err = totpService.Enable(ctx, "user1", "000000")
+	assert.Equal(t, platform.ErrWrongTOTPCode, err)
+	recoveryCodes, err := totpService.Enable(ctx, "user1", totpCode(t, secondEnrollment.Secret, *now))
+	require.NoError(t, err)
+	assert.Len(t, recoveryCodes, platform.RecoveryCodesCount)
+
+	status, err = totpService.Status(ctx, "user1")
+	require.NoError(t, err)
+	assert.True(t, status.Enabled)
+	assert.Equal(t, platform.RecoveryCodesCount, status.RecoveryCodesLeft)
+
+	// the secret is not shown again
+	_, err = totpService.Enroll(ctx, "user1")
+	assert.Equal(t, platform.ErrTOTPAlreadyEnabled, err)
+	_, err = totpService.QRCode(ctx, "user1")
+	assert.Equal(t, platform.ErrTOTPAlreadyEnabled, err)
+
+	_, err = totpService.Enroll(ctx, "nobody")
+	assert.Equal(t, platform.ErrNotFound, err)
+}
+
+func TestTOTPService_Verify(t *testing.T) {
+	totpService, now := newTOTPServiceTest(t)
+	ctx := context.Background()
+	secret, _ := enableTOTP(t, totpService, *now)
+
+	assert.Equal(t, platform.ErrTOTPRequired, totpService.Verify(ctx, "user1", ""))
+	assert.Equal(t, platform.ErrWrongTOTPCode, totpService.Verify(ctx, "user1", "000000"))
+
+	// the code enabling it is used up already
+	assert.Equal(t, platform.ErrWrongTOTPCode, totpService.Verify(ctx, "user1", totpCode(t, secret, *now)))
+
+	*now = now.Add(platform.TOTPPeriod)
+	code := totpCode(t, secret, *now)
+	require.NoError(t, totpService.Verify(ctx, "user1", code))
+	assert.Equal(t, platform.ErrWrongTOTPCode, totpService.Verify(ctx, "user1", code))
+
+	// codes of the past steps cannot be replayed, even within the allowed skew
+	*now = now.Add(platform.TOTPPeriod)
+	require.NoError(t, totpService.Verify(ctx, "user1", totpCode(t, secret, *now)))
+	assert.Equal(t, platform.ErrWrongTOTPCode, totpService.Verify(ctx, "user1", code))
+}
+
+func TestTOTPService_RecoveryCodes(t *testing.T) {
+	totpService, now := newTOTPServiceTest(t)
+	ctx := context.Background()
+	secret, recoveryCodes := enableTOTP(t, totpService, *now)
+
+	require.NoError(t, totpService.Verify(ctx, "user1", recoveryCodes[0]))
+	assert.Equal(t, platform.ErrWrongTOTPCode, totpService.Verify(ctx, "user1", recoveryCodes[0]))
+	status, err := totpService.Status(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, platform.RecoveryCodesCount-1, status.RecoveryCodesLeft)
+
+	// regenerating needs a code from the app, and makes the old codes stop working
+	_, err = totpService.RegenerateRecoveryCodes(ctx, "user1", recoveryCodes[1])
+	assert.Equal(t, platform.ErrWrongTOTPCode, err)
+	*now = now.Add(platform.TOTPPeriod)
+	newRecoveryCodes, err := totpService.RegenerateRecoveryCodes(ctx, "user1", totpCode(t, secret, *now))
+	require.NoError(t, err)
+	assert.Len(t, newRecoveryCodes, platform.RecoveryCodesCount)
+	assert.Equal(t, platform.ErrWrongTOTPCode, totpService.Verify(ctx, "user1", recoveryCodes[1]))
+
+	// a recovery code disables it too
+	assert.Equal(t, platform.ErrWrongTOTPCode, totpService.Disable(ctx, "user1", "000000"))
+	require.NoError(t, totpService.Disable(ctx, "user1", newRecoveryCodes[0]))
+	require.NoError(t, totpService.Verify(ctx, "user1", ""))
+	assert.Equal(t, platform.ErrTOTPNotEnabled, totpService.Disable(ctx, "user1", newRecoveryCodes[1]))
+	_, err = totpService.RegenerateRecoveryCodes(ctx, "user1", "123456")
+	assert.Equal(t, platform.ErrTOTPNotEnabled, err)
+}
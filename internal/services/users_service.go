@@ -1,8 +1,10 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/2beens/ispend/internal/db"
 	"github.com/2beens/ispend/internal/metrics"
@@ -12,15 +14,29 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const MaxDisplayNameLength = 64
+
 type UsersService struct {
-	db        db.SpenderDB
-	mutex     *sync.RWMutex
-	cache     *ristretto.Cache
-	graphite  *metrics.GraphiteClient
-	usernames []string
+	db    db.SpenderDB
+	mutex *sync.RWMutex
+	// cache keeps the spends and spend kinds of the users; it's written under the mutex and waited for,
+	// as ristretto sets in the background, and drops a set of a key while an earlier one is pending
+	cache    *ristretto.Cache
+	graphite *metrics.GraphiteClient
+	// passwordHasher hashes the new passwords, and the old ones again when its parameters change
+	passwordHasher *platform.PasswordHasher
+	passwordPolicy *platform.PasswordPolicy
+	usernames      []string
+	// roles are looked up with every authenticated request, so they are all kept in memory
+	roles map[string]string
 }
 
-func NewUsersService(db db.SpenderDB, graphite *metrics.GraphiteClient) *UsersService {
+func NewUsersService(
+	db db.SpenderDB,
+	graphite *metrics.GraphiteClient,
+	passwordHasher *platform.PasswordHasher,
+	passwordPolicy *platform.PasswordPolicy,
+) *UsersService {
 	config := &ristretto.Config{
 		NumCounters: 1e7,     // number of keys to track frequency of (10M).
 		MaxCost:     1 << 30, // maximum cost of cache (1GB).
@@ -37,9 +53,13 @@ func NewUsersService(db db.SpenderDB, graphite *metrics.GraphiteClient) *UsersSe
 		cache:     cache,
 		graphite:  graphite,
 		usernames: []string{},
+		roles:     make(map[string]string),
+
+		passwordHasher: passwordHasher,
+		passwordPolicy: passwordPolicy,
 	}
 
-	allUsers, err := db.GetAllUsers(true)
+	allUsers, err := db.GetAllUsers(context.Background(), true)
 	if err != nil {
 		log.Fatalf("cannot initialize UsersService: %s", err.Error())
 	}
@@ -47,6 +67,7 @@ func NewUsersService(db db.SpenderDB, graphite *metrics.GraphiteClient) *UsersSe
 		usersService.setUserSpendsCache(user.Username, user.Spends)
 		usersService.setUserSpendKindsCache(user.Username, user.SpendKinds)
 		usersService.usernames = append(usersService.usernames, user.Username)
+		usersService.roles[user.Username] = user.Role
 	}
 
 	graphite.SimpleSendInt("users.total", len(allUsers))
@@ -56,32 +77,70 @@ func NewUsersService(db db.SpenderDB, graphite *metrics.GraphiteClient) *UsersSe
 	return usersService
 }
 
-func (us *UsersService) GetSpendKind(username string, spendingKindID int) (*models.SpendKind, error) {
-	return us.db.GetSpendKind(username, spendingKindID)
+func (us *UsersService) GetSpendKind(ctx context.Context, username string, spendingKindID int) (*models.SpendKind, error) {
+	return us.db.GetSpendKind(ctx, username, spendingKindID)
 }
 
-func (us *UsersService) GetAllDefaultSpendKinds() ([]models.SpendKind, error) {
-	return us.db.GetAllDefaultSpendKinds()
+func (us *UsersService) GetAllDefaultSpendKinds(ctx context.Context) ([]models.SpendKind, error) {
+	return us.db.GetAllDefaultSpendKinds(ctx)
 }
 
-func (us *UsersService) GetAllUsers() (models.Users, error) {
-	var users models.Users
-	for _, username := range us.getCachedUsernamesSynced() {
-		user, err := us.GetUser(username)
+// GetAllUsers loads the users at once, with their spends and spend kinds from the cache; the ones missing
+// there are loaded at once too, for all the users missing them
+func (us *UsersService) GetAllUsers(ctx context.Context) (models.Users, error) {
+	users, err := us.db.GetAllUsers(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var spendsMisses, spendKindsMisses []string
+	for _, user := range users {
+		if spends, found := us.getUserSpendsCache(user.Username); spends != nil && found {
+			user.Spends = spends
+		} else {
+			spendsMisses = append(spendsMisses, user.Username)
+		}
+		if spendKinds, found := us.getUserSpendKindsCache(user.Username); spendKinds != nil && found {
+			user.SpendKinds = spendKinds
+		} else {
+			spendKindsMisses = append(spendKindsMisses, user.Username)
+		}
+	}
+
+	if len(spendsMisses) > 0 {
+		log.Tracef("users service [get all users], spends cache misses: %d. will recreate", len(spendsMisses))
+		spendsOfUsers, err := us.db.GetSpendsOfUsers(ctx, spendsMisses)
 		if err != nil {
-			log.Errorf("user service error [get all users]: %s", err.Error())
-			continue
+			return nil, err
+		}
+		for _, user := range users {
+			if spends, found := spendsOfUsers[user.Username]; found {
+				user.Spends = us.loadUserSpendsCache(user.Username, spends)
+			}
 		}
-		users = append(users, user)
 	}
+	if len(spendKindsMisses) > 0 {
+		log.Tracef("users service [get all users], spend kinds cache misses: %d. will recreate", len(spendKindsMisses))
+		spendKindsOfUsers, err := us.db.GetSpendKindsOfUsers(ctx, spendKindsMisses)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if spendKinds, found := spendKindsOfUsers[user.Username]; found {
+				us.setUserSpendKindsCache(user.Username, spendKinds)
+				user.SpendKinds = spendKinds
+			}
+		}
+	}
+
 	return users, nil
 }
 
-func (us *UsersService) AddUser(user *models.User) error {
+func (us *UsersService) AddUser(ctx context.Context, user *models.User) error {
 	if user == nil {
 		return errors.New("user is nil, cannot add")
 	}
-	_, err := us.db.StoreUser(user)
+	_, err := us.db.StoreUser(ctx, user)
 	if err != nil {
 		return err
 	}
@@ -89,19 +148,24 @@ func (us *UsersService) AddUser(user *models.User) error {
 	us.setUserSpendsCache(user.Username, user.Spends)
 	us.setUserSpendKindsCache(user.Username, user.SpendKinds)
 
+	role := user.Role
+	if role == "" {
+		role = models.RoleUser
+	}
 	us.mutex.Lock()
 	us.usernames = append(us.usernames, user.Username)
+	us.roles[user.Username] = role
 	us.mutex.Unlock()
 
 	return nil
 }
 
-func (us *UsersService) GetUser(username string) (*models.User, error) {
+func (us *UsersService) GetUser(ctx context.Context, username string) (*models.User, error) {
 	if !us.UserExists(username) {
 		return nil, platform.ErrNotFound
 	}
 
-	user, err := us.db.GetUser(username, false)
+	user, err := us.db.GetUser(ctx, username, false)
 	if err != nil {
 		return nil, err
 	}
@@ -109,28 +173,184 @@ func (us *UsersService) GetUser(username string) (*models.User, error) {
 	spends, found := us.getUserSpendsCache(username)
 	if spends == nil || !found {
 		log.Tracef("users service [get user: %s], spends cache miss. will recreate", username)
-		spends, err = us.db.GetSpends(username)
+		spends, err = us.db.GetSpends(ctx, username)
 		if err != nil {
 			return nil, err
 		}
-		us.setUserSpendsCache(user.Username, user.Spends)
+		spends = us.loadUserSpendsCache(user.Username, spends)
 	}
 	user.Spends = spends
 
 	spendKinds, found := us.getUserSpendKindsCache(username)
 	if spendKinds == nil || !found {
 		log.Tracef("users service [get user: %s], spend kinds cache miss. will recreate", username)
-		spendKinds, err = us.db.GetSpendKinds(username)
+		spendKinds, err = us.db.GetSpendKinds(ctx, username)
 		if err != nil {
 			return nil, err
 		}
-		us.setUserSpendKindsCache(user.Username, user.SpendKinds)
+		us.setUserSpendKindsCache(user.Username, spendKinds)
 	}
 	user.SpendKinds = spendKinds
 
 	return user, nil
 }
 
+// Authenticate returns the user if the password is right, platform.ErrNotFound
+// for an unknown user and platform.ErrWrongPassword for a wrong password
+func (us *UsersService) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	user, err := us.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	ok, needsRehash, err := us.passwordHasher.Verify(password, user.Password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, platform.ErrWrongPassword
+	}
+
+	// the only moment the password is known, to upgrade its hash to the current algorithm and parameters
+	if needsRehash {
+		if passwordHash, err := us.passwordHasher.Hash(password); err != nil {
+			log.Errorf("users service [rehash password of %s]: %s", username, err)
+		} else if err := us.SetPassword(ctx, username, passwordHash); err != nil {
+			log.Errorf("users service [rehash password of %s]: %s", username, err)
+		} else {
+			log.Debugf("users service: rehashed the password of user [%s]", username)
+			user.Password = passwordHash
+		}
+	}
+	return user, nil
+}
+
+// CheckNewPassword returns the password policy error if the password cannot be chosen
+func (us *UsersService) CheckNewPassword(password string) error {
+	return us.passwordPolicy.Check(password)
+}
+
+// HashNewPassword checks the password against the password policy, and hashes it if it passes
+func (us *UsersService) HashNewPassword(password string) (string, error) {
+	if err := us.passwordPolicy.Check(password); err != nil {
+		return "", err
+	}
+	return us.passwordHasher.Hash(password)
+}
+
+// GetRole returns the role of the user, or platform.ErrNotFound for an unknown user
+func (us *UsersService) GetRole(username string) (string, error) {
+	us.mutex.RLock()
+	defer us.mutex.RUnlock()
+	role, ok := us.roles[username]
+	if !ok {
+		return "", platform.ErrNotFound
+	}
+	return role, nil
+}
+
+// SetRole changes the role of the user, it applies to all its sessions and tokens right away
+func (us *UsersService) SetRole(ctx context.Context, username, role string) error {
+	if !models.IsValidRole(role) {
+		return platform.ErrInvalidRole
+	}
+	if err := us.db.SetUserRole(ctx, username, role); err != nil {
+		return err
+	}
+
+	us.mutex.Lock()
+	us.roles[username] = role
+	us.mutex.Unlock()
+
+	return nil
+}
+
+func (us *UsersService) SetEmailVerified(ctx context.Context, username string, verified bool) error {
+	return us.db.SetEmailVerified(ctx, username, verified)
+}
+
+// SetPassword replaces the user's password hash; ending the user's sessions is up to the caller
+func (us *UsersService) SetPassword(ctx context.Context, username, passwordHash string) error {
+	return us.db.SetUserPassword(ctx, username, passwordHash)
+}
+
+// UpdateProfile replaces the user's profile, returns one of the profile errors from platform for an invalid one
+func (us *UsersService) UpdateProfile(ctx context.Context, username string, profile models.UserProfile) error {
+	if err := checkProfile(profile); err != nil {
+		return err
+	}
+	return us.db.WithTx(ctx, func(tx db.SpenderTx) error {
+		user, err := tx.GetUser(ctx, username, false)
+		if err != nil {
+			return err
+		}
+		user.Profile = profile
+		return tx.UpdateUser(ctx, user)
+	})
+}
+
+func checkProfile(profile models.UserProfile) error {
+	if utf8.RuneCountInString(profile.DisplayName) > MaxDisplayNameLength {
+		return platform.ErrDisplayNameTooLong
+	}
+	if profile.DefaultCurrency != "" && !platform.IsCurrencyCode(profile.DefaultCurrency) {
+		return platform.ErrInvalidCurrency
+	}
+	if profile.Timezone != "" && !platform.IsTimezone(profile.Timezone) {
+		return platform.ErrInvalidTimezone
+	}
+	if profile.Locale != "" && !platform.IsLocale(profile.Locale) {
+		return platform.ErrInvalidLocale
+	}
+	return nil
+}
+
+// SetEmail changes the user's email address, which is not verified anymore; returns
+// platform.ErrAlreadyExists if another user has the address
+func (us *UsersService) SetEmail(ctx context.Context, username, email string) error {
+	return us.db.WithTx(ctx, func(tx db.SpenderTx) error {
+		user, err := tx.GetUser(ctx, username, false)
+		if err != nil {
+			return err
+		}
+		user.Email = email
+		user.EmailVerified = false
+		return tx.UpdateUser(ctx, user)
+	})
+}
+
+// DeleteUser erases the user with all its data from the DB, and forgets it in the cache;
+// the user's sessions and tokens are up to the caller
+func (us *UsersService) DeleteUser(ctx context.Context, username string) error {
+	err := us.db.WithTx(ctx, func(tx db.SpenderTx) error {
+		return tx.DeleteUser(ctx, username)
+	})
+	if err != nil {
+		return err
+	}
+
+	us.mutex.Lock()
+	usernames := make([]string, 0, len(us.usernames))
+	for _, u := range us.usernames {
+		if u != username {
+			usernames = append(usernames, u)
+		}
+	}
+	// a new slice, getCachedUsernamesSynced callers may still be iterating the old one
+	us.usernames = usernames
+	delete(us.roles, username)
+	us.cache.Del(username)
+	us.cache.Del(username + "|sk")
+	us.cache.Wait()
+	us.mutex.Unlock()
+
+	us.graphite.SimpleSendInt("users.deleted", 1)
+	return nil
+}
+
+func (us *UsersService) SetTOTP(ctx context.Context, username string, totp models.TOTP) error {
+	return us.db.SetUserTOTP(ctx, username, totp)
+}
+
 func (us *UsersService) UserExists(username string) bool {
 	for _, u := range us.getCachedUsernamesSynced() {
 		if u == username {
@@ -140,32 +360,47 @@ func (us *UsersService) UserExists(username string) bool {
 	return false
 }
 
-func (us *UsersService) StoreSpending(user *models.User, spending models.Spending) error {
-	id, err := us.db.StoreSpending(user.Username, spending)
+// StoreSpending stores the spending of the user, and sets its new ID
+func (us *UsersService) StoreSpending(ctx context.Context, user *models.User, spending *models.Spending) error {
+	id, err := us.db.StoreSpending(ctx, user.Username, *spending)
 	if err != nil {
 		return err
 	}
-
 	spending.ID = id
-	user.Spends = append(user.Spends, spending)
-	us.setUserSpendsCache(user.Username, user.Spends)
+
+	// the cached spends are read again under the lock, user.Spends may be behind the concurrent changes
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	spends, found := us.cachedSpends(user.Username)
+	if !found {
+		// loaded from the DB, with the new spending, when the user is read next
+		spends = user.Spends
+	}
+	// a new slice with the spending, the cached one may still be read
+	updated := make([]models.Spending, 0, len(spends)+1)
+	updated = append(updated, spends...)
+	updated = append(updated, *spending)
+	if found {
+		us.setCachedSpends(user.Username, updated)
+	}
+	user.Spends = updated
 
 	return nil
 }
 
-func (us *UsersService) DeleteSpending(username, spendID string) error {
-	err := us.db.DeleteSpending(username, spendID)
+func (us *UsersService) DeleteSpending(ctx context.Context, username, spendID string) error {
+	err := us.db.DeleteSpending(ctx, username, spendID)
 	if err != nil {
 		return err
 	}
 
 	// delete from cache too
-	var spends []models.Spending
-	if spendsFromCache, found := us.getUserSpendsCache(username); !found {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	spends, found := us.cachedSpends(username)
+	if !found {
 		log.Errorf("delete spending from cache error [not found for user: %s]! indicator of bug - db and cache not in sync", username)
 		return nil
-	} else {
-		spends = spendsFromCache
 	}
 
 	indexToRemove := -1
@@ -180,10 +415,11 @@ func (us *UsersService) DeleteSpending(username, spendID string) error {
 		return platform.ErrNotFound
 	}
 
-	// remove spending by its index
-	spends = append(spends[:indexToRemove], spends[indexToRemove+1:]...)
-
-	us.setUserSpendsCache(username, spends)
+	// a new slice without the spending, the cached one may still be read
+	remaining := make([]models.Spending, 0, len(spends)-1)
+	remaining = append(remaining, spends[:indexToRemove]...)
+	remaining = append(remaining, spends[indexToRemove+1:]...)
+	us.setCachedSpends(username, remaining)
 
 	return nil
 }
@@ -191,10 +427,17 @@ func (us *UsersService) DeleteSpending(username, spendID string) error {
 func (us *UsersService) getUserSpendsCache(username string) ([]models.Spending, bool) {
 	us.mutex.RLock()
 	defer us.mutex.RUnlock()
+	spends, found := us.cachedSpends(username)
+	if found {
+		log.Tracef("found %d spends for user %s", len(spends), username)
+	}
+	return spends, found
+}
+
+// cachedSpends returns the cached spends of the user, the mutex has to be held
+func (us *UsersService) cachedSpends(username string) ([]models.Spending, bool) {
 	if spends, found := us.cache.Get(username); found {
-		spendsSlice := spends.([]models.Spending)
-		log.Tracef("found %d spends for user %s", len(spendsSlice), username)
-		return spendsSlice, found
+		return spends.([]models.Spending), true
 	}
 	return nil, false
 }
@@ -212,8 +455,26 @@ func (us *UsersService) getUserSpendKindsCache(username string) ([]models.SpendK
 
 func (us *UsersService) setUserSpendsCache(username string, spends []models.Spending) bool {
 	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	return us.setCachedSpends(username, spends)
+}
+
+// loadUserSpendsCache caches the spends loaded from the DB, unless a change cached others meanwhile,
+// which are the newer ones
+func (us *UsersService) loadUserSpendsCache(username string, spends []models.Spending) []models.Spending {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	if cached, found := us.cachedSpends(username); found {
+		return cached
+	}
+	us.setCachedSpends(username, spends)
+	return spends
+}
+
+// setCachedSpends caches the spends of the user, the mutex has to be held
+func (us *UsersService) setCachedSpends(username string, spends []models.Spending) bool {
 	stored := us.cache.Set(username, spends, 1)
-	us.mutex.Unlock()
+	us.cache.Wait()
 	log.Tracef("user service cache: storing %d spends for user [%s], stored: %t", len(spends), username, stored)
 	return stored
 }
@@ -221,6 +482,7 @@ func (us *UsersService) setUserSpendsCache(username string, spends []models.Spen
 func (us *UsersService) setUserSpendKindsCache(username string, spendKinds []models.SpendKind) bool {
 	us.mutex.Lock()
 	stored := us.cache.Set(username+"|sk", spendKinds, 1)
+	us.cache.Wait()
 	us.mutex.Unlock()
 	log.Tracef("user service cache: storing %d spend kinds for user [%s], stored: %t", len(spendKinds), username, stored)
 	return stored
@@ -1,6 +1,9 @@
 package services_test
 
 import (
+	"context"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -8,21 +11,59 @@ import (
 	"github.com/2beens/ispend/internal/db"
 	"github.com/2beens/ispend/internal/metrics"
 	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
 	"github.com/2beens/ispend/internal/services"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestGetAllUsers(t *testing.T) {
 	usersService := getUserServiceTest()
-	allUsers, err := usersService.GetAllUsers()
+	allUsers, err := usersService.GetAllUsers(context.Background())
 	require.NoError(t, err)
 	assert.Len(t, allUsers, 2)
 }
 
+func TestGetAllUsers_LoadsAtOnce(t *testing.T) {
+	ctx := context.Background()
+	countingDB := &countingDB{SpenderDB: db.NewInMemoryDB(), calls: make(map[string]int)}
+	graphiteClient := metrics.NewGraphiteNop("test.graphite.host", 1000)
+	usersService := services.NewUsersService(countingDB, graphiteClient, testPasswordHasher(t), testPasswordPolicy())
+
+	// stored past the service, so its spends and spend kinds are not cached
+	user := models.NewUser("walker@example.com", "walker", "password-hash", []models.SpendKind{{Name: "food"}})
+	user.Spends = []models.Spending{{Currency: "EUR", Amount: 7, Kind: &models.SpendKind{Name: "food"}, Timestamp: time.Now()}}
+	_, err := countingDB.SpenderDB.StoreUser(ctx, user)
+	require.NoError(t, err)
+	countingDB.reset()
+
+	allUsers, err := usersService.GetAllUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, allUsers, 3)
+	for _, u := range allUsers {
+		if u.Username == "walker" {
+			require.Len(t, u.Spends, 1)
+			assert.Equal(t, float32(7), u.Spends[0].Amount)
+			require.Len(t, u.SpendKinds, 1)
+			assert.Equal(t, "food", u.SpendKinds[0].Name)
+		} else {
+			assert.NotNil(t, u.SpendKinds, u.Username)
+		}
+	}
+	assert.Equal(t, map[string]int{"GetAllUsers": 1, "GetSpendsOfUsers": 1, "GetSpendKindsOfUsers": 1}, countingDB.calls)
+
+	// all cached now
+	countingDB.reset()
+	allUsers, err = usersService.GetAllUsers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, allUsers, 3)
+	assert.Equal(t, map[string]int{"GetAllUsers": 1}, countingDB.calls)
+}
+
 func TestStoreAndRetrieveUser(t *testing.T) {
 	usersService := getUserServiceTest()
-	allUsersBefore, err := usersService.GetAllUsers()
+	allUsersBefore, err := usersService.GetAllUsers(context.Background())
 	require.NoError(t, err)
 
 	spendKind := &models.SpendKind{
@@ -44,14 +85,14 @@ func TestStoreAndRetrieveUser(t *testing.T) {
 		Spends:     []models.Spending{*spend},
 		SpendKinds: []models.SpendKind{*spendKind},
 	}
-	err = usersService.AddUser(user)
+	err = usersService.AddUser(context.Background(), user)
 	require.NoError(t, err)
 
-	allUsersAfter, err := usersService.GetAllUsers()
+	allUsersAfter, err := usersService.GetAllUsers(context.Background())
 	require.NoError(t, err)
 
 	assert.Equal(t, len(allUsersBefore)+1, len(allUsersAfter))
-	retrievedUser, err := usersService.GetUser(username)
+	retrievedUser, err := usersService.GetUser(context.Background(), username)
 	require.NoError(t, err)
 	assert.Equal(t, username, retrievedUser.Username)
 	assert.Len(t, retrievedUser.Spends, 1)
@@ -60,7 +101,7 @@ func TestStoreAndRetrieveUser(t *testing.T) {
 
 func TestStoreAndRetrieveUser_Multithreaded(t *testing.T) {
 	usersService := getUserServiceTest()
-	allUsersBefore, err := usersService.GetAllUsers()
+	allUsersBefore, err := usersService.GetAllUsers(context.Background())
 	require.NoError(t, err)
 	require.Len(t, allUsersBefore, 2)
 
@@ -77,20 +118,20 @@ func TestStoreAndRetrieveUser_Multithreaded(t *testing.T) {
 			Timestamp: time.Now(),
 		}
 		user := &models.User{
-			Email:      "testEmail",
+			Email:      username + "@example.com",
 			Username:   username,
 			Password:   "testPass",
 			Spends:     []models.Spending{*spend},
 			SpendKinds: []models.SpendKind{*spendKind},
 		}
-		return usersService.AddUser(user)
+		return usersService.AddUser(context.Background(), user)
 	}
 
 	usersCount := 5
 	var wg sync.WaitGroup
 	for i := 1; i <= usersCount; i++ {
 		wg.Add(1)
-		username := "username" + string(i)
+		username := "username" + strconv.Itoa(i)
 		go func(t *testing.T) {
 			err := storeUserTestFunc(username)
 			assert.NoError(t, err)
@@ -100,21 +141,297 @@ func TestStoreAndRetrieveUser_Multithreaded(t *testing.T) {
 
 	wg.Wait()
 
-	allUsers, err := usersService.GetAllUsers()
+	allUsers, err := usersService.GetAllUsers(context.Background())
 	assert.NoError(t, err)
 	assert.Len(t, allUsers, len(allUsersBefore)+usersCount)
 
 	for i := 1; i <= usersCount; i++ {
-		username := "username" + string(i)
-		user, err := usersService.GetUser(username)
+		username := "username" + strconv.Itoa(i)
+		user, err := usersService.GetUser(context.Background(), username)
 		assert.NoError(t, err)
 		assert.Equal(t, username, user.Username)
 	}
 }
 
+func TestGetUser_CanceledContext(t *testing.T) {
+	usersService := getUserServiceTest()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	user, err := usersService.GetUser(ctx, "admin")
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, user)
+}
+
+func TestUserRoles(t *testing.T) {
+	usersService := getUserServiceTest()
+	ctx := context.Background()
+
+	user := models.NewUser("email1", "user1", "pass1", nil)
+	require.NoError(t, usersService.AddUser(ctx, user))
+	role, err := usersService.GetRole("user1")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, role)
+
+	require.NoError(t, usersService.SetRole(ctx, "user1", models.RoleReadOnly))
+	role, err = usersService.GetRole("user1")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleReadOnly, role)
+	storedUser, err := usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleReadOnly, storedUser.Role)
+
+	assert.Equal(t, platform.ErrInvalidRole, usersService.SetRole(ctx, "user1", "superuser"))
+	assert.Equal(t, platform.ErrNotFound, usersService.SetRole(ctx, "nobody", models.RoleAdmin))
+	_, err = usersService.GetRole("nobody")
+	assert.Equal(t, platform.ErrNotFound, err)
+}
+
+func TestHashNewPassword(t *testing.T) {
+	usersService := getUserServiceTest()
+
+	_, err := usersService.HashNewPassword("short")
+	assert.Equal(t, platform.ErrPasswordTooShort, err)
+	_, err = usersService.HashNewPassword("password123")
+	assert.Equal(t, platform.ErrPasswordBreached, err)
+
+	passwordHash, err := usersService.HashNewPassword("correct horse")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(passwordHash, "$argon2id$"), passwordHash)
+}
+
+func TestAuthenticate_RehashesPassword(t *testing.T) {
+	ctx := context.Background()
+	inMemDB := db.NewInMemoryDB()
+	graphiteClient := metrics.NewGraphiteNop("test.graphite.host", 1000)
+
+	bcryptHasher, err := platform.NewPasswordHasher(platform.PasswordHashBcrypt, testArgon2Params, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	require.NoError(t, err)
+	oldUsersService := services.NewUsersService(inMemDB, graphiteClient, bcryptHasher, testPasswordPolicy())
+	legacyHash, err := oldUsersService.HashNewPassword("correct horse")
+	require.NoError(t, err)
+	require.NoError(t, oldUsersService.AddUser(ctx, models.NewUser("user1@example.com", "user1", legacyHash, nil)))
+
+	// the server restarted with argon2id configured
+	usersService := services.NewUsersService(inMemDB, graphiteClient, testPasswordHasher(t), testPasswordPolicy())
+
+	// a wrong password changes nothing
+	_, err = usersService.Authenticate(ctx, "user1", "wrong horse")
+	assert.Equal(t, platform.ErrWrongPassword, err)
+	storedUser, err := usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, legacyHash, storedUser.Password)
+
+	user, err := usersService.Authenticate(ctx, "user1", "correct horse")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(user.Password, "$argon2id$"), user.Password)
+	storedUser, err = usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, user.Password, storedUser.Password)
+
+	// once upgraded, the hash stays
+	_, err = usersService.Authenticate(ctx, "user1", "correct horse")
+	require.NoError(t, err)
+	storedUser, err = usersService.GetUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, user.Password, storedUser.Password)
+}
+
+func TestUpdateProfile(t *testing.T) {
+	ctx := context.Background()
+	usersService := getUserServiceTest()
+
+	testCases := []struct {
+		name     string
+		profile  models.UserProfile
+		expected error
+	}{
+		{"empty", models.UserProfile{}, nil},
+		{"full", models.UserProfile{DisplayName: "Serj", DefaultCurrency: "RSD", Timezone: "Europe/Belgrade", Locale: "sr-Latn-RS"}, nil},
+		{"max display name", models.UserProfile{DisplayName: strings.Repeat("ж", services.MaxDisplayNameLength)}, nil},
+		{"display name too long", models.UserProfile{DisplayName: strings.Repeat("ж", services.MaxDisplayNameLength+1)}, platform.ErrDisplayNameTooLong},
+		{"lowercase currency", models.UserProfile{DefaultCurrency: "eur"}, nil},
+		{"long currency", models.UserProfile{DefaultCurrency: "EURO"}, platform.ErrInvalidCurrency},
+		{"currency symbol", models.UserProfile{DefaultCurrency: "€"}, platform.ErrInvalidCurrency},
+		{"UTC", models.UserProfile{Timezone: "UTC"}, nil},
+		{"unknown timezone", models.UserProfile{Timezone: "Europe/Atlantis"}, platform.ErrInvalidTimezone},
+		{"local timezone", models.UserProfile{Timezone: "Local"}, platform.ErrInvalidTimezone},
+		{"language only", models.UserProfile{Locale: "de"}, nil},
+		{"locale with underscore", models.UserProfile{Locale: "de_DE"}, platform.ErrInvalidLocale},
+		{"locale garbage", models.UserProfile{Locale: "<script>"}, platform.ErrInvalidLocale},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := usersService.UpdateProfile(ctx, "lazar", tc.profile)
+			assert.Equal(t, tc.expected, err)
+			if tc.expected == nil {
+				user, err := usersService.GetUser(ctx, "lazar")
+				require.NoError(t, err)
+				assert.Equal(t, tc.profile, user.Profile)
+			}
+		})
+	}
+
+	assert.Equal(t, platform.ErrNotFound, usersService.UpdateProfile(ctx, "nobody", models.UserProfile{}))
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	usersService := getUserServiceTest()
+
+	user, err := usersService.GetUser(ctx, "lazar")
+	require.NoError(t, err)
+	require.NotEmpty(t, user.Spends)
+
+	require.NoError(t, usersService.DeleteUser(ctx, "lazar"))
+	assert.False(t, usersService.UserExists("lazar"))
+	_, err = usersService.GetUser(ctx, "lazar")
+	assert.Equal(t, platform.ErrNotFound, err)
+	_, err = usersService.GetRole("lazar")
+	assert.Equal(t, platform.ErrNotFound, err)
+	allUsers, err := usersService.GetAllUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, allUsers, 1)
+	assert.Equal(t, "admin", allUsers[0].Username)
+
+	assert.Equal(t, platform.ErrNotFound, usersService.DeleteUser(ctx, "lazar"))
+
+	// a new user of the same name gets none of the cached spends
+	require.NoError(t, usersService.AddUser(ctx, models.NewUser("lazar@example.com", "lazar", "hash", nil)))
+	user, err = usersService.GetUser(ctx, "lazar")
+	require.NoError(t, err)
+	assert.Empty(t, user.Spends)
+}
+
+func TestStoreSpending_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	usersService := getUserServiceTest()
+
+	user, err := usersService.GetUser(ctx, "lazar")
+	require.NoError(t, err)
+	require.NotEmpty(t, user.Spends)
+	spendsBefore := len(user.Spends)
+	kind := user.Spends[0].Kind
+
+	// each request reads the user, as the handlers do, then stores its spending
+	const spendsCount = 200
+	var wg sync.WaitGroup
+	for i := 0; i < spendsCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := usersService.GetUser(ctx, "lazar")
+			if !assert.NoError(t, err) {
+				return
+			}
+			spending := models.Spending{Currency: "EUR", Amount: 1, Kind: kind, Timestamp: time.Now()}
+			assert.NoError(t, usersService.StoreSpending(ctx, user, &spending))
+		}()
+	}
+	wg.Wait()
+
+	user, err = usersService.GetUser(ctx, "lazar")
+	require.NoError(t, err)
+	assert.Len(t, user.Spends, spendsBefore+spendsCount)
+}
+
+func TestDeleteSpending(t *testing.T) {
+	ctx := context.Background()
+	usersService := getUserServiceTest()
+
+	user, err := usersService.GetUser(ctx, "lazar")
+	require.NoError(t, err)
+	require.NotEmpty(t, user.Spends)
+	spending := models.Spending{Currency: "EUR", Amount: 3, Kind: user.Spends[0].Kind, Timestamp: time.Now()}
+	require.NoError(t, usersService.StoreSpending(ctx, user, &spending))
+
+	user, err = usersService.GetUser(ctx, "lazar")
+	require.NoError(t, err)
+	require.Len(t, user.Spends, 2)
+	spends := user.Spends
+	before := append([]models.Spending(nil), spends...)
+
+	require.NoError(t, usersService.DeleteSpending(ctx, "lazar", spends[0].ID))
+	// the spends read before are left as they were
+	assert.Equal(t, before, spends)
+	user, err = usersService.GetUser(ctx, "lazar")
+	require.NoError(t, err)
+	assert.Equal(t, before[1:], user.Spends)
+
+	assert.Equal(t, platform.ErrNotFound, usersService.DeleteSpending(ctx, "lazar", before[0].ID))
+}
+
+// cheap parameters, the tests need not be slow
+var testArgon2Params = platform.Argon2Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func testPasswordHasher(t *testing.T) *platform.PasswordHasher {
+	hasher, err := platform.NewPasswordHasher(platform.PasswordHashArgon2id, testArgon2Params, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	require.NoError(t, err)
+	return hasher
+}
+
+func testPasswordPolicy() *platform.PasswordPolicy {
+	policy := platform.NewPasswordPolicy(platform.DefaultPasswordMinLength, platform.DefaultPasswordMaxLength)
+	if _, err := policy.ReadBreachedPasswords(strings.NewReader("password123\n")); err != nil {
+		panic(err)
+	}
+	return policy
+}
+
 func getUserServiceTest() *services.UsersService {
 	inMemDB := db.NewInMemoryDB()
 	graphiteClient := metrics.NewGraphiteNop("test.graphite.host", 1000)
-	us := services.NewUsersService(inMemDB, graphiteClient)
+	hasher, err := platform.NewPasswordHasher(platform.PasswordHashArgon2id, testArgon2Params, bcrypt.MinCost, platform.DefaultArgon2MemoryBudget)
+	if err != nil {
+		panic(err)
+	}
+	us := services.NewUsersService(inMemDB, graphiteClient, hasher, testPasswordPolicy())
 	return us
 }
+
+// countingDB counts the queries of the users, their spends and spend kinds
+type countingDB struct {
+	db.SpenderDB
+	calls map[string]int
+}
+
+func (c *countingDB) reset() {
+	c.calls = make(map[string]int)
+}
+
+func (c *countingDB) GetAllUsers(ctx context.Context, loadAllUserData bool) (models.Users, error) {
+	c.calls["GetAllUsers"]++
+	return c.SpenderDB.GetAllUsers(ctx, loadAllUserData)
+}
+
+func (c *countingDB) GetUser(ctx context.Context, username string, loadAllData bool) (*models.User, error) {
+	c.calls["GetUser"]++
+	return c.SpenderDB.GetUser(ctx, username, loadAllData)
+}
+
+func (c *countingDB) GetSpends(ctx context.Context, username string) ([]models.Spending, error) {
+	c.calls["GetSpends"]++
+	return c.SpenderDB.GetSpends(ctx, username)
+}
+
+func (c *countingDB) GetSpendKinds(ctx context.Context, username string) ([]models.SpendKind, error) {
+	c.calls["GetSpendKinds"]++
+	return c.SpenderDB.GetSpendKinds(ctx, username)
+}
+
+func (c *countingDB) GetSpendsOfUsers(ctx context.Context, usernames []string) (map[string][]models.Spending, error) {
+	c.calls["GetSpendsOfUsers"]++
+	return c.SpenderDB.GetSpendsOfUsers(ctx, usernames)
+}
+
+func (c *countingDB) GetSpendKindsOfUsers(ctx context.Context, usernames []string) (map[string][]models.SpendKind, error) {
+	c.calls["GetSpendKindsOfUsers"]++
+	return c.SpenderDB.GetSpendKindsOfUsers(ctx, usernames)
+}
@@ -0,0 +1,419 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	log "github.com/sirupsen/logrus"
+)
+
+// PasskeyCeremonyTTL is how long the browser has to finish a passkey registration or login once begun
+const PasskeyCeremonyTTL = 5 * time.Minute
+
+// maxPasskeyCeremonies bounds the pending ceremonies, anyone can begin a login
+const maxPasskeyCeremonies = 10000
+
+// MaxPasskeyNameLength is the longest name a user can give to a passkey
+const MaxPasskeyNameLength = 64
+
+// PasskeyCeremony is what the browser needs to begin a passkey registration or login; it sends the
+// ceremony ID back together with the result of navigator.credentials.create / get
+type PasskeyCeremony struct {
+	ID string `json:"ceremony"`
+	// Options is the protocol.CredentialCreation or protocol.CredentialAssertion for the browser
+	Options interface{} `json:"options"`
+}
+
+// WebAuthnService registers the users' passkeys and logs them in with those, as an alternative to the
+// password. The passkeys must verify the user (with a PIN or biometrics), so they need no second factor.
+type WebAuthnService struct {
+	usersService *UsersService
+	db           db.SpenderDB
+	webAuthn     *webauthn.WebAuthn
+	// ceremonies are the begun registrations and logins, by their ID, waiting for the browser
+	mutex      sync.Mutex
+	ceremonies map[string]*passkeyCeremony
+	now        func() time.Time
+}
+
+type passkeyCeremony struct {
+	registration bool
+	// username is empty for the logins where the passkey tells who the user is
+	username string
+	// name is the name of the passkey being registered
+	name    string
+	session webauthn.SessionData
+	expires time.Time
+}
+
+// NewWebAuthnService makes the service for the site at the base URL, whose host the passkeys are bound to
+func NewWebAuthnService(usersService *UsersService, spenderDB db.SpenderDB, displayName, baseURL string) (*WebAuthnService, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Hostname() == "" {
+		return nil, errors.New("base URL must be absolute: " + baseURL)
+	}
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:                  u.Hostname(),
+		RPDisplayName:         displayName,
+		RPOrigins:             []string{u.Scheme + "://" + u.Host},
+		AttestationPreference: protocol.PreferNoAttestation,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: PasskeyCeremonyTTL, TimeoutUVD: PasskeyCeremonyTTL},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: PasskeyCeremonyTTL, TimeoutUVD: PasskeyCeremonyTTL},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnService{
+		usersService: usersService,
+		db:           spenderDB,
+		webAuthn:     webAuthn,
+		ceremonies:   make(map[string]*passkeyCeremony),
+		now:          time.Now,
+	}, nil
+}
+
+func (ws *WebAuthnService) Credentials(ctx context.Context, username string) ([]models.WebAuthnCredential, error) {
+	return ws.db.GetWebAuthnCredentials(ctx, username)
+}
+
+// DeleteCredential removes the user's passkey, platform.ErrNotFound if the user has no such passkey
+func (ws *WebAuthnService) DeleteCredential(ctx context.Context, username string, credentialID []byte) error {
+	return ws.db.DeleteWebAuthnCredential(ctx, username, credentialID)
+}
+
+// BeginRegistration starts adding a passkey with the given name to the user's account
+func (ws *WebAuthnService) BeginRegistration(ctx context.Context, username, name string) (*PasskeyCeremony, error) {
+	if !ws.usersService.UserExists(username) {
+		return nil, platform.ErrNotFound
+	}
+	user, err := ws.webAuthnUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.handle == nil {
+		// the first passkey of the user
+		if user.handle, err = newUserHandle(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the authenticators holding a passkey of the user already refuse to make another one
+	creation, session, err := ws.webAuthn.BeginRegistration(user, webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()))
+	if err != nil {
+		return nil, err
+	}
+
+	ceremonyID, err := ws.addCeremony(&passkeyCeremony{
+		registration: true,
+		username:     username,
+		name:         name,
+		session:      *session,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PasskeyCeremony{ID: ceremonyID, Options: creation}, nil
+}
+
+// FinishRegistration checks the new passkey from the browser's response and stores it
+func (ws *WebAuthnService) FinishRegistration(ctx context.Context, username, ceremonyID string, response io.Reader) (*models.WebAuthnCredential, error) {
+	ceremony, err := ws.takeCeremony(ceremonyID)
+	if err != nil {
+		return nil, err
+	}
+	if !ceremony.registration || ceremony.username != username {
+		return nil, platform.ErrPasskeyCeremonyNotFound
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(response)
+	if err != nil {
+		log.Warnf("webauthn service, cannot parse registration of [%s]: %s", username, webAuthnErrorInfo(err))
+		return nil, platform.ErrPasskeyRejected
+	}
+	user, err := ws.webAuthnUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	// the handle was made together with the ceremony for the first passkey; all the passkeys of
+	// the user must share it, and another first passkey could have been registered meanwhile
+	if user.handle != nil && !bytes.Equal(user.handle, ceremony.session.UserID) {
+		return nil, platform.ErrPasskeyCeremonyNotFound
+	}
+	user.handle = ceremony.session.UserID
+	credential, err := ws.webAuthn.CreateCredential(user, ceremony.session, parsed)
+	if err != nil {
+		log.Warnf("webauthn service, registration of [%s] rejected: %s", username, webAuthnErrorInfo(err))
+		return nil, platform.ErrPasskeyRejected
+	}
+
+	now := ws.now()
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+	stored := &models.WebAuthnCredential{
+		ID:              credential.ID,
+		Username:        username,
+		UserHandle:      user.handle,
+		Name:            ceremony.name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		CreatedAt:       now,
+		LastUsedAt:      now,
+	}
+	if err := ws.db.StoreWebAuthnCredential(ctx, stored); err != nil {
+		return nil, err
+	}
+
+	log.Infof("webauthn service: user [%s] registered passkey [%s]", username, ceremony.name)
+	return stored, nil
+}
+
+// BeginLogin starts a passkey login; without the username, the browser offers all the
+// passkeys it has for the site, and the chosen one tells who the user is
+func (ws *WebAuthnService) BeginLogin(ctx context.Context, username string) (*PasskeyCeremony, error) {
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	if username == "" {
+		var err error
+		assertion, session, err = ws.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !ws.usersService.UserExists(username) {
+			return nil, platform.ErrNotFound
+		}
+		user, err := ws.webAuthnUser(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if len(user.credentials) == 0 {
+			return nil, platform.ErrNotFound
+		}
+		assertion, session, err = ws.webAuthn.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ceremonyID, err := ws.addCeremony(&passkeyCeremony{
+		username: username,
+		session:  *session,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PasskeyCeremony{ID: ceremonyID, Options: assertion}, nil
+}
+
+// FinishLogin checks the passkey's signature from the browser's response and returns who logged in
+func (ws *WebAuthnService) FinishLogin(ctx context.Context, ceremonyID string, response io.Reader) (string, error) {
+	ceremony, err := ws.takeCeremony(ceremonyID)
+	if err != nil {
+		return "", err
+	}
+	if ceremony.registration {
+		return "", platform.ErrPasskeyCeremonyNotFound
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(response)
+	if err != nil {
+		log.Warnf("webauthn service, cannot parse login: %s", webAuthnErrorInfo(err))
+		return "", platform.ErrPasskeyRejected
+	}
+
+	var user *webAuthnUser
+	var credential *webauthn.Credential
+	if ceremony.username == "" {
+		var discovered webauthn.User
+		discovered, credential, err = ws.webAuthn.ValidatePasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			return ws.discoverUser(ctx, rawID, userHandle)
+		}, ceremony.session, parsed)
+		if err == nil {
+			user = discovered.(*webAuthnUser)
+		}
+	} else {
+		user, err = ws.webAuthnUser(ctx, ceremony.username)
+		if err != nil {
+			return "", err
+		}
+		credential, err = ws.webAuthn.ValidateLogin(user, ceremony.session, parsed)
+	}
+	if err != nil {
+		log.Warnf("webauthn service, login rejected: %s", webAuthnErrorInfo(err))
+		return "", platform.ErrPasskeyRejected
+	}
+
+	// a signature counter going back means the private key was copied
+	if credential.Authenticator.CloneWarning {
+		log.Warnf("webauthn service: passkey of [%s] may be cloned, signature counter %d, login rejected", user.username, credential.Authenticator.SignCount)
+		return "", platform.ErrPasskeyRejected
+	}
+	if err := ws.db.UpdateWebAuthnCredentialUse(ctx, credential.ID, credential.Authenticator.SignCount, credential.Flags.BackupState, ws.now()); err != nil {
+		return "", err
+	}
+	return user.username, nil
+}
+
+func (ws *WebAuthnService) discoverUser(ctx context.Context, credentialID, userHandle []byte) (*webAuthnUser, error) {
+	credential, err := ws.db.GetWebAuthnCredential(ctx, credentialID)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(credential.UserHandle, userHandle) {
+		return nil, errors.New("user handle does not match the credential")
+	}
+	return ws.webAuthnUser(ctx, credential.Username)
+}
+
+func (ws *WebAuthnService) webAuthnUser(ctx context.Context, username string) (*webAuthnUser, error) {
+	credentials, err := ws.db.GetWebAuthnCredentials(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	user := &webAuthnUser{
+		username:    username,
+		credentials: credentials,
+	}
+	if len(credentials) > 0 {
+		user.handle = credentials[0].UserHandle
+	}
+	return user, nil
+}
+
+func (ws *WebAuthnService) addCeremony(ceremony *passkeyCeremony) (string, error) {
+	ceremonyID, err := platform.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	now := ws.now()
+	for id, c := range ws.ceremonies {
+		if now.After(c.expires) {
+			delete(ws.ceremonies, id)
+		}
+	}
+	if len(ws.ceremonies) >= maxPasskeyCeremonies {
+		return "", errors.New("too many pending passkey ceremonies")
+	}
+
+	ceremony.expires = now.Add(PasskeyCeremonyTTL)
+	ws.ceremonies[ceremonyID] = ceremony
+	return ceremonyID, nil
+}
+
+// takeCeremony removes the ceremony, so each can be finished only once
+func (ws *WebAuthnService) takeCeremony(ceremonyID string) (*passkeyCeremony, error) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	ceremony, ok := ws.ceremonies[ceremonyID]
+	if !ok {
+		return nil, platform.ErrPasskeyCeremonyNotFound
+	}
+	delete(ws.ceremonies, ceremonyID)
+	if ws.now().After(ceremony.expires) {
+		return nil, platform.ErrPasskeyCeremonyNotFound
+	}
+	return ceremony, nil
+}
+
+// webAuthnUser is the user as the webauthn library sees it
+type webAuthnUser struct {
+	username    string
+	handle      []byte
+	credentials []models.WebAuthnCredential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return u.handle
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.username
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(c.Transports))
+		for _, transport := range c.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              c.ID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+// newUserHandle makes the random WebAuthn user ID, which unlike the username tells nothing about the user
+func newUserHandle() ([]byte, error) {
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+// webAuthnErrorInfo returns the details the webauthn library keeps on its errors, for the logs
+func webAuthnErrorInfo(err error) string {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) {
+		return protocolErr.Details + " " + protocolErr.DevInfo
+	}
+	return err.Error()
+}
+
+// DecodeCredentialID decodes the credential ID as shown in models.WebAuthnCredentialDTO
+func DecodeCredentialID(id string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(id)
+}
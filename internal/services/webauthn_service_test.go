@@ -0,0 +1,328 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/2beens/ispend/internal/db"
+	"github.com/2beens/ispend/internal/metrics"
+	"github.com/2beens/ispend/internal/models"
+	"github.com/2beens/ispend/internal/platform"
+	"github.com/2beens/ispend/internal/services"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOrigin = "https://ispend.example.com"
+
+// softAuthenticator is a passkey in software, doing what the browser and the authenticator do together
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	origin       string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	require.NoError(t, err)
+	return &softAuthenticator{
+		key:          key,
+		credentialID: credentialID,
+		origin:       testOrigin,
+	}
+}
+
+// ceremonyOptions are the parts of the options the authenticator needs, as the browser gets them
+type ceremonyOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		RPID      string `json:"rpId"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+func parseCeremonyOptions(t *testing.T, ceremony *services.PasskeyCeremony) ceremonyOptions {
+	optionsJSON, err := json.Marshal(ceremony.Options)
+	require.NoError(t, err)
+	var options ceremonyOptions
+	require.NoError(t, json.Unmarshal(optionsJSON, &options))
+	return options
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremonyType, challenge string) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+	require.NoError(t, err)
+	return clientData
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte, attestedCredential []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append([]byte{}, rpIDHash[:]...)
+	authData = append(authData, flags)
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+	return append(authData, attestedCredential...)
+}
+
+// create makes the passkey, returning the browser's response to navigator.credentials.create
+func (a *softAuthenticator) create(t *testing.T, ceremony *services.PasskeyCeremony) []byte {
+	options := parseCeremonyOptions(t, ceremony)
+	userHandle, err := base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+	require.NoError(t, err)
+	a.userHandle = userHandle
+
+	// the COSE key, EC2 on P-256 for ES256
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,
+		3:  -7,
+		-1: 1,
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(t, err)
+	attestedCredential := make([]byte, 16) // AAGUID
+	attestedCredential = binary.BigEndian.AppendUint16(attestedCredential, uint16(len(a.credentialID)))
+	attestedCredential = append(attestedCredential, a.credentialID...)
+	attestedCredential = append(attestedCredential, coseKey...)
+
+	// user present, user verified, attested credential data
+	authData := a.authData(options.PublicKey.RP.ID, 0x01|0x04|0x40, attestedCredential)
+	attestationObject, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	require.NoError(t, err)
+
+	return a.response(t, map[string]interface{}{
+		"clientDataJSON":    a.encode(a.clientData(t, "webauthn.create", options.PublicKey.Challenge)),
+		"attestationObject": a.encode(attestationObject),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get signs the login challenge, returning the browser's response to navigator.credentials.get
+func (a *softAuthenticator) get(t *testing.T, ceremony *services.PasskeyCeremony) []byte {
+	options := parseCeremonyOptions(t, ceremony)
+	a.signCount++
+
+	clientData := a.clientData(t, "webauthn.get", options.PublicKey.Challenge)
+	// user present, user verified
+	authData := a.authData(options.PublicKey.RPID, 0x01|0x04, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	require.NoError(t, err)
+
+	return a.response(t, map[string]interface{}{
+		"clientDataJSON":    a.encode(clientData),
+		"authenticatorData": a.encode(authData),
+		"signature":         a.encode(signature),
+		"userHandle":        a.encode(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) response(t *testing.T, response map[string]interface{}) []byte {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":       a.encode(a.credentialID),
+		"rawId":    a.encode(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	require.NoError(t, err)
+	return body
+}
+
+func (a *softAuthenticator) encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func newWebAuthnServiceTest(t *testing.T) (*services.WebAuthnService, *time.Time) {
+	inMemDB := db.NewInMemoryDB()
+	usersService := services.NewUsersService(inMemDB, metrics.NewGraphiteNop("test.graphite.host", 1000), testPasswordHasher(t), testPasswordPolicy())
+	require.NoError(t, usersService.AddUser(context.Background(), models.NewUser("user1@example.com", "user1", "hash", nil)))
+	require.NoError(t, usersService.AddUser(context.Background(), models.NewUser("user2@example.com", "user2", "hash", nil)))
+
+	webAuthnService, err := services.NewWebAuthnService(usersService, inMemDB, "iSpend", testOrigin)
+	require.NoError(t, err)
+	now := time.Now()
+	webAuthnService.SetNow(func() time.Time { return now })
+	return webAuthnService, &now
+}
+
+// registerPasskey registers a new software passkey for the user
+func registerPasskey(t *testing.T, webAuthnService *services.WebAuthnService, username, name string) *softAuthenticator {
+	ctx := context.Background()
+	authenticator := newSoftAuthenticator(t)
+	ceremony, err := webAuthnService.BeginRegistration(ctx, username, name)
+	require.NoError(t, err)
+	credential, err := webAuthnService.FinishRegistration(ctx, username, ceremony.ID, bytes.NewReader(authenticator.create(t, ceremony)))
+	require.NoError(t, err)
+	require.Equal(t, authenticator.credentialID, credential.ID)
+	return authenticator
+}
+
+func TestWebAuthnService_RegisterAndLogin(t *testing.T) {
+	webAuthnService, now := newWebAuthnServiceTest(t)
+	ctx := context.Background()
+
+	_, err := webAuthnService.BeginLogin(ctx, "user1")
+	assert.Equal(t, platform.ErrNotFound, err, "no passkeys yet")
+
+	authenticator := registerPasskey(t, webAuthnService, "user1", "laptop")
+	credentials, err := webAuthnService.Credentials(ctx, "user1")
+	require.NoError(t, err)
+	require.Len(t, credentials, 1)
+	assert.Equal(t, "laptop", credentials[0].Name)
+	assert.Equal(t, authenticator.userHandle, credentials[0].UserHandle)
+	assert.Equal(t, []string{"internal"}, credentials[0].Transports)
+	assert.NotContains(t, string(authenticator.userHandle), "user1")
+
+	// the passkey tells who the user is
+	*now = now.Add(time.Minute)
+	ceremony, err := webAuthnService.BeginLogin(ctx, "")
+	require.NoError(t, err)
+	username, err := webAuthnService.FinishLogin(ctx, ceremony.ID, bytes.NewReader(authenticator.get(t, ceremony)))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", username)
+
+	credentials, err = webAuthnService.Credentials(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), credentials[0].SignCount)
+	assert.True(t, now.Equal(credentials[0].LastUsedAt))
+
+	// or the user does
+	ceremony, err = webAuthnService.BeginLogin(ctx, "user1")
+	require.NoError(t, err)
+	username, err = webAuthnService.FinishLogin(ctx, ceremony.ID, bytes.NewReader(authenticator.get(t, ceremony)))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", username)
+
+	// the second passkey of the user gets the same user handle
+	secondAuthenticator := registerPasskey(t, webAuthnService, "user1", "phone")
+	assert.Equal(t, authenticator.userHandle, secondAuthenticator.userHandle)
+	// the other user's not
+	otherAuthenticator := registerPasskey(t, webAuthnService, "user2", "laptop")
+	assert.NotEqual(t, authenticator.userHandle, otherAuthenticator.userHandle)
+}
+
+func TestWebAuthnService_CeremonyUsedOnce(t *testing.T) {
+	webAuthnService, _ := newWebAuthnServiceTest(t)
+	ctx := context.Background()
+	authenticator := registerPasskey(t, webAuthnService, "user1", "laptop")
+
+	ceremony, err := webAuthnService.BeginLogin(ctx, "")
+	require.NoError(t, err)
+	response := authenticator.get(t, ceremony)
+	_, err = webAuthnService.FinishLogin(ctx, ceremony.ID, bytes.NewReader(response))
+	require.NoError(t, err)
+	_, err = webAuthnService.FinishLogin(ctx, ceremony.ID, bytes.NewReader(response))
+	assert.Equal(t, platform.ErrPasskeyCeremonyNotFound, err)
+
+	_, err = webAuthnService.FinishLogin(ctx, "unknown", bytes.NewReader(response))
+	assert.Equal(t, platform.ErrPasskeyCeremonyNotFound, err)
+
+	// a registration ceremony cannot finish a login, nor another user's registration
+	registration, err := webAuthnService.BeginRegistration(ctx, "user1", "phone")
+	require.NoError(t, err)
+	_, err = webAuthnService.FinishLogin(ctx, registration.ID, bytes.NewReader(response))
+	assert.Equal(t, platform.ErrPasskeyCeremonyNotFound, err)
+	registration, err = webAuthnService.BeginRegistration(ctx, "user1", "phone")
+	require.NoError(t, err)
+	_, err = webAuthnService.FinishRegistration(ctx, "user2", registration.ID, bytes.NewReader(newSoftAuthenticator(t).create(t, registration)))
+	assert.Equal(t, platform.ErrPasskeyCeremonyNotFound, err)
+}
+
+func TestWebAuthnService_CeremonyExpires(t *testing.T) {
+	webAuthnService, now := newWebAuthnServiceTest(t)
+	ctx := context.Background()
+	authenticator := registerPasskey(t, webAuthnService, "user1", "laptop")
+
+	ceremony, err := webAuthnService.BeginLogin(ctx, "user1")
+	require.NoError(t, err)
+	*now = now.Add(services.PasskeyCeremonyTTL + time.Second)
+	_, err = webAuthnService.FinishLogin(ctx, ceremony.ID, bytes.NewReader(authenticator.get(t, ceremony)))
+	assert.Equal(t, platform.ErrPasskeyCeremonyNotFound, err)
+}
+
+func TestWebAuthnService_LoginRejected(t *testing.T) {
+	webAuthnService, _ := newWebAuthnServiceTest(t)
+	ctx := context.Background()
+	authenticator := registerPasskey(t, webAuthnService, "user1", "laptop")
+	otherAuthenticator := registerPasskey(t, webAuthnService, "user2", "laptop")
+
+	login := func(username string, authenticator *softAuthenticator) (string, error) {
+		ceremony, err := webAuthnService.BeginLogin(ctx, username)
+		require.NoError(t, err)
+		return webAuthnService.FinishLogin(ctx, ceremony.ID, bytes.NewReader(authenticator.get(t, ceremony)))
+	}
+
+	// another user's passkey
+	_, err := login("user1", otherAuthenticator)
+	assert.Equal(t, platform.ErrPasskeyRejected, err)
+
+	// a phishing site
+	authenticator.origin = "https://ispend.example.com.evil.example"
+	_, err = login("", authenticator)
+	assert.Equal(t, platform.ErrPasskeyRejected, err)
+	authenticator.origin = testOrigin
+
+	// an unknown passkey, with a known user handle
+	unknown := newSoftAuthenticator(t)
+	unknown.userHandle = authenticator.userHandle
+	_, err = login("", unknown)
+	assert.Equal(t, platform.ErrPasskeyRejected, err)
+
+	// a clone, its signature counter falls behind the original's
+	clone := *authenticator
+	_, err = login("", authenticator)
+	require.NoError(t, err)
+	_, err = login("", authenticator)
+	require.NoError(t, err)
+	_, err = login("", &clone)
+	assert.Equal(t, platform.ErrPasskeyRejected, err)
+}
+
+func TestWebAuthnService_DeleteCredential(t *testing.T) {
+	webAuthnService, _ := newWebAuthnServiceTest(t)
+	ctx := context.Background()
+	authenticator := registerPasskey(t, webAuthnService, "user1", "laptop")
+
+	// the registration excludes the passkeys the user has already
+	ceremony, err := webAuthnService.BeginRegistration(ctx, "user1", "phone")
+	require.NoError(t, err)
+	optionsJSON, err := json.Marshal(ceremony.Options)
+	require.NoError(t, err)
+	assert.Contains(t, string(optionsJSON), base64.RawURLEncoding.EncodeToString(authenticator.credentialID))
+
+	assert.Equal(t, platform.ErrNotFound, webAuthnService.DeleteCredential(ctx, "user2", authenticator.credentialID))
+	require.NoError(t, webAuthnService.DeleteCredential(ctx, "user1", authenticator.credentialID))
+
+	ceremony, err = webAuthnService.BeginLogin(ctx, "")
+	require.NoError(t, err)
+	_, err = webAuthnService.FinishLogin(ctx, ceremony.ID, bytes.NewReader(authenticator.get(t, ceremony)))
+	assert.Equal(t, platform.ErrPasskeyRejected, err)
+}
@@ -4,21 +4,31 @@ function htmlToElement(html) {
     return template.content.firstChild;
 }
 
+// the session itself lives in an HttpOnly cookie, only the username is kept here for the UI
 function getLoggedUser() {
     const username = localStorage.getItem("username");
-    const sessionId = localStorage.getItem("sessionId");
-    const isLogged = username !== "" && sessionId !== "";
-    return {username: username, sessionId: sessionId, isLogged: isLogged};
+    const isLogged = !!username;
+    return {username: username, isLogged: isLogged};
 }
 
 function clearLoginData() {
-    localStorage.setItem("sessionId", "");
     localStorage.setItem("username", "");
     refreshLoggedUserInfo();
 }
 
-function getSessionID() {
-    return localStorage.getItem("sessionId");
+function getCookie(name) {
+    const prefix = name + "=";
+    const cookies = document.cookie ? document.cookie.split("; ") : [];
+    for (const cookie of cookies) {
+        if (cookie.startsWith(prefix)) {
+            return decodeURIComponent(cookie.substring(prefix.length));
+        }
+    }
+    return "";
+}
+
+function isStateChangingMethod(method) {
+    return !/^(GET|HEAD|OPTIONS|TRACE)$/i.test(method);
 }
 
 function getUsername() {
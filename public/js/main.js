@@ -1,3 +1,12 @@
+// every state changing request must carry the CSRF token from the ispend_csrf cookie
+$.ajaxSetup({
+	beforeSend: function (jqXhr, settings) {
+		if (isStateChangingMethod(settings.type)) {
+			jqXhr.setRequestHeader("X-CSRF-Token", getCookie("ispend_csrf"));
+		}
+	},
+});
+
 window.onload = function () {
     refreshLoggedUserInfo();
 
@@ -38,18 +47,16 @@ function checkSessionOK() {
 	}
 
 	const username = localStorage.getItem("username");
-	const sessionId = localStorage.getItem("sessionId");
-	if (!username || !sessionId) {
+	if (!username) {
 		return;
 	}
 
 	console.log('about to check session ...');
 	$.ajax({
 		url: "/users/login/check",
-		type: "POST",
+		type: "GET",
 		dataType: "json",                 // expected format for response
-		contentType: "application/x-www-form-urlencoded; charset=utf-8",
-		data: {username: username, sessionId: sessionId},
+		data: {username: username},
 		success: function (data, textStatus, jQxhr) {
 			console.log('check session response: ' + JSON.stringify(data));
 			if (data && !data.isError) {
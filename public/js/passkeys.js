@@ -0,0 +1,65 @@
+// the passkey ceremonies carry binary values, which travel as base64url in the JSON
+
+function base64urlToBuffer(value) {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    const binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4));
+    return Uint8Array.from(binary, c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64url(buffer) {
+    const binary = String.fromCharCode(...new Uint8Array(buffer));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function loginWithPasskey() {
+    if (!window.PublicKeyCredential) {
+        toastr.error('This browser does not support passkeys', 'Login error');
+        return;
+    }
+
+    // with the username left empty, the browser offers all its passkeys for the site
+    const username = $('#form_username').val();
+    $.post("/users/login/webauthn/begin", {username: username}).then(function (data) {
+        if (!data || data.isError) {
+            throw new Error(data ? data.message : 'no response');
+        }
+        const ceremony = data.data;
+        const options = ceremony.options.publicKey;
+        options.challenge = base64urlToBuffer(options.challenge);
+        (options.allowCredentials || []).forEach(c => c.id = base64urlToBuffer(c.id));
+
+        return navigator.credentials.get({publicKey: options}).then(function (credential) {
+            return $.ajax({
+                url: "/users/login/webauthn/finish?ceremony=" + encodeURIComponent(ceremony.ceremony),
+                type: "POST",
+                dataType: "json",
+                contentType: "application/json; charset=utf-8",
+                data: JSON.stringify({
+                    id: credential.id,
+                    rawId: bufferToBase64url(credential.rawId),
+                    type: credential.type,
+                    response: {
+                        clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+                        authenticatorData: bufferToBase64url(credential.response.authenticatorData),
+                        signature: bufferToBase64url(credential.response.signature),
+                        userHandle: bufferToBase64url(credential.response.userHandle),
+                    },
+                }),
+            });
+        });
+    }).then(function (data) {
+        if (!data || data.isError) {
+            throw new Error(data ? data.message : 'no response');
+        }
+        // the session cookie is set already, ask who logged in
+        return $.getJSON("/users/me");
+    }).then(function (data) {
+        localStorage.setItem("username", data.data.username);
+        $('#form_username').val('');
+        toastr.success('', `Login [${data.data.username}] success!`);
+        refreshLoggedUserInfo();
+    }).catch(function (err) {
+        console.log('passkey login error: ' + err);
+        toastr.error(err.message || String(err), 'Login error');
+    });
+}
@@ -0,0 +1,70 @@
+function getResetToken() {
+    return new URLSearchParams(window.location.search).get('token');
+}
+
+function forgotPasswordPost() {
+    var username = $('#username').val();
+    if (!username) {
+        toastr.error('username empty', 'Password reset error');
+        return;
+    }
+
+    $.ajax({
+        url: "/users/password/forgot",
+        type: "POST",
+        dataType: "json",
+        contentType: "application/x-www-form-urlencoded; charset=utf-8",
+        data: {username: username},
+        complete: function () {
+            $('#username').val('');
+        },
+        success: function (data, textStatus, jQxhr) {
+            if (data && !data.isError) {
+                toastr.success(data.message, 'Password reset');
+            } else {
+                toastr.error(data.message, 'Password reset error');
+            }
+        },
+        error: function (jqXhr, textStatus, errorThrown) {
+            toastr.error(JSON.stringify(errorThrown), 'Password reset error');
+        },
+    });
+}
+
+function resetPasswordPost() {
+    var password = $('#password').val();
+    if (!password) {
+        toastr.error('password empty', 'Password reset error');
+        return;
+    }
+
+    $.ajax({
+        url: "/users/password/reset",
+        type: "POST",
+        dataType: "json",
+        contentType: "application/x-www-form-urlencoded; charset=utf-8",
+        data: {token: getResetToken(), password: password},
+        complete: function () {
+            $('#password').val('');
+        },
+        success: function (data, textStatus, jQxhr) {
+            if (data && !data.isError) {
+                clearLoginData();
+                toastr.success(data.message, 'Password changed, log in again');
+            } else {
+                toastr.error(data.message, 'Password reset error');
+            }
+        },
+        error: function (jqXhr, textStatus, errorThrown) {
+            toastr.error(JSON.stringify(errorThrown), 'Password reset error');
+        },
+    });
+}
+
+(function () {
+    console.log('iSpend reset password script loaded ...');
+    if (getResetToken()) {
+        $('#forgot-form').hide();
+        $('#reset-form').show();
+    }
+})();
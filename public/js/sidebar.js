@@ -1,29 +1,38 @@
 function login() {
     const username = $('#form_username').val();
     const password = $('#form_password').val();
+    const totpCode = $('#form_totp_code').val();
     if (!username || !password) {
         console.error('username | password empty');
         return;
     }
 
+    let totpRequired = false;
     $.ajax({
         url: "/users/login",
         type: "POST",
         dataType: "json",                 // expected format for response
         contentType: "application/x-www-form-urlencoded; charset=utf-8",
-        data: {username: username, password: password},
+        data: {username: username, password: password, totp_code: totpCode},
         complete: function () {
             console.log('login request complete');
-            $('#form_username').val('');
-            $('#form_password').val('');
+            // keep the username and password for the second step
+            if (!totpRequired) {
+                $('#form_username').val('');
+                $('#form_password').val('');
+                $('#form_totp_code').val('').css("display", "none");
+            }
         },
         success: function (data, textStatus, jQxhr) {
             console.log('response: ' + JSON.stringify(data));
             if (data && !data.isError) {
-                localStorage.setItem("sessionId", data.data);
                 localStorage.setItem("username", username);
                 toastr.success(data.message, `Login [${username}] success!`);
                 refreshLoggedUserInfo();
+            } else if (data && data.data && data.data.totp_required) {
+                totpRequired = true;
+                $('#form_totp_code').css("display", "block").focus();
+                toastr.info('Enter the code from your authenticator app', 'Two-factor authentication');
             } else {
                 toastr.error(data.message, 'Login error');
             }
@@ -37,9 +46,8 @@ function login() {
 
 function logout() {
     const username = localStorage.getItem("username");
-    const sessionId = localStorage.getItem("sessionId");
-    if (!username || !sessionId) {
-        console.error('username | sessionId empty');
+    if (!username) {
+        console.error('username empty');
         return;
     }
 
@@ -47,15 +55,12 @@ function logout() {
         url: "/users/logout",
         type: "POST",
         dataType: "json",                 // expected format for response
-        contentType: "application/x-www-form-urlencoded; charset=utf-8",
-        data: {username: username, sessionId: sessionId},
         complete: function () {
             console.log('logout request complete');
         },
         success: function (data, textStatus, jQxhr) {
             console.log('response: ' + JSON.stringify(data));
             if (data && !data.isError) {
-                localStorage.setItem("sessionId", "");
                 localStorage.setItem("username", "");
                 toastr.success(data.message, `Logout [${username}] success!`);
                 // refreshLoggedUserInfo();
@@ -63,7 +68,6 @@ function logout() {
             } else {
                 toastr.error(data.message, 'Logout error');
                 if (data && data.message && data.message.includes("session not found")) {
-                    localStorage.setItem("sessionId", "");
                     localStorage.setItem("username", "");
                     refreshLoggedUserInfo();
                 }
@@ -78,8 +82,7 @@ function logout() {
 
 function refreshLoggedUserInfo() {
     const username = localStorage.getItem("username");
-    const sessionId = localStorage.getItem("sessionId");
-    if (!username || !sessionId) {
+    if (!username) {
         $('#loginForm').css("display", "block");
         $('#loggedUserInfo').css("display", "none");
         $('#usernameInfo').text("-> " + username);
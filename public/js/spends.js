@@ -31,9 +31,6 @@ function getSpends(user, callback) {
         type: 'GET',
         dataType: 'json',                 // expected format for response
         contentType: 'application/x-www-form-urlencoded; charset=utf-8',
-        headers: {
-            'X-Ispend-SessionID': getSessionID()
-        },
         complete: function () {
             console.log('get spends request complete');
         },
@@ -67,9 +64,6 @@ function deleteSpend(spendID, callback) {
         type: "DELETE",
         dataType: "json",                 // expected format for response
         contentType: "application/x-www-form-urlencoded; charset=utf-8",  // send as JSON
-        headers: {
-            'X-Ispend-SessionID': getSessionID()
-        },
         success: function (data, textStatus, jQxhr) {
             console.log('response: ' + JSON.stringify(data));
             if (data && !data.isError) {
@@ -102,9 +96,6 @@ function postNewSpending(user, spending, callback) {
         type: "POST",
         dataType: "json",                 // expected format for response
         contentType: "application/x-www-form-urlencoded; charset=utf-8",  // send as JSON
-        headers: {
-            'X-Ispend-SessionID': getSessionID()
-        },
         data: {username: user.username, currency: spending.currency, amount: spending.amount, kind_id: spending.skId},
         complete: function () {
             console.log('new spending request complete');
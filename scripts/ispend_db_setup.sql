@@ -1,3 +1,6 @@
+-- DEV ONLY: recreates the whole DB from scratch with some test data.
+-- Schema changes go to internal/db/migrations, applied via "ispend migrate up" or on server start.
+
 SET TIME ZONE '+00:00';
 
 DROP TABLE IF EXISTS spends;